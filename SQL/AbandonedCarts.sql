@@ -0,0 +1,33 @@
+-- Needs Coupons.sql, Orders.sql and PriceAlerts.sql.
+-- One row each time a user's cart goes idle. last_activity_at is when the cart was
+-- last changed, so a cart is only recorded again once it's been changed since.
+-- recovered_at and order_id are set when the user goes on to place an order.
+CREATE TABLE IF NOT EXISTS cart_abandonments (
+    id               SERIAL PRIMARY KEY,
+    user_id          INTEGER        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    last_activity_at TIMESTAMPTZ    NOT NULL,
+    item_count       INTEGER        NOT NULL,
+    subtotal         NUMERIC(10, 2) NOT NULL,
+    coupon_code      VARCHAR(25) REFERENCES coupons (code) ON DELETE SET NULL ON UPDATE CASCADE,
+    recovered_at     TIMESTAMPTZ,
+    order_id         INTEGER REFERENCES orders (id) ON DELETE SET NULL,
+    created_at       TIMESTAMPTZ    NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, last_activity_at)
+);
+
+CREATE INDEX IF NOT EXISTS cart_abandonments_created_at_idx ON cart_abandonments (created_at);
+CREATE INDEX IF NOT EXISTS cart_abandonments_open_idx ON cart_abandonments (user_id) WHERE recovered_at IS NULL;
+
+-- Users don't have email addresses on file yet, so emails are stored here for a
+-- mailer to pick up and send; sent_at is set once it has.
+CREATE TABLE IF NOT EXISTS outgoing_emails (
+    id         SERIAL PRIMARY KEY,
+    user_id    INTEGER      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    type       VARCHAR(50)  NOT NULL,
+    subject    VARCHAR(255) NOT NULL,
+    body       TEXT         NOT NULL,
+    sent_at    TIMESTAMPTZ,
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS outgoing_emails_unsent_idx ON outgoing_emails (created_at) WHERE sent_at IS NULL;
@@ -0,0 +1,14 @@
+-- Needs Variants.sql.
+-- A bundle is an ordinary inventory item (its own name, slug, price and tags) that
+-- ships as the component variants listed here. It has no stock of its own: what's
+-- available is however many complete sets the component stock makes up.
+CREATE TABLE IF NOT EXISTS bundle_components (
+    id             SERIAL PRIMARY KEY,
+    bundle_item_id INTEGER NOT NULL REFERENCES inventories (id) ON DELETE CASCADE,
+    variant_id     INTEGER NOT NULL REFERENCES inventory_item_variants (id) ON DELETE RESTRICT,
+    quantity       INTEGER NOT NULL CHECK (quantity > 0),
+    sort_order     INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (bundle_item_id, variant_id)
+);
+
+CREATE INDEX IF NOT EXISTS bundle_components_variant_idx ON bundle_components (variant_id);
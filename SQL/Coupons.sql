@@ -0,0 +1,43 @@
+INSERT INTO coupon_types (name)
+SELECT 'fixed_price_reduction'
+WHERE NOT EXISTS (SELECT 1 FROM coupon_types WHERE name = 'fixed_price_reduction');
+
+-- Promotion rules. Null limits are unlimited; a null shipping option means free
+-- shipping applies to whichever option the customer picks.
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS amount_off NUMERIC(10, 2) NOT NULL DEFAULT 0;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS minimum_subtotal NUMERIC(10, 2) NOT NULL DEFAULT 0;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS starts_at TIMESTAMPTZ;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS max_redemptions INTEGER;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS max_redemptions_per_user INTEGER;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS shipping_option_id INTEGER REFERENCES shipping_options (id);
+
+-- Codes are matched case-insensitively and stored upper case. The plain index backs
+-- the foreign keys below; the UPPER one stops SAVE10 and save10 both being created.
+UPDATE coupons SET code = UPPER(code) WHERE code <> UPPER(code);
+CREATE UNIQUE INDEX IF NOT EXISTS coupons_code_idx ON coupons (code);
+CREATE UNIQUE INDEX IF NOT EXISTS coupons_code_upper_idx ON coupons (UPPER(code));
+
+-- A coupon with no tags or items applies to the whole cart. Otherwise it only
+-- discounts items carrying one of its tags or listed directly.
+CREATE TABLE IF NOT EXISTS coupon_tags (
+    coupon_code VARCHAR(25) NOT NULL REFERENCES coupons (code) ON DELETE CASCADE ON UPDATE CASCADE,
+    tag_id      INTEGER     NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+    PRIMARY KEY (coupon_code, tag_id)
+);
+
+CREATE TABLE IF NOT EXISTS coupon_inventory_items (
+    coupon_code       VARCHAR(25) NOT NULL REFERENCES coupons (code) ON DELETE CASCADE ON UPDATE CASCADE,
+    inventory_item_id INTEGER     NOT NULL REFERENCES inventories (id) ON DELETE CASCADE,
+    PRIMARY KEY (coupon_code, inventory_item_id)
+);
+
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+    id              SERIAL PRIMARY KEY,
+    coupon_code     VARCHAR(25)    NOT NULL REFERENCES coupons (code) ON DELETE CASCADE ON UPDATE CASCADE,
+    user_id         INTEGER        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    order_id        INTEGER        NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    discount_amount NUMERIC(10, 2) NOT NULL,
+    created_at      TIMESTAMPTZ    NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS coupon_redemptions_coupon_user_idx ON coupon_redemptions (coupon_code, user_id);
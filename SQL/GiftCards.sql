@@ -0,0 +1,37 @@
+-- Needs Orders.sql.
+-- Prepaid cards. balance_cents is always the sum of the card's ledger; it's only ever
+-- changed by a conditional UPDATE so concurrent redemptions can't overdraw it.
+CREATE TABLE IF NOT EXISTS gift_cards (
+    id                    SERIAL PRIMARY KEY,
+    code                  VARCHAR(25) NOT NULL UNIQUE,
+    initial_balance_cents BIGINT      NOT NULL CHECK (initial_balance_cents > 0),
+    balance_cents         BIGINT      NOT NULL CHECK (balance_cents >= 0),
+    expires_at            TIMESTAMPTZ NOT NULL,
+    voided_at             TIMESTAMPTZ,
+    issued_by_user_id     INTEGER REFERENCES users (id) ON DELETE SET NULL,
+    created_at            TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at            TIMESTAMPTZ
+);
+
+-- Debits are negative, credits positive. An unsettled redemption is applied to the
+-- user's cart; it's settled when their order is placed, or when they take it off the
+-- cart and the amount is credited back, which also happens once it's been on the cart
+-- for a day. What an order took off each card, less any refunds credited back to it, is
+-- the sum of the card's entries with that order_id.
+CREATE TABLE IF NOT EXISTS gift_card_transactions (
+    id           SERIAL PRIMARY KEY,
+    gift_card_id INTEGER     NOT NULL REFERENCES gift_cards (id) ON DELETE CASCADE,
+    type         VARCHAR(20) NOT NULL,
+    amount_cents BIGINT      NOT NULL,
+    user_id      INTEGER REFERENCES users (id) ON DELETE SET NULL,
+    order_id     INTEGER REFERENCES orders (id) ON DELETE SET NULL,
+    settled_at   TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS gift_card_transactions_card_idx ON gift_card_transactions (gift_card_id);
+CREATE INDEX IF NOT EXISTS gift_card_transactions_pending_idx
+    ON gift_card_transactions (user_id) WHERE type = 'redeem' AND settled_at IS NULL;
+
+-- What was paid by gift card. total is what's left to charge.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS gift_card_amount NUMERIC(10, 2) NOT NULL DEFAULT 0;
@@ -0,0 +1,22 @@
+-- Carts for visitors who haven't signed in, identified by a signed cookie holding
+-- the token. They're merged into the user's cart on sign-in and otherwise deleted
+-- by the scheduled job once expires_at passes.
+CREATE TABLE IF NOT EXISTS guest_carts (
+    id         SERIAL PRIMARY KEY,
+    token      UUID        NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS guest_carts_expires_at_idx ON guest_carts (expires_at);
+
+CREATE TABLE IF NOT EXISTS guest_cart_items (
+    id                SERIAL PRIMARY KEY,
+    guest_cart_id     INTEGER     NOT NULL REFERENCES guest_carts (id) ON DELETE CASCADE,
+    inventory_item_id INTEGER     NOT NULL REFERENCES inventories (id) ON DELETE CASCADE,
+    quantity          INTEGER     NOT NULL CHECK (quantity > 0),
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at        TIMESTAMPTZ,
+    UNIQUE (guest_cart_id, inventory_item_id)
+);
@@ -0,0 +1,7 @@
+-- Needs Orders.sql.
+-- Heat profiles are worked out from reviews, orders and carts as they're asked for. Resetting
+-- one only counts what the user reviewed, ordered and added to their cart after reset_at.
+CREATE TABLE IF NOT EXISTS heat_profile_resets (
+    user_id  INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    reset_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,89 @@
+CREATE TABLE IF NOT EXISTS orders (
+    id                 SERIAL PRIMARY KEY,
+    order_number       VARCHAR(20)    NOT NULL UNIQUE,
+    user_id            INTEGER        NOT NULL REFERENCES users (id),
+    status             VARCHAR(50)    NOT NULL DEFAULT 'pending_payment',
+    shipping_option_id INTEGER        NOT NULL REFERENCES shipping_options (id),
+    shipping_price     NUMERIC(10, 2) NOT NULL DEFAULT 0,
+    coupon_code        VARCHAR(25),
+    subtotal           NUMERIC(10, 2) NOT NULL DEFAULT 0,
+    discount_amount    NUMERIC(10, 2) NOT NULL DEFAULT 0,
+    total              NUMERIC(10, 2) NOT NULL DEFAULT 0,
+    created_at         TIMESTAMPTZ    NOT NULL DEFAULT NOW(),
+    updated_at         TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS orders_user_id_idx ON orders (user_id);
+
+CREATE TABLE IF NOT EXISTS order_items (
+    id                SERIAL PRIMARY KEY,
+    order_id          INTEGER        NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    inventory_item_id INTEGER        NOT NULL REFERENCES inventories (id),
+    name              VARCHAR(255)   NOT NULL,
+    slug              VARCHAR(255)   NOT NULL,
+    price             NUMERIC(10, 2) NOT NULL,
+    quantity          INTEGER        NOT NULL,
+    created_at        TIMESTAMPTZ    NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS order_items_order_id_idx ON order_items (order_id);
+
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id                 SERIAL PRIMARY KEY,
+    order_id           INTEGER     NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    status             VARCHAR(50) NOT NULL,
+    changed_by_user_id INTEGER REFERENCES users (id),
+    created_at         TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS order_status_history_order_id_idx ON order_status_history (order_id);
+
+CREATE TABLE IF NOT EXISTS payment_attempts (
+    id                 SERIAL PRIMARY KEY,
+    order_id           INTEGER     NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    user_id            INTEGER     NOT NULL REFERENCES users (id),
+    provider           VARCHAR(50) NOT NULL,
+    provider_reference VARCHAR(255),
+    amount_cents       BIGINT      NOT NULL,
+    refunded_cents     BIGINT      NOT NULL DEFAULT 0,
+    status             VARCHAR(50) NOT NULL,
+    decline_reason     VARCHAR(255),
+    created_at         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at         TIMESTAMPTZ,
+    UNIQUE (provider, provider_reference)
+);
+
+CREATE INDEX IF NOT EXISTS payment_attempts_order_id_idx ON payment_attempts (order_id);
+-- An order can only have one payment in flight or taken at a time
+CREATE UNIQUE INDEX IF NOT EXISTS payment_attempts_in_flight_idx
+    ON payment_attempts (order_id) WHERE status IN ('pending', 'authorized', 'captured');
+
+-- Tax is worked out for the country/region given at checkout. With prices_include_tax
+-- the tax is already in the subtotal, otherwise it is added to the total.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS tax_amount NUMERIC(10, 2) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS prices_include_tax BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS tax_country VARCHAR(2) NOT NULL DEFAULT '';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS tax_region VARCHAR(10) NOT NULL DEFAULT '';
+
+-- Tax on the whole line, after its share of the order discount
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS tax_category VARCHAR(50) NOT NULL DEFAULT '';
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS tax_rate_basis_points INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS tax_amount NUMERIC(10, 2) NOT NULL DEFAULT 0;
+
+-- Each line's share of the coupon discount, as allocated when the order was placed, so returns
+-- refund what was actually paid for a line. Orders from before this spread the discount over
+-- every line in proportion to its total.
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS discount_amount NUMERIC(10, 2);
+UPDATE order_items oi
+SET discount_amount = CASE
+    WHEN o.subtotal > 0 THEN ROUND(oi.price * oi.quantity * o.discount_amount / o.subtotal, 2)
+    ELSE 0
+END
+FROM orders o
+WHERE o.id = oi.order_id AND oi.discount_amount IS NULL;
+ALTER TABLE order_items ALTER COLUMN discount_amount SET DEFAULT 0;
+ALTER TABLE order_items ALTER COLUMN discount_amount SET NOT NULL;
+
+-- Set while the payment provider still has to refund what it took for a cancelled or refunded
+-- order. Refunds the provider couldn't make at the time are retried by a job.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS provider_refund_pending BOOLEAN NOT NULL DEFAULT FALSE;
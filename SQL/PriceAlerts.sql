@@ -0,0 +1,29 @@
+-- Price-drop alerts. An alert fires once, when the item's price falls below
+-- threshold_price; triggered_at records when. Saving the alert again re-arms it.
+CREATE TABLE IF NOT EXISTS price_alerts (
+    id                SERIAL PRIMARY KEY,
+    user_id           INTEGER        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    inventory_item_id INTEGER        NOT NULL REFERENCES inventories (id) ON DELETE CASCADE,
+    threshold_price   NUMERIC(10, 2) NOT NULL CHECK (threshold_price > 0),
+    triggered_at      TIMESTAMPTZ,
+    created_at        TIMESTAMPTZ    NOT NULL DEFAULT NOW(),
+    updated_at        TIMESTAMPTZ,
+    UNIQUE (user_id, inventory_item_id)
+);
+
+CREATE INDEX IF NOT EXISTS price_alerts_armed_idx
+    ON price_alerts (inventory_item_id) WHERE triggered_at IS NULL;
+
+-- Notifications are sent over the websocket as they happen and kept here so users
+-- who weren't connected can see them later.
+CREATE TABLE IF NOT EXISTS notifications (
+    id         SERIAL PRIMARY KEY,
+    user_id    INTEGER      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    type       VARCHAR(50)  NOT NULL,
+    message    VARCHAR(500) NOT NULL,
+    data       JSONB        NOT NULL DEFAULT '{}',
+    read_at    TIMESTAMPTZ,
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications (user_id, created_at DESC);
@@ -0,0 +1,38 @@
+-- Needs Variants.sql.
+-- Every list price a variant has had. A row is added whenever a save changes the price.
+CREATE TABLE IF NOT EXISTS price_history (
+    id                SERIAL PRIMARY KEY,
+    inventory_item_id INTEGER        NOT NULL REFERENCES inventories (id) ON DELETE CASCADE,
+    variant_id        INTEGER        NOT NULL REFERENCES inventory_item_variants (id) ON DELETE CASCADE,
+    price             NUMERIC(10, 2) NOT NULL,
+    created_at        TIMESTAMPTZ    NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS price_history_variant_idx ON price_history (variant_id, created_at);
+CREATE INDEX IF NOT EXISTS price_history_item_idx ON price_history (inventory_item_id, created_at);
+
+-- Variants from before price history start with their current price
+INSERT INTO price_history (inventory_item_id, variant_id, price, created_at)
+SELECT v.inventory_item_id, v.id, v.price, COALESCE(v.updated_at, v.created_at)
+FROM inventory_item_variants v
+WHERE NOT EXISTS (SELECT 1 FROM price_history ph WHERE ph.variant_id = v.id);
+
+-- Scheduled sales. While a sale is running its sale_price is what the variant sells
+-- for; the list price is left alone. A variant's sales can't overlap.
+CREATE TABLE IF NOT EXISTS price_sales (
+    id                SERIAL PRIMARY KEY,
+    inventory_item_id INTEGER        NOT NULL REFERENCES inventories (id) ON DELETE CASCADE,
+    variant_id        INTEGER        NOT NULL REFERENCES inventory_item_variants (id) ON DELETE CASCADE,
+    sale_price        NUMERIC(10, 2) NOT NULL CHECK (sale_price > 0),
+    starts_at         TIMESTAMPTZ    NOT NULL,
+    ends_at           TIMESTAMPTZ    NOT NULL,
+    created_at        TIMESTAMPTZ    NOT NULL DEFAULT NOW(),
+    updated_at        TIMESTAMPTZ,
+    CHECK (ends_at > starts_at)
+);
+
+-- Set once price alerts have been checked against the sale after it started
+ALTER TABLE price_sales ADD COLUMN IF NOT EXISTS alerts_checked_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS price_sales_variant_idx ON price_sales (variant_id, ends_at);
+CREATE INDEX IF NOT EXISTS price_sales_item_idx ON price_sales (inventory_item_id, ends_at);
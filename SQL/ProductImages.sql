@@ -0,0 +1,20 @@
+-- Product image galleries. Images are shown in position order; the primary image's
+-- thumbnail is the one shown in product lists.
+CREATE TABLE IF NOT EXISTS inventory_item_images (
+    id                 SERIAL PRIMARY KEY,
+    inventory_item_id  INTEGER      NOT NULL REFERENCES inventories (id) ON DELETE CASCADE,
+    filename           VARCHAR(255) NOT NULL,
+    thumbnail_filename VARCHAR(255) NOT NULL,
+    mime_type          VARCHAR(50)  NOT NULL,
+    orig_width         INTEGER      NOT NULL,
+    orig_height        INTEGER      NOT NULL,
+    thumbnail_width    INTEGER      NOT NULL,
+    thumbnail_height   INTEGER      NOT NULL,
+    position           INTEGER      NOT NULL DEFAULT 0,
+    is_primary         BOOLEAN      NOT NULL DEFAULT FALSE,
+    created_at         TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS inventory_item_images_item_idx ON inventory_item_images (inventory_item_id, position);
+CREATE UNIQUE INDEX IF NOT EXISTS inventory_item_images_primary_idx
+    ON inventory_item_images (inventory_item_id) WHERE is_primary;
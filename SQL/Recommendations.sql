@@ -0,0 +1,13 @@
+-- Needs Tags.sql.
+-- "Customers who liked this also liked", rebuilt periodically by a background job.
+-- source is 'reviews' for items liked by the same customers and 'tags' for the fallback
+-- on shared tags and similar heat, used for items with too few reviews.
+CREATE TABLE IF NOT EXISTS product_similarities (
+    inventory_item_id INTEGER     NOT NULL REFERENCES inventories (id) ON DELETE CASCADE,
+    similar_item_id   INTEGER     NOT NULL REFERENCES inventories (id) ON DELETE CASCADE,
+    score             REAL        NOT NULL,
+    source            VARCHAR(10) NOT NULL CHECK (source IN ('reviews', 'tags')),
+    computed_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (inventory_item_id, similar_item_id),
+    CHECK (inventory_item_id <> similar_item_id)
+);
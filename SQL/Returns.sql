@@ -0,0 +1,43 @@
+-- Return merchandise authorizations. A return covers one or more lines of a
+-- delivered order; refunds are recorded per line against return_items.
+CREATE TABLE IF NOT EXISTS returns (
+    id            SERIAL PRIMARY KEY,
+    return_number VARCHAR(20)  NOT NULL UNIQUE,
+    order_id      INTEGER      NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    user_id       INTEGER      NOT NULL REFERENCES users (id),
+    status        VARCHAR(50)  NOT NULL DEFAULT 'requested',
+    reason        VARCHAR(1000) NOT NULL,
+    created_at    TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    updated_at    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS returns_order_id_idx ON returns (order_id);
+CREATE INDEX IF NOT EXISTS returns_status_idx ON returns (status);
+
+CREATE TABLE IF NOT EXISTS return_items (
+    id              SERIAL PRIMARY KEY,
+    return_id       INTEGER        NOT NULL REFERENCES returns (id) ON DELETE CASCADE,
+    order_item_id   INTEGER        NOT NULL REFERENCES order_items (id) ON DELETE CASCADE,
+    quantity        INTEGER        NOT NULL CHECK (quantity > 0),
+    refunded_amount NUMERIC(10, 2) NOT NULL DEFAULT 0,
+    created_at      TIMESTAMPTZ    NOT NULL DEFAULT NOW(),
+    UNIQUE (return_id, order_item_id)
+);
+
+CREATE INDEX IF NOT EXISTS return_items_order_item_id_idx ON return_items (order_item_id);
+
+CREATE TABLE IF NOT EXISTS return_status_history (
+    id                 SERIAL PRIMARY KEY,
+    return_id          INTEGER     NOT NULL REFERENCES returns (id) ON DELETE CASCADE,
+    status             VARCHAR(50) NOT NULL,
+    note               VARCHAR(1000),
+    changed_by_user_id INTEGER REFERENCES users (id),
+    created_at         TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS return_status_history_return_id_idx ON return_status_history (return_id);
+
+-- Refunds are recorded as refund_pending before the payment provider is called. provider_refund_cents
+-- is the share of the refund the provider owes, and provider_refunded_cents how much it has refunded.
+ALTER TABLE returns ADD COLUMN IF NOT EXISTS provider_refund_cents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE returns ADD COLUMN IF NOT EXISTS provider_refunded_cents BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,91 @@
+-- Needs Tags.sql.
+-- Product search. search_vector weights the name over tag names over the short
+-- description over the description; search_text is the name and tag names, matched by
+-- trigram for typo tolerance. Both are kept up to date by the triggers below, so every
+-- way of changing items and their tags is covered.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE inventories ADD COLUMN IF NOT EXISTS search_vector TSVECTOR;
+ALTER TABLE inventories ADD COLUMN IF NOT EXISTS search_text TEXT NOT NULL DEFAULT '';
+
+CREATE OR REPLACE FUNCTION inventory_tag_names(item_id INTEGER) RETURNS TEXT AS $$
+    SELECT COALESCE(STRING_AGG(t.name, ' ' ORDER BY t.name), '')
+    FROM inventory_tags it
+    JOIN tags t ON t.id = it.tag_id
+    WHERE it.inventory_id = item_id
+$$ LANGUAGE SQL STABLE;
+
+CREATE OR REPLACE FUNCTION inventory_search_vector(
+    item_name TEXT, tag_names TEXT, item_short_description TEXT, item_description TEXT
+) RETURNS TSVECTOR AS $$
+    SELECT SETWEIGHT(TO_TSVECTOR('english', COALESCE(item_name, '')), 'A') ||
+           SETWEIGHT(TO_TSVECTOR('english', COALESCE(tag_names, '')), 'B') ||
+           SETWEIGHT(TO_TSVECTOR('english', COALESCE(item_short_description, '')), 'C') ||
+           SETWEIGHT(TO_TSVECTOR('english', COALESCE(item_description, '')), 'D')
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- Escapes text to go in HTML. Search highlights escape the name and descriptions before
+-- ts_headline adds its <mark> tags, so the only markup in them is the highlighting.
+CREATE OR REPLACE FUNCTION html_escape(value TEXT) RETURNS TEXT AS $$
+    SELECT REPLACE(REPLACE(REPLACE(REPLACE(REPLACE(
+        value, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;'), '''', '&#39;')
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- Recomputes the search columns of one item, or of every item when item_id is null
+CREATE OR REPLACE FUNCTION refresh_inventory_search(item_id INTEGER) RETURNS VOID AS $$
+    UPDATE inventories i
+    SET search_vector = inventory_search_vector(i.name, inventory_tag_names(i.id), i.short_description, i.description),
+        search_text   = LOWER(i.name || ' ' || inventory_tag_names(i.id))
+    WHERE item_id IS NULL OR i.id = item_id
+$$ LANGUAGE SQL;
+
+CREATE OR REPLACE FUNCTION inventories_search_trigger() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.search_vector := inventory_search_vector(
+        NEW.name, inventory_tag_names(NEW.id), NEW.short_description, NEW.description
+    );
+    NEW.search_text := LOWER(NEW.name || ' ' || inventory_tag_names(NEW.id));
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS inventories_search ON inventories;
+CREATE TRIGGER inventories_search
+    BEFORE INSERT OR UPDATE OF name, short_description, description ON inventories
+    FOR EACH ROW EXECUTE FUNCTION inventories_search_trigger();
+
+CREATE OR REPLACE FUNCTION inventory_tags_search_trigger() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM refresh_inventory_search(OLD.inventory_id);
+    ELSE
+        PERFORM refresh_inventory_search(NEW.inventory_id);
+    END IF;
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS inventory_tags_search ON inventory_tags;
+CREATE TRIGGER inventory_tags_search
+    AFTER INSERT OR DELETE ON inventory_tags
+    FOR EACH ROW EXECUTE FUNCTION inventory_tags_search_trigger();
+
+CREATE OR REPLACE FUNCTION tags_search_trigger() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM refresh_inventory_search(it.inventory_id)
+    FROM inventory_tags it
+    WHERE it.tag_id = NEW.id;
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS tags_search ON tags;
+CREATE TRIGGER tags_search
+    AFTER UPDATE OF name ON tags
+    FOR EACH ROW EXECUTE FUNCTION tags_search_trigger();
+
+-- Items from before search
+SELECT refresh_inventory_search(NULL);
+
+CREATE INDEX IF NOT EXISTS inventories_search_vector_idx ON inventories USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS inventories_search_text_trgm_idx ON inventories USING GIN (search_text gin_trgm_ops);
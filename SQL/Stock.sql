@@ -0,0 +1,17 @@
+-- NULL means stock isn't tracked and the item can always be bought, so products from before
+-- stock levels stay on sale until an admin sets theirs
+ALTER TABLE inventories ADD COLUMN IF NOT EXISTS stock_quantity INTEGER;
+
+-- Checkout holds. Rows past expires_at no longer count against stock and are
+-- cleaned up by the scheduled release job.
+CREATE TABLE IF NOT EXISTS stock_reservations (
+    id                SERIAL PRIMARY KEY,
+    user_id           INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    inventory_item_id INTEGER     NOT NULL REFERENCES inventories (id) ON DELETE CASCADE,
+    quantity          INTEGER     NOT NULL CHECK (quantity > 0),
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at        TIMESTAMPTZ NOT NULL,
+    UNIQUE (user_id, inventory_item_id)
+);
+
+CREATE INDEX IF NOT EXISTS stock_reservations_item_expires_idx ON stock_reservations (inventory_item_id, expires_at);
@@ -0,0 +1,87 @@
+-- Needs Variants.sql.
+-- Subscription boxes. A plan ships the variants listed in subscription_plan_items every
+-- month or every quarter; admins change the items as the featured sauces change.
+CREATE TABLE IF NOT EXISTS subscription_plans (
+    id               SERIAL PRIMARY KEY,
+    slug             VARCHAR(255)   NOT NULL UNIQUE,
+    name             VARCHAR(255)   NOT NULL,
+    description      VARCHAR(1000)  NOT NULL DEFAULT '',
+    billing_interval VARCHAR(20)    NOT NULL CHECK (billing_interval IN ('monthly', 'quarterly')),
+    price            NUMERIC(10, 2) NOT NULL CHECK (price > 0),
+    is_active        BOOLEAN        NOT NULL DEFAULT TRUE,
+    created_at       TIMESTAMPTZ    NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS subscription_plan_items (
+    id         SERIAL PRIMARY KEY,
+    plan_id    INTEGER NOT NULL REFERENCES subscription_plans (id) ON DELETE CASCADE,
+    variant_id INTEGER NOT NULL REFERENCES inventory_item_variants (id) ON DELETE RESTRICT,
+    quantity   INTEGER NOT NULL CHECK (quantity > 0),
+    sort_order INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (plan_id, variant_id)
+);
+
+-- next_shipment_on is the date of the next cycle. The scheduled job creates that cycle's
+-- shipment once the date arrives and moves next_shipment_on on by the plan's interval.
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id                 SERIAL PRIMARY KEY,
+    user_id            INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    plan_id            INTEGER     NOT NULL REFERENCES subscription_plans (id),
+    shipping_option_id INTEGER     NOT NULL REFERENCES shipping_options (id),
+    status             VARCHAR(20) NOT NULL DEFAULT 'active',
+    next_shipment_on   DATE        NOT NULL,
+    paused_at          TIMESTAMPTZ,
+    cancelled_at       TIMESTAMPTZ,
+    created_at         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at         TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS subscriptions_user_id_idx ON subscriptions (user_id);
+CREATE INDEX IF NOT EXISTS subscriptions_due_idx ON subscriptions (next_shipment_on) WHERE status = 'active';
+-- One live subscription per user per plan
+CREATE UNIQUE INDEX IF NOT EXISTS subscriptions_user_plan_live_idx
+    ON subscriptions (user_id, plan_id) WHERE status <> 'cancelled';
+
+-- The card each cycle is charged to, saved with the payment provider when subscribing
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS payment_provider VARCHAR(50);
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS card_reference VARCHAR(255);
+
+-- One row per cycle. A pending shipment is charged price plus shipping_price, then retried
+-- until it's paid for and its stock can be taken; after too many failures it's marked failed
+-- and the subscription is paused. A charge for a cycle that fails or is skipped is refunded.
+CREATE TABLE IF NOT EXISTS subscription_shipments (
+    id              SERIAL PRIMARY KEY,
+    subscription_id INTEGER        NOT NULL REFERENCES subscriptions (id) ON DELETE CASCADE,
+    cycle_on        DATE           NOT NULL,
+    status          VARCHAR(20)    NOT NULL DEFAULT 'pending',
+    attempts        INTEGER        NOT NULL DEFAULT 0,
+    last_error      VARCHAR(1000),
+    next_attempt_at TIMESTAMPTZ,
+    price           NUMERIC(10, 2) NOT NULL,
+    shipping_price  NUMERIC(10, 2) NOT NULL,
+    fulfilled_at    TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ    NOT NULL DEFAULT NOW(),
+    updated_at      TIMESTAMPTZ,
+    UNIQUE (subscription_id, cycle_on)
+);
+
+-- payment_status is null until the cycle is charged, then one of the payment statuses,
+-- refund_pending while a refund is with the provider, or refunded.
+ALTER TABLE subscription_shipments ADD COLUMN IF NOT EXISTS payment_status VARCHAR(20);
+ALTER TABLE subscription_shipments ADD COLUMN IF NOT EXISTS payment_reference VARCHAR(255);
+
+CREATE INDEX IF NOT EXISTS subscription_shipments_pending_idx
+    ON subscription_shipments (next_attempt_at) WHERE status = 'pending';
+
+-- What a fulfilled shipment contained, as the plan stood at the time
+CREATE TABLE IF NOT EXISTS subscription_shipment_items (
+    id          SERIAL PRIMARY KEY,
+    shipment_id INTEGER      NOT NULL REFERENCES subscription_shipments (id) ON DELETE CASCADE,
+    variant_id  INTEGER REFERENCES inventory_item_variants (id) ON DELETE SET NULL,
+    name        VARCHAR(255) NOT NULL,
+    sku         VARCHAR(64)  NOT NULL,
+    quantity    INTEGER      NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS subscription_shipment_items_shipment_id_idx ON subscription_shipment_items (shipment_id);
@@ -25,4 +25,7 @@ INSERT INTO roles_permissions(role_id, permission_id) VALUES(2, 3);
 INSERT INTO roles_permissions(role_id, permission_id) VALUES(2, 4);
 
 -- Reviewer
-INSERT INTO roles_permissions(role_id, permission_id) VALUES(3, 5);
\ No newline at end of file
+INSERT INTO roles_permissions(role_id, permission_id) VALUES(3, 5);
+
+-- Shop Admin: manages coupons and shipping options. Orders and returns stay with User Admin
+INSERT INTO roles(name, slug) VALUES('Shop Admin', 'shop-admin');
@@ -0,0 +1,69 @@
+-- Sellable versions of an inventory item (bottle sizes, multi-packs). Price and stock
+-- live on the variant; every item has exactly one default variant, which mirrors the
+-- item's own price and is used when a cart request doesn't name a variant. A NULL
+-- stock_quantity isn't tracked; new variants start tracked, with none in stock.
+CREATE TABLE IF NOT EXISTS inventory_item_variants (
+    id                SERIAL PRIMARY KEY,
+    inventory_item_id INTEGER        NOT NULL REFERENCES inventories (id) ON DELETE CASCADE,
+    sku               VARCHAR(64)    NOT NULL UNIQUE,
+    name              VARCHAR(100)   NOT NULL,
+    price             NUMERIC(10, 2) NOT NULL CHECK (price > 0),
+    weight_grams      INTEGER        NOT NULL DEFAULT 0 CHECK (weight_grams >= 0),
+    stock_quantity    INTEGER                 DEFAULT 0 CHECK (stock_quantity >= 0),
+    is_default        BOOLEAN        NOT NULL DEFAULT FALSE,
+    sort_order        INTEGER        NOT NULL DEFAULT 0,
+    created_at        TIMESTAMPTZ    NOT NULL DEFAULT NOW(),
+    updated_at        TIMESTAMPTZ
+);
+
+ALTER TABLE inventory_item_variants ALTER COLUMN stock_quantity DROP NOT NULL;
+
+CREATE INDEX IF NOT EXISTS inventory_item_variants_item_idx ON inventory_item_variants (inventory_item_id);
+CREATE UNIQUE INDEX IF NOT EXISTS inventory_item_variants_default_idx
+    ON inventory_item_variants (inventory_item_id) WHERE is_default;
+
+-- Items from before variants get a default variant carrying their price and stock. The SKU
+-- is the upper-cased slug and the item's id, as DefaultVariantSku makes them.
+INSERT INTO inventory_item_variants (inventory_item_id, sku, name, price, stock_quantity, is_default)
+SELECT i.id, LEFT(UPPER(i.slug), 64 - LENGTH('-' || i.id)) || '-' || i.id, 'Standard', i.price, i.stock_quantity, TRUE
+FROM inventories i
+WHERE NOT EXISTS (SELECT 1 FROM inventory_item_variants v WHERE v.inventory_item_id = i.id);
+
+-- Cart lines are per variant, so two sizes of the same sauce are separate lines
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS variant_id INTEGER
+    REFERENCES inventory_item_variants (id) ON DELETE CASCADE;
+UPDATE cart_items ci
+SET variant_id = v.id
+FROM inventory_item_variants v
+WHERE v.inventory_item_id = ci.inventory_item_id AND v.is_default AND ci.variant_id IS NULL;
+ALTER TABLE cart_items ALTER COLUMN variant_id SET NOT NULL;
+ALTER TABLE cart_items DROP CONSTRAINT IF EXISTS cart_items_inventory_item_id_user_id_key;
+CREATE UNIQUE INDEX IF NOT EXISTS cart_items_user_variant_idx ON cart_items (user_id, variant_id);
+
+ALTER TABLE guest_cart_items ADD COLUMN IF NOT EXISTS variant_id INTEGER
+    REFERENCES inventory_item_variants (id) ON DELETE CASCADE;
+UPDATE guest_cart_items gci
+SET variant_id = v.id
+FROM inventory_item_variants v
+WHERE v.inventory_item_id = gci.inventory_item_id AND v.is_default AND gci.variant_id IS NULL;
+ALTER TABLE guest_cart_items ALTER COLUMN variant_id SET NOT NULL;
+ALTER TABLE guest_cart_items DROP CONSTRAINT IF EXISTS guest_cart_items_guest_cart_id_inventory_item_id_key;
+CREATE UNIQUE INDEX IF NOT EXISTS guest_cart_items_cart_variant_idx ON guest_cart_items (guest_cart_id, variant_id);
+
+ALTER TABLE stock_reservations ADD COLUMN IF NOT EXISTS variant_id INTEGER
+    REFERENCES inventory_item_variants (id) ON DELETE CASCADE;
+UPDATE stock_reservations sr
+SET variant_id = v.id
+FROM inventory_item_variants v
+WHERE v.inventory_item_id = sr.inventory_item_id AND v.is_default AND sr.variant_id IS NULL;
+ALTER TABLE stock_reservations ALTER COLUMN variant_id SET NOT NULL;
+ALTER TABLE stock_reservations DROP CONSTRAINT IF EXISTS stock_reservations_user_id_inventory_item_id_key;
+CREATE UNIQUE INDEX IF NOT EXISTS stock_reservations_user_variant_idx ON stock_reservations (user_id, variant_id);
+CREATE INDEX IF NOT EXISTS stock_reservations_variant_expires_idx ON stock_reservations (variant_id, expires_at);
+
+-- Order lines keep the variant they were bought as. variant_id is null for orders
+-- placed before variants existed, or whose variant has since been deleted.
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS variant_id INTEGER
+    REFERENCES inventory_item_variants (id) ON DELETE SET NULL;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS variant_name VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS sku VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1,26 @@
+-- Needs Variants.sql.
+-- Named lists of items a user wants to keep track of. share_slug is random so a list
+-- can only be found by someone it's shared with, and only while is_public.
+CREATE TABLE IF NOT EXISTS wishlists (
+    id         SERIAL PRIMARY KEY,
+    user_id    INTEGER      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name       VARCHAR(100) NOT NULL,
+    share_slug VARCHAR(32)  NOT NULL UNIQUE,
+    is_public  BOOLEAN      NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ,
+    UNIQUE (user_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS wishlist_items (
+    id                SERIAL PRIMARY KEY,
+    wishlist_id       INTEGER     NOT NULL REFERENCES wishlists (id) ON DELETE CASCADE,
+    inventory_item_id INTEGER     NOT NULL REFERENCES inventories (id) ON DELETE CASCADE,
+    variant_id        INTEGER     NOT NULL REFERENCES inventory_item_variants (id) ON DELETE CASCADE,
+    quantity          INTEGER     NOT NULL DEFAULT 1 CHECK (quantity > 0),
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at        TIMESTAMPTZ,
+    UNIQUE (wishlist_id, variant_id)
+);
+
+CREATE INDEX IF NOT EXISTS wishlist_items_variant_id_idx ON wishlist_items (variant_id);
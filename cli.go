@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"hotsauceshop/lib"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const cliUsage = `Usage:
+  hotsauceshop                      run the server
+  hotsauceshop export-products [-format csv|json] [-out file]
+  hotsauceshop import-products [-format csv|json] [-dry-run] file`
+
+/*
+runCommand runs the subcommand named by args[0], if any, and reports whether it did.
+The server isn't started when a subcommand runs.
+*/
+func runCommand(args []string, dbPool *pgxpool.Pool, logger *slog.Logger) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch args[0] {
+	case "export-products":
+		return true, exportProductsCommand(args[1:], dbPool, logger)
+	case "import-products":
+		return true, importProductsCommand(args[1:], dbPool, logger)
+	case "help", "-h", "-help", "--help":
+		fmt.Println(cliUsage)
+		return true, nil
+	}
+	return true, fmt.Errorf("unknown command %v\n%v", args[0], cliUsage)
+}
+
+func exportProductsCommand(args []string, dbPool *pgxpool.Pool, logger *slog.Logger) error {
+	flags := flag.NewFlagSet("export-products", flag.ContinueOnError)
+	format := flags.String("format", lib.CatalogueFormatCsv, "csv or json")
+	out := flags.String("out", "", "file to write to instead of stdout")
+	if parseErr := flags.Parse(args); parseErr != nil {
+		return parseErr
+	}
+	if !lib.IsValidCatalogueFormat(*format) {
+		return fmt.Errorf("unknown format: %v", *format)
+	}
+
+	items, itemsErr := lib.GetCatalogueItems(dbPool)
+	if itemsErr != nil {
+		return itemsErr
+	}
+
+	var w io.Writer = os.Stdout
+	if len(*out) > 0 {
+		file, createErr := os.Create(*out)
+		if createErr != nil {
+			return createErr
+		}
+		defer closeFile(file, logger)
+		w = file
+	}
+	buffered := bufio.NewWriter(w)
+	writeErr := lib.WriteCatalogue(buffered, *format, items)
+	if writeErr != nil {
+		return writeErr
+	}
+	return buffered.Flush()
+}
+
+// importProductsCommand prints the import result as JSON. The format defaults to the file's extension.
+func importProductsCommand(args []string, dbPool *pgxpool.Pool, logger *slog.Logger) error {
+	flags := flag.NewFlagSet("import-products", flag.ContinueOnError)
+	format := flags.String("format", "", "csv or json; taken from the file extension when left out")
+	dryRun := flags.Bool("dry-run", false, "validate and report without saving anything")
+	if parseErr := flags.Parse(args); parseErr != nil {
+		return parseErr
+	}
+	if flags.NArg() != 1 {
+		return errors.New("import-products needs the file to import")
+	}
+	filename := flags.Arg(0)
+	if len(*format) == 0 {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	}
+	if !lib.IsValidCatalogueFormat(*format) {
+		return fmt.Errorf("unknown format: %v", *format)
+	}
+
+	file, openErr := os.Open(filename)
+	if openErr != nil {
+		return openErr
+	}
+	defer closeFile(file, logger)
+	catalogueRows, readErr := lib.ReadCatalogue(file, *format)
+	if readErr != nil {
+		return readErr
+	}
+
+	result, importErr := lib.ImportCatalogue(dbPool, logger, catalogueRows, *dryRun)
+	if importErr != nil {
+		return importErr
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encodeErr := encoder.Encode(result)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if !result.Valid {
+		return errors.New("some rows are invalid; nothing was imported")
+	}
+	return nil
+}
+
+func closeFile(file *os.File, logger *slog.Logger) {
+	closeErr := file.Close()
+	if closeErr != nil {
+		logger.Error(fmt.Sprintf("Error closing %v: %v", file.Name(), closeErr))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"hotsauceshop/lib"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const StockReservationReleaseInterval = time.Minute
+const GiftCardRedemptionReleaseInterval = 15 * time.Minute
+const GuestCartExpiryInterval = time.Hour
+const SubscriptionProcessingInterval = 15 * time.Minute
+const AbandonedCartCheckInterval = 15 * time.Minute
+const ProductSimilarityRefreshInterval = time.Hour
+const SalePriceAlertInterval = 5 * time.Minute
+const UnpaidOrderCheckInterval = 15 * time.Minute
+const OrderRefundRetryInterval = 15 * time.Minute
+
+func startScheduledJobs(
+	dbPool *pgxpool.Pool,
+	logger *slog.Logger,
+	paymentProvider lib.PaymentProvider,
+	abandonedCarts lib.AbandonedCarts,
+	pendingPaymentTimeout time.Duration,
+) {
+	lib.RunPeriodically("release expired stock reservations", StockReservationReleaseInterval, logger, func() error {
+		released, err := lib.ReleaseExpiredStockReservations(dbPool)
+		if err != nil {
+			return err
+		}
+		if released > 0 {
+			logger.Info(fmt.Sprintf("Released %v expired stock reservations", released))
+		}
+		return nil
+	})
+
+	lib.RunPeriodically("release expired gift card redemptions", GiftCardRedemptionReleaseInterval, logger, func() error {
+		released, err := lib.ReleaseExpiredGiftCardRedemptions(dbPool, logger)
+		if err != nil {
+			return err
+		}
+		if released > 0 {
+			logger.Info(fmt.Sprintf("Released %v expired gift card redemptions", released))
+		}
+		return nil
+	})
+
+	lib.RunPeriodically("cancel unpaid orders", UnpaidOrderCheckInterval, logger, func() error {
+		cancelled, err := lib.CancelUnpaidOrders(dbPool, logger, paymentProvider, pendingPaymentTimeout)
+		if cancelled > 0 {
+			logger.Info(fmt.Sprintf("Cancelled %v orders left waiting for payment", cancelled))
+		}
+		return err
+	})
+
+	lib.RunPeriodically("retry order refunds", OrderRefundRetryInterval, logger, func() error {
+		refunded, err := lib.RefundPendingOrders(dbPool, logger, paymentProvider)
+		if refunded > 0 {
+			logger.Info(fmt.Sprintf("Refunded %v cancelled or refunded orders", refunded))
+		}
+		return err
+	})
+
+	lib.RunPeriodically("delete expired guest carts", GuestCartExpiryInterval, logger, func() error {
+		deleted, err := lib.DeleteExpiredGuestCarts(dbPool)
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			logger.Info(fmt.Sprintf("Deleted %v expired guest carts", deleted))
+		}
+		return nil
+	})
+
+	lib.RunPeriodically("process subscriptions", SubscriptionProcessingInterval, logger, func() error {
+		created, createErr := lib.CreateDueSubscriptionShipments(dbPool, logger)
+		if createErr != nil {
+			return createErr
+		}
+		fulfilled, failed, fulfilErr := lib.FulfilPendingSubscriptionShipments(dbPool, logger, paymentProvider)
+		refunded, refundErr := lib.RefundUnshippedSubscriptionShipments(dbPool, logger, paymentProvider)
+		if created > 0 || fulfilled > 0 || failed > 0 || refunded > 0 {
+			logger.Info(fmt.Sprintf(
+				"Subscriptions: %v cycles started, %v shipments fulfilled, %v failed, %v refunded",
+				created, fulfilled, failed, refunded,
+			))
+		}
+		return errors.Join(fulfilErr, refundErr)
+	})
+
+	lib.RunPeriodically("remind abandoned carts", AbandonedCartCheckInterval, logger, func() error {
+		reminded, err := lib.RemindAbandonedCarts(dbPool, logger, abandonedCarts)
+		if reminded > 0 {
+			logger.Info(fmt.Sprintf("Sent %v abandoned cart reminders", reminded))
+		}
+		return err
+	})
+
+	lib.RunPeriodically("trigger price alerts for started sales", SalePriceAlertInterval, logger, func() error {
+		triggered, err := lib.TriggerStartedSalePriceAlerts(dbPool, logger)
+		if triggered > 0 {
+			logger.Info(fmt.Sprintf("Triggered %v price alerts for started sales", triggered))
+		}
+		return err
+	})
+
+	lib.RunPeriodically("refresh product recommendations", ProductSimilarityRefreshInterval, logger, func() error {
+		refreshed, err := lib.RefreshProductSimilarities(dbPool, logger)
+		if err != nil {
+			return err
+		}
+		if refreshed > 0 {
+			logger.Info(fmt.Sprintf("Refreshed %v product recommendations", refreshed))
+		}
+		return nil
+	})
+}
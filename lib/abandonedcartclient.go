@@ -0,0 +1,371 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const DefaultAbandonedCartIdleHours = 24
+const DefaultReminderCouponExpiryDays = 7
+
+const NotificationTypeCartReminder = "cart_reminder"
+const EmailTypeCartReminder = "cart_reminder"
+
+// abandonedCartBatchSize is how many carts one run of the job reminds
+const abandonedCartBatchSize = 100
+
+// AbandonedCarts - how long a cart sits unchanged before it's abandoned, and the coupon
+// sent with the reminder. No coupon is sent when CouponPercent is 0.
+type AbandonedCarts struct {
+	IdleAfter     time.Duration
+	CouponPercent int
+	CouponExpiry  time.Duration
+}
+
+type CartAbandonment struct {
+	Id             int        `json:"id" db:"id"`
+	UserId         int        `json:"userId" db:"user_id"`
+	LastActivityAt time.Time  `json:"lastActivityAt" db:"last_activity_at"`
+	ItemCount      int        `json:"itemCount" db:"item_count"`
+	Subtotal       float64    `json:"subtotal" db:"subtotal"`
+	CouponCode     *string    `json:"couponCode" db:"coupon_code"`
+	RecoveredAt    *time.Time `json:"recoveredAt" db:"recovered_at"`
+	OrderId        *int       `json:"orderId" db:"order_id"`
+	CreatedAt      time.Time  `json:"createdAt" db:"created_at"`
+}
+
+// idleCart is a user's cart as a whole, as found by the abandoned cart job
+type idleCart struct {
+	UserId         int       `db:"user_id"`
+	LastActivityAt time.Time `db:"last_activity_at"`
+	ItemCount      int       `db:"item_count"`
+	Subtotal       float64   `db:"subtotal"`
+}
+
+/*
+AbandonedCartReport covers the carts abandoned in a period. Carts that were checked out
+without going idle are the orders placed less those recovered, so AbandonmentRate is
+abandoned carts over abandoned carts plus those. RecoveryRate is recovered over abandoned.
+*/
+type AbandonedCartReport struct {
+	AbandonedCarts  int     `json:"abandonedCarts" db:"abandoned_carts"`
+	RecoveredCarts  int     `json:"recoveredCarts" db:"recovered_carts"`
+	OrdersPlaced    int     `json:"ordersPlaced" db:"orders_placed"`
+	AbandonedValue  float64 `json:"abandonedValue" db:"abandoned_value"`
+	RecoveredValue  float64 `json:"recoveredValue" db:"recovered_value"`
+	CouponsIssued   int     `json:"couponsIssued" db:"coupons_issued"`
+	CouponsRedeemed int     `json:"couponsRedeemed" db:"coupons_redeemed"`
+	AbandonmentRate float64 `json:"abandonmentRate" db:"-"`
+	RecoveryRate    float64 `json:"recoveryRate" db:"-"`
+}
+
+func NewAbandonedCarts(config ConfigAbandonedCarts) (AbandonedCarts, error) {
+	if config.ReminderCouponPercent < 0 || config.ReminderCouponPercent > 100 {
+		return AbandonedCarts{}, errors.New("abandonedCarts.reminderCouponPercent must be between 0 and 100")
+	}
+	idleHours := config.IdleHours
+	if idleHours <= 0 {
+		idleHours = DefaultAbandonedCartIdleHours
+	}
+	couponExpiryDays := config.ReminderCouponExpiryDays
+	if couponExpiryDays <= 0 {
+		couponExpiryDays = DefaultReminderCouponExpiryDays
+	}
+	return AbandonedCarts{
+		IdleAfter:     time.Duration(idleHours) * time.Hour,
+		CouponPercent: config.ReminderCouponPercent,
+		CouponExpiry:  time.Duration(couponExpiryDays) * 24 * time.Hour,
+	}, nil
+}
+
+// GenerateReminderCouponCode returns a random code that fits the coupons table's alphanumeric codes
+func GenerateReminderCouponCode() (string, error) {
+	codeUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	return "BACK" + strings.ToUpper(strings.ReplaceAll(codeUUID.String(), "-", "")[:10]), nil
+}
+
+// cartReminderMessage - couponCode is empty when no coupon is sent
+func cartReminderMessage(itemCount int, couponCode string, couponPercent int, couponExpiresAt time.Time) string {
+	items := "an item"
+	if itemCount != 1 {
+		items = fmt.Sprintf("%v items", itemCount)
+	}
+	message := fmt.Sprintf("You left %v in your cart.", items)
+	if len(couponCode) > 0 {
+		message += fmt.Sprintf(
+			" Use code %v for %v%% off before %v.", couponCode, couponPercent, couponExpiresAt.Format("January 2"),
+		)
+	}
+	return message
+}
+
+// calculateRates fills in the rates from the counts, leaving them 0 when there's nothing to divide by
+func (r *AbandonedCartReport) calculateRates() {
+	checkedOutWithoutAbandoning := max(r.OrdersPlaced-r.RecoveredCarts, 0)
+	if total := r.AbandonedCarts + checkedOutWithoutAbandoning; total > 0 {
+		r.AbandonmentRate = math.Round(float64(r.AbandonedCarts)/float64(total)*10000) / 10000
+	}
+	if r.AbandonedCarts > 0 {
+		r.RecoveryRate = math.Round(float64(r.RecoveredCarts)/float64(r.AbandonedCarts)*10000) / 10000
+	}
+}
+
+func addOutgoingEmail(db DBTX, userId int, emailType string, subject string, body string) error {
+	const query = `
+		INSERT INTO outgoing_emails (user_id, type, subject, body, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+	`
+	_, err := db.Exec(context.Background(), query, userId, emailType, subject, body)
+	return err
+}
+
+/*
+RemindAbandonedCarts is run by the scheduler
+ 1. Find carts that haven't changed for IdleAfter and haven't been recorded since they last changed
+ 2. Record each as abandoned and remind its user, with a one-time coupon if configured
+
+Returns how many carts were recorded.
+*/
+func RemindAbandonedCarts(dbPool *pgxpool.Pool, logger *slog.Logger, abandonedCarts AbandonedCarts) (int, error) {
+	query := `
+		WITH carts AS (
+			SELECT ci.user_id,
+			       MAX(COALESCE(ci.updated_at, ci.created_at)) AS last_activity_at,
+			       SUM(ci.quantity) AS item_count,
+			       SUM(` + variantEffectivePriceColumn + ` * ci.quantity) AS subtotal
+			FROM cart_items ci
+			JOIN inventory_item_variants v ON v.id = ci.variant_id
+			GROUP BY ci.user_id
+		)
+		SELECT c.*
+		FROM carts c
+		WHERE c.last_activity_at < $1
+		AND NOT EXISTS (
+			SELECT 1
+			FROM cart_abandonments ca
+			WHERE ca.user_id = c.user_id
+			AND ca.last_activity_at >= c.last_activity_at
+		)
+		ORDER BY c.last_activity_at
+		LIMIT $2
+	`
+	cutoff := time.Now().Add(-abandonedCarts.IdleAfter)
+	rows, queryErr := dbPool.Query(context.Background(), query, cutoff, abandonedCartBatchSize)
+	if queryErr != nil {
+		return 0, queryErr
+	}
+	carts, collectErr := pgx.CollectRows(rows, pgx.RowToStructByName[idleCart])
+	if collectErr != nil {
+		return 0, collectErr
+	}
+
+	recorded := 0
+	for _, cart := range carts {
+		notification, remindErr := remindAbandonedCart(dbPool, logger, abandonedCarts, cart)
+		if errors.Is(remindErr, pgx.ErrNoRows) {
+			// Another run got to it first
+			continue
+		}
+		if remindErr != nil {
+			return recorded, remindErr
+		}
+		recorded++
+
+		sendErr := SendNotification(notification, logger)
+		if sendErr != nil {
+			logger.Error(fmt.Sprintf("RemindAbandonedCarts: error sending reminder to user %v: %v", cart.UserId, sendErr))
+		}
+	}
+	return recorded, nil
+}
+
+/*
+remindAbandonedCart
+ 1. Record the abandonment, once per user per last change to the cart
+ 2. Create a one-time coupon, unless coupons are off or the user still has an unused one from an earlier reminder
+ 3. Store the reminder as a notification and as an email
+
+Returns pgx.ErrNoRows if the abandonment was already recorded.
+*/
+func remindAbandonedCart(
+	dbPool *pgxpool.Pool, logger *slog.Logger, abandonedCarts AbandonedCarts, cart idleCart,
+) (Notification, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return Notification{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("remindAbandonedCart: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	const insertQuery = `
+		INSERT INTO cart_abandonments (user_id, last_activity_at, item_count, subtotal, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (user_id, last_activity_at) DO NOTHING
+		RETURNING id
+	`
+	var abandonmentId int
+	insertErr := tx.QueryRow(
+		ctx, insertQuery, cart.UserId, cart.LastActivityAt, cart.ItemCount, ToCents(cart.Subtotal).Dollars(),
+	).Scan(&abandonmentId)
+	if insertErr != nil {
+		return Notification{}, insertErr
+	}
+
+	couponCode, couponExpiresAt, couponErr := createReminderCoupon(tx, abandonedCarts, cart.UserId, abandonmentId)
+	if couponErr != nil {
+		return Notification{}, couponErr
+	}
+
+	message := cartReminderMessage(cart.ItemCount, couponCode, abandonedCarts.CouponPercent, couponExpiresAt)
+	notification, notificationErr := addNotification(tx, cart.UserId, NotificationTypeCartReminder, message,
+		map[string]any{
+			"cartAbandonmentId": abandonmentId,
+			"itemCount":         cart.ItemCount,
+			"couponCode":        couponCode,
+		})
+	if notificationErr != nil {
+		return Notification{}, notificationErr
+	}
+	emailErr := addOutgoingEmail(tx, cart.UserId, EmailTypeCartReminder, "You left something in your cart", message)
+	if emailErr != nil {
+		return Notification{}, emailErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return Notification{}, commitErr
+	}
+	logger.Info(fmt.Sprintf("Cart of user %v abandoned with %v items; reminder sent", cart.UserId, cart.ItemCount))
+	return notification, nil
+}
+
+// createReminderCoupon returns an empty code when no coupon is sent
+func createReminderCoupon(
+	tx pgx.Tx, abandonedCarts AbandonedCarts, userId int, abandonmentId int,
+) (string, time.Time, error) {
+	if abandonedCarts.CouponPercent == 0 {
+		return "", time.Time{}, nil
+	}
+
+	const unusedCouponQuery = `
+		SELECT EXISTS (
+			SELECT 1
+			FROM cart_abandonments ca
+			JOIN coupons c ON c.code = ca.coupon_code
+			WHERE ca.user_id = $1
+			AND c.expires_at > NOW()
+			AND NOT EXISTS (SELECT 1 FROM coupon_redemptions r WHERE r.coupon_code = c.code)
+		)
+	`
+	var hasUnusedCoupon bool
+	unusedErr := tx.QueryRow(context.Background(), unusedCouponQuery, userId).Scan(&hasUnusedCoupon)
+	if unusedErr != nil || hasUnusedCoupon {
+		return "", time.Time{}, unusedErr
+	}
+
+	code, codeErr := GenerateReminderCouponCode()
+	if codeErr != nil {
+		return "", time.Time{}, codeErr
+	}
+	oneRedemption := 1
+	expiresAt := time.Now().Add(abandonedCarts.CouponExpiry)
+	insertErr := insertCoupon(tx, CreateCouponRequest{
+		Code: code,
+		CouponRequest: CouponRequest{
+			Description:           fmt.Sprintf("Abandoned cart reminder for user %v", userId),
+			CouponTypeName:        CouponTypePercentPriceReduction,
+			ReductionPercent:      abandonedCarts.CouponPercent,
+			ExpiresAt:             expiresAt,
+			MaxRedemptions:        &oneRedemption,
+			MaxRedemptionsPerUser: &oneRedemption,
+		},
+	})
+	if insertErr != nil {
+		return "", time.Time{}, insertErr
+	}
+
+	const updateQuery = `UPDATE cart_abandonments SET coupon_code = $1 WHERE id = $2`
+	_, updateErr := tx.Exec(context.Background(), updateQuery, code, abandonmentId)
+	if updateErr != nil {
+		return "", time.Time{}, updateErr
+	}
+	return code, expiresAt, nil
+}
+
+// markCartAbandonmentRecovered ties an order to the user's latest abandonment since their previous order, if any
+func markCartAbandonmentRecovered(db DBTX, userId int, orderId int) error {
+	const query = `
+		UPDATE cart_abandonments
+		SET recovered_at = NOW(), order_id = $2
+		WHERE id = (
+			SELECT ca.id
+			FROM cart_abandonments ca
+			WHERE ca.user_id = $1
+			AND ca.recovered_at IS NULL
+			AND NOT EXISTS (
+				SELECT 1
+				FROM orders o
+				WHERE o.user_id = ca.user_id
+				AND o.id <> $2
+				AND o.created_at > ca.created_at
+			)
+			ORDER BY ca.created_at DESC
+			LIMIT 1
+		)
+	`
+	_, err := db.Exec(context.Background(), query, userId, orderId)
+	return err
+}
+
+// GetAbandonedCartReport covers carts abandoned, and orders placed, between createdAfter and createdBefore
+func GetAbandonedCartReport(
+	dbPool *pgxpool.Pool, createdAfter *time.Time, createdBefore *time.Time,
+) (AbandonedCartReport, error) {
+	const query = `
+		SELECT COUNT(*) AS abandoned_carts,
+		       COUNT(ca.recovered_at) AS recovered_carts,
+		       (
+		       	SELECT COUNT(*)
+		       	FROM orders o
+		       	WHERE ($1::timestamptz IS NULL OR o.created_at >= $1)
+		       	AND ($2::timestamptz IS NULL OR o.created_at < $2)
+		       ) AS orders_placed,
+		       COALESCE(SUM(ca.subtotal), 0) AS abandoned_value,
+		       COALESCE(SUM(ro.total), 0) AS recovered_value,
+		       COUNT(ca.coupon_code) AS coupons_issued,
+		       COUNT(*) FILTER (
+		       	WHERE EXISTS (SELECT 1 FROM coupon_redemptions r WHERE r.coupon_code = ca.coupon_code)
+		       ) AS coupons_redeemed
+		FROM cart_abandonments ca
+		LEFT JOIN orders ro ON ro.id = ca.order_id
+		WHERE ($1::timestamptz IS NULL OR ca.created_at >= $1)
+		AND ($2::timestamptz IS NULL OR ca.created_at < $2)
+	`
+	rows, err := dbPool.Query(context.Background(), query, createdAfter, createdBefore)
+	if err != nil {
+		return AbandonedCartReport{}, err
+	}
+	report, collectErr := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[AbandonedCartReport])
+	if collectErr != nil {
+		return AbandonedCartReport{}, collectErr
+	}
+	report.calculateRates()
+	return report, nil
+}
@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestNewAbandonedCarts(t *testing.T) {
+	abandonedCarts, err := NewAbandonedCarts(ConfigAbandonedCarts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if abandonedCarts.IdleAfter != DefaultAbandonedCartIdleHours*time.Hour || abandonedCarts.CouponPercent != 0 {
+		t.Fatalf("Unexpected defaults: %+v", abandonedCarts)
+	}
+
+	_, err = NewAbandonedCarts(ConfigAbandonedCarts{ReminderCouponPercent: 101})
+	if err == nil {
+		t.Fatal("Coupon percents over 100 should be rejected")
+	}
+}
+
+func TestGenerateReminderCouponCode(t *testing.T) {
+	code, err := GenerateReminderCouponCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Coupon codes are alphanumeric and at most 25 characters
+	if !regexp.MustCompile(`^BACK[0-9A-F]{10}$`).MatchString(code) {
+		t.Fatalf("Unexpected coupon code: %v", code)
+	}
+}
+
+func TestCartReminderMessage(t *testing.T) {
+	if message := cartReminderMessage(1, "", 0, time.Time{}); message != "You left an item in your cart." {
+		t.Fatalf("Unexpected message: %v", message)
+	}
+	expiresAt := time.Date(2026, time.March, 7, 12, 0, 0, 0, time.UTC)
+	message := cartReminderMessage(3, "BACK0123456789", 10, expiresAt)
+	if message != "You left 3 items in your cart. Use code BACK0123456789 for 10% off before March 7." {
+		t.Fatalf("Unexpected message: %v", message)
+	}
+}
+
+func TestAbandonedCartReportRates(t *testing.T) {
+	// 10 carts went idle and 2 of those were recovered; 8 orders were placed, 2 of them the recovered carts
+	report := AbandonedCartReport{AbandonedCarts: 10, RecoveredCarts: 2, OrdersPlaced: 8}
+	report.calculateRates()
+	if report.AbandonmentRate != 0.625 || report.RecoveryRate != 0.2 {
+		t.Fatalf("Unexpected rates: %+v", report)
+	}
+
+	empty := AbandonedCartReport{}
+	empty.calculateRates()
+	if empty.AbandonmentRate != 0 || empty.RecoveryRate != 0 {
+		t.Fatalf("Rates should be 0 with nothing to report: %+v", empty)
+	}
+}
@@ -10,6 +10,13 @@ type StatusForbiddenError struct {
 	Message    string
 }
 
+// StatusBadRequestError carries an error code so routes can pass it through to the client
+type StatusBadRequestError struct {
+	StatusCode int
+	Message    string
+	ErrorCode  string
+}
+
 func (e *InternalServerError) Error() string {
 	return e.Message
 }
@@ -18,7 +25,60 @@ func (e *StatusForbiddenError) Error() string {
 	return e.Message
 }
 
+func (e *StatusBadRequestError) Error() string {
+	return e.Message
+}
+
 const ErrorCodeInsufficientKarma = "ERR_INSUFFICIENT_KARMA"
 const ErrorCodePermissionDenied = "ERR_PERMISSION_DENIED"
 const ErrorCodeUserNotFound = "ERR_USER_NOT_FOUND"
 const ErrorCodeUserExists = "ERR_USER_EXISTS"
+const ErrorCodeInsufficientStock = "ERR_INSUFFICIENT_STOCK"
+const ErrorCodeCartEmpty = "ERR_CART_EMPTY"
+const ErrorCodeInvalidShippingOption = "ERR_INVALID_SHIPPING_OPTION"
+const ErrorCodeInvalidCouponCode = "ERR_INVALID_COUPON_CODE"
+const ErrorCodeCouponMinimumSubtotal = "ERR_COUPON_MINIMUM_SUBTOTAL"
+const ErrorCodeCouponUsageLimitReached = "ERR_COUPON_USAGE_LIMIT_REACHED"
+const ErrorCodeCouponNotApplicable = "ERR_COUPON_NOT_APPLICABLE"
+const ErrorCodeInvalidCoupon = "ERR_INVALID_COUPON"
+const ErrorCodeCouponExists = "ERR_COUPON_EXISTS"
+const ErrorCodeShippingOptionInUse = "ERR_SHIPPING_OPTION_IN_USE"
+const ErrorCodeInvalidOrderStatus = "ERR_INVALID_ORDER_STATUS"
+const ErrorCodeInvalidOrderStatusTransition = "ERR_INVALID_ORDER_STATUS_TRANSITION"
+const ErrorCodeOrderNotPayable = "ERR_ORDER_NOT_PAYABLE"
+const ErrorCodePaymentPending = "ERR_PAYMENT_PENDING"
+const ErrorCodePaymentDeclined = "ERR_PAYMENT_DECLINED"
+const ErrorCodeOrderNotReturnable = "ERR_ORDER_NOT_RETURNABLE"
+const ErrorCodeInvalidReturnItems = "ERR_INVALID_RETURN_ITEMS"
+const ErrorCodeInvalidReturnStatusTransition = "ERR_INVALID_RETURN_STATUS_TRANSITION"
+const ErrorCodeInvalidRefundAmount = "ERR_INVALID_REFUND_AMOUNT"
+const ErrorCodeRefundPending = "ERR_REFUND_PENDING"
+const ErrorCodeInvalidTaxLocation = "ERR_INVALID_TAX_LOCATION"
+const ErrorCodeInventoryItemNotFound = "ERR_INVENTORY_ITEM_NOT_FOUND"
+const ErrorCodeVariantNotFound = "ERR_VARIANT_NOT_FOUND"
+const ErrorCodeSkuExists = "ERR_SKU_EXISTS"
+const ErrorCodeDefaultVariant = "ERR_DEFAULT_VARIANT"
+const ErrorCodeInvalidBundle = "ERR_INVALID_BUNDLE"
+const ErrorCodeVariantInBundle = "ERR_VARIANT_IN_BUNDLE"
+const ErrorCodeInvalidGiftCard = "ERR_INVALID_GIFT_CARD"
+const ErrorCodeGiftCardNotFound = "ERR_GIFT_CARD_NOT_FOUND"
+const ErrorCodeGiftCardExists = "ERR_GIFT_CARD_EXISTS"
+const ErrorCodeGiftCardVoided = "ERR_GIFT_CARD_VOIDED"
+const ErrorCodeGiftCardExpired = "ERR_GIFT_CARD_EXPIRED"
+const ErrorCodeGiftCardInsufficientBalance = "ERR_GIFT_CARD_INSUFFICIENT_BALANCE"
+const ErrorCodeGiftCardExceedsCart = "ERR_GIFT_CARD_EXCEEDS_CART"
+const ErrorCodeSubscriptionPlanNotFound = "ERR_SUBSCRIPTION_PLAN_NOT_FOUND"
+const ErrorCodeSubscriptionPlanExists = "ERR_SUBSCRIPTION_PLAN_EXISTS"
+const ErrorCodeInvalidSubscriptionPlan = "ERR_INVALID_SUBSCRIPTION_PLAN"
+const ErrorCodeAlreadySubscribed = "ERR_ALREADY_SUBSCRIBED"
+const ErrorCodeSubscriptionNotActive = "ERR_SUBSCRIPTION_NOT_ACTIVE"
+const ErrorCodeInvalidSubscriptionStatusTransition = "ERR_INVALID_SUBSCRIPTION_STATUS_TRANSITION"
+const ErrorCodeWishlistExists = "ERR_WISHLIST_EXISTS"
+const ErrorCodeTooManyWishlists = "ERR_TOO_MANY_WISHLISTS"
+const ErrorCodeInvalidCartQuantity = "ERR_INVALID_CART_QUANTITY"
+const ErrorCodeCartItemNotFound = "ERR_CART_ITEM_NOT_FOUND"
+const ErrorCodePriceAlreadyBelowThreshold = "ERR_PRICE_ALREADY_BELOW_THRESHOLD"
+const ErrorCodeInvalidSale = "ERR_INVALID_SALE"
+const ErrorCodeSaleOverlaps = "ERR_SALE_OVERLAPS"
+const ErrorCodeInvalidProductImage = "ERR_INVALID_PRODUCT_IMAGE"
+const ErrorCodeInvalidProductImageOrder = "ERR_INVALID_PRODUCT_IMAGE_ORDER"
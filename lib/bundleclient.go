@@ -0,0 +1,268 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// bundleColumns - whether the item is a bundle, and what it saves at the prices the bundle and its
+// components sell for now, for use in inventory item queries aliased as "i" with itemSaleJoin
+const bundleColumns = `EXISTS (SELECT 1 FROM bundle_components bc WHERE bc.bundle_item_id = i.id) AS is_bundle,
+		       COALESCE(GREATEST(
+		       	(SELECT SUM(` + variantEffectivePriceColumn + ` * bc.quantity)
+		       	 FROM bundle_components bc
+		       	 JOIN inventory_item_variants v ON v.id = bc.variant_id
+		       	 WHERE bc.bundle_item_id = i.id) - ` + itemEffectivePriceColumn + `, 0), 0) AS bundle_savings`
+
+// BundleComponent is one of the variants a bundle ships as, priced at what it sells for on its own
+type BundleComponent struct {
+	BundleItemId     int     `json:"bundleItemId" db:"bundle_item_id"`
+	VariantId        int     `json:"variantId" db:"variant_id"`
+	InventoryItemId  int     `json:"inventoryItemId" db:"inventory_item_id"`
+	Name             string  `json:"name" db:"name"`
+	VariantName      string  `json:"variantName" db:"variant_name"`
+	IsDefaultVariant bool    `json:"isDefaultVariant" db:"is_default_variant"`
+	Sku              string  `json:"sku" db:"sku"`
+	Slug             string  `json:"slug" db:"slug"`
+	Price            float32 `json:"price" db:"price"`
+	Quantity         int     `json:"quantity" db:"quantity"`
+}
+
+// Bundle - ComponentsPrice is what the components would cost bought separately
+type Bundle struct {
+	Components      []BundleComponent `json:"components"`
+	ComponentsPrice float32           `json:"componentsPrice"`
+	Savings         float32           `json:"savings"`
+	SavingsPercent  int               `json:"savingsPercent"`
+}
+
+type BundleComponentRequest struct {
+	VariantId int `json:"variantId" validate:"required,min=1"`
+	Quantity  int `json:"quantity" validate:"required,min=1,max=100"`
+}
+
+// BundleRequest - an empty component list turns the bundle back into an ordinary item
+type BundleRequest struct {
+	Components []BundleComponentRequest `json:"components" validate:"max=50,dive"`
+}
+
+// DisplayName is the name to show customers, e.g. in stock errors
+func (b BundleComponent) DisplayName() string {
+	return VariantDisplayName(b.Name, b.VariantName, b.IsDefaultVariant)
+}
+
+/*
+NewBundle works out what a bundle saves against buying its components separately.
+Savings are never negative: a bundle priced above its parts just saves nothing.
+*/
+func NewBundle(bundlePrice float32, components []BundleComponent) Bundle {
+	var componentsPrice Cents
+	for _, component := range components {
+		componentsPrice += ToCents(float64(component.Price)) * Cents(component.Quantity)
+	}
+	savings := max(componentsPrice-ToCents(float64(bundlePrice)), 0)
+	savingsPercent := 0
+	if componentsPrice > 0 {
+		savingsPercent = int(savings * 100 / componentsPrice)
+	}
+	return Bundle{
+		Components:      components,
+		ComponentsPrice: float32(componentsPrice.Dollars()),
+		Savings:         float32(savings.Dollars()),
+		SavingsPercent:  savingsPercent,
+	}
+}
+
+// getBundleComponents returns the components of each of the given items that is a bundle, keyed by item id
+func getBundleComponents(db DBTX, inventoryItemIds []int) (map[int][]BundleComponent, error) {
+	const query = `
+		SELECT bc.bundle_item_id,
+		       bc.variant_id,
+		       v.inventory_item_id,
+		       i.name,
+		       v.name AS variant_name,
+		       v.is_default AS is_default_variant,
+		       v.sku,
+		       i.slug,
+		       ` + variantEffectivePriceColumn + ` AS price,
+		       bc.quantity
+		FROM bundle_components bc
+		JOIN inventory_item_variants v ON v.id = bc.variant_id
+		JOIN inventories i ON i.id = v.inventory_item_id
+		WHERE bc.bundle_item_id = ANY($1)
+		ORDER BY bc.bundle_item_id, bc.sort_order, bc.id
+	`
+	rows, err := db.Query(context.Background(), query, inventoryItemIds)
+	if err != nil {
+		return nil, err
+	}
+	components, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[BundleComponent])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+
+	bundleComponents := make(map[int][]BundleComponent)
+	for _, component := range components {
+		bundleComponents[component.BundleItemId] = append(bundleComponents[component.BundleItemId], component)
+	}
+	return bundleComponents, nil
+}
+
+// GetBundle returns false if the item isn't a bundle
+func GetBundle(dbPool *pgxpool.Pool, item InventoryItem) (Bundle, bool, error) {
+	bundleComponents, err := getBundleComponents(dbPool, []int{item.Id})
+	if err != nil {
+		return Bundle{}, false, err
+	}
+	components, isBundle := bundleComponents[item.Id]
+	if !isBundle {
+		return Bundle{}, false, nil
+	}
+	return NewBundle(item.Price, components), true, nil
+}
+
+// addBundleComponents fills in BundleComponents on the cart lines that are bundles
+func addBundleComponents(db DBTX, cartItems []CartItem) error {
+	bundleComponents, err := getBundleComponents(db, getCartInventoryItemIds(cartItems))
+	if err != nil {
+		return err
+	}
+	for i := range cartItems {
+		cartItems[i].BundleComponents = bundleComponents[cartItems[i].InventoryItemId]
+	}
+	return nil
+}
+
+/*
+validateBundleComponents
+ 1. Every component is a variant of some other item
+ 2. No component is itself a bundle, so stock only ever has to be expanded once
+ 3. No variant is listed twice
+*/
+func validateBundleComponents(tx pgx.Tx, bundleItemId int, components []BundleComponentRequest) error {
+	variantIds := make([]int, 0, len(components))
+	for _, component := range components {
+		if slices.Contains(variantIds, component.VariantId) {
+			return newInvalidBundleError(fmt.Sprintf("Variant %v is listed more than once", component.VariantId))
+		}
+		variantIds = append(variantIds, component.VariantId)
+	}
+
+	const query = `
+		SELECT v.id
+		FROM inventory_item_variants v
+		WHERE v.id = ANY($1)
+		AND v.inventory_item_id <> $2
+		AND NOT EXISTS (SELECT 1 FROM bundle_components bc WHERE bc.bundle_item_id = v.inventory_item_id)
+	`
+	rows, err := tx.Query(context.Background(), query, variantIds, bundleItemId)
+	if err != nil {
+		return err
+	}
+	validIds, collectRowsErr := pgx.CollectRows(rows, pgx.RowTo[int])
+	if collectRowsErr != nil {
+		return collectRowsErr
+	}
+	for _, variantId := range variantIds {
+		if !slices.Contains(validIds, variantId) {
+			return newInvalidBundleError(
+				fmt.Sprintf("Variant %v doesn't exist, is a bundle, or belongs to this bundle", variantId),
+			)
+		}
+	}
+	return nil
+}
+
+func newInvalidBundleError(message string) *StatusBadRequestError {
+	return &StatusBadRequestError{
+		StatusCode: http.StatusBadRequest,
+		Message:    message,
+		ErrorCode:  ErrorCodeInvalidBundle,
+	}
+}
+
+/*
+SaveBundle
+ 1. Check the components
+ 2. Replace the item's components, in the order given
+ 3. Return the bundle as customers will see it
+
+An item that's a component of another bundle can't become a bundle itself.
+*/
+func SaveBundle(
+	dbPool *pgxpool.Pool, logger *slog.Logger, inventoryItemId int, request BundleRequest,
+) (Bundle, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return Bundle{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("SaveBundle: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	if len(request.Components) > 0 {
+		var isComponent bool
+		const componentQuery = `
+			SELECT EXISTS (
+				SELECT 1 FROM bundle_components bc
+				JOIN inventory_item_variants v ON v.id = bc.variant_id
+				WHERE v.inventory_item_id = $1
+			)
+		`
+		componentErr := tx.QueryRow(ctx, componentQuery, inventoryItemId).Scan(&isComponent)
+		if componentErr != nil {
+			return Bundle{}, componentErr
+		}
+		if isComponent {
+			return Bundle{}, newInvalidBundleError("This item is part of another bundle")
+		}
+
+		validationErr := validateBundleComponents(tx, inventoryItemId, request.Components)
+		if validationErr != nil {
+			return Bundle{}, validationErr
+		}
+	}
+
+	_, deleteErr := tx.Exec(ctx, `DELETE FROM bundle_components WHERE bundle_item_id = $1`, inventoryItemId)
+	if deleteErr != nil {
+		return Bundle{}, deleteErr
+	}
+	for i, component := range request.Components {
+		const query = `
+			INSERT INTO bundle_components (bundle_item_id, variant_id, quantity, sort_order)
+			VALUES ($1, $2, $3, $4)
+		`
+		_, insertErr := tx.Exec(ctx, query, inventoryItemId, component.VariantId, component.Quantity, i)
+		if insertErr != nil {
+			return Bundle{}, insertErr
+		}
+	}
+
+	bundleComponents, componentsErr := getBundleComponents(tx, []int{inventoryItemId})
+	if componentsErr != nil {
+		return Bundle{}, componentsErr
+	}
+	var bundlePrice float32
+	priceErr := tx.QueryRow(ctx, `SELECT price FROM inventories WHERE id = $1`, inventoryItemId).Scan(&bundlePrice)
+	if priceErr != nil {
+		return Bundle{}, priceErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return Bundle{}, commitErr
+	}
+	logger.Info(fmt.Sprintf("Saved %v bundle components for inventory item %v", len(request.Components), inventoryItemId))
+	return NewBundle(bundlePrice, bundleComponents[inventoryItemId]), nil
+}
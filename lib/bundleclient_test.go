@@ -0,0 +1,44 @@
+package lib
+
+import "testing"
+
+func TestNewBundle(t *testing.T) {
+	components := []BundleComponent{
+		{VariantId: 1, Price: 9.99, Quantity: 2},
+		{VariantId: 2, Price: 14.50, Quantity: 1},
+	}
+	bundle := NewBundle(29.99, components)
+	if bundle.ComponentsPrice != 34.48 || bundle.Savings != 4.49 || bundle.SavingsPercent != 13 {
+		t.Fatalf("Unexpected bundle savings: %+v", bundle)
+	}
+
+	bundle = NewBundle(40, components)
+	if bundle.Savings != 0 || bundle.SavingsPercent != 0 {
+		t.Fatalf("A bundle priced above its parts shouldn't report negative savings: %+v", bundle)
+	}
+}
+
+func TestGetCartStockDemand(t *testing.T) {
+	cartItems := []CartItem{
+		{VariantId: 7, InventoryItemId: 3, Name: "Reaper Sampler", IsDefaultVariant: true, Quantity: 2,
+			BundleComponents: []BundleComponent{
+				{VariantId: 5, InventoryItemId: 1, Name: "Carolina Reaper", IsDefaultVariant: true, Quantity: 1},
+				{VariantId: 2, InventoryItemId: 2, Name: "Ghost Pepper", VariantName: "3-pack", Quantity: 3},
+			}},
+		{VariantId: 5, InventoryItemId: 1, Name: "Carolina Reaper", IsDefaultVariant: true, Quantity: 1},
+	}
+
+	stockDemand := GetCartStockDemand(cartItems)
+	expected := []StockDemand{
+		{VariantId: 2, InventoryItemId: 2, Name: "Ghost Pepper (3-pack)", Quantity: 6},
+		{VariantId: 5, InventoryItemId: 1, Name: "Carolina Reaper", Quantity: 3},
+	}
+	if len(stockDemand) != len(expected) {
+		t.Fatalf("Unexpected stock demand: %+v", stockDemand)
+	}
+	for i := range expected {
+		if stockDemand[i] != expected[i] {
+			t.Fatalf("Expected %+v, got %+v", expected[i], stockDemand[i])
+		}
+	}
+}
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"time"
@@ -13,7 +14,12 @@ import (
 type CartItem struct {
 	Id                            int        `json:"id" db:"id"`
 	InventoryItemId               int        `json:"inventoryItemId" db:"inventory_item_id"`
+	VariantId                     int        `json:"variantId" db:"variant_id"`
 	Name                          string     `json:"name" db:"name"`
+	VariantName                   string     `json:"variantName" db:"variant_name"`
+	IsDefaultVariant              bool       `json:"isDefaultVariant" db:"is_default_variant"`
+	Sku                           string     `json:"sku" db:"sku"`
+	WeightGrams                   int        `json:"weightGrams" db:"weight_grams"`
 	Price                         float32    `json:"price" db:"price"`
 	UserId                        int        `json:"userId" db:"user_id"`
 	Quantity                      int        `json:"quantity" db:"quantity"`
@@ -21,31 +27,62 @@ type CartItem struct {
 	UpdatedAt                     *time.Time `json:"updatedAt" db:"updated_at"`
 	InventoryItemSlug             string     `json:"inventoryItemSlug" db:"slug"`
 	InventoryItemShortDescription string     `json:"inventoryItemShortDescription" db:"short_description"`
+	// Only set for bundles
+	BundleComponents []BundleComponent `json:"bundleComponents,omitempty" db:"-"`
 }
 
+// AddCartItemRequest - the item's default variant is used when VariantId is left out
 type AddCartItemRequest struct {
 	InventoryItemId  int  `json:"inventoryItemId"`
+	VariantId        int  `json:"variantId"`
 	Quantity         int  `json:"quantity"`
 	UserId           int  `json:"userId"`
 	OverrideQuantity bool `json:"overrideQuantity"`
 }
 
+// DeleteCartItemRequest - without a VariantId, every variant of the item is removed
 type DeleteCartItemRequest struct {
 	InventoryItemId int `json:"inventoryItemId"`
+	VariantId       int `json:"variantId"`
 }
 
-func GetCartItems(dbPool *pgxpool.Pool, userId int) ([]CartItem, error) {
-	const query = `
-		SELECT ci.*, 
-		       i.price,
+// DisplayName is the name to show customers, e.g. in stock errors
+func (c CartItem) DisplayName() string {
+	return VariantDisplayName(c.Name, c.VariantName, c.IsDefaultVariant)
+}
+
+// cartItemColumns - everything a CartItem needs besides the cart_items row itself.
+// The price is the sale price while a sale is running.
+const cartItemColumns = `
+		       ` + variantEffectivePriceColumn + ` AS price,
 		       i.name,
+		       v.name AS variant_name,
+		       v.is_default AS is_default_variant,
+		       v.sku,
+		       v.weight_grams,
 		       i.slug,
-		       i.short_description
+		       i.short_description`
+
+const cartItemsQuery = `
+		SELECT ci.*,` + cartItemColumns + `
 		FROM cart_items ci
+		JOIN inventory_item_variants v ON ci.variant_id = v.id
 		JOIN inventories i ON ci.inventory_item_id = i.id
 		WHERE ci.user_id = $1
 		ORDER BY ci.updated_at, ci.created_at DESC`
-	rows, err := dbPool.Query(context.Background(), query, userId)
+
+func GetCartItems(dbPool *pgxpool.Pool, userId int) ([]CartItem, error) {
+	return getCartItems(dbPool, cartItemsQuery, userId)
+}
+
+// getCartItemsForUpdate locks the user's cart rows until the transaction ends,
+// so the cart can't change underneath an order being placed
+func getCartItemsForUpdate(tx pgx.Tx, userId int) ([]CartItem, error) {
+	return getCartItems(tx, cartItemsQuery+"\n\t\tFOR UPDATE OF ci", userId)
+}
+
+func getCartItems(db DBTX, query string, userId int) ([]CartItem, error) {
+	rows, err := db.Query(context.Background(), query, userId)
 	if err != nil {
 		return nil, err
 	}
@@ -53,67 +90,88 @@ func GetCartItems(dbPool *pgxpool.Pool, userId int) ([]CartItem, error) {
 	if collectRowsErr != nil {
 		return nil, collectRowsErr
 	}
+	componentsErr := addBundleComponents(db, cartItems)
+	if componentsErr != nil {
+		return nil, componentsErr
+	}
 	return cartItems, nil
 }
 
+func deleteCartItemsByUserId(db DBTX, userId int) error {
+	const query = `DELETE FROM cart_items WHERE user_id = $1`
+	_, err := db.Exec(context.Background(), query, userId)
+	return err
+}
+
 /*
 validateAddCartItemRequest
-1. Check if the inventory item exists
+1. Check if the variant exists, filling in the item's default variant if none was given
 2. Check if the user exists
 3. Check if the quantity is > 0
 */
-func validateAddCartItemRequest(dbPool *pgxpool.Pool, req AddCartItemRequest) (bool, error) {
-	itemExists, itemExistsErr := InventoryItemExists(dbPool, req.InventoryItemId)
-	if itemExistsErr != nil {
-		return false, itemExistsErr
+func validateAddCartItemRequest(dbPool *pgxpool.Pool, req *AddCartItemRequest) (bool, error) {
+	variant, variantErr := resolveVariant(dbPool, req.InventoryItemId, req.VariantId)
+	if variantErr != nil {
+		return false, variantErr
 	}
+	req.InventoryItemId = variant.InventoryItemId
+	req.VariantId = variant.Id
 
 	userExists, userExistsErr := UserIdExists(dbPool, req.UserId)
 	if userExistsErr != nil {
 		return false, userExistsErr
 	}
 
-	if req.Quantity < 1 || req.Quantity > 100 {
-		return false, fmt.Errorf("quantity must be between 1 and 100: %v", req.Quantity)
+	if req.Quantity < 1 || req.Quantity > MaxCartItemQuantity {
+		return false, fmt.Errorf("quantity must be between 1 and %d: %v", MaxCartItemQuantity, req.Quantity)
 	}
 
-	return itemExists && userExists, nil
+	return userExists, nil
 }
 
 /*
 UpdateCart
- 1. Check if a cart item with this inventory item and user id exists
+ 1. Check if a cart item with this variant and user id exists
  2. Quantity is 1 by default
  3. If the cart item exists, add 1 to that
  3. If override quantity, update quantity
- 4. Add cart item
+ 4. Check there is enough stock for the new quantity
+ 5. Add cart item
 */
 func UpdateCart(dbPool *pgxpool.Pool, logger *slog.Logger, req AddCartItemRequest) error {
-	isValid, validityErr := validateAddCartItemRequest(dbPool, req)
+	isValid, validityErr := validateAddCartItemRequest(dbPool, &req)
 	if validityErr != nil || !isValid {
 		return validityErr
 	}
 
-	existingCartItem, err := GetCartItemsByInventoryItemIdAndUserId(dbPool, req.InventoryItemId, req.UserId)
+	existingCartItem, err := GetCartItemByVariantIdAndUserId(dbPool, req.VariantId, req.UserId)
 	if err != nil {
 		return err
 	}
 
 	quantity := 1
-	if existingCartItem != (CartItem{}) {
+	if existingCartItem.Id != 0 {
 		quantity = existingCartItem.Quantity + 1
 	}
+	if req.OverrideQuantity {
+		quantity = req.Quantity
+	}
+
+	stockErr := CheckStockAvailable(dbPool, req.VariantId, req.UserId, quantity)
+	if stockErr != nil {
+		return stockErr
+	}
 
 	// When overriding the quantity, we don't want to follow the usual flow
 	if req.OverrideQuantity {
-		logger.Info(fmt.Sprintf("Updating cart item %v with quantity: %v", req.InventoryItemId, quantity))
-		updateErr := updateCartItemQuantity(dbPool, req.InventoryItemId, quantity, req.UserId)
+		logger.Info(fmt.Sprintf("Updating cart item %v variant %v with quantity: %v", req.InventoryItemId, req.VariantId, quantity))
+		updateErr := updateCartItemQuantity(dbPool, req.VariantId, req.UserId, quantity)
 		if updateErr != nil {
 			return updateErr
 		}
 	} else {
-		logger.Info(fmt.Sprintf("Adding cart item %v with quantity: %v", req.InventoryItemId, quantity))
-		_, addCartErr := addCartItem(dbPool, req.InventoryItemId, req.UserId, quantity)
+		logger.Info(fmt.Sprintf("Adding cart item %v variant %v with quantity: %v", req.InventoryItemId, req.VariantId, quantity))
+		_, addCartErr := addCartItem(dbPool, req.InventoryItemId, req.VariantId, req.UserId, quantity)
 		if addCartErr != nil {
 			return addCartErr
 		}
@@ -122,14 +180,14 @@ func UpdateCart(dbPool *pgxpool.Pool, logger *slog.Logger, req AddCartItemReques
 	return nil
 }
 
-func updateCartItemQuantity(dbPool *pgxpool.Pool, inventoryItemId int, userId int, quantity int) error {
+func updateCartItemQuantity(dbPool *pgxpool.Pool, variantId int, userId int, quantity int) error {
 	const query = `
 		UPDATE cart_items
 		SET quantity = $1
-		WHERE inventory_item_id = $2
+		WHERE variant_id = $2
 		AND user_id = $3
 	`
-	_, err := dbPool.Exec(context.Background(), query, quantity, inventoryItemId, userId)
+	_, err := dbPool.Exec(context.Background(), query, quantity, variantId, userId)
 	if err != nil {
 		return err
 	}
@@ -137,50 +195,73 @@ func updateCartItemQuantity(dbPool *pgxpool.Pool, inventoryItemId int, userId in
 	return nil
 }
 
-func addCartItem(dbPool *pgxpool.Pool, inventoryItemId int, userId int, quantity int) (int, error) {
+func addCartItem(dbPool *pgxpool.Pool, inventoryItemId int, variantId int, userId int, quantity int) (int, error) {
 	lastInsertId := 0
 	const query = `
-		INSERT INTO cart_items (quantity, inventory_item_id, user_id, created_at) 
-		VALUES ($1, $2, $3, NOW())
-		ON CONFLICT(inventory_item_id, user_id)
+		INSERT INTO cart_items (quantity, inventory_item_id, variant_id, user_id, created_at) 
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT(user_id, variant_id)
 		    DO UPDATE SET quantity = cart_items.quantity + 1, updated_at = NOW()
 		RETURNING id
 	`
-	insertErr := dbPool.QueryRow(context.Background(), query, quantity, inventoryItemId, userId).Scan(&lastInsertId)
+	insertErr := dbPool.QueryRow(context.Background(), query, quantity, inventoryItemId, variantId, userId).
+		Scan(&lastInsertId)
 	if insertErr != nil {
 		return 0, insertErr
 	}
 	return lastInsertId, nil
 }
 
-func GetCartItemsByInventoryItemIdAndUserId(dbPool *pgxpool.Pool, inventoryItemId int, userId int) (CartItem, error) {
+// setCartItemQuantity adds the variant to the cart with quantity, or sets the quantity of the line already there
+func setCartItemQuantity(db DBTX, inventoryItemId int, variantId int, userId int, quantity int) error {
 	const query = `
-		SELECT ci.*
+		INSERT INTO cart_items (quantity, inventory_item_id, variant_id, user_id, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT(user_id, variant_id)
+		    DO UPDATE SET quantity = EXCLUDED.quantity, updated_at = NOW()
+	`
+	_, err := db.Exec(context.Background(), query, quantity, inventoryItemId, variantId, userId)
+	return err
+}
+
+func GetCartItemByVariantIdAndUserId(dbPool *pgxpool.Pool, variantId int, userId int) (CartItem, error) {
+	return getCartItemByVariantIdAndUserId(dbPool, variantId, userId)
+}
+
+func getCartItemByVariantIdAndUserId(db DBTX, variantId int, userId int) (CartItem, error) {
+	const query = `
+		SELECT ci.*,` + cartItemColumns + `
 		FROM cart_items ci
+		JOIN inventory_item_variants v ON ci.variant_id = v.id
 		JOIN inventories i ON i.id = ci.inventory_item_id
 		WHERE 1=1
-		AND inventory_item_id = $1
-		AND user_id = $2`
+		AND ci.variant_id = $1
+		AND ci.user_id = $2`
 	cartItem := CartItem{}
-	rows, err := dbPool.Query(context.Background(), query, inventoryItemId, userId)
+	rows, err := db.Query(context.Background(), query, variantId, userId)
 	if err != nil {
 		return cartItem, err
 	}
 	defer rows.Close()
 	cartItem, collectRowsErr := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[CartItem])
 	if collectRowsErr != nil {
-		return cartItem, err
+		// Not having this item in the cart yet is fine
+		if errors.Is(collectRowsErr, pgx.ErrNoRows) {
+			return CartItem{}, nil
+		}
+		return cartItem, collectRowsErr
 	}
 	return cartItem, nil
 }
 
-func DeleteCartItem(dbPool *pgxpool.Pool, inventoryItemId int, userId int) error {
+// DeleteCartItem removes one variant's line, or every line for the item when variantId is 0
+func DeleteCartItem(dbPool *pgxpool.Pool, req DeleteCartItemRequest, userId int) error {
 	const query = `
 		DELETE FROM cart_items
-		WHERE inventory_item_id = $1
-		AND user_id = $2
+		WHERE user_id = $1
+		AND (variant_id = $2 OR ($2 = 0 AND inventory_item_id = $3))
 	`
-	_, err := dbPool.Exec(context.Background(), query, inventoryItemId, userId)
+	_, err := dbPool.Exec(context.Background(), query, userId, req.VariantId, req.InventoryItemId)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,391 @@
+package lib
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gosimple/slug"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const CatalogueFormatCsv = "csv"
+const CatalogueFormatJson = "json"
+
+// catalogueTagSeparator separates tag slugs in the CSV tags column
+const catalogueTagSeparator = ";"
+
+var catalogueCsvHeader = []string{
+	"name", "slug", "description", "shortDescription", "price", "spiceRating", "stockQuantity", "tags",
+}
+
+// CatalogueItem is an inventory item as it's exported and imported. Tags are tag slugs.
+// StockQuantity is the default variant's stock, and is left alone on import when omitted.
+type CatalogueItem struct {
+	Name             string   `json:"name" db:"name"`
+	Slug             string   `json:"slug" db:"slug"`
+	Description      string   `json:"description" db:"description"`
+	ShortDescription string   `json:"shortDescription" db:"short_description"`
+	Price            float32  `json:"price" db:"price"`
+	SpiceRating      int      `json:"spiceRating" db:"spice_rating"`
+	StockQuantity    *int     `json:"stockQuantity" db:"stock_quantity"`
+	Tags             []string `json:"tags" db:"tags"`
+}
+
+// CatalogueRow is an item read from an import file with anything wrong with it. Row counts from 1,
+// not counting the CSV header.
+type CatalogueRow struct {
+	Row    int           `json:"row"`
+	Item   CatalogueItem `json:"item"`
+	Action string        `json:"action"`
+	Errors []string      `json:"errors"`
+}
+
+// CatalogueImportResult - nothing is saved unless every row is valid and it isn't a dry run
+type CatalogueImportResult struct {
+	DryRun  bool           `json:"dryRun"`
+	Valid   bool           `json:"valid"`
+	Created int            `json:"created"`
+	Updated int            `json:"updated"`
+	Rows    []CatalogueRow `json:"rows"`
+}
+
+const (
+	CatalogueActionCreate = "create"
+	CatalogueActionUpdate = "update"
+)
+
+func IsValidCatalogueFormat(format string) bool {
+	return format == CatalogueFormatCsv || format == CatalogueFormatJson
+}
+
+// GetCatalogueItems returns every inventory item with its tags, by name
+func GetCatalogueItems(dbPool *pgxpool.Pool) ([]CatalogueItem, error) {
+	const query = `
+		SELECT i.name,
+		       i.slug,
+		       i.description,
+		       i.short_description,
+		       i.price,
+		       i.spice_rating,
+		       (SELECT v.stock_quantity
+		        FROM inventory_item_variants v
+		        WHERE v.inventory_item_id = i.id AND v.is_default) AS stock_quantity,
+		       ARRAY(
+		       	SELECT t.slug
+		       	FROM inventory_tags it
+		       	JOIN tags t ON t.id = it.tag_id
+		       	WHERE it.inventory_id = i.id
+		       	ORDER BY t.slug
+		       ) AS tags
+		FROM inventories i
+		ORDER BY i.name
+	`
+	rows, err := dbPool.Query(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[CatalogueItem])
+}
+
+func WriteCatalogue(w io.Writer, format string, items []CatalogueItem) error {
+	if format == CatalogueFormatJson {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(items)
+	}
+
+	csvWriter := csv.NewWriter(w)
+	writeErr := csvWriter.Write(catalogueCsvHeader)
+	if writeErr != nil {
+		return writeErr
+	}
+	for _, item := range items {
+		stockQuantity := ""
+		if item.StockQuantity != nil {
+			stockQuantity = strconv.Itoa(*item.StockQuantity)
+		}
+		writeErr = csvWriter.Write([]string{
+			item.Name,
+			item.Slug,
+			item.Description,
+			item.ShortDescription,
+			strconv.FormatFloat(float64(item.Price), 'f', 2, 32),
+			strconv.Itoa(item.SpiceRating),
+			stockQuantity,
+			strings.Join(item.Tags, catalogueTagSeparator),
+		})
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// ReadCatalogue parses an import file. Values that can't be parsed are reported on their row;
+// an error is only returned if the file as a whole can't be read.
+func ReadCatalogue(r io.Reader, format string) ([]CatalogueRow, error) {
+	if format == CatalogueFormatJson {
+		var items []CatalogueItem
+		decodeErr := json.NewDecoder(r).Decode(&items)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		catalogueRows := make([]CatalogueRow, 0, len(items))
+		for i, item := range items {
+			catalogueRows = append(catalogueRows, CatalogueRow{Row: i + 1, Item: item, Errors: []string{}})
+		}
+		return catalogueRows, nil
+	}
+
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = -1
+	records, readErr := csvReader.ReadAll()
+	if readErr != nil {
+		return nil, readErr
+	}
+	if len(records) == 0 {
+		return nil, errors.New("the file is empty")
+	}
+	columns := make(map[string]int)
+	for i, column := range records[0] {
+		columns[strings.TrimSpace(column)] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, errors.New("the header row has no name column")
+	}
+
+	catalogueRows := make([]CatalogueRow, 0, len(records)-1)
+	for i, record := range records[1:] {
+		catalogueRows = append(catalogueRows, parseCatalogueRecord(i+1, columns, record))
+	}
+	return catalogueRows, nil
+}
+
+func parseCatalogueRecord(rowNumber int, columns map[string]int, record []string) CatalogueRow {
+	catalogueRow := CatalogueRow{Row: rowNumber, Errors: []string{}}
+	value := func(column string) string {
+		i, ok := columns[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	catalogueRow.Item = CatalogueItem{
+		Name:             value("name"),
+		Slug:             value("slug"),
+		Description:      value("description"),
+		ShortDescription: value("shortDescription"),
+		Tags:             []string{},
+	}
+	if price := value("price"); len(price) > 0 {
+		parsedPrice, parseErr := strconv.ParseFloat(price, 32)
+		if parseErr != nil {
+			catalogueRow.Errors = append(catalogueRow.Errors, fmt.Sprintf("price: %v isn't a number", price))
+		}
+		catalogueRow.Item.Price = float32(parsedPrice)
+	}
+	if spiceRating := value("spiceRating"); len(spiceRating) > 0 {
+		parsedSpiceRating, parseErr := strconv.Atoi(spiceRating)
+		if parseErr != nil {
+			catalogueRow.Errors = append(catalogueRow.Errors, fmt.Sprintf("spiceRating: %v isn't a whole number", spiceRating))
+		}
+		catalogueRow.Item.SpiceRating = parsedSpiceRating
+	}
+	if stockQuantity := value("stockQuantity"); len(stockQuantity) > 0 {
+		parsedStockQuantity, parseErr := strconv.Atoi(stockQuantity)
+		if parseErr != nil {
+			catalogueRow.Errors = append(catalogueRow.Errors, fmt.Sprintf("stockQuantity: %v isn't a whole number", stockQuantity))
+		}
+		catalogueRow.Item.StockQuantity = &parsedStockQuantity
+	}
+	for _, tagSlug := range strings.Split(value("tags"), catalogueTagSeparator) {
+		if tagSlug = strings.TrimSpace(tagSlug); len(tagSlug) > 0 {
+			catalogueRow.Item.Tags = append(catalogueRow.Item.Tags, tagSlug)
+		}
+	}
+	return catalogueRow
+}
+
+// newCatalogueValidator reports fields by their JSON names, which are also the CSV column names
+func newCatalogueValidator() *validator.Validate {
+	validate := validator.New(validator.WithRequiredStructEnabled())
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		return name
+	})
+	return validate
+}
+
+// toUpdateRequest maps the row onto the request the product endpoints take, noting unknown tags
+func (r *CatalogueRow) toUpdateRequest(tagIdsBySlug map[string]int) InventoryItemUpdateRequest {
+	request := InventoryItemUpdateRequest{
+		Name:             r.Item.Name,
+		Price:            r.Item.Price,
+		SpiceRating:      r.Item.SpiceRating,
+		Description:      r.Item.Description,
+		ShortDescription: r.Item.ShortDescription,
+		StockQuantity:    r.Item.StockQuantity,
+		TagIds:           []int{},
+	}
+	for _, tagSlug := range r.Item.Tags {
+		tagId, ok := tagIdsBySlug[tagSlug]
+		if !ok {
+			r.Errors = append(r.Errors, fmt.Sprintf("tags: there's no tag %v", tagSlug))
+			continue
+		}
+		request.TagIds = append(request.TagIds, tagId)
+	}
+	return request
+}
+
+/*
+validateCatalogueRows checks every row and notes whether it creates or updates an item
+ 1. Validate the row as an InventoryItemUpdateRequest
+ 2. Check its tags exist and its slug, if given, is the one its name makes
+ 3. Check no other row has the same name
+
+Items are matched by name, as SaveInventoryItem does, so renaming isn't possible by import.
+*/
+func validateCatalogueRows(
+	catalogueRows []CatalogueRow, existingNames []string, tagIdsBySlug map[string]int,
+) ([]InventoryItemUpdateRequest, bool) {
+	validate := newCatalogueValidator()
+	requests := make([]InventoryItemUpdateRequest, len(catalogueRows))
+	rowsByName := make(map[string]int)
+	valid := true
+	for i := range catalogueRows {
+		catalogueRow := &catalogueRows[i]
+		requests[i] = catalogueRow.toUpdateRequest(tagIdsBySlug)
+
+		var validationErrs validator.ValidationErrors
+		if validationErr := validate.Struct(requests[i]); errors.As(validationErr, &validationErrs) {
+			for _, fieldErr := range validationErrs {
+				catalogueRow.Errors = append(
+					catalogueRow.Errors, fmt.Sprintf("%v: failed the %v check", fieldErr.Field(), fieldErr.Tag()),
+				)
+			}
+		}
+		if len(catalogueRow.Item.Slug) > 0 && catalogueRow.Item.Slug != slug.Make(catalogueRow.Item.Name) {
+			catalogueRow.Errors = append(catalogueRow.Errors, fmt.Sprintf(
+				"slug: %v doesn't match the name, which gives %v", catalogueRow.Item.Slug, slug.Make(catalogueRow.Item.Name),
+			))
+		}
+		if firstRow, ok := rowsByName[catalogueRow.Item.Name]; ok {
+			catalogueRow.Errors = append(catalogueRow.Errors, fmt.Sprintf("name: also used on row %v", firstRow))
+		} else {
+			rowsByName[catalogueRow.Item.Name] = catalogueRow.Row
+		}
+
+		catalogueRow.Action = CatalogueActionCreate
+		if slices.Contains(existingNames, catalogueRow.Item.Name) {
+			catalogueRow.Action = CatalogueActionUpdate
+		}
+		if len(catalogueRow.Errors) > 0 {
+			valid = false
+		}
+	}
+	return requests, valid
+}
+
+/*
+ImportCatalogue
+ 1. Validate every row, reporting all that's wrong with each
+ 2. Stop there if any row is invalid or it's a dry run
+ 3. Otherwise save each row as the product endpoints do, with its tags and stock, all in one
+    transaction so a row that fails leaves the catalogue as it was
+ 4. Trigger price alerts for the saved items once it's committed
+*/
+func ImportCatalogue(
+	dbPool *pgxpool.Pool, logger *slog.Logger, catalogueRows []CatalogueRow, dryRun bool,
+) (CatalogueImportResult, error) {
+	tags, tagsErr := GetTagsOrderedByName(dbPool)
+	if tagsErr != nil {
+		return CatalogueImportResult{}, tagsErr
+	}
+	tagIdsBySlug := make(map[string]int, len(tags))
+	for _, tag := range tags {
+		tagIdsBySlug[tag.Slug] = tag.Id
+	}
+	nameRows, namesErr := dbPool.Query(context.Background(), `SELECT name FROM inventories`)
+	if namesErr != nil {
+		return CatalogueImportResult{}, namesErr
+	}
+	existingNames, collectErr := pgx.CollectRows(nameRows, pgx.RowTo[string])
+	if collectErr != nil {
+		return CatalogueImportResult{}, collectErr
+	}
+
+	requests, valid := validateCatalogueRows(catalogueRows, existingNames, tagIdsBySlug)
+	result := CatalogueImportResult{DryRun: dryRun, Valid: valid, Rows: catalogueRows}
+	if !valid || dryRun {
+		return result, nil
+	}
+
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return result, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("ImportCatalogue: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	var created, updated int
+	itemIds := make([]int, 0, len(requests))
+	for i, request := range requests {
+		itemId, saveErr := saveInventoryItem(tx, logger, request)
+		if saveErr != nil {
+			return result, fmt.Errorf("row %v: %w", catalogueRows[i].Row, saveErr)
+		}
+		_, tagsErr := updateInventoryItemTags(tx, logger, itemId, request.TagIds)
+		if tagsErr != nil {
+			return result, fmt.Errorf("row %v: %w", catalogueRows[i].Row, tagsErr)
+		}
+		if request.StockQuantity != nil {
+			stockErr := updateInventoryItemStock(tx, itemId, *request.StockQuantity)
+			if stockErr != nil {
+				return result, fmt.Errorf("row %v: %w", catalogueRows[i].Row, stockErr)
+			}
+		}
+		if catalogueRows[i].Action == CatalogueActionCreate {
+			created++
+		} else {
+			updated++
+		}
+		itemIds = append(itemIds, itemId)
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return result, commitErr
+	}
+	result.Created = created
+	result.Updated = updated
+
+	// The catalogue is saved either way; alerts that don't fire now are checked again on the next save
+	for _, itemId := range itemIds {
+		_, alertsErr := TriggerPriceAlerts(dbPool, logger, itemId)
+		if alertsErr != nil {
+			logger.Error(fmt.Sprintf("ImportCatalogue: Error triggering price alerts for item %v: %v", itemId, alertsErr))
+		}
+	}
+	logger.Info(fmt.Sprintf("Catalogue imported: %v items created, %v updated", result.Created, result.Updated))
+	return result, nil
+}
@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCatalogueCsvRoundTrip(t *testing.T) {
+	stockQuantity := 12
+	items := []CatalogueItem{{
+		Name:             "Reaper Relish",
+		Slug:             "reaper-relish",
+		Description:      "Carolina Reapers, vinegar and a little garlic, \"aged\" for a month",
+		ShortDescription: "Relish, but hot",
+		Price:            11.5,
+		SpiceRating:      5,
+		StockQuantity:    &stockQuantity,
+		Tags:             []string{"garlic", "reaper"},
+	}}
+	var buffer bytes.Buffer
+	if err := WriteCatalogue(&buffer, CatalogueFormatCsv, items); err != nil {
+		t.Fatal(err)
+	}
+
+	catalogueRows, err := ReadCatalogue(&buffer, CatalogueFormatCsv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalogueRows) != 1 || len(catalogueRows[0].Errors) > 0 {
+		t.Fatalf("Unexpected rows: %+v", catalogueRows)
+	}
+	item := catalogueRows[0].Item
+	if item.Name != items[0].Name || item.Description != items[0].Description || item.Price != 11.5 ||
+		*item.StockQuantity != 12 || strings.Join(item.Tags, ",") != "garlic,reaper" {
+		t.Fatalf("Item didn't survive the round trip: %+v", item)
+	}
+}
+
+func TestReadCatalogueReportsUnreadableValues(t *testing.T) {
+	csvFile := "name,price,spiceRating\nGhost Glaze,cheap,4\n"
+	catalogueRows, err := ReadCatalogue(strings.NewReader(csvFile), CatalogueFormatCsv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalogueRows) != 1 || len(catalogueRows[0].Errors) != 1 || catalogueRows[0].Row != 1 {
+		t.Fatalf("Expected one error on row 1: %+v", catalogueRows)
+	}
+
+	_, err = ReadCatalogue(strings.NewReader("price,spiceRating\n9.99,3\n"), CatalogueFormatCsv)
+	if err == nil {
+		t.Fatal("A file without a name column should be rejected")
+	}
+}
+
+func TestValidateCatalogueRows(t *testing.T) {
+	valid := CatalogueItem{
+		Name:             "Ghost Glaze",
+		Description:      "Ghost peppers in a sticky glaze",
+		ShortDescription: "Sticky heat",
+		Price:            9.99,
+		SpiceRating:      4,
+		Tags:             []string{"ghost"},
+	}
+	badSlug := valid
+	badSlug.Name = "Habanero Honey"
+	badSlug.Slug = "ghost-glaze"
+	unknownTag := valid
+	unknownTag.Name = "Scorpion Sauce"
+	unknownTag.Tags = []string{"scorpion"}
+	invalid := valid
+	invalid.Name = "Jolokia Jam"
+	invalid.Price = 0
+	invalid.SpiceRating = 9
+
+	catalogueRows := []CatalogueRow{
+		{Row: 1, Item: valid},
+		{Row: 2, Item: badSlug},
+		{Row: 3, Item: unknownTag},
+		{Row: 4, Item: invalid},
+		{Row: 5, Item: valid},
+	}
+	requests, ok := validateCatalogueRows(catalogueRows, []string{"Ghost Glaze"}, map[string]int{"ghost": 7})
+	if ok {
+		t.Fatal("The rows shouldn't be valid")
+	}
+	if len(catalogueRows[0].Errors) != 0 || catalogueRows[0].Action != CatalogueActionUpdate ||
+		len(requests[0].TagIds) != 1 || requests[0].TagIds[0] != 7 {
+		t.Fatalf("Row 1 should update Ghost Glaze: %+v %+v", catalogueRows[0], requests[0])
+	}
+	expectedErrors := map[int]int{1: 1, 2: 1, 3: 2, 4: 1}
+	for i, errorCount := range expectedErrors {
+		if len(catalogueRows[i].Errors) != errorCount {
+			t.Fatalf("Row %v: expected %v errors, got %v", catalogueRows[i].Row, errorCount, catalogueRows[i].Errors)
+		}
+	}
+	if catalogueRows[1].Action != CatalogueActionCreate {
+		t.Fatalf("Row 2 should create an item: %+v", catalogueRows[1])
+	}
+	if !strings.HasPrefix(catalogueRows[3].Errors[0], "price:") {
+		t.Fatalf("Errors should name the field as it appears in the file: %v", catalogueRows[3].Errors)
+	}
+}
@@ -33,11 +33,60 @@ type ConfigCache struct {
 	PostList         time.Duration `toml:"postList"`
 }
 
+type ConfigPayments struct {
+	Provider      string `toml:"provider"`
+	WebhookSecret string `toml:"webhookSecret"`
+}
+
+// ConfigTaxRate - Rate is a percentage. An empty Region applies to the whole country,
+// and an empty Category is the standard rate.
+type ConfigTaxRate struct {
+	Country  string  `toml:"country"`
+	Region   string  `toml:"region"`
+	Category string  `toml:"category"`
+	Rate     float64 `toml:"rate"`
+}
+
+// ConfigTax - TagCategories maps tag slugs to tax categories
+type ConfigTax struct {
+	PricesIncludeTax bool              `toml:"pricesIncludeTax"`
+	DefaultCountry   string            `toml:"defaultCountry"`
+	DefaultRegion    string            `toml:"defaultRegion"`
+	Rates            []ConfigTaxRate   `toml:"rates"`
+	TagCategories    map[string]string `toml:"tagCategories"`
+}
+
+// ConfigGuestCarts - CookieSecret signs the guest cart cookie. Carts expire ExpiryDays
+// after they were last changed.
+type ConfigGuestCarts struct {
+	CookieSecret string `toml:"cookieSecret"`
+	ExpiryDays   int    `toml:"expiryDays"`
+}
+
+// ConfigAbandonedCarts - carts left unchanged for IdleHours get a reminder. When
+// ReminderCouponPercent is set, the reminder comes with a one-time coupon for that much
+// off that expires after ReminderCouponExpiryDays.
+type ConfigAbandonedCarts struct {
+	IdleHours                int `toml:"idleHours"`
+	ReminderCouponPercent    int `toml:"reminderCouponPercent"`
+	ReminderCouponExpiryDays int `toml:"reminderCouponExpiryDays"`
+}
+
+// ConfigOrders - orders still waiting for payment after PendingPaymentTimeoutHours are cancelled
+type ConfigOrders struct {
+	PendingPaymentTimeoutHours int `toml:"pendingPaymentTimeoutHours"`
+}
+
 type HotSauceShopConfig struct {
-	Server    ConfigServer    `toml:"server"`
-	Database  ConfigDatabase  `toml:"database"`
-	TestUsers ConfigTestUsers `toml:"testUsers"`
-	Cache     ConfigCache     `toml:"cache"`
+	Server         ConfigServer         `toml:"server"`
+	Database       ConfigDatabase       `toml:"database"`
+	TestUsers      ConfigTestUsers      `toml:"testUsers"`
+	Cache          ConfigCache          `toml:"cache"`
+	Payments       ConfigPayments       `toml:"payments"`
+	Tax            ConfigTax            `toml:"tax"`
+	GuestCarts     ConfigGuestCarts     `toml:"guestCarts"`
+	AbandonedCarts ConfigAbandonedCarts `toml:"abandonedCarts"`
+	Orders         ConfigOrders         `toml:"orders"`
 }
 
 func ReadConfig(filename string) (HotSauceShopConfig, error) {
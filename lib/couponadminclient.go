@@ -0,0 +1,351 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// AdminCoupon is a coupon with its scope and how many times it has been redeemed
+type AdminCoupon struct {
+	CouponCode
+	TagIds           []int `json:"tagIds"`
+	InventoryItemIds []int `json:"inventoryItemIds"`
+	RedemptionCount  int   `json:"redemptionCount"`
+}
+
+/*
+CouponRequest - ReductionPercent is required for percent reductions and AmountOff for
+fixed reductions. ShippingOptionId only applies to free shipping coupons. Leave
+TagIds and InventoryItemIds empty for a coupon that applies to the whole cart.
+*/
+type CouponRequest struct {
+	Description           string     `json:"description" validate:"required,max=255"`
+	CouponTypeName        string     `json:"couponTypeName" validate:"required,oneof=free_shipping percent_price_reduction fixed_price_reduction"`
+	ReductionPercent      int        `json:"reductionPercent" validate:"min=0,max=100"`
+	AmountOff             float64    `json:"amountOff" validate:"min=0,max=10000"`
+	MinimumSubtotal       float64    `json:"minimumSubtotal" validate:"min=0,max=100000"`
+	StartsAt              *time.Time `json:"startsAt"`
+	ExpiresAt             time.Time  `json:"expiresAt" validate:"required"`
+	MaxRedemptions        *int       `json:"maxRedemptions" validate:"omitempty,min=1"`
+	MaxRedemptionsPerUser *int       `json:"maxRedemptionsPerUser" validate:"omitempty,min=1"`
+	ShippingOptionId      *int       `json:"shippingOptionId" validate:"omitempty,min=1"`
+	TagIds                []int      `json:"tagIds" validate:"omitempty,dive,min=1"`
+	InventoryItemIds      []int      `json:"inventoryItemIds" validate:"omitempty,dive,min=1"`
+}
+
+type CreateCouponRequest struct {
+	Code string `json:"code" validate:"required,alphanum,min=4,max=25"`
+	CouponRequest
+}
+
+func newInvalidCouponError(message string) *StatusBadRequestError {
+	return &StatusBadRequestError{
+		StatusCode: http.StatusBadRequest,
+		Message:    message,
+		ErrorCode:  ErrorCodeInvalidCoupon,
+	}
+}
+
+// ValidateCouponRequest checks the rules that depend on the coupon type
+func ValidateCouponRequest(request CouponRequest) error {
+	switch request.CouponTypeName {
+	case CouponTypePercentPriceReduction:
+		if request.ReductionPercent < 1 {
+			return newInvalidCouponError("Percent reductions need a reductionPercent between 1 and 100")
+		}
+	case CouponTypeFixedPriceReduction:
+		if request.AmountOff <= 0 {
+			return newInvalidCouponError("Fixed reductions need an amountOff")
+		}
+	}
+	if request.ShippingOptionId != nil && request.CouponTypeName != CouponTypeFreeShipping {
+		return newInvalidCouponError("Only free shipping coupons can be tied to a shipping option")
+	}
+	if request.StartsAt != nil && !request.StartsAt.Before(request.ExpiresAt) {
+		return newInvalidCouponError("startsAt must be before expiresAt")
+	}
+	return nil
+}
+
+/*
+CreateCoupon
+ 1. Validate the rules for the coupon type
+ 2. Insert the coupon and its tag and item scope
+
+Codes are stored upper case. Fails with ErrorCodeCouponExists if the code is taken, in any case.
+*/
+func CreateCoupon(dbPool *pgxpool.Pool, logger *slog.Logger, request CreateCouponRequest) (AdminCoupon, error) {
+	request.Code = strings.ToUpper(request.Code)
+	validationErr := ValidateCouponRequest(request.CouponRequest)
+	if validationErr != nil {
+		return AdminCoupon{}, validationErr
+	}
+
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return AdminCoupon{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("CreateCoupon: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	insertErr := insertCoupon(tx, request)
+	if isPgError(insertErr, pgErrorCodeUniqueViolation) {
+		return AdminCoupon{}, &StatusBadRequestError{
+			StatusCode: http.StatusConflict,
+			Message:    fmt.Sprintf("Coupon %v already exists", request.Code),
+			ErrorCode:  ErrorCodeCouponExists,
+		}
+	}
+	if insertErr != nil {
+		return AdminCoupon{}, mapCouponReferenceError(insertErr)
+	}
+
+	scopeErr := replaceCouponScope(tx, request.Code, request.TagIds, request.InventoryItemIds)
+	if scopeErr != nil {
+		return AdminCoupon{}, mapCouponReferenceError(scopeErr)
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return AdminCoupon{}, commitErr
+	}
+
+	logger.Info(fmt.Sprintf("Coupon %v created", request.Code))
+
+	return GetAdminCouponByCode(dbPool, request.Code)
+}
+
+// insertCoupon inserts the coupon's rules without its tag and item scope
+func insertCoupon(db DBTX, request CreateCouponRequest) error {
+	const query = `
+		INSERT INTO coupons (
+			code,
+			description,
+			coupon_type_id,
+			reduction_percent,
+			amount_off,
+			minimum_subtotal,
+			starts_at,
+			expires_at,
+			max_redemptions,
+			max_redemptions_per_user,
+			shipping_option_id,
+			created_at,
+			updated_at
+		)
+		VALUES ($1, $2, (SELECT id FROM coupon_types WHERE name = $3), $4, $5, $6, $7, $8, $9, $10, $11, NOW(), NOW())
+	`
+	_, err := db.Exec(
+		context.Background(),
+		query,
+		request.Code,
+		request.Description,
+		request.CouponTypeName,
+		request.ReductionPercent,
+		ToCents(request.AmountOff).Dollars(),
+		ToCents(request.MinimumSubtotal).Dollars(),
+		request.StartsAt,
+		request.ExpiresAt,
+		request.MaxRedemptions,
+		request.MaxRedemptionsPerUser,
+		request.ShippingOptionId,
+	)
+	return err
+}
+
+// UpdateCoupon replaces the coupon's rules and scope. Returns pgx.ErrNoRows if there is no such coupon.
+func UpdateCoupon(dbPool *pgxpool.Pool, logger *slog.Logger, code string, request CouponRequest) (AdminCoupon, error) {
+	code = strings.ToUpper(code)
+	validationErr := ValidateCouponRequest(request)
+	if validationErr != nil {
+		return AdminCoupon{}, validationErr
+	}
+
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return AdminCoupon{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("UpdateCoupon: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	const query = `
+		UPDATE coupons
+		SET description = $1,
+		    coupon_type_id = (SELECT id FROM coupon_types WHERE name = $2),
+		    reduction_percent = $3,
+		    amount_off = $4,
+		    minimum_subtotal = $5,
+		    starts_at = $6,
+		    expires_at = $7,
+		    max_redemptions = $8,
+		    max_redemptions_per_user = $9,
+		    shipping_option_id = $10,
+		    updated_at = NOW()
+		WHERE code = $11
+	`
+	result, updateErr := tx.Exec(
+		ctx,
+		query,
+		request.Description,
+		request.CouponTypeName,
+		request.ReductionPercent,
+		ToCents(request.AmountOff).Dollars(),
+		ToCents(request.MinimumSubtotal).Dollars(),
+		request.StartsAt,
+		request.ExpiresAt,
+		request.MaxRedemptions,
+		request.MaxRedemptionsPerUser,
+		request.ShippingOptionId,
+		code,
+	)
+	if updateErr != nil {
+		return AdminCoupon{}, mapCouponReferenceError(updateErr)
+	}
+	if result.RowsAffected() == 0 {
+		return AdminCoupon{}, pgx.ErrNoRows
+	}
+
+	scopeErr := replaceCouponScope(tx, code, request.TagIds, request.InventoryItemIds)
+	if scopeErr != nil {
+		return AdminCoupon{}, mapCouponReferenceError(scopeErr)
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return AdminCoupon{}, commitErr
+	}
+
+	logger.Info(fmt.Sprintf("Coupon %v updated", code))
+
+	return GetAdminCouponByCode(dbPool, code)
+}
+
+// ExpireCoupon ends a coupon now. Returns pgx.ErrNoRows if there is no such coupon.
+func ExpireCoupon(dbPool *pgxpool.Pool, code string) (AdminCoupon, error) {
+	code = strings.ToUpper(code)
+	const query = `
+		UPDATE coupons
+		SET expires_at = LEAST(expires_at, NOW()), updated_at = NOW()
+		WHERE code = $1
+	`
+	result, err := dbPool.Exec(context.Background(), query, code)
+	if err != nil {
+		return AdminCoupon{}, err
+	}
+	if result.RowsAffected() == 0 {
+		return AdminCoupon{}, pgx.ErrNoRows
+	}
+	return GetAdminCouponByCode(dbPool, code)
+}
+
+// mapCouponReferenceError reports unknown shipping options, tags and items as bad requests
+func mapCouponReferenceError(err error) error {
+	if isPgError(err, pgErrorCodeForeignKeyViolation) {
+		return newInvalidCouponError("Unknown shipping option, tag or inventory item")
+	}
+	return err
+}
+
+func replaceCouponScope(tx pgx.Tx, code string, tagIds []int, inventoryItemIds []int) error {
+	ctx := context.Background()
+	_, deleteTagsErr := tx.Exec(ctx, `DELETE FROM coupon_tags WHERE coupon_code = $1`, code)
+	if deleteTagsErr != nil {
+		return deleteTagsErr
+	}
+	_, deleteItemsErr := tx.Exec(ctx, `DELETE FROM coupon_inventory_items WHERE coupon_code = $1`, code)
+	if deleteItemsErr != nil {
+		return deleteItemsErr
+	}
+
+	const tagsQuery = `
+		INSERT INTO coupon_tags (coupon_code, tag_id)
+		SELECT $1, UNNEST($2::INTEGER[])
+		ON CONFLICT DO NOTHING
+	`
+	_, tagsErr := tx.Exec(ctx, tagsQuery, code, tagIds)
+	if tagsErr != nil {
+		return tagsErr
+	}
+	const itemsQuery = `
+		INSERT INTO coupon_inventory_items (coupon_code, inventory_item_id)
+		SELECT $1, UNNEST($2::INTEGER[])
+		ON CONFLICT DO NOTHING
+	`
+	_, itemsErr := tx.Exec(ctx, itemsQuery, code, inventoryItemIds)
+	return itemsErr
+}
+
+// adminCouponQuery - redemptions on cancelled orders aren't counted, matching the usage limits
+const adminCouponQuery = `
+		SELECT c.code, c.description, c.created_at, c.updated_at, c.expires_at, c.reduction_percent,
+		       ct.name AS coupon_type_name,
+		       c.amount_off,
+		       c.minimum_subtotal,
+		       c.starts_at,
+		       c.max_redemptions,
+		       c.max_redemptions_per_user,
+		       c.shipping_option_id,
+		       ARRAY(SELECT tag_id FROM coupon_tags WHERE coupon_code = c.code ORDER BY tag_id) AS tag_ids,
+		       ARRAY(SELECT inventory_item_id FROM coupon_inventory_items
+		             WHERE coupon_code = c.code ORDER BY inventory_item_id) AS inventory_item_ids,
+		       (SELECT COUNT(*) FROM coupon_redemptions cr
+		        JOIN orders o ON o.id = cr.order_id
+		        WHERE cr.coupon_code = c.code AND o.status <> 'cancelled') AS redemption_count
+		FROM coupons c
+		JOIN coupon_types ct ON ct.id = c.coupon_type_id`
+
+// GetAdminCouponByCode returns pgx.ErrNoRows if there is no such coupon. Includes expired coupons.
+func GetAdminCouponByCode(dbPool *pgxpool.Pool, code string) (AdminCoupon, error) {
+	rows, err := dbPool.Query(context.Background(), adminCouponQuery+"\n\t\tWHERE c.code = $1", strings.ToUpper(code))
+	if err != nil {
+		return AdminCoupon{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[AdminCoupon])
+}
+
+// GetAdminCoupons lists every coupon, newest first, including expired ones
+func GetAdminCoupons(dbPool *pgxpool.Pool, paginationData PaginationData) ([]AdminCoupon, error) {
+	query := adminCouponQuery + `
+		ORDER BY c.created_at DESC, c.code
+		LIMIT $1
+		OFFSET $2`
+	rows, err := dbPool.Query(context.Background(), query, paginationData.PerPage, paginationData.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	coupons, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[AdminCoupon])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+	return coupons, nil
+}
+
+func GetTotalCoupons(dbPool *pgxpool.Pool) (int, error) {
+	const query = `SELECT COUNT(*) FROM coupons`
+	var count int
+	err := dbPool.QueryRow(context.Background(), query).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
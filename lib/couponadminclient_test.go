@@ -0,0 +1,34 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateCouponRequest(t *testing.T) {
+	expiresAt := time.Now().Add(24 * time.Hour)
+
+	valid := CouponRequest{CouponTypeName: CouponTypePercentPriceReduction, ReductionPercent: 15, ExpiresAt: expiresAt}
+	if err := ValidateCouponRequest(valid); err != nil {
+		t.Fatalf("Expected valid percent coupon: %v", err)
+	}
+
+	missingPercent := CouponRequest{CouponTypeName: CouponTypePercentPriceReduction, ExpiresAt: expiresAt}
+	expectErrorCode(t, ValidateCouponRequest(missingPercent), ErrorCodeInvalidCoupon)
+
+	missingAmount := CouponRequest{CouponTypeName: CouponTypeFixedPriceReduction, ExpiresAt: expiresAt}
+	expectErrorCode(t, ValidateCouponRequest(missingAmount), ErrorCodeInvalidCoupon)
+
+	shippingOptionId := 1
+	shippingOnDiscount := CouponRequest{
+		CouponTypeName:   CouponTypeFixedPriceReduction,
+		AmountOff:        5,
+		ExpiresAt:        expiresAt,
+		ShippingOptionId: &shippingOptionId,
+	}
+	expectErrorCode(t, ValidateCouponRequest(shippingOnDiscount), ErrorCodeInvalidCoupon)
+
+	startsAfterExpiry := expiresAt.Add(time.Hour)
+	backwards := CouponRequest{CouponTypeName: CouponTypeFreeShipping, ExpiresAt: expiresAt, StartsAt: &startsAfterExpiry}
+	expectErrorCode(t, ValidateCouponRequest(backwards), ErrorCodeInvalidCoupon)
+}
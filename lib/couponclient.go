@@ -0,0 +1,352 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const CouponTypeFreeShipping = "free_shipping"
+const CouponTypePercentPriceReduction = "percent_price_reduction"
+const CouponTypeFixedPriceReduction = "fixed_price_reduction"
+
+/*
+CouponCode - AmountOff is used by fixed price reductions, ReductionPercent by percent
+reductions. Nil limits are unlimited, and a nil ShippingOptionId lets free shipping
+apply to any shipping option.
+*/
+type CouponCode struct {
+	Code                  string     `json:"code"`
+	Description           string     `json:"description"`
+	CreatedAt             time.Time  `json:"createdAt"`
+	UpdatedAt             time.Time  `json:"updatedAt"`
+	ExpiresAt             time.Time  `json:"expiresAt"`
+	ReductionPercent      int        `json:"reductionPercent"`
+	CouponTypeName        string     `json:"couponTypeName"`
+	AmountOff             float64    `json:"amountOff"`
+	MinimumSubtotal       float64    `json:"minimumSubtotal"`
+	StartsAt              *time.Time `json:"startsAt"`
+	MaxRedemptions        *int       `json:"maxRedemptions"`
+	MaxRedemptionsPerUser *int       `json:"maxRedemptionsPerUser"`
+	ShippingOptionId      *int       `json:"shippingOptionId"`
+}
+
+// CouponScope - a coupon with no tags or items applies to the whole cart
+type CouponScope struct {
+	TagIds           []int `json:"tagIds"`
+	InventoryItemIds []int `json:"inventoryItemIds"`
+}
+
+// CouponUsage counts redemptions on orders that weren't cancelled
+type CouponUsage struct {
+	TotalRedemptions int
+	UserRedemptions  int
+}
+
+/*
+CouponEvaluation is the effect of a coupon on a cart. ShippingDiscountCents is only known
+once a shipping option has been chosen. EligibleInventoryItemIds are the cart lines the
+discount is spread over.
+*/
+type CouponEvaluation struct {
+	CouponCode               string `json:"couponCode"`
+	EligibleInventoryItemIds []int  `json:"eligibleInventoryItemIds"`
+	EligibleSubtotalCents    Cents  `json:"eligibleSubtotalCents"`
+	DiscountCents            Cents  `json:"discountCents"`
+	FreeShipping             bool   `json:"freeShipping"`
+	ShippingDiscountCents    Cents  `json:"shippingDiscountCents"`
+}
+
+func (e CouponEvaluation) AppliesTo(inventoryItemId int) bool {
+	return slices.Contains(e.EligibleInventoryItemIds, inventoryItemId)
+}
+
+const couponQuery = `
+		SELECT code, description, created_at, updated_at, expires_at, reduction_percent,
+		       ct.name AS coupon_type_name,
+		       amount_off,
+		       minimum_subtotal,
+		       starts_at,
+		       max_redemptions,
+		       max_redemptions_per_user,
+		       shipping_option_id
+		FROM coupons
+		JOIN coupon_types ct ON ct.id = coupons.coupon_type_id
+		WHERE UPPER(code) = UPPER($1)
+		AND expires_at > NOW()
+		AND (starts_at IS NULL OR starts_at <= NOW())`
+
+func newCouponError(message string, errorCode string) *StatusBadRequestError {
+	return &StatusBadRequestError{
+		StatusCode: http.StatusBadRequest,
+		Message:    message,
+		ErrorCode:  errorCode,
+	}
+}
+
+// GetCouponByCode returns pgx.ErrNoRows unless the coupon exists and is currently running
+func GetCouponByCode(dbPool *pgxpool.Pool, code string) (CouponCode, error) {
+	return getCoupon(dbPool, couponQuery, code)
+}
+
+func getCoupon(db DBTX, query string, code string) (CouponCode, error) {
+	row, err := db.Query(context.Background(), query, code)
+	if err != nil {
+		return CouponCode{}, err
+	}
+	defer row.Close()
+	coupon, collectRowsErr := pgx.CollectExactlyOneRow(row, pgx.RowToStructByName[CouponCode])
+	if collectRowsErr != nil {
+		return CouponCode{}, collectRowsErr
+	}
+	return coupon, nil
+}
+
+func getCouponScope(db DBTX, code string) (CouponScope, error) {
+	var scope CouponScope
+	const tagsQuery = `SELECT tag_id FROM coupon_tags WHERE coupon_code = $1 ORDER BY tag_id`
+	tagRows, tagsErr := db.Query(context.Background(), tagsQuery, code)
+	if tagsErr != nil {
+		return CouponScope{}, tagsErr
+	}
+	tagIds, collectTagsErr := pgx.CollectRows(tagRows, pgx.RowTo[int])
+	if collectTagsErr != nil {
+		return CouponScope{}, collectTagsErr
+	}
+	scope.TagIds = tagIds
+
+	const itemsQuery = `
+		SELECT inventory_item_id FROM coupon_inventory_items WHERE coupon_code = $1 ORDER BY inventory_item_id
+	`
+	itemRows, itemsErr := db.Query(context.Background(), itemsQuery, code)
+	if itemsErr != nil {
+		return CouponScope{}, itemsErr
+	}
+	inventoryItemIds, collectItemsErr := pgx.CollectRows(itemRows, pgx.RowTo[int])
+	if collectItemsErr != nil {
+		return CouponScope{}, collectItemsErr
+	}
+	scope.InventoryItemIds = inventoryItemIds
+	return scope, nil
+}
+
+func getCouponUsage(db DBTX, code string, userId int) (CouponUsage, error) {
+	const query = `
+		SELECT COUNT(*),
+		       COUNT(*) FILTER (WHERE cr.user_id = $2)
+		FROM coupon_redemptions cr
+		JOIN orders o ON o.id = cr.order_id
+		WHERE cr.coupon_code = $1
+		AND o.status <> $3
+	`
+	var usage CouponUsage
+	err := db.QueryRow(context.Background(), query, code, userId, OrderStatusCancelled).
+		Scan(&usage.TotalRedemptions, &usage.UserRedemptions)
+	if err != nil {
+		return CouponUsage{}, err
+	}
+	return usage, nil
+}
+
+// getInventoryItemTagIds returns the tag ids of each item, by inventory item id
+func getInventoryItemTagIds(db DBTX, inventoryItemIds []int) (map[int][]int, error) {
+	const query = `SELECT inventory_id, tag_id FROM inventory_tags WHERE inventory_id = ANY($1)`
+	rows, err := db.Query(context.Background(), query, inventoryItemIds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	itemTagIds := make(map[int][]int)
+	for rows.Next() {
+		var inventoryItemId, tagId int
+		scanErr := rows.Scan(&inventoryItemId, &tagId)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		itemTagIds[inventoryItemId] = append(itemTagIds[inventoryItemId], tagId)
+	}
+	return itemTagIds, rows.Err()
+}
+
+func isCartItemInCouponScope(scope CouponScope, inventoryItemId int, tagIds []int) bool {
+	if len(scope.TagIds) == 0 && len(scope.InventoryItemIds) == 0 {
+		return true
+	}
+	if slices.Contains(scope.InventoryItemIds, inventoryItemId) {
+		return true
+	}
+	for _, tagId := range tagIds {
+		if slices.Contains(scope.TagIds, tagId) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+EvaluateCoupon
+ 1. Check the coupon is running and within its usage limits
+ 2. Check the cart meets the minimum subtotal
+ 3. Total up the lines the coupon is scoped to
+ 4. Work out the discount for the coupon type
+
+shippingOption is optional; without it a free shipping coupon can't be checked
+against an option or given a ShippingDiscountCents. itemTagIds maps inventory item ids to
+their tag ids.
+*/
+func EvaluateCoupon(
+	coupon CouponCode,
+	scope CouponScope,
+	usage CouponUsage,
+	cartItems []CartItem,
+	itemTagIds map[int][]int,
+	shippingOption *ShippingOption,
+	now time.Time,
+) (CouponEvaluation, error) {
+	if !now.Before(coupon.ExpiresAt) || (coupon.StartsAt != nil && now.Before(*coupon.StartsAt)) {
+		return CouponEvaluation{}, newCouponError("Invalid coupon code", ErrorCodeInvalidCouponCode)
+	}
+	if coupon.MaxRedemptions != nil && usage.TotalRedemptions >= *coupon.MaxRedemptions {
+		return CouponEvaluation{}, newCouponError(
+			"This coupon has been fully redeemed", ErrorCodeCouponUsageLimitReached,
+		)
+	}
+	if coupon.MaxRedemptionsPerUser != nil && usage.UserRedemptions >= *coupon.MaxRedemptionsPerUser {
+		return CouponEvaluation{}, newCouponError(
+			"You have already used this coupon", ErrorCodeCouponUsageLimitReached,
+		)
+	}
+
+	var subtotal Cents
+	evaluation := CouponEvaluation{CouponCode: coupon.Code, EligibleInventoryItemIds: []int{}}
+	for _, cartItem := range cartItems {
+		lineAmount := ToCents(float64(cartItem.Price)) * Cents(cartItem.Quantity)
+		subtotal += lineAmount
+		if isCartItemInCouponScope(scope, cartItem.InventoryItemId, itemTagIds[cartItem.InventoryItemId]) {
+			evaluation.EligibleSubtotalCents += lineAmount
+			// Two variants of one item are separate lines but one eligible item
+			if !evaluation.AppliesTo(cartItem.InventoryItemId) {
+				evaluation.EligibleInventoryItemIds = append(evaluation.EligibleInventoryItemIds, cartItem.InventoryItemId)
+			}
+		}
+	}
+
+	if subtotal < ToCents(coupon.MinimumSubtotal) {
+		return CouponEvaluation{}, newCouponError(
+			fmt.Sprintf("This coupon needs a subtotal of at least %.2f", coupon.MinimumSubtotal),
+			ErrorCodeCouponMinimumSubtotal,
+		)
+	}
+
+	switch coupon.CouponTypeName {
+	case CouponTypeFreeShipping:
+		if shippingOption != nil && coupon.ShippingOptionId != nil && *coupon.ShippingOptionId != shippingOption.Id {
+			return CouponEvaluation{}, newCouponError(
+				"This coupon doesn't apply to the chosen shipping option", ErrorCodeCouponNotApplicable,
+			)
+		}
+		evaluation.FreeShipping = true
+		if shippingOption != nil {
+			evaluation.ShippingDiscountCents = ToCents(shippingOption.Price)
+		}
+		return evaluation, nil
+	case CouponTypePercentPriceReduction:
+		evaluation.DiscountCents = evaluation.EligibleSubtotalCents.Percent(coupon.ReductionPercent)
+	case CouponTypeFixedPriceReduction:
+		evaluation.DiscountCents = min(ToCents(coupon.AmountOff), evaluation.EligibleSubtotalCents)
+	default:
+		return CouponEvaluation{}, newCouponError("Invalid coupon code", ErrorCodeInvalidCouponCode)
+	}
+
+	if evaluation.EligibleSubtotalCents == 0 {
+		return CouponEvaluation{}, newCouponError(
+			"This coupon doesn't apply to anything in your cart", ErrorCodeCouponNotApplicable,
+		)
+	}
+	return evaluation, nil
+}
+
+/*
+evaluateCoupon loads everything EvaluateCoupon needs. In a transaction, pass lockCoupon
+so concurrent orders can't both take the last redemption. Returns pgx.ErrNoRows if
+the coupon doesn't exist or isn't running.
+*/
+func evaluateCoupon(
+	db DBTX,
+	lockCoupon bool,
+	code string,
+	userId int,
+	cartItems []CartItem,
+	shippingOption *ShippingOption,
+) (CouponCode, CouponEvaluation, error) {
+	query := couponQuery
+	if lockCoupon {
+		query += "\n\t\tFOR UPDATE OF coupons"
+	}
+	coupon, couponErr := getCoupon(db, query, code)
+	if couponErr != nil {
+		return CouponCode{}, CouponEvaluation{}, couponErr
+	}
+	scope, scopeErr := getCouponScope(db, coupon.Code)
+	if scopeErr != nil {
+		return CouponCode{}, CouponEvaluation{}, scopeErr
+	}
+	usage, usageErr := getCouponUsage(db, coupon.Code, userId)
+	if usageErr != nil {
+		return CouponCode{}, CouponEvaluation{}, usageErr
+	}
+	itemTagIds, itemTagIdsErr := getInventoryItemTagIds(db, getCartInventoryItemIds(cartItems))
+	if itemTagIdsErr != nil {
+		return CouponCode{}, CouponEvaluation{}, itemTagIdsErr
+	}
+	evaluation, evaluationErr := EvaluateCoupon(
+		coupon, scope, usage, cartItems, itemTagIds, shippingOption, time.Now(),
+	)
+	return coupon, evaluation, evaluationErr
+}
+
+/*
+EvaluateCouponForCart evaluates a coupon against the user's current cart. shippingOptionId
+is optional (0). Returns pgx.ErrNoRows if the coupon doesn't exist or isn't running,
+and a StatusBadRequestError if the cart doesn't qualify.
+*/
+func EvaluateCouponForCart(
+	dbPool *pgxpool.Pool, code string, userId int, shippingOptionId int,
+) (CouponCode, CouponEvaluation, error) {
+	cartItems, cartErr := GetCartItems(dbPool, userId)
+	if cartErr != nil {
+		return CouponCode{}, CouponEvaluation{}, cartErr
+	}
+
+	var shippingOption *ShippingOption
+	if shippingOptionId > 0 {
+		option, shippingErr := getShippingOptionById(dbPool, shippingOptionId)
+		if shippingErr != nil {
+			if errors.Is(shippingErr, pgx.ErrNoRows) {
+				return CouponCode{}, CouponEvaluation{}, newCouponError(
+					"Invalid shipping option", ErrorCodeInvalidShippingOption,
+				)
+			}
+			return CouponCode{}, CouponEvaluation{}, shippingErr
+		}
+		shippingOption = &option
+	}
+
+	return evaluateCoupon(dbPool, false, code, userId, cartItems, shippingOption)
+}
+
+func addCouponRedemption(db DBTX, code string, userId int, orderId int, discountAmount float64) error {
+	const query = `
+		INSERT INTO coupon_redemptions (coupon_code, user_id, order_id, discount_amount, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+	`
+	_, err := db.Exec(context.Background(), query, code, userId, orderId, discountAmount)
+	return err
+}
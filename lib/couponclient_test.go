@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func getTestCoupon(couponTypeName string) CouponCode {
+	return CouponCode{
+		Code:           "HOTDEAL",
+		CouponTypeName: couponTypeName,
+		ExpiresAt:      time.Now().Add(time.Hour),
+	}
+}
+
+func getTestCouponCart() ([]CartItem, map[int][]int) {
+	cartItems := []CartItem{
+		{InventoryItemId: 1, Price: 10, Quantity: 2},
+		{InventoryItemId: 2, Price: 5, Quantity: 1},
+	}
+	itemTagIds := map[int][]int{1: {100}, 2: {200}}
+	return cartItems, itemTagIds
+}
+
+func TestEvaluateCouponDiscounts(t *testing.T) {
+	cartItems, itemTagIds := getTestCouponCart()
+	now := time.Now()
+
+	percentCoupon := getTestCoupon(CouponTypePercentPriceReduction)
+	percentCoupon.ReductionPercent = 10
+	evaluation, err := EvaluateCoupon(percentCoupon, CouponScope{}, CouponUsage{}, cartItems, itemTagIds, nil, now)
+	if err != nil || evaluation.DiscountCents != 250 {
+		t.Fatalf("Percent coupon: %+v %v", evaluation, err)
+	}
+
+	fixedCoupon := getTestCoupon(CouponTypeFixedPriceReduction)
+	fixedCoupon.AmountOff = 100
+	evaluation, err = EvaluateCoupon(fixedCoupon, CouponScope{}, CouponUsage{}, cartItems, itemTagIds, nil, now)
+	if err != nil || evaluation.DiscountCents != 2500 {
+		t.Fatalf("Fixed coupon should be capped at the eligible subtotal: %+v %v", evaluation, err)
+	}
+
+	shippingOptionId := 3
+	freeShippingCoupon := getTestCoupon(CouponTypeFreeShipping)
+	freeShippingCoupon.ShippingOptionId = &shippingOptionId
+	shippingOption := ShippingOption{Id: 3, Price: 7.99}
+	evaluation, err = EvaluateCoupon(
+		freeShippingCoupon, CouponScope{}, CouponUsage{}, cartItems, itemTagIds, &shippingOption, now,
+	)
+	if err != nil || !evaluation.FreeShipping || evaluation.ShippingDiscountCents != 799 {
+		t.Fatalf("Free shipping coupon: %+v %v", evaluation, err)
+	}
+
+	otherShippingOption := ShippingOption{Id: 4, Price: 12}
+	_, err = EvaluateCoupon(
+		freeShippingCoupon, CouponScope{}, CouponUsage{}, cartItems, itemTagIds, &otherShippingOption, now,
+	)
+	expectErrorCode(t, err, ErrorCodeCouponNotApplicable)
+}
+
+func TestEvaluateCouponScope(t *testing.T) {
+	cartItems, itemTagIds := getTestCouponCart()
+	coupon := getTestCoupon(CouponTypePercentPriceReduction)
+	coupon.ReductionPercent = 50
+
+	evaluation, err := EvaluateCoupon(
+		coupon, CouponScope{TagIds: []int{200}}, CouponUsage{}, cartItems, itemTagIds, nil, time.Now(),
+	)
+	if err != nil || evaluation.EligibleSubtotalCents != 500 || evaluation.DiscountCents != 250 {
+		t.Fatalf("Tag scoped coupon: %+v %v", evaluation, err)
+	}
+
+	evaluation, err = EvaluateCoupon(
+		coupon, CouponScope{InventoryItemIds: []int{1}}, CouponUsage{}, cartItems, itemTagIds, nil, time.Now(),
+	)
+	if err != nil || evaluation.EligibleSubtotalCents != 2000 {
+		t.Fatalf("Item scoped coupon: %+v %v", evaluation, err)
+	}
+
+	_, err = EvaluateCoupon(
+		coupon, CouponScope{TagIds: []int{300}}, CouponUsage{}, cartItems, itemTagIds, nil, time.Now(),
+	)
+	expectErrorCode(t, err, ErrorCodeCouponNotApplicable)
+}
+
+func TestEvaluateCouponRules(t *testing.T) {
+	cartItems, itemTagIds := getTestCouponCart()
+	now := time.Now()
+
+	minimumCoupon := getTestCoupon(CouponTypePercentPriceReduction)
+	minimumCoupon.MinimumSubtotal = 30
+	_, err := EvaluateCoupon(minimumCoupon, CouponScope{}, CouponUsage{}, cartItems, itemTagIds, nil, now)
+	expectErrorCode(t, err, ErrorCodeCouponMinimumSubtotal)
+
+	limit := 1
+	limitedCoupon := getTestCoupon(CouponTypePercentPriceReduction)
+	limitedCoupon.MaxRedemptions = &limit
+	_, err = EvaluateCoupon(
+		limitedCoupon, CouponScope{}, CouponUsage{TotalRedemptions: 1}, cartItems, itemTagIds, nil, now,
+	)
+	expectErrorCode(t, err, ErrorCodeCouponUsageLimitReached)
+
+	perUserCoupon := getTestCoupon(CouponTypePercentPriceReduction)
+	perUserCoupon.MaxRedemptionsPerUser = &limit
+	_, err = EvaluateCoupon(
+		perUserCoupon, CouponScope{}, CouponUsage{TotalRedemptions: 5, UserRedemptions: 1}, cartItems, itemTagIds, nil, now,
+	)
+	expectErrorCode(t, err, ErrorCodeCouponUsageLimitReached)
+
+	startsAt := now.Add(time.Hour)
+	futureCoupon := getTestCoupon(CouponTypePercentPriceReduction)
+	futureCoupon.StartsAt = &startsAt
+	_, err = EvaluateCoupon(futureCoupon, CouponScope{}, CouponUsage{}, cartItems, itemTagIds, nil, now)
+	expectErrorCode(t, err, ErrorCodeInvalidCouponCode)
+}
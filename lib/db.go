@@ -2,11 +2,33 @@ package lib
 
 import (
 	"context"
+	"errors"
 	"log"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// DBTX is satisfied by both *pgxpool.Pool and pgx.Tx, so query helpers
+// can be shared between regular requests and transactions.
+type DBTX interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Postgres error codes we handle rather than report as internal errors
+const (
+	pgErrorCodeForeignKeyViolation = "23503"
+	pgErrorCodeUniqueViolation     = "23505"
+)
+
+func isPgError(err error, code string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == code
+}
+
 func InitDB(dsn string) *pgxpool.Pool {
 	dbPool, err := pgxpool.New(context.Background(), dsn)
 	if err != nil {
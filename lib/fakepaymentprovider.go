@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Card numbers ending in these digits trigger the fake provider's other outcomes.
+// Every other card number succeeds.
+const (
+	FakeCardSuffixDeclined          = "0002"
+	FakeCardSuffixInsufficientFunds = "9995"
+	FakeCardSuffixDelayedSettlement = "0077"
+)
+
+const FakePaymentWebhookSignatureHeader = "X-Fake-Signature"
+
+const fakeSavedCardPrefix = "fake_card_"
+
+/*
+FakePaymentProvider simulates a card processor so the purchase path can be built and
+tested offline. Outcomes are chosen by the card number:
+
+  - ...0002 is declined
+  - ...9995 is declined for insufficient funds
+  - ...0077 stays pending until a payment.settled or payment.failed webhook arrives
+  - anything else is authorized and can then be captured
+
+Saved cards keep the last four digits in their reference, so they have the same outcomes
+and still work after a restart. Webhooks are signed with an HMAC-SHA256 of the body using
+the configured secret.
+*/
+type FakePaymentProvider struct {
+	webhookSecret string
+	// Authorized amounts by reference, so captures and refunds can be checked
+	mutex      sync.Mutex
+	authorized map[string]int64
+	refunded   map[string]int64
+}
+
+func NewFakePaymentProvider(webhookSecret string) *FakePaymentProvider {
+	return &FakePaymentProvider{
+		webhookSecret: webhookSecret,
+		authorized:    make(map[string]int64),
+		refunded:      make(map[string]int64),
+	}
+}
+
+func (p *FakePaymentProvider) Name() string {
+	return PaymentProviderFake
+}
+
+func (p *FakePaymentProvider) WebhookSignatureHeader() string {
+	return FakePaymentWebhookSignatureHeader
+}
+
+func (p *FakePaymentProvider) Authorize(amountCents int64, card PaymentCard) (PaymentResult, error) {
+	if amountCents <= 0 {
+		return PaymentResult{}, fmt.Errorf("amount must be positive: %v", amountCents)
+	}
+	reference := fmt.Sprintf("fake_%s", uuid.NewString())
+
+	switch {
+	case strings.HasSuffix(card.Number, FakeCardSuffixDeclined):
+		return PaymentResult{
+			ProviderReference: reference,
+			Status:            PaymentStatusDeclined,
+			DeclineReason:     "card_declined",
+		}, nil
+	case strings.HasSuffix(card.Number, FakeCardSuffixInsufficientFunds):
+		return PaymentResult{
+			ProviderReference: reference,
+			Status:            PaymentStatusDeclined,
+			DeclineReason:     "insufficient_funds",
+		}, nil
+	}
+
+	p.mutex.Lock()
+	p.authorized[reference] = amountCents
+	p.mutex.Unlock()
+
+	if strings.HasSuffix(card.Number, FakeCardSuffixDelayedSettlement) {
+		return PaymentResult{ProviderReference: reference, Status: PaymentStatusPending}, nil
+	}
+
+	return PaymentResult{ProviderReference: reference, Status: PaymentStatusAuthorized}, nil
+}
+
+func (p *FakePaymentProvider) Capture(providerReference string, amountCents int64) (PaymentResult, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	authorizedAmount, ok := p.authorized[providerReference]
+	if !ok {
+		return PaymentResult{}, fmt.Errorf("unknown payment reference: %v", providerReference)
+	}
+	if amountCents > authorizedAmount {
+		return PaymentResult{}, fmt.Errorf("capture of %v exceeds authorized %v", amountCents, authorizedAmount)
+	}
+	return PaymentResult{ProviderReference: providerReference, Status: PaymentStatusCaptured}, nil
+}
+
+func (p *FakePaymentProvider) Void(providerReference string) (PaymentResult, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.authorized[providerReference]; !ok {
+		return PaymentResult{}, fmt.Errorf("unknown payment reference: %v", providerReference)
+	}
+	delete(p.authorized, providerReference)
+	return PaymentResult{ProviderReference: providerReference, Status: PaymentStatusVoided}, nil
+}
+
+func (p *FakePaymentProvider) Refund(providerReference string, amountCents int64) (PaymentResult, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	authorizedAmount, ok := p.authorized[providerReference]
+	// References from before a restart aren't in memory; accept them rather than strand refunds
+	if ok && p.refunded[providerReference]+amountCents > authorizedAmount {
+		return PaymentResult{}, fmt.Errorf("refund of %v exceeds captured %v", amountCents, authorizedAmount)
+	}
+	p.refunded[providerReference] += amountCents
+	return PaymentResult{ProviderReference: providerReference, Status: PaymentStatusRefunded}, nil
+}
+
+func (p *FakePaymentProvider) SaveCard(card PaymentCard) (string, error) {
+	if len(card.Number) < 4 {
+		return "", errors.New("invalid card number")
+	}
+	return fmt.Sprintf("%s%s_%s", fakeSavedCardPrefix, card.Number[len(card.Number)-4:], uuid.NewString()), nil
+}
+
+func (p *FakePaymentProvider) AuthorizeSavedCard(cardReference string, amountCents int64) (PaymentResult, error) {
+	lastFour, _, ok := strings.Cut(strings.TrimPrefix(cardReference, fakeSavedCardPrefix), "_")
+	if !strings.HasPrefix(cardReference, fakeSavedCardPrefix) || !ok {
+		return PaymentResult{}, fmt.Errorf("unknown card reference: %v", cardReference)
+	}
+	return p.Authorize(amountCents, PaymentCard{Number: lastFour})
+}
+
+func (p *FakePaymentProvider) SignWebhookPayload(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(p.webhookSecret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *FakePaymentProvider) VerifyWebhook(payload []byte, signature string) (PaymentWebhookEvent, error) {
+	expected := p.SignWebhookPayload(payload)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return PaymentWebhookEvent{}, errors.New("invalid webhook signature")
+	}
+	var event PaymentWebhookEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return PaymentWebhookEvent{}, err
+	}
+	if event.EventType != PaymentWebhookEventSettled && event.EventType != PaymentWebhookEventFailed {
+		return PaymentWebhookEvent{}, fmt.Errorf("unknown webhook event type: %v", event.EventType)
+	}
+	return event, nil
+}
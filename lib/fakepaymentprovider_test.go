@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"testing"
+)
+
+func getFakeTestCard(number string) PaymentCard {
+	return PaymentCard{Number: number, ExpiryMonth: 12, ExpiryYear: 2030, Cvc: "123"}
+}
+
+func TestFakePaymentProviderCardOutcomes(t *testing.T) {
+	provider := NewFakePaymentProvider("secret")
+	outcomes := map[string]string{
+		"4242424242424242": PaymentStatusAuthorized,
+		"4000000000000002": PaymentStatusDeclined,
+		"4000000000009995": PaymentStatusDeclined,
+		"4000000000000077": PaymentStatusPending,
+	}
+	for number, expectedStatus := range outcomes {
+		result, err := provider.Authorize(1999, getFakeTestCard(number))
+		if err != nil {
+			t.Fatalf("Authorize %v: %v", number, err)
+		}
+		if result.Status != expectedStatus {
+			t.Fatalf("Card %v: expected %v, got %v", number, expectedStatus, result.Status)
+		}
+	}
+}
+
+func TestFakePaymentProviderCaptureAndRefund(t *testing.T) {
+	provider := NewFakePaymentProvider("secret")
+	result, _ := provider.Authorize(1999, getFakeTestCard("4242424242424242"))
+
+	if _, err := provider.Capture(result.ProviderReference, 2000); err == nil {
+		t.Fatal("Expected capturing more than was authorized to fail")
+	}
+	captured, captureErr := provider.Capture(result.ProviderReference, 1999)
+	if captureErr != nil || captured.Status != PaymentStatusCaptured {
+		t.Fatalf("Expected capture to succeed: %v %v", captured.Status, captureErr)
+	}
+
+	if _, err := provider.Refund(result.ProviderReference, 1000); err != nil {
+		t.Fatalf("Partial refund failed: %v", err)
+	}
+	if _, err := provider.Refund(result.ProviderReference, 1000); err == nil {
+		t.Fatal("Expected refunding more than was captured to fail")
+	}
+}
+
+func TestFakePaymentProviderVoid(t *testing.T) {
+	provider := NewFakePaymentProvider("secret")
+	result, _ := provider.Authorize(1999, getFakeTestCard("4242424242424242"))
+
+	voided, voidErr := provider.Void(result.ProviderReference)
+	if voidErr != nil || voided.Status != PaymentStatusVoided {
+		t.Fatalf("Expected void to succeed: %v %v", voided.Status, voidErr)
+	}
+	if _, err := provider.Capture(result.ProviderReference, 1999); err == nil {
+		t.Fatal("Expected capturing a voided payment to fail")
+	}
+}
+
+func TestFakePaymentProviderSavedCard(t *testing.T) {
+	provider := NewFakePaymentProvider("secret")
+	cardReference, saveErr := provider.SaveCard(getFakeTestCard("4000000000000002"))
+	if saveErr != nil {
+		t.Fatalf("SaveCard: %v", saveErr)
+	}
+	result, err := provider.AuthorizeSavedCard(cardReference, 1999)
+	if err != nil || result.Status != PaymentStatusDeclined {
+		t.Fatalf("Expected the saved card to keep its outcome: %v %v", result.Status, err)
+	}
+	if _, unknownErr := provider.AuthorizeSavedCard("fake_123", 1999); unknownErr == nil {
+		t.Fatal("Expected an unknown card reference to be rejected")
+	}
+}
+
+func TestFakePaymentProviderVerifyWebhook(t *testing.T) {
+	provider := NewFakePaymentProvider("secret")
+	payload := []byte(`{"type":"payment.settled","providerReference":"fake_123"}`)
+
+	event, err := provider.VerifyWebhook(payload, provider.SignWebhookPayload(payload))
+	if err != nil {
+		t.Fatalf("Expected valid signature: %v", err)
+	}
+	if event.EventType != PaymentWebhookEventSettled || event.ProviderReference != "fake_123" {
+		t.Fatalf("Unexpected event: %+v", event)
+	}
+
+	if _, badSignatureErr := provider.VerifyWebhook(payload, "bad"); badSignatureErr == nil {
+		t.Fatal("Expected invalid signature to be rejected")
+	}
+}
+
+func TestNewPaymentProvider(t *testing.T) {
+	provider, err := NewPaymentProvider(ConfigPayments{Provider: PaymentProviderFake})
+	if err != nil || provider.Name() != PaymentProviderFake {
+		t.Fatalf("Expected the fake provider when chosen: %v", err)
+	}
+
+	invalidConfigs := map[string]ConfigPayments{
+		"no provider":       {WebhookSecret: "secret"},
+		"unknown provider":  {Provider: "unknown", WebhookSecret: "secret"},
+		"no webhook secret": {Provider: "unknown"},
+	}
+	for name, config := range invalidConfigs {
+		if _, configErr := NewPaymentProvider(config); configErr == nil {
+			t.Fatalf("%v: expected an error", name)
+		}
+	}
+}
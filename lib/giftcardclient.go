@@ -0,0 +1,685 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	GiftCardTransactionIssue   = "issue"
+	GiftCardTransactionRedeem  = "redeem"
+	GiftCardTransactionRelease = "release"
+	GiftCardTransactionRefund  = "refund"
+	GiftCardTransactionVoid    = "void"
+)
+
+// DefaultGiftCardExpiry is used when a card is issued without an expiry
+const DefaultGiftCardExpiry = 365 * 24 * time.Hour
+
+// GiftCardRedemptionTimeout is how long a redemption stays on a cart before it's credited back to the card
+const GiftCardRedemptionTimeout = 24 * time.Hour
+
+type GiftCard struct {
+	Id                  int        `json:"id" db:"id"`
+	Code                string     `json:"code" db:"code"`
+	InitialBalanceCents Cents      `json:"initialBalanceCents" db:"initial_balance_cents"`
+	BalanceCents        Cents      `json:"balanceCents" db:"balance_cents"`
+	ExpiresAt           time.Time  `json:"expiresAt" db:"expires_at"`
+	VoidedAt            *time.Time `json:"voidedAt" db:"voided_at"`
+	IssuedByUserId      *int       `json:"issuedByUserId" db:"issued_by_user_id"`
+	CreatedAt           time.Time  `json:"createdAt" db:"created_at"`
+	UpdatedAt           *time.Time `json:"updatedAt" db:"updated_at"`
+}
+
+// GiftCardTransaction is a ledger entry. Debits are negative.
+type GiftCardTransaction struct {
+	Id          int        `json:"id" db:"id"`
+	GiftCardId  int        `json:"giftCardId" db:"gift_card_id"`
+	Type        string     `json:"type" db:"type"`
+	AmountCents Cents      `json:"amountCents" db:"amount_cents"`
+	UserId      *int       `json:"userId" db:"user_id"`
+	OrderId     *int       `json:"orderId" db:"order_id"`
+	SettledAt   *time.Time `json:"settledAt" db:"settled_at"`
+	CreatedAt   time.Time  `json:"createdAt" db:"created_at"`
+}
+
+// GiftCardRedemption is an amount taken off a card and applied to a user's cart
+type GiftCardRedemption struct {
+	Id          int       `json:"id" db:"id"`
+	GiftCardId  int       `json:"giftCardId" db:"gift_card_id"`
+	Code        string    `json:"code" db:"code"`
+	AmountCents Cents     `json:"amountCents" db:"amount_cents"`
+	CreatedAt   time.Time `json:"createdAt" db:"created_at"`
+}
+
+// IssueGiftCardRequest - a code is generated when none is given. Custom codes are at least as
+// long as the 16 random characters of a generated one, so they can't be guessed any more easily.
+type IssueGiftCardRequest struct {
+	Code                string     `json:"code" validate:"omitempty,min=16,max=25,alphanum"`
+	InitialBalanceCents int64      `json:"initialBalanceCents" validate:"required,min=100,max=100000"`
+	ExpiresAt           *time.Time `json:"expiresAt"`
+}
+
+// RedeemGiftCardRequest - without AmountCents, as much as the card and cart allow is redeemed.
+// The other fields price the cart the same way as GET /api/v1/cart.
+type RedeemGiftCardRequest struct {
+	AmountCents      int64  `json:"amountCents" validate:"min=0,max=100000"`
+	ShippingOptionId int    `json:"shippingOptionId" validate:"min=0"`
+	CouponCode       string `json:"couponCode" validate:"omitempty,min=4,max=25"`
+	Country          string `json:"country" validate:"omitempty,len=2,alpha"`
+	Region           string `json:"region" validate:"omitempty,max=10,alphanum"`
+}
+
+// GenerateGiftCardCode returns a random code, e.g. GC-3F9A-1C2B-7D4E-8A0B
+func GenerateGiftCardCode() (string, error) {
+	codeUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	hex := strings.ToUpper(strings.ReplaceAll(codeUUID.String(), "-", ""))
+	return fmt.Sprintf("GC-%s-%s-%s-%s", hex[0:4], hex[4:8], hex[8:12], hex[12:16]), nil
+}
+
+// NormalizeGiftCardCode - codes are matched case-insensitively and ignoring surrounding space
+func NormalizeGiftCardCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// IsUsable - a card can be redeemed until it's voided, expired or empty
+func (g GiftCard) IsUsable(now time.Time) bool {
+	return g.VoidedAt == nil && now.Before(g.ExpiresAt) && g.BalanceCents > 0
+}
+
+func newGiftCardError(statusCode int, message string, errorCode string) *StatusBadRequestError {
+	return &StatusBadRequestError{
+		StatusCode: statusCode,
+		Message:    message,
+		ErrorCode:  errorCode,
+	}
+}
+
+// giftCardUnusableError says why a card can't be redeemed, or returns nil if it can
+func giftCardUnusableError(giftCard GiftCard, now time.Time) error {
+	switch {
+	case giftCard.VoidedAt != nil:
+		return newGiftCardError(http.StatusBadRequest, "This gift card has been voided", ErrorCodeGiftCardVoided)
+	case !now.Before(giftCard.ExpiresAt):
+		return newGiftCardError(http.StatusBadRequest, "This gift card has expired", ErrorCodeGiftCardExpired)
+	case giftCard.BalanceCents <= 0:
+		return newGiftCardError(
+			http.StatusBadRequest, "This gift card has no balance left", ErrorCodeGiftCardInsufficientBalance,
+		)
+	}
+	return nil
+}
+
+func getGiftCardByCode(db DBTX, code string, lockClause string) (GiftCard, error) {
+	query := `SELECT * FROM gift_cards WHERE code = $1` + lockClause
+	rows, err := db.Query(context.Background(), query, NormalizeGiftCardCode(code))
+	if err != nil {
+		return GiftCard{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[GiftCard])
+}
+
+// GetGiftCardByCode returns pgx.ErrNoRows if there's no such card
+func GetGiftCardByCode(dbPool *pgxpool.Pool, code string) (GiftCard, error) {
+	return getGiftCardByCode(dbPool, code, "")
+}
+
+func GetGiftCardTransactions(dbPool *pgxpool.Pool, giftCardId int) ([]GiftCardTransaction, error) {
+	const query = `SELECT * FROM gift_card_transactions WHERE gift_card_id = $1 ORDER BY created_at, id`
+	rows, err := dbPool.Query(context.Background(), query, giftCardId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[GiftCardTransaction])
+}
+
+func addGiftCardTransaction(db DBTX, transaction GiftCardTransaction) error {
+	const query = `
+		INSERT INTO gift_card_transactions (
+			gift_card_id, type, amount_cents, user_id, order_id, settled_at, created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+	`
+	_, err := db.Exec(
+		context.Background(),
+		query,
+		transaction.GiftCardId,
+		transaction.Type,
+		transaction.AmountCents,
+		transaction.UserId,
+		transaction.OrderId,
+		transaction.SettledAt,
+	)
+	return err
+}
+
+// creditGiftCard puts an amount back on a card, e.g. a redemption that wasn't used or a refund.
+// transactionType is GiftCardTransactionRelease or GiftCardTransactionRefund.
+func creditGiftCard(db DBTX, giftCardId int, amount Cents, transactionType string, userId *int, orderId *int) error {
+	const query = `
+		UPDATE gift_cards
+		SET balance_cents = balance_cents + $2, updated_at = NOW()
+		WHERE id = $1
+	`
+	_, err := db.Exec(context.Background(), query, giftCardId, amount)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return addGiftCardTransaction(db, GiftCardTransaction{
+		GiftCardId:  giftCardId,
+		Type:        transactionType,
+		AmountCents: amount,
+		UserId:      userId,
+		OrderId:     orderId,
+		SettledAt:   &now,
+	})
+}
+
+/*
+IssueGiftCard
+ 1. Use the requested code, or generate one
+ 2. Insert the card with its full balance, expiring after DefaultGiftCardExpiry unless a date is given
+ 3. Record the issue in the ledger
+*/
+func IssueGiftCard(
+	dbPool *pgxpool.Pool, logger *slog.Logger, issuedByUserId int, request IssueGiftCardRequest,
+) (GiftCard, error) {
+	code := NormalizeGiftCardCode(request.Code)
+	if len(code) == 0 {
+		generatedCode, codeErr := GenerateGiftCardCode()
+		if codeErr != nil {
+			return GiftCard{}, codeErr
+		}
+		code = generatedCode
+	}
+	expiresAt := time.Now().Add(DefaultGiftCardExpiry)
+	if request.ExpiresAt != nil {
+		if !request.ExpiresAt.After(time.Now()) {
+			return GiftCard{}, newGiftCardError(
+				http.StatusBadRequest, "Expiry must be in the future", ErrorCodeInvalidGiftCard,
+			)
+		}
+		expiresAt = *request.ExpiresAt
+	}
+
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return GiftCard{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("IssueGiftCard: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	const query = `
+		INSERT INTO gift_cards (code, initial_balance_cents, balance_cents, expires_at, issued_by_user_id, created_at)
+		VALUES ($1, $2, $2, $3, $4, NOW())
+		RETURNING *
+	`
+	rows, insertErr := tx.Query(ctx, query, code, request.InitialBalanceCents, expiresAt, issuedByUserId)
+	if insertErr != nil {
+		return GiftCard{}, insertErr
+	}
+	giftCard, collectErr := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[GiftCard])
+	if isPgError(collectErr, pgErrorCodeUniqueViolation) {
+		return GiftCard{}, newGiftCardError(
+			http.StatusConflict, fmt.Sprintf("Gift card %v already exists", code), ErrorCodeGiftCardExists,
+		)
+	}
+	if collectErr != nil {
+		return GiftCard{}, collectErr
+	}
+
+	ledgerErr := addGiftCardTransaction(tx, GiftCardTransaction{
+		GiftCardId:  giftCard.Id,
+		Type:        GiftCardTransactionIssue,
+		AmountCents: giftCard.InitialBalanceCents,
+		UserId:      &issuedByUserId,
+		SettledAt:   &giftCard.CreatedAt,
+	})
+	if ledgerErr != nil {
+		return GiftCard{}, ledgerErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return GiftCard{}, commitErr
+	}
+	logger.Info(fmt.Sprintf("Gift card %v issued for %v by user %v", giftCard.Id, giftCard.InitialBalanceCents, issuedByUserId))
+	return giftCard, nil
+}
+
+// VoidGiftCard empties the card so it can't be redeemed again. Redemptions already applied to carts stand.
+func VoidGiftCard(dbPool *pgxpool.Pool, logger *slog.Logger, code string, voidedByUserId int) (GiftCard, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return GiftCard{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("VoidGiftCard: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	giftCard, giftCardErr := getGiftCardByCode(tx, code, "\n\t\tFOR UPDATE")
+	if giftCardErr != nil {
+		return GiftCard{}, giftCardErr
+	}
+	if giftCard.VoidedAt != nil {
+		return GiftCard{}, newGiftCardError(
+			http.StatusConflict, "This gift card has already been voided", ErrorCodeGiftCardVoided,
+		)
+	}
+
+	const query = `
+		UPDATE gift_cards
+		SET balance_cents = 0, voided_at = NOW(), updated_at = NOW()
+		WHERE id = $1
+		RETURNING *
+	`
+	rows, updateErr := tx.Query(ctx, query, giftCard.Id)
+	if updateErr != nil {
+		return GiftCard{}, updateErr
+	}
+	voidedGiftCard, collectErr := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[GiftCard])
+	if collectErr != nil {
+		return GiftCard{}, collectErr
+	}
+
+	ledgerErr := addGiftCardTransaction(tx, GiftCardTransaction{
+		GiftCardId:  giftCard.Id,
+		Type:        GiftCardTransactionVoid,
+		AmountCents: -giftCard.BalanceCents,
+		UserId:      &voidedByUserId,
+		SettledAt:   voidedGiftCard.VoidedAt,
+	})
+	if ledgerErr != nil {
+		return GiftCard{}, ledgerErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return GiftCard{}, commitErr
+	}
+	logger.Info(fmt.Sprintf("Gift card %v voided by user %v with %v left", giftCard.Id, voidedByUserId, giftCard.BalanceCents))
+	return voidedGiftCard, nil
+}
+
+func getPendingGiftCardRedemptions(db DBTX, userId int, lockClause string) ([]GiftCardRedemption, error) {
+	query := `
+		SELECT t.id, t.gift_card_id, g.code, -t.amount_cents AS amount_cents, t.created_at
+		FROM gift_card_transactions t
+		JOIN gift_cards g ON g.id = t.gift_card_id
+		WHERE t.user_id = $1
+		AND t.type = 'redeem'
+		AND t.settled_at IS NULL
+		ORDER BY t.created_at, t.id` + lockClause
+	rows, err := db.Query(context.Background(), query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[GiftCardRedemption])
+}
+
+// GetPendingGiftCardRedemptions returns what's been redeemed against the user's cart
+func GetPendingGiftCardRedemptions(dbPool *pgxpool.Pool, userId int) ([]GiftCardRedemption, error) {
+	return getPendingGiftCardRedemptions(dbPool, userId, "")
+}
+
+func getPendingGiftCardCents(db DBTX, userId int) (Cents, error) {
+	const query = `
+		SELECT COALESCE(-SUM(amount_cents), 0)
+		FROM gift_card_transactions
+		WHERE user_id = $1
+		AND type = 'redeem'
+		AND settled_at IS NULL
+	`
+	var pending Cents
+	err := db.QueryRow(context.Background(), query, userId).Scan(&pending)
+	return pending, err
+}
+
+/*
+GiftCardRedemptionAmount is how much to take off a card: the amount asked for, or if
+none, as much as the card's balance and the unpaid cart total allow. Returns an error
+code when the request can't be met.
+*/
+func GiftCardRedemptionAmount(requested Cents, balance Cents, amountDue Cents) (Cents, string) {
+	if amountDue <= 0 {
+		return 0, ErrorCodeGiftCardExceedsCart
+	}
+	if requested == 0 {
+		return min(balance, amountDue), ""
+	}
+	if requested > amountDue {
+		return 0, ErrorCodeGiftCardExceedsCart
+	}
+	if requested > balance {
+		return 0, ErrorCodeGiftCardInsufficientBalance
+	}
+	return requested, ""
+}
+
+/*
+RedeemGiftCard
+ 1. Price the user's cart, less what's already been redeemed against it
+ 2. Work out the amount with GiftCardRedemptionAmount
+ 3. Debit the card, only if it's still usable and has the balance. The check and the
+    debit are one UPDATE, so concurrent redemptions of the same card can't overspend it.
+ 4. Record the redemption in the ledger, unsettled until the order is placed. It's credited
+    back by ReleaseExpiredGiftCardRedemptions if that takes longer than GiftCardRedemptionTimeout.
+*/
+func RedeemGiftCard(
+	dbPool *pgxpool.Pool,
+	logger *slog.Logger,
+	taxRules TaxRules,
+	userId int,
+	code string,
+	request RedeemGiftCardRequest,
+) (GiftCardRedemption, GiftCard, error) {
+	giftCard, giftCardErr := GetGiftCardByCode(dbPool, code)
+	if giftCardErr != nil {
+		return GiftCardRedemption{}, GiftCard{}, giftCardErr
+	}
+	unusableErr := giftCardUnusableError(giftCard, time.Now())
+	if unusableErr != nil {
+		return GiftCardRedemption{}, GiftCard{}, unusableErr
+	}
+
+	cartItems, cartErr := GetCartItems(dbPool, userId)
+	if cartErr != nil {
+		return GiftCardRedemption{}, GiftCard{}, cartErr
+	}
+	totals, totalsErr := PriceCart(
+		dbPool,
+		taxRules,
+		userId,
+		cartItems,
+		request.ShippingOptionId,
+		request.CouponCode,
+		TaxLocation{Country: request.Country, Region: request.Region},
+	)
+	if totalsErr != nil {
+		return GiftCardRedemption{}, GiftCard{}, totalsErr
+	}
+
+	amount, amountErrCode := GiftCardRedemptionAmount(
+		Cents(request.AmountCents), giftCard.BalanceCents, totals.AmountDueCents,
+	)
+	switch amountErrCode {
+	case ErrorCodeGiftCardExceedsCart:
+		return GiftCardRedemption{}, GiftCard{}, newGiftCardError(
+			http.StatusBadRequest,
+			fmt.Sprintf("Only %v of the cart is left to pay", totals.AmountDueCents),
+			amountErrCode,
+		)
+	case ErrorCodeGiftCardInsufficientBalance:
+		return GiftCardRedemption{}, GiftCard{}, newGiftCardError(
+			http.StatusBadRequest,
+			fmt.Sprintf("This gift card only has %v left", giftCard.BalanceCents),
+			amountErrCode,
+		)
+	}
+
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return GiftCardRedemption{}, GiftCard{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("RedeemGiftCard: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	const debitQuery = `
+		UPDATE gift_cards
+		SET balance_cents = balance_cents - $2, updated_at = NOW()
+		WHERE id = $1
+		AND balance_cents >= $2
+		AND voided_at IS NULL
+		AND expires_at > NOW()
+		RETURNING *
+	`
+	rows, debitErr := tx.Query(ctx, debitQuery, giftCard.Id, amount)
+	if debitErr != nil {
+		return GiftCardRedemption{}, GiftCard{}, debitErr
+	}
+	debitedGiftCard, collectErr := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[GiftCard])
+	if errors.Is(collectErr, pgx.ErrNoRows) {
+		// Spent, voided or expired since it was read
+		return GiftCardRedemption{}, GiftCard{}, newGiftCardError(
+			http.StatusConflict,
+			"This gift card no longer has enough balance",
+			ErrorCodeGiftCardInsufficientBalance,
+		)
+	}
+	if collectErr != nil {
+		return GiftCardRedemption{}, GiftCard{}, collectErr
+	}
+
+	redemption := GiftCardRedemption{GiftCardId: giftCard.Id, Code: giftCard.Code, AmountCents: amount}
+	const ledgerQuery = `
+		INSERT INTO gift_card_transactions (gift_card_id, type, amount_cents, user_id, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		RETURNING id, created_at
+	`
+	ledgerErr := tx.QueryRow(ctx, ledgerQuery, giftCard.Id, GiftCardTransactionRedeem, -amount, userId).
+		Scan(&redemption.Id, &redemption.CreatedAt)
+	if ledgerErr != nil {
+		return GiftCardRedemption{}, GiftCard{}, ledgerErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return GiftCardRedemption{}, GiftCard{}, commitErr
+	}
+	logger.Info(fmt.Sprintf("User %v redeemed %v from gift card %v", userId, amount, giftCard.Id))
+	return redemption, debitedGiftCard, nil
+}
+
+// ReleaseGiftCardRedemptions takes a card off the user's cart, crediting back what was redeemed
+func ReleaseGiftCardRedemptions(dbPool *pgxpool.Pool, logger *slog.Logger, userId int, code string) (Cents, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return 0, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("ReleaseGiftCardRedemptions: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	redemptions, redemptionsErr := getPendingGiftCardRedemptions(tx, userId, "\n\t\tFOR UPDATE OF t")
+	if redemptionsErr != nil {
+		return 0, redemptionsErr
+	}
+	var released Cents
+	for _, redemption := range redemptions {
+		if redemption.Code != NormalizeGiftCardCode(code) {
+			continue
+		}
+		settleErr := settleGiftCardRedemption(tx, redemption.Id, nil)
+		if settleErr != nil {
+			return 0, settleErr
+		}
+		creditErr := creditGiftCard(
+			tx, redemption.GiftCardId, redemption.AmountCents, GiftCardTransactionRelease, &userId, nil,
+		)
+		if creditErr != nil {
+			return 0, creditErr
+		}
+		released += redemption.AmountCents
+	}
+	if released == 0 {
+		return 0, pgx.ErrNoRows
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return 0, commitErr
+	}
+	logger.Info(fmt.Sprintf("Released %v of gift card %v from user %v's cart", released, code, userId))
+	return released, nil
+}
+
+/*
+ReleaseExpiredGiftCardRedemptions credits back redemptions that have been on a cart for longer
+than GiftCardRedemptionTimeout without an order being placed. Returns the number released.
+*/
+func ReleaseExpiredGiftCardRedemptions(dbPool *pgxpool.Pool, logger *slog.Logger) (int, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return 0, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("ReleaseExpiredGiftCardRedemptions: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	// The lock waits for an order being placed with one of these, which settles it
+	const query = `
+		SELECT * FROM gift_card_transactions
+		WHERE type = 'redeem'
+		AND settled_at IS NULL
+		AND created_at <= $1
+		ORDER BY id
+		FOR UPDATE
+	`
+	rows, queryErr := tx.Query(ctx, query, time.Now().Add(-GiftCardRedemptionTimeout))
+	if queryErr != nil {
+		return 0, queryErr
+	}
+	redemptions, collectErr := pgx.CollectRows(rows, pgx.RowToStructByName[GiftCardTransaction])
+	if collectErr != nil {
+		return 0, collectErr
+	}
+	for _, redemption := range redemptions {
+		settleErr := settleGiftCardRedemption(tx, redemption.Id, nil)
+		if settleErr != nil {
+			return 0, settleErr
+		}
+		creditErr := creditGiftCard(
+			tx, redemption.GiftCardId, -redemption.AmountCents, GiftCardTransactionRelease, redemption.UserId, nil,
+		)
+		if creditErr != nil {
+			return 0, creditErr
+		}
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return 0, commitErr
+	}
+	return len(redemptions), nil
+}
+
+func settleGiftCardRedemption(db DBTX, transactionId int, orderId *int) error {
+	const query = `
+		UPDATE gift_card_transactions
+		SET settled_at = NOW(), order_id = $2
+		WHERE id = $1
+	`
+	_, err := db.Exec(context.Background(), query, transactionId, orderId)
+	return err
+}
+
+/*
+settleGiftCardRedemptions attaches the user's redemptions to their new order, oldest
+first, up to applied. Whatever the order didn't need, e.g. because the cart shrank
+after redeeming, is credited back to its card.
+*/
+func settleGiftCardRedemptions(tx pgx.Tx, userId int, orderId int, redemptions []GiftCardRedemption, applied Cents) error {
+	remaining := applied
+	for _, redemption := range redemptions {
+		settleErr := settleGiftCardRedemption(tx, redemption.Id, &orderId)
+		if settleErr != nil {
+			return settleErr
+		}
+		used := min(redemption.AmountCents, remaining)
+		remaining -= used
+		if unused := redemption.AmountCents - used; unused > 0 {
+			creditErr := creditGiftCard(tx, redemption.GiftCardId, unused, GiftCardTransactionRelease, &userId, &orderId)
+			if creditErr != nil {
+				return creditErr
+			}
+		}
+	}
+	return nil
+}
+
+// orderGiftCardPayment is what's still paid for an order by one gift card, after anything refunded to it
+type orderGiftCardPayment struct {
+	GiftCardId  int   `db:"gift_card_id"`
+	AmountCents Cents `db:"amount_cents"`
+}
+
+// getOrderGiftCardPayments nets each card's ledger entries for the order, in the order the cards were redeemed
+func getOrderGiftCardPayments(db DBTX, orderId int) ([]orderGiftCardPayment, error) {
+	const query = `
+		SELECT gift_card_id, -SUM(amount_cents) AS amount_cents
+		FROM gift_card_transactions
+		WHERE order_id = $1
+		AND settled_at IS NOT NULL
+		GROUP BY gift_card_id
+		HAVING SUM(amount_cents) < 0
+		ORDER BY MIN(id)
+	`
+	rows, err := db.Query(context.Background(), query, orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[orderGiftCardPayment])
+}
+
+/*
+refundOrderGiftCards credits up to amount back onto the cards that paid for the order, in the order
+they were redeemed, and returns what's left to refund some other way
+*/
+func refundOrderGiftCards(tx pgx.Tx, userId int, orderId int, amount Cents) (Cents, error) {
+	payments, paymentsErr := getOrderGiftCardPayments(tx, orderId)
+	if paymentsErr != nil {
+		return 0, paymentsErr
+	}
+	remaining := amount
+	for _, payment := range payments {
+		if remaining == 0 {
+			break
+		}
+		refund := min(payment.AmountCents, remaining)
+		creditErr := creditGiftCard(tx, payment.GiftCardId, refund, GiftCardTransactionRefund, &userId, &orderId)
+		if creditErr != nil {
+			return 0, creditErr
+		}
+		remaining -= refund
+	}
+	return remaining, nil
+}
@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestGenerateGiftCardCode(t *testing.T) {
+	code, err := GenerateGiftCardCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^GC-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{4}$`).MatchString(code) {
+		t.Fatalf("Unexpected gift card code: %v", code)
+	}
+	if NormalizeGiftCardCode(" "+code[:3]+"abcd ") != code[:3]+"ABCD" {
+		t.Fatalf("Codes should be matched case-insensitively")
+	}
+}
+
+func TestGiftCardIsUsable(t *testing.T) {
+	now := time.Now()
+	giftCard := GiftCard{BalanceCents: 500, ExpiresAt: now.Add(time.Hour)}
+	if !giftCard.IsUsable(now) || giftCardUnusableError(giftCard, now) != nil {
+		t.Fatalf("Gift card should be usable: %+v", giftCard)
+	}
+
+	expired := GiftCard{BalanceCents: 500, ExpiresAt: now.Add(-time.Hour)}
+	voided := GiftCard{BalanceCents: 0, ExpiresAt: now.Add(time.Hour), VoidedAt: &now}
+	empty := GiftCard{BalanceCents: 0, ExpiresAt: now.Add(time.Hour)}
+	cases := map[string]GiftCard{
+		ErrorCodeGiftCardExpired:             expired,
+		ErrorCodeGiftCardVoided:              voided,
+		ErrorCodeGiftCardInsufficientBalance: empty,
+	}
+	for errorCode, card := range cases {
+		if card.IsUsable(now) {
+			t.Fatalf("Gift card shouldn't be usable: %+v", card)
+		}
+		unusableErr, _ := giftCardUnusableError(card, now).(*StatusBadRequestError)
+		if unusableErr == nil || unusableErr.ErrorCode != errorCode {
+			t.Fatalf("Expected %v for %+v, got %v", errorCode, card, unusableErr)
+		}
+	}
+}
+
+func TestGiftCardRedemptionAmount(t *testing.T) {
+	cases := []struct {
+		requested, balance, amountDue, expected Cents
+		errorCode                               string
+	}{
+		{0, 2500, 1800, 1800, ""},
+		{0, 1000, 1800, 1000, ""},
+		{500, 1000, 1800, 500, ""},
+		{1200, 1000, 1800, 0, ErrorCodeGiftCardInsufficientBalance},
+		{2000, 5000, 1800, 0, ErrorCodeGiftCardExceedsCart},
+		{0, 1000, 0, 0, ErrorCodeGiftCardExceedsCart},
+	}
+	for _, tc := range cases {
+		amount, errorCode := GiftCardRedemptionAmount(tc.requested, tc.balance, tc.amountDue)
+		if amount != tc.expected || errorCode != tc.errorCode {
+			t.Fatalf("GiftCardRedemptionAmount(%v, %v, %v) = %v, %q", tc.requested, tc.balance, tc.amountDue, amount, errorCode)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package lib
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const GuestCartCookieName = "guestCartId"
+const DefaultGuestCartExpiryDays = 30
+
+// MaxCartItemQuantity is the most of one item a cart line can hold
+const MaxCartItemQuantity = 100
+
+type GuestCart struct {
+	Id        int       `json:"id" db:"id"`
+	Token     string    `json:"token" db:"token"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	UpdatedAt time.Time `json:"updatedAt" db:"updated_at"`
+	ExpiresAt time.Time `json:"expiresAt" db:"expires_at"`
+}
+
+/*
+GuestCarts signs and checks guest cart cookies. The cookie holds the cart token and an
+HMAC of it, so visitors can't pick up someone else's cart by guessing tokens.
+*/
+type GuestCarts struct {
+	secret []byte
+	Expiry time.Duration
+}
+
+func NewGuestCarts(config ConfigGuestCarts) (GuestCarts, error) {
+	if len(config.CookieSecret) == 0 {
+		return GuestCarts{}, errors.New("guestCarts.cookieSecret is not set")
+	}
+	expiryDays := config.ExpiryDays
+	if expiryDays <= 0 {
+		expiryDays = DefaultGuestCartExpiryDays
+	}
+	return GuestCarts{
+		secret: []byte(config.CookieSecret),
+		Expiry: time.Duration(expiryDays) * 24 * time.Hour,
+	}, nil
+}
+
+func (g GuestCarts) sign(token string) string {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CookieValue returns the signed cookie value for a cart token
+func (g GuestCarts) CookieValue(token string) string {
+	return fmt.Sprintf("%s.%s", token, g.sign(token))
+}
+
+// TokenFromCookieValue returns the cart token, or false if the cookie wasn't signed by us
+func (g GuestCarts) TokenFromCookieValue(cookieValue string) (string, bool) {
+	token, signature, found := strings.Cut(cookieValue, ".")
+	if !found || len(token) == 0 {
+		return "", false
+	}
+	if !hmac.Equal([]byte(signature), []byte(g.sign(token))) {
+		return "", false
+	}
+	if _, parseErr := uuid.Parse(token); parseErr != nil {
+		return "", false
+	}
+	return token, true
+}
+
+// GetGuestCartByToken returns pgx.ErrNoRows if there's no unexpired cart for token
+func GetGuestCartByToken(dbPool *pgxpool.Pool, token string) (GuestCart, error) {
+	return getGuestCartByToken(dbPool, token, "")
+}
+
+func getGuestCartByToken(db DBTX, token string, lockClause string) (GuestCart, error) {
+	query := `
+		SELECT id, token::text AS token, created_at, updated_at, expires_at
+		FROM guest_carts
+		WHERE token = $1
+		AND expires_at > NOW()` + lockClause
+	rows, err := db.Query(context.Background(), query, token)
+	if err != nil {
+		return GuestCart{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[GuestCart])
+}
+
+func AddGuestCart(dbPool *pgxpool.Pool, expiry time.Duration) (GuestCart, error) {
+	token, tokenErr := uuid.NewRandom()
+	if tokenErr != nil {
+		return GuestCart{}, tokenErr
+	}
+	const query = `
+		INSERT INTO guest_carts (token, created_at, updated_at, expires_at)
+		VALUES ($1, NOW(), NOW(), $2)
+		RETURNING id, token::text AS token, created_at, updated_at, expires_at
+	`
+	rows, err := dbPool.Query(context.Background(), query, token.String(), time.Now().Add(expiry))
+	if err != nil {
+		return GuestCart{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[GuestCart])
+}
+
+// touchGuestCart pushes the cart's expiry back, since it's still in use
+func touchGuestCart(db DBTX, guestCartId int, expiry time.Duration) error {
+	const query = `
+		UPDATE guest_carts
+		SET updated_at = NOW(), expires_at = $2
+		WHERE id = $1
+	`
+	_, err := db.Exec(context.Background(), query, guestCartId, time.Now().Add(expiry))
+	return err
+}
+
+// GetGuestCartItems returns the lines as CartItems, with no user, so they can be priced like a user cart
+func GetGuestCartItems(dbPool *pgxpool.Pool, guestCartId int) ([]CartItem, error) {
+	return getGuestCartItems(dbPool, guestCartId)
+}
+
+func getGuestCartItems(db DBTX, guestCartId int) ([]CartItem, error) {
+	const query = `
+		SELECT gci.id,
+		       gci.inventory_item_id,
+		       gci.variant_id,
+		       0 AS user_id,
+		       gci.quantity,
+		       gci.created_at,
+		       gci.updated_at,` + cartItemColumns + `
+		FROM guest_cart_items gci
+		JOIN inventory_item_variants v ON gci.variant_id = v.id
+		JOIN inventories i ON gci.inventory_item_id = i.id
+		WHERE gci.guest_cart_id = $1
+		ORDER BY gci.updated_at, gci.created_at DESC`
+	rows, err := db.Query(context.Background(), query, guestCartId)
+	if err != nil {
+		return nil, err
+	}
+	cartItems, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[CartItem])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+	componentsErr := addBundleComponents(db, cartItems)
+	if componentsErr != nil {
+		return nil, componentsErr
+	}
+	return cartItems, nil
+}
+
+/*
+UpdateGuestCart follows the same rules as UpdateCart: the line goes up by one, or to
+req.Quantity when OverrideQuantity is set, as long as there's stock for it.
+*/
+func UpdateGuestCart(
+	dbPool *pgxpool.Pool, logger *slog.Logger, guestCarts GuestCarts, guestCartId int, req AddCartItemRequest,
+) error {
+	variant, variantErr := resolveVariant(dbPool, req.InventoryItemId, req.VariantId)
+	if variantErr != nil {
+		return variantErr
+	}
+	if req.Quantity < 1 || req.Quantity > MaxCartItemQuantity {
+		return fmt.Errorf("quantity must be between 1 and %d: %v", MaxCartItemQuantity, req.Quantity)
+	}
+
+	var existingQuantity int
+	const existingQuery = `
+		SELECT COALESCE(
+			(SELECT quantity FROM guest_cart_items WHERE guest_cart_id = $1 AND variant_id = $2), 0
+		)
+	`
+	existingErr := dbPool.QueryRow(context.Background(), existingQuery, guestCartId, variant.Id).
+		Scan(&existingQuantity)
+	if existingErr != nil {
+		return existingErr
+	}
+
+	quantity := existingQuantity + 1
+	if req.OverrideQuantity {
+		quantity = req.Quantity
+	}
+
+	stockErr := CheckStockAvailable(dbPool, variant.Id, 0, quantity)
+	if stockErr != nil {
+		return stockErr
+	}
+
+	logger.Info(fmt.Sprintf("Setting guest cart %v variant %v to quantity %v", guestCartId, variant.Id, quantity))
+	const query = `
+		INSERT INTO guest_cart_items (guest_cart_id, inventory_item_id, variant_id, quantity, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (guest_cart_id, variant_id)
+		    DO UPDATE SET quantity = $4, updated_at = NOW()
+	`
+	_, err := dbPool.Exec(context.Background(), query, guestCartId, variant.InventoryItemId, variant.Id, quantity)
+	if err != nil {
+		return err
+	}
+	return touchGuestCart(dbPool, guestCartId, guestCarts.Expiry)
+}
+
+// DeleteGuestCartItem follows DeleteCartItem: without a VariantId every variant of the item goes
+func DeleteGuestCartItem(dbPool *pgxpool.Pool, guestCartId int, req DeleteCartItemRequest) error {
+	const query = `
+		DELETE FROM guest_cart_items
+		WHERE guest_cart_id = $1
+		AND (variant_id = $2 OR ($2 = 0 AND inventory_item_id = $3))
+	`
+	_, err := dbPool.Exec(context.Background(), query, guestCartId, req.VariantId, req.InventoryItemId)
+	return err
+}
+
+/*
+MergeCartQuantity is the quantity a user's line ends up with when a guest line for the
+same variant is merged into it: the two added together, capped at MaxCartItemQuantity and
+at the stock available. The user's own quantity is never reduced by the merge.
+*/
+func MergeCartQuantity(userQuantity int, guestQuantity int, available int) int {
+	merged := min(userQuantity+guestQuantity, MaxCartItemQuantity, available)
+	return max(merged, userQuantity)
+}
+
+/*
+MergeGuestCart
+ 1. Lock the guest cart so a concurrent sign-in can't merge it twice
+ 2. Add each guest line to the user's cart, following MergeCartQuantity
+ 3. Delete the guest cart
+
+Returns the number of lines that changed the user's cart. A missing or expired guest
+cart merges nothing.
+*/
+func MergeGuestCart(dbPool *pgxpool.Pool, logger *slog.Logger, token string, userId int) (int, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return 0, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("MergeGuestCart: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	guestCart, guestCartErr := getGuestCartByToken(tx, token, "\n\t\tFOR UPDATE")
+	if errors.Is(guestCartErr, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if guestCartErr != nil {
+		return 0, guestCartErr
+	}
+
+	guestCartItems, guestCartItemsErr := getGuestCartItems(tx, guestCart.Id)
+	if guestCartItemsErr != nil {
+		return 0, guestCartItemsErr
+	}
+	userCartItems, userCartItemsErr := getCartItemsForUpdate(tx, userId)
+	if userCartItemsErr != nil {
+		return 0, userCartItemsErr
+	}
+	userQuantities := make(map[int]int, len(userCartItems))
+	for _, userCartItem := range userCartItems {
+		userQuantities[userCartItem.VariantId] = userCartItem.Quantity
+	}
+
+	merged := 0
+	for _, guestCartItem := range guestCartItems {
+		available, availableErr := getAvailableStock(tx, guestCartItem.VariantId, userId)
+		if availableErr != nil {
+			return 0, availableErr
+		}
+		availableQuantity := MaxCartItemQuantity
+		if available != nil {
+			availableQuantity = *available
+		}
+		userQuantity := userQuantities[guestCartItem.VariantId]
+		quantity := MergeCartQuantity(userQuantity, guestCartItem.Quantity, availableQuantity)
+		if quantity == userQuantity {
+			continue
+		}
+		const query = `
+			INSERT INTO cart_items (quantity, inventory_item_id, variant_id, user_id, created_at)
+			VALUES ($1, $2, $3, $4, NOW())
+			ON CONFLICT (user_id, variant_id)
+			    DO UPDATE SET quantity = $1, updated_at = NOW()
+		`
+		_, upsertErr := tx.Exec(ctx, query, quantity, guestCartItem.InventoryItemId, guestCartItem.VariantId, userId)
+		if upsertErr != nil {
+			return 0, upsertErr
+		}
+		merged++
+	}
+
+	_, deleteErr := tx.Exec(ctx, `DELETE FROM guest_carts WHERE id = $1`, guestCart.Id)
+	if deleteErr != nil {
+		return 0, deleteErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return 0, commitErr
+	}
+	logger.Info(fmt.Sprintf("Merged %v of %v guest cart lines into user %v's cart", merged, len(guestCartItems), userId))
+	return merged, nil
+}
+
+// DeleteExpiredGuestCarts removes guest carts past their expiry, along with their lines
+func DeleteExpiredGuestCarts(dbPool *pgxpool.Pool) (int64, error) {
+	const query = `DELETE FROM guest_carts WHERE expires_at <= NOW()`
+	result, err := dbPool.Exec(context.Background(), query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
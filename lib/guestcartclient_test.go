@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGuestCartCookieSigning(t *testing.T) {
+	guestCarts, err := NewGuestCarts(ConfigGuestCarts{CookieSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const token = "4f1c2b7e-8a3d-4c6b-9e2f-1a2b3c4d5e6f"
+	cookieValue := guestCarts.CookieValue(token)
+	if parsed, ok := guestCarts.TokenFromCookieValue(cookieValue); !ok || parsed != token {
+		t.Fatalf("Expected the signed cookie to verify: %v %v", parsed, ok)
+	}
+
+	otherGuestCarts, _ := NewGuestCarts(ConfigGuestCarts{CookieSecret: "other-secret"})
+	if _, ok := otherGuestCarts.TokenFromCookieValue(cookieValue); ok {
+		t.Fatal("A cookie signed with another secret should be rejected")
+	}
+	tampered := strings.Replace(cookieValue, "4f1c", "5f1c", 1)
+	if _, ok := guestCarts.TokenFromCookieValue(tampered); ok {
+		t.Fatal("A tampered token should be rejected")
+	}
+	if _, ok := guestCarts.TokenFromCookieValue(token); ok {
+		t.Fatal("An unsigned token should be rejected")
+	}
+
+	if _, err = NewGuestCarts(ConfigGuestCarts{}); err == nil {
+		t.Fatal("A missing cookie secret should be rejected")
+	}
+	if guestCarts.Expiry.Hours() != DefaultGuestCartExpiryDays*24 {
+		t.Fatalf("Expected the default expiry, got %v", guestCarts.Expiry)
+	}
+}
+
+func TestMergeCartQuantity(t *testing.T) {
+	if quantity := MergeCartQuantity(2, 3, 50); quantity != 5 {
+		t.Fatalf("Guest and user quantities should be added, got %v", quantity)
+	}
+	if quantity := MergeCartQuantity(0, 10, 4); quantity != 4 {
+		t.Fatalf("Merged quantity should be capped at the stock available, got %v", quantity)
+	}
+	if quantity := MergeCartQuantity(60, 60, 500); quantity != MaxCartItemQuantity {
+		t.Fatalf("Merged quantity should be capped at the line maximum, got %v", quantity)
+	}
+	if quantity := MergeCartQuantity(5, 2, 3); quantity != 5 {
+		t.Fatalf("The user's own quantity shouldn't be reduced, got %v", quantity)
+	}
+	if quantity := MergeCartQuantity(0, 2, 0); quantity != 0 {
+		t.Fatalf("Out of stock guest lines shouldn't be merged, got %v", quantity)
+	}
+}
@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Reviews rated above this pull the heat profile towards the heat the user felt, more so the higher
+// the rating. Reviews rated at or below it say nothing about what the user enjoys.
+const heatProfileNeutralRating = 2
+
+// HeatProfile - how hot the user likes it, from the heat they felt in items they enjoyed and the
+// heat of items they've ordered or put in their cart
+type HeatProfile struct {
+	// PreferredSpiceRating is nil until there's something to go on
+	PreferredSpiceRating      *float32   `json:"preferredSpiceRating"`
+	HottestEnjoyedSpiceRating *int       `json:"hottestEnjoyedSpiceRating"`
+	ReviewCount               int        `json:"reviewCount"`
+	ItemCount                 int        `json:"itemCount"`
+	ResetAt                   *time.Time `json:"resetAt"`
+}
+
+// heatSignal - a review, or an item ordered or in the cart when Rating is nil
+type heatSignal struct {
+	SpiceRating int  `db:"spice_rating"`
+	Rating      *int `db:"rating"`
+}
+
+func calculateHeatProfile(signals []heatSignal) HeatProfile {
+	var profile HeatProfile
+	var weightedSpice, totalWeight int
+	for _, signal := range signals {
+		weight := 1
+		if signal.Rating != nil {
+			profile.ReviewCount++
+			weight = max(*signal.Rating-heatProfileNeutralRating, 0)
+			if *signal.Rating >= RecommendationLikeRating &&
+				(profile.HottestEnjoyedSpiceRating == nil || signal.SpiceRating > *profile.HottestEnjoyedSpiceRating) {
+				hottest := signal.SpiceRating
+				profile.HottestEnjoyedSpiceRating = &hottest
+			}
+		} else {
+			profile.ItemCount++
+		}
+		weightedSpice += signal.SpiceRating * weight
+		totalWeight += weight
+	}
+	if totalWeight > 0 {
+		preferred := float32(math.Round(float64(weightedSpice)/float64(totalWeight)*10) / 10)
+		profile.PreferredSpiceRating = &preferred
+	}
+	return profile
+}
+
+// GetHeatProfile works out the user's heat profile from what they've done since it was last reset.
+// Cancelled orders don't count.
+func GetHeatProfile(dbPool *pgxpool.Pool, userId int) (HeatProfile, error) {
+	ctx := context.Background()
+	var resetAt *time.Time
+	resetErr := dbPool.QueryRow(
+		ctx, `SELECT reset_at FROM heat_profile_resets WHERE user_id = $1`, userId,
+	).Scan(&resetAt)
+	if resetErr != nil && !errors.Is(resetErr, pgx.ErrNoRows) {
+		return HeatProfile{}, resetErr
+	}
+
+	const query = `
+		SELECT r.spice_rating, r.rating
+		FROM inventory_item_reviews r
+		WHERE r.user_id = $1
+		AND r.created_at > COALESCE($2::TIMESTAMPTZ, '-infinity')
+		UNION ALL
+		SELECT i.spice_rating, NULL
+		FROM (
+			SELECT oi.inventory_item_id
+			FROM order_items oi
+			JOIN orders o ON o.id = oi.order_id
+			WHERE o.user_id = $1
+			AND o.status <> $3
+			AND o.created_at > COALESCE($2::TIMESTAMPTZ, '-infinity')
+			UNION
+			SELECT ci.inventory_item_id
+			FROM cart_items ci
+			WHERE ci.user_id = $1
+			AND ci.created_at > COALESCE($2::TIMESTAMPTZ, '-infinity')
+		) items
+		JOIN inventories i ON i.id = items.inventory_item_id
+	`
+	rows, err := dbPool.Query(ctx, query, userId, resetAt, OrderStatusCancelled)
+	if err != nil {
+		return HeatProfile{}, err
+	}
+	signals, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[heatSignal])
+	if collectRowsErr != nil {
+		return HeatProfile{}, collectRowsErr
+	}
+
+	profile := calculateHeatProfile(signals)
+	profile.ResetAt = resetAt
+	return profile, nil
+}
+
+// ResetHeatProfile starts the user's heat profile again from now
+func ResetHeatProfile(dbPool *pgxpool.Pool, userId int) error {
+	const query = `
+		INSERT INTO heat_profile_resets (user_id, reset_at)
+		VALUES ($1, NOW())
+		ON CONFLICT (user_id) DO UPDATE SET reset_at = NOW()
+	`
+	_, err := dbPool.Exec(context.Background(), query, userId)
+	return err
+}
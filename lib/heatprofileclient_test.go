@@ -0,0 +1,33 @@
+package lib
+
+import "testing"
+
+func TestCalculateHeatProfile(t *testing.T) {
+	empty := calculateHeatProfile(nil)
+	if empty.PreferredSpiceRating != nil || empty.HottestEnjoyedSpiceRating != nil {
+		t.Fatalf("Expected no preference without reviews or items, got %+v", empty)
+	}
+
+	loved, liked, disliked := 5, 4, 1
+	profile := calculateHeatProfile([]heatSignal{
+		{SpiceRating: 4, Rating: &loved},
+		{SpiceRating: 5, Rating: &liked},
+		{SpiceRating: 1, Rating: &disliked},
+		{SpiceRating: 2},
+	})
+	if profile.ReviewCount != 3 || profile.ItemCount != 1 {
+		t.Fatalf("Expected 3 reviews and 1 item, got %+v", profile)
+	}
+	// (4*3 + 5*2 + 2*1) / (3 + 2 + 1); the disliked review doesn't count
+	if profile.PreferredSpiceRating == nil || *profile.PreferredSpiceRating != 4 {
+		t.Fatalf("Expected a preferred spice rating of 4, got %v", profile.PreferredSpiceRating)
+	}
+	if profile.HottestEnjoyedSpiceRating == nil || *profile.HottestEnjoyedSpiceRating != 5 {
+		t.Fatalf("Expected the hottest enjoyed spice rating to be 5, got %v", profile.HottestEnjoyedSpiceRating)
+	}
+
+	onlyDisliked := calculateHeatProfile([]heatSignal{{SpiceRating: 5, Rating: &disliked}})
+	if onlyDisliked.PreferredSpiceRating != nil {
+		t.Fatalf("Expected no preference from disliked reviews alone, got %v", *onlyDisliked.PreferredSpiceRating)
+	}
+}
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -24,14 +25,37 @@ type InventoryItem struct {
 	ShortDescription   string     `json:"shortDescription" db:"short_description"`
 	Slug               string     `json:"slug" db:"slug"`
 	Price              float32    `json:"price" db:"price"`
+	OriginalPrice      float32    `json:"originalPrice" db:"original_price"`
+	SalePrice          *float32   `json:"salePrice" db:"sale_price"`
+	SaleEndsAt         *time.Time `json:"saleEndsAt" db:"sale_ends_at"`
+	MinPrice           float32    `json:"minPrice" db:"min_price"`
+	MaxPrice           float32    `json:"maxPrice" db:"max_price"`
+	IsBundle           bool       `json:"isBundle" db:"is_bundle"`
+	BundleSavings      float32    `json:"bundleSavings" db:"bundle_savings"`
 	SpiceRating        int        `json:"spiceRating" db:"spice_rating"`
 	CreatedAt          time.Time  `json:"createdAt" db:"created_at"`
 	UpdatedAt          *time.Time `json:"updatedAt" db:"updated_at"`
 	ReviewCount        int        `json:"reviewCount" db:"review_count"`
 	AverageRating      *float32   `json:"averageRating" db:"average_rating"`
 	AverageSpiceRating *float32   `json:"averageSpiceRating" db:"average_spice_rating"`
+	// StockQuantity and StockRemaining are nil when the item's stock isn't tracked
+	StockQuantity  *int `json:"stockQuantity" db:"stock_quantity"`
+	StockRemaining *int `json:"stockRemaining" db:"stock_remaining"`
+	InStock        bool `json:"inStock" db:"in_stock"`
+	// The primary image's thumbnail, if the item has images
+	ThumbnailFilename *string `json:"thumbnailFilename" db:"thumbnail_filename"`
+	ThumbnailWidth    *int    `json:"thumbnailWidth" db:"thumbnail_width"`
+	ThumbnailHeight   *int    `json:"thumbnailHeight" db:"thumbnail_height"`
 }
 
+// priceRangeColumns - the cheapest and dearest variant as they sell now, for use in inventory item queries aliased as "i"
+const priceRangeColumns = `COALESCE(
+		       	(SELECT MIN(` + variantEffectivePriceColumn + `)
+		       	 FROM inventory_item_variants v WHERE v.inventory_item_id = i.id), i.price) AS min_price,
+		       COALESCE(
+		       	(SELECT MAX(` + variantEffectivePriceColumn + `)
+		       	 FROM inventory_item_variants v WHERE v.inventory_item_id = i.id), i.price) AS max_price`
+
 type ProductAutocompleteSuggestion struct {
 	Name string `json:"name"`
 	Slug string `json:"slug"`
@@ -49,6 +73,8 @@ type InventoryItemUpdateRequest struct {
 	TagIds           []int   `json:"tagIds"`
 	Description      string  `json:"description" validate:"required,min=3,max=1000000"`
 	ShortDescription string  `json:"shortDescription" validate:"required,min=3,max=1000"`
+	// Stock is left alone when omitted. Price and stock are the item's default variant's.
+	StockQuantity *int `json:"stockQuantity" validate:"omitempty,min=0,max=1000000"`
 }
 
 type PaginationData struct {
@@ -56,7 +82,42 @@ type PaginationData struct {
 	Offset  int `json:"limit"`
 }
 
+// AddOrUpdateInventoryItem also creates the item's default variant, or updates its price, in the same
+// transaction, and fires any price alerts the new price is below
 func AddOrUpdateInventoryItem(dbPool *pgxpool.Pool, logger *slog.Logger, inventoryItem InventoryItem) (int, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		logger.Error(fmt.Sprintf("AddOrUpdateInventoryItem: Error starting transaction: %v", beginErr))
+		return 0, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("AddOrUpdateInventoryItem: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	id, saveErr := addOrUpdateInventoryItem(tx, logger, inventoryItem)
+	if saveErr != nil {
+		return 0, saveErr
+	}
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		logger.Error(fmt.Sprintf("AddOrUpdateInventoryItem: Error committing: %v", commitErr))
+		return 0, commitErr
+	}
+
+	// The item is saved either way; alerts that don't fire now are checked again on the next save
+	_, alertsErr := TriggerPriceAlerts(dbPool, logger, id)
+	if alertsErr != nil {
+		logger.Error(fmt.Sprintf("AddOrUpdateInventoryItem: Error triggering price alerts: %v", alertsErr))
+	}
+	return id, nil
+}
+
+// addOrUpdateInventoryItem is AddOrUpdateInventoryItem without the transaction or price alerts
+func addOrUpdateInventoryItem(db DBTX, logger *slog.Logger, inventoryItem InventoryItem) (int, error) {
 	const query = `
 		INSERT INTO inventories (
 			name,
@@ -74,7 +135,7 @@ func AddOrUpdateInventoryItem(dbPool *pgxpool.Pool, logger *slog.Logger, invento
 		RETURNING id
 	`
 	var id int
-	err := dbPool.QueryRow(
+	err := db.QueryRow(
 		context.Background(),
 		query,
 		inventoryItem.Name,
@@ -88,12 +149,46 @@ func AddOrUpdateInventoryItem(dbPool *pgxpool.Pool, logger *slog.Logger, invento
 		logger.Error(fmt.Sprintf("AddOrUpdateInventoryItem: Error adding/updating inventory item: %v", err))
 		return 0, err
 	}
+
+	variantErr := saveDefaultVariant(db, id, inventoryItem.Slug, inventoryItem.Price)
+	if variantErr != nil {
+		logger.Error(fmt.Sprintf("AddOrUpdateInventoryItem: Error saving default variant: %v", variantErr))
+		return 0, variantErr
+	}
+	historyErr := recordPriceHistory(db, id)
+	if historyErr != nil {
+		logger.Error(fmt.Sprintf("AddOrUpdateInventoryItem: Error recording price history: %v", historyErr))
+		return 0, historyErr
+	}
 	return id, nil
 }
 
+// inventoryItemColumns - the columns of InventoryItem, for use in inventory item queries aliased as "i" with itemSaleJoin
+var inventoryItemColumns = `i.id,
+		       i.name,
+		       i.description,
+		       i.short_description,
+		       i.slug,
+		       ` + itemPriceColumns + `,
+		       ` + priceRangeColumns + `,
+		       ` + bundleColumns + `,
+		       i.created_at,
+		       i.updated_at,
+		       i.spice_rating,
+		       (SELECT COUNT(*)
+		        FROM inventory_item_reviews WHERE inventory_item_id = i.id) AS review_count,
+		       COALESCE((SELECT AVG(rating)
+		                 FROM inventory_item_reviews WHERE inventory_item_id = i.id), 0) AS average_rating,
+		       COALESCE(
+		       	(SELECT AVG(inventory_item_reviews.spice_rating)
+		       	 FROM inventory_item_reviews WHERE inventory_item_id = i.id), 0) AS average_spice_rating,
+		       ` + stockQuantityColumn + ` AS stock_quantity,
+		       ` + stockRemainingColumn + ` AS stock_remaining,
+		       ` + inStockSql(stockRemainingColumn) + ` AS in_stock,
+		       ` + primaryImageColumns
+
 func GetInventoryItemsOrderedBySortKey(
-	dbPool *pgxpool.Pool, logger *slog.Logger, limit int, offset int, sort string,
-	tagIds []int,
+	dbPool *pgxpool.Pool, logger *slog.Logger, limit int, offset int, sort string, filters ProductFilters,
 ) ([]InventoryItem, error) {
 	// Sort is validated at endpoint
 	direction := "ASC"
@@ -101,49 +196,34 @@ func GetInventoryItemsOrderedBySortKey(
 	if slices.Contains(descSorts, sort) {
 		direction = "DESC"
 	}
-	sortClause := fmt.Sprintf("ORDER BY %s %s\n", sort, direction)
+	sortClause := fmt.Sprintf("ORDER BY %s %s, id\n", sort, direction)
+	whereClause, args := getProductFiltersClause(filters)
+	return getFilteredInventoryItems(dbPool, logger, limit, offset, whereClause, sortClause, args)
+}
+
+// GetInventoryItemsForHeatProfile lists items nearest the preferred spice rating first, best rated first among equals
+func GetInventoryItemsForHeatProfile(
+	dbPool *pgxpool.Pool, logger *slog.Logger, limit int, offset int, preferredSpiceRating float32,
+	filters ProductFilters,
+) ([]InventoryItem, error) {
+	whereClause, args := getProductFiltersClause(filters)
+	args = append(args, preferredSpiceRating)
+	sortClause := fmt.Sprintf("ORDER BY ABS(spice_rating - $%d::REAL), average_rating DESC, id\n", len(args))
+	return getFilteredInventoryItems(dbPool, logger, limit, offset, whereClause, sortClause, args)
+}
+
+func getFilteredInventoryItems(
+	dbPool *pgxpool.Pool, logger *slog.Logger, limit int, offset int, whereClause string, sortClause string,
+	args []any,
+) ([]InventoryItem, error) {
 	offsetClause := fmt.Sprintf("OFFSET %d\n", offset)
 	limitClause := ""
 	if limit > 0 {
 		limitClause = fmt.Sprintf("LIMIT %d\n", limit)
 	}
 
-	// Converted to int in controller area first
-	tagIdsClause := ""
-	tagIdsJoinClause := ""
-	if len(tagIds) > 0 {
-		tagIdsClause = "AND it.tag_id = ANY($1)\n"
-		tagIdsJoinClause = "JOIN inventory_tags it ON i.id = it.inventory_id\n"
-	}
-
-	query := `
-		SELECT i.id,
-		       i.name, 
-		       i.description,
-		       i.short_description,
-		       i.slug,
-		       i.price,
-		       i.created_at,
-		       i.updated_at,
-		       i.spice_rating,
-		       (SELECT COUNT(*) 
-		        FROM inventory_item_reviews WHERE inventory_item_id = i.id) AS review_count,
-		       COALESCE((SELECT AVG(rating) 
-		                 FROM inventory_item_reviews WHERE inventory_item_id = i.id), 0) AS average_rating,
-		       COALESCE(
-		       	(SELECT AVG(inventory_item_reviews.spice_rating) 
-		       	 FROM inventory_item_reviews WHERE inventory_item_id = i.id), 0) AS average_spice_rating
-		FROM inventories i
-	` + tagIdsJoinClause + `
-		WHERE 1=1
-	` + tagIdsClause + sortClause + limitClause + offsetClause
-	var rows pgx.Rows
-	var err error
-	if len(tagIdsClause) > 0 {
-		rows, err = dbPool.Query(context.Background(), query, tagIds)
-	} else {
-		rows, err = dbPool.Query(context.Background(), query)
-	}
+	query := filteredItemsQuery(whereClause) + sortClause + limitClause + offsetClause
+	rows, err := dbPool.Query(context.Background(), query, args...)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error running inventory item query: %v", err))
 		return nil, err
@@ -156,8 +236,12 @@ func GetInventoryItemsOrderedBySortKey(
 }
 
 func DeleteInventoryItemTags(dbPool *pgxpool.Pool, logger *slog.Logger, inventoryItemId int, tagIds []int) (bool, error) {
+	return deleteInventoryItemTags(dbPool, logger, inventoryItemId, tagIds)
+}
+
+func deleteInventoryItemTags(db DBTX, logger *slog.Logger, inventoryItemId int, tagIds []int) (bool, error) {
 	const query = `DELETE FROM inventory_tags WHERE inventory_id = $1 AND tag_id = ANY($2)`
-	_, err := dbPool.Exec(context.Background(), query, inventoryItemId, tagIds)
+	_, err := db.Exec(context.Background(), query, inventoryItemId, tagIds)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error deleting inventory item tags: %v", err))
 		return false, err
@@ -166,18 +250,22 @@ func DeleteInventoryItemTags(dbPool *pgxpool.Pool, logger *slog.Logger, inventor
 }
 
 func UpdateInventoryItemTags(dbPool *pgxpool.Pool, logger *slog.Logger, inventoryItemId int, tagIds []int) (bool, error) {
+	return updateInventoryItemTags(dbPool, logger, inventoryItemId, tagIds)
+}
+
+func updateInventoryItemTags(db DBTX, logger *slog.Logger, inventoryItemId int, tagIds []int) (bool, error) {
 	if len(tagIds) == 0 {
 		logger.Info("No tags provided for item, not updating tags")
 		return true, nil
 	}
 
-	_, deleteErr := DeleteInventoryItemTags(dbPool, logger, inventoryItemId, tagIds)
+	_, deleteErr := deleteInventoryItemTags(db, logger, inventoryItemId, tagIds)
 	if deleteErr != nil {
 		return false, deleteErr
 	}
 	for _, tagId := range tagIds {
 		const query = `INSERT INTO inventory_tags (inventory_id, tag_id) VALUES ($1, $2)`
-		_, insertTagsErr := dbPool.Exec(context.Background(), query, inventoryItemId, tagId)
+		_, insertTagsErr := db.Exec(context.Background(), query, inventoryItemId, tagId)
 		if insertTagsErr != nil {
 			return false, insertTagsErr
 		}
@@ -188,15 +276,19 @@ func UpdateInventoryItemTags(dbPool *pgxpool.Pool, logger *slog.Logger, inventor
 	return true, nil
 }
 
+// GetAutocompleteSuggestions matches what's typed so far against the search index, so the last word
+// can be incomplete and misspellings still find products
 func GetAutocompleteSuggestions(dbPool *pgxpool.Pool, logger *slog.Logger, searchQuery string) ([]ProductAutocompleteSuggestion, error) {
 	const query = `
-		SELECT name, slug
-		FROM inventories
-		WHERE name ILIKE '%' || $1 || '%'
-		ORDER BY name
+		SELECT i.name, i.slug
+		FROM inventories i
+		WHERE i.search_vector @@ TO_TSQUERY('english', $1)
+		OR LOWER($2) <% i.search_text
+		ORDER BY TS_RANK_CD(i.search_vector, TO_TSQUERY('english', $1)) + WORD_SIMILARITY(LOWER($2), i.search_text) DESC,
+		         i.name
 		LIMIT 10
 	`
-	rows, err := dbPool.Query(context.Background(), query, searchQuery)
+	rows, err := dbPool.Query(context.Background(), query, prefixTsQuery(searchQuery), searchQuery)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error running inventory item query: %v", err))
 		return nil, err
@@ -233,22 +325,10 @@ func GetInventoryItemTags(dbPool *pgxpool.Pool, logger *slog.Logger, inventoryIt
 }
 
 func GetInventoryItemBySlug(dbPool *pgxpool.Pool, slug string) (InventoryItem, error) {
-	const query = `
-		SELECT
-			id,
-		   	name, 
-		   	description,
-		   	short_description,
-		   	slug,
-		   	price,
-		   	created_at,
-		   	updated_at,
-		   	spice_rating,
-		   	(SELECT COUNT(*) FROM inventory_item_reviews WHERE inventory_item_id = i.id) AS review_count,
-			COALESCE((SELECT AVG(rating) FROM inventory_item_reviews WHERE inventory_item_id = i.id), 0) AS average_rating,
-			COALESCE((SELECT AVG(inventory_item_reviews.spice_rating) FROM inventory_item_reviews WHERE inventory_item_id = i.id), 0) AS average_spice_rating
-		FROM inventories i
-		WHERE slug = $1
+	query := `
+		SELECT ` + inventoryItemColumns + `
+		FROM inventories i` + itemSaleJoin + `
+		WHERE i.slug = $1
 	`
 	inventoryItem := InventoryItem{}
 	rows, err := dbPool.Query(context.Background(), query, slug)
@@ -303,13 +383,12 @@ func InventoryItemExists(dbPool *pgxpool.Pool, id int) (bool, error) {
 	return true, nil
 }
 
-func GetTotalInventoryItems(dbPool *pgxpool.Pool) (int32, error) {
-	const query = `
-		SELECT COUNT(*)
-		FROM inventories
-	`
+// GetTotalInventoryItems counts the items matching the filters
+func GetTotalInventoryItems(dbPool *pgxpool.Pool, filters ProductFilters) (int32, error) {
+	whereClause, args := getProductFiltersClause(filters)
+	query := `SELECT COUNT(*) FROM (` + filteredItemsQuery(whereClause) + `) filtered`
 	var count int32
-	err := dbPool.QueryRow(context.Background(), query).Scan(&count)
+	err := dbPool.QueryRow(context.Background(), query, args...).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
@@ -378,9 +457,7 @@ func ValidateInventoryItemAddOrUpdateRequest(
 	return itemUpdateRequest, nil
 }
 
-func SaveInventoryItem(
-	dbPool *pgxpool.Pool, logger *slog.Logger, itemUpdateRequest InventoryItemUpdateRequest,
-) (int, error) {
+func inventoryItemFromUpdateRequest(itemUpdateRequest InventoryItemUpdateRequest) InventoryItem {
 	var item InventoryItem
 	item.Name = itemUpdateRequest.Name
 	item.Price = itemUpdateRequest.Price
@@ -388,7 +465,13 @@ func SaveInventoryItem(
 	item.Description = itemUpdateRequest.Description
 	item.ShortDescription = itemUpdateRequest.ShortDescription
 	item.Slug = slug.Make(itemUpdateRequest.Name)
+	return item
+}
 
+func SaveInventoryItem(
+	dbPool *pgxpool.Pool, logger *slog.Logger, itemUpdateRequest InventoryItemUpdateRequest,
+) (int, error) {
+	item := inventoryItemFromUpdateRequest(itemUpdateRequest)
 	logger.Info(fmt.Sprintf("Saving inventory item: %+v", item))
 
 	itemId, addUpdateItemErr := AddOrUpdateInventoryItem(dbPool, logger, item)
@@ -399,3 +482,11 @@ func SaveInventoryItem(
 
 	return itemId, nil
 }
+
+// saveInventoryItem is SaveInventoryItem in the caller's transaction. The caller triggers price alerts
+// once it's committed.
+func saveInventoryItem(db DBTX, logger *slog.Logger, itemUpdateRequest InventoryItemUpdateRequest) (int, error) {
+	item := inventoryItemFromUpdateRequest(itemUpdateRequest)
+	logger.Info(fmt.Sprintf("Saving inventory item: %+v", item))
+	return addOrUpdateInventoryItem(db, logger, item)
+}
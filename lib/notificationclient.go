@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const WebsocketMessageTypeNotification = "notification"
+
+// NotificationsLimit is how many of a user's most recent notifications are listed
+const NotificationsLimit = 100
+
+type Notification struct {
+	Id        int            `json:"id" db:"id"`
+	UserId    int            `json:"userId" db:"user_id"`
+	Type      string         `json:"type" db:"type"`
+	Message   string         `json:"message" db:"message"`
+	Data      map[string]any `json:"data" db:"data"`
+	ReadAt    *time.Time     `json:"readAt" db:"read_at"`
+	CreatedAt time.Time      `json:"createdAt" db:"created_at"`
+}
+
+// addNotification stores a notification so it can be listed after it's been sent
+func addNotification(
+	db DBTX, userId int, notificationType string, message string, data map[string]any,
+) (Notification, error) {
+	const query = `
+		INSERT INTO notifications (user_id, type, message, data, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		RETURNING *
+	`
+	rows, err := db.Query(context.Background(), query, userId, notificationType, message, data)
+	if err != nil {
+		return Notification{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Notification])
+}
+
+// SendNotification pushes a stored notification to its user's open connections
+func SendNotification(notification Notification, logger *slog.Logger) error {
+	return SendWebsocketMessageToUser(notification.UserId, WebsocketMessage{
+		MessageType: WebsocketMessageTypeNotification,
+		Data: gin.H{
+			"notification": notification,
+		},
+	}, logger)
+}
+
+// GetNotificationsByUserId lists the newest notifications first
+func GetNotificationsByUserId(dbPool *pgxpool.Pool, userId int, unreadOnly bool) ([]Notification, error) {
+	const query = `
+		SELECT *
+		FROM notifications
+		WHERE user_id = $1
+		AND ($2 = FALSE OR read_at IS NULL)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3
+	`
+	rows, err := dbPool.Query(context.Background(), query, userId, unreadOnly, NotificationsLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Notification])
+}
+
+// MarkNotificationRead returns pgx.ErrNoRows if the notification isn't the user's
+func MarkNotificationRead(dbPool *pgxpool.Pool, userId int, notificationId int) error {
+	const query = `
+		UPDATE notifications
+		SET read_at = COALESCE(read_at, NOW())
+		WHERE id = $1
+		AND user_id = $2
+	`
+	result, err := dbPool.Exec(context.Background(), query, notificationId, userId)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// MarkAllNotificationsRead returns how many notifications were unread
+func MarkAllNotificationsRead(dbPool *pgxpool.Pool, userId int) (int64, error) {
+	const query = `
+		UPDATE notifications
+		SET read_at = NOW()
+		WHERE user_id = $1
+		AND read_at IS NULL
+	`
+	result, err := dbPool.Exec(context.Background(), query, userId)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
@@ -2,62 +2,527 @@ package lib
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-type CouponCode struct {
-	Code             string    `json:"code"`
-	Description      string    `json:"description"`
-	CreatedAt        time.Time `json:"createdAt"`
-	UpdatedAt        time.Time `json:"updatedAt"`
-	ExpiresAt        time.Time `json:"expiresAt"`
-	ReductionPercent int       `json:"reductionPercent"`
-	CouponTypeName   string    `json:"couponTypeName"`
+type Order struct {
+	Id               int        `json:"id" db:"id"`
+	OrderNumber      string     `json:"orderNumber" db:"order_number"`
+	UserId           int        `json:"userId" db:"user_id"`
+	Status           string     `json:"status" db:"status"`
+	ShippingOptionId int        `json:"shippingOptionId" db:"shipping_option_id"`
+	ShippingPrice    float64    `json:"shippingPrice" db:"shipping_price"`
+	CouponCode       *string    `json:"couponCode" db:"coupon_code"`
+	Subtotal         float64    `json:"subtotal" db:"subtotal"`
+	DiscountAmount   float64    `json:"discountAmount" db:"discount_amount"`
+	TaxAmount        float64    `json:"taxAmount" db:"tax_amount"`
+	PricesIncludeTax bool       `json:"pricesIncludeTax" db:"prices_include_tax"`
+	TaxCountry       string     `json:"taxCountry" db:"tax_country"`
+	TaxRegion        string     `json:"taxRegion" db:"tax_region"`
+	GiftCardAmount   float64    `json:"giftCardAmount" db:"gift_card_amount"`
+	Total            float64    `json:"total" db:"total"`
+	CreatedAt        time.Time  `json:"createdAt" db:"created_at"`
+	UpdatedAt        *time.Time `json:"updatedAt" db:"updated_at"`
+	// ProviderRefundPending - the order was cancelled or refunded and the provider hasn't refunded it all yet
+	ProviderRefundPending bool `json:"providerRefundPending" db:"provider_refund_pending"`
 }
 
-type ShippingOption struct {
-	Id                     int     `json:"id"`
-	Name                   string  `json:"name"`
-	Description            string  `json:"description"`
-	Price                  float64 `json:"price"`
-	TimeToShipUnitQuantity int     `json:"timeToShipUnitQuantity"`
-	TimeToShipUnit         string  `json:"timeToShipUnit"`
+type OrderItem struct {
+	Id                 int       `json:"id" db:"id"`
+	OrderId            int       `json:"orderId" db:"order_id"`
+	InventoryItemId    int       `json:"inventoryItemId" db:"inventory_item_id"`
+	VariantId          *int      `json:"variantId" db:"variant_id"`
+	VariantName        string    `json:"variantName" db:"variant_name"`
+	Sku                string    `json:"sku" db:"sku"`
+	Name               string    `json:"name" db:"name"`
+	Slug               string    `json:"slug" db:"slug"`
+	Price              float64   `json:"price" db:"price"`
+	Quantity           int       `json:"quantity" db:"quantity"`
+	DiscountAmount     float64   `json:"discountAmount" db:"discount_amount"`
+	TaxCategory        string    `json:"taxCategory" db:"tax_category"`
+	TaxRateBasisPoints int       `json:"taxRateBasisPoints" db:"tax_rate_basis_points"`
+	TaxAmount          float64   `json:"taxAmount" db:"tax_amount"`
+	CreatedAt          time.Time `json:"createdAt" db:"created_at"`
 }
 
-func GetShippingOptions(dbPool *pgxpool.Pool) ([]ShippingOption, error) {
-	const query = `SELECT * FROM shipping_options ORDER BY price DESC`
-	rows, err := dbPool.Query(context.Background(), query)
+type OrderStatusHistoryEntry struct {
+	Id                int       `json:"id" db:"id"`
+	OrderId           int       `json:"orderId" db:"order_id"`
+	Status            string    `json:"status" db:"status"`
+	ChangedByUserId   *int      `json:"changedByUserId" db:"changed_by_user_id"`
+	ChangedByUsername *string   `json:"changedByUsername" db:"changed_by_username"`
+	CreatedAt         time.Time `json:"createdAt" db:"created_at"`
+}
+
+// AdminOrder is an order along with who placed it, for the admin order list
+type AdminOrder struct {
+	Order
+	Username string `json:"username" db:"username"`
+	UserSlug string `json:"userSlug" db:"user_slug"`
+}
+
+// AdminOrderFilters - empty values are not filtered on. CreatedBefore is exclusive.
+type AdminOrderFilters struct {
+	Status        string
+	UserId        int
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+type PlaceOrderRequest struct {
+	ShippingOptionId int    `json:"shippingOptionId" validate:"required,min=1"`
+	CouponCode       string `json:"couponCode" validate:"omitempty,min=4,max=25"`
+	Country          string `json:"country" validate:"omitempty,len=2,alpha"`
+	Region           string `json:"region" validate:"omitempty,max=10,alphanum"`
+}
+
+// GenerateOrderNumber returns a short, human-friendly order number, e.g. HS-3F9A1C2B7D
+func GenerateOrderNumber() (string, error) {
+	return generateReferenceNumber("HS")
+}
+
+func generateReferenceNumber(prefix string) (string, error) {
+	referenceUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	hex := strings.ReplaceAll(referenceUUID.String(), "-", "")
+	return fmt.Sprintf("%s-%s", prefix, strings.ToUpper(hex[:10])), nil
+}
+
+/*
+PlaceOrder
+ 1. Lock the user's cart and snapshot the lines with current prices
+ 2. Validate shipping option, and evaluate the coupon against the cart
+ 3. Price and tax the cart for the checkout location, less any gift cards redeemed against it
+ 4. Take the items out of stock, confirming any checkout hold
+ 5. Insert the order and its items, settling the gift card redemptions against it
+ 6. Clear the cart, marking it recovered if it had been abandoned
+
+An order fully paid by gift card is placed as paid.
+
+Everything happens in one transaction, so a failure leaves the cart untouched.
+*/
+func PlaceOrder(
+	dbPool *pgxpool.Pool, logger *slog.Logger, taxRules TaxRules, userId int, req PlaceOrderRequest,
+) (Order, []OrderItem, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return Order{}, nil, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("PlaceOrder: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	cartItems, cartErr := getCartItemsForUpdate(tx, userId)
+	if cartErr != nil {
+		return Order{}, nil, cartErr
+	}
+	if len(cartItems) == 0 {
+		return Order{}, nil, &StatusBadRequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "Cart is empty",
+			ErrorCode:  ErrorCodeCartEmpty,
+		}
+	}
+
+	shippingOption, shippingErr := getShippingOptionById(tx, req.ShippingOptionId)
+	if shippingErr != nil {
+		if errors.Is(shippingErr, pgx.ErrNoRows) {
+			return Order{}, nil, &StatusBadRequestError{
+				StatusCode: http.StatusBadRequest,
+				Message:    "Invalid shipping option",
+				ErrorCode:  ErrorCodeInvalidShippingOption,
+			}
+		}
+		return Order{}, nil, shippingErr
+	}
+
+	var couponEvaluation *CouponEvaluation
+	var couponCode *string
+	if len(req.CouponCode) > 0 {
+		coupon, evaluation, couponErr := evaluateCoupon(tx, true, req.CouponCode, userId, cartItems, &shippingOption)
+		if couponErr != nil {
+			if errors.Is(couponErr, pgx.ErrNoRows) {
+				return Order{}, nil, newCouponError("Invalid coupon code", ErrorCodeInvalidCouponCode)
+			}
+			return Order{}, nil, couponErr
+		}
+		couponEvaluation = &evaluation
+		couponCode = &coupon.Code
+	}
+
+	cartTax, cartTaxErr := newCartTax(tx, taxRules, TaxLocation{Country: req.Country, Region: req.Region}, cartItems)
+	if cartTaxErr != nil {
+		return Order{}, nil, cartTaxErr
+	}
+	totals := CalculateCartTotals(cartItems, &shippingOption, couponEvaluation, cartTax)
+
+	giftCardRedemptions, giftCardErr := getPendingGiftCardRedemptions(tx, userId, "\n\t\tFOR UPDATE OF t")
+	if giftCardErr != nil {
+		return Order{}, nil, giftCardErr
+	}
+	var giftCardCents Cents
+	for _, redemption := range giftCardRedemptions {
+		giftCardCents += redemption.AmountCents
+	}
+	totals.ApplyGiftCards(giftCardCents)
+
+	stockErr := confirmStockReservations(tx, userId, cartItems)
+	if stockErr != nil {
+		return Order{}, nil, stockErr
+	}
+
+	orderNumber, orderNumberErr := GenerateOrderNumber()
+	if orderNumberErr != nil {
+		return Order{}, nil, orderNumberErr
+	}
+
+	status := OrderStatusPendingPayment
+	if totals.AmountDueCents == 0 {
+		status = OrderStatusPaid
+	}
+
+	order, orderErr := addOrder(tx, Order{
+		OrderNumber:      orderNumber,
+		UserId:           userId,
+		Status:           status,
+		ShippingOptionId: shippingOption.Id,
+		ShippingPrice:    totals.ShippingCents.Dollars(),
+		CouponCode:       couponCode,
+		Subtotal:         totals.SubtotalCents.Dollars(),
+		DiscountAmount:   totals.DiscountCents.Dollars(),
+		TaxAmount:        totals.TaxCents.Dollars(),
+		PricesIncludeTax: totals.PricesIncludeTax,
+		TaxCountry:       totals.TaxLocation.Country,
+		TaxRegion:        totals.TaxLocation.Region,
+		GiftCardAmount:   totals.GiftCardCents.Dollars(),
+		Total:            totals.AmountDueCents.Dollars(),
+	})
+	if orderErr != nil {
+		return Order{}, nil, orderErr
+	}
+
+	historyErr := addOrderStatusHistory(tx, order.Id, order.Status, &userId)
+	if historyErr != nil {
+		return Order{}, nil, historyErr
+	}
+
+	if couponCode != nil {
+		shippingDiscount := ToCents(shippingOption.Price) - totals.ShippingCents
+		redemptionErr := addCouponRedemption(
+			tx, *couponCode, userId, order.Id, (totals.DiscountCents + shippingDiscount).Dollars(),
+		)
+		if redemptionErr != nil {
+			return Order{}, nil, redemptionErr
+		}
+	}
+
+	giftCardSettleErr := settleGiftCardRedemptions(tx, userId, order.Id, giftCardRedemptions, totals.GiftCardCents)
+	if giftCardSettleErr != nil {
+		return Order{}, nil, giftCardSettleErr
+	}
+
+	orderItems := make([]OrderItem, 0, len(cartItems))
+	for i, cartItem := range cartItems {
+		orderItem, orderItemErr := addOrderItem(tx, order.Id, cartItem, totals.Lines[i])
+		if orderItemErr != nil {
+			return Order{}, nil, orderItemErr
+		}
+		orderItems = append(orderItems, orderItem)
+	}
+
+	recoveredErr := markCartAbandonmentRecovered(tx, userId, order.Id)
+	if recoveredErr != nil {
+		return Order{}, nil, recoveredErr
+	}
+
+	clearCartErr := deleteCartItemsByUserId(tx, userId)
+	if clearCartErr != nil {
+		return Order{}, nil, clearCartErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return Order{}, nil, commitErr
+	}
+
+	logger.Info(fmt.Sprintf("Order %v placed by user %v: %v items", order.OrderNumber, userId, len(orderItems)))
+
+	return order, orderItems, nil
+}
+
+func addOrder(db DBTX, order Order) (Order, error) {
+	const query = `
+		INSERT INTO orders (
+			order_number,
+			user_id,
+			status,
+			shipping_option_id,
+			shipping_price,
+			coupon_code,
+			subtotal,
+			discount_amount,
+			tax_amount,
+			prices_include_tax,
+			tax_country,
+			tax_region,
+			gift_card_amount,
+			total,
+			created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, NOW())
+		RETURNING *
+	`
+	rows, err := db.Query(
+		context.Background(),
+		query,
+		order.OrderNumber,
+		order.UserId,
+		order.Status,
+		order.ShippingOptionId,
+		order.ShippingPrice,
+		order.CouponCode,
+		order.Subtotal,
+		order.DiscountAmount,
+		order.TaxAmount,
+		order.PricesIncludeTax,
+		order.TaxCountry,
+		order.TaxRegion,
+		order.GiftCardAmount,
+		order.Total,
+	)
+	if err != nil {
+		return Order{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Order])
+}
+
+func addOrderItem(db DBTX, orderId int, cartItem CartItem, lineTotal LineTotal) (OrderItem, error) {
+	const query = `
+		INSERT INTO order_items (
+			order_id,
+			inventory_item_id,
+			variant_id,
+			variant_name,
+			sku,
+			name,
+			slug,
+			price,
+			quantity,
+			discount_amount,
+			tax_category,
+			tax_rate_basis_points,
+			tax_amount,
+			created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, NOW())
+		RETURNING *
+	`
+	rows, err := db.Query(
+		context.Background(),
+		query,
+		orderId,
+		cartItem.InventoryItemId,
+		cartItem.VariantId,
+		cartItem.VariantName,
+		cartItem.Sku,
+		cartItem.Name,
+		cartItem.InventoryItemSlug,
+		lineTotal.UnitPriceCents.Dollars(),
+		cartItem.Quantity,
+		lineTotal.DiscountCents.Dollars(),
+		lineTotal.TaxCategory,
+		lineTotal.TaxRateBasisPoints,
+		lineTotal.TaxCents.Dollars(),
+	)
+	if err != nil {
+		return OrderItem{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[OrderItem])
+}
+
+func addOrderStatusHistory(db DBTX, orderId int, status string, changedByUserId *int) error {
+	const query = `
+		INSERT INTO order_status_history (order_id, status, changed_by_user_id, created_at)
+		VALUES ($1, $2, $3, NOW())
+	`
+	_, err := db.Exec(context.Background(), query, orderId, status, changedByUserId)
+	return err
+}
+
+func GetOrdersByUserId(dbPool *pgxpool.Pool, userId int, paginationData PaginationData) ([]Order, error) {
+	const query = `
+		SELECT *
+		FROM orders
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+		OFFSET $3
+	`
+	rows, err := dbPool.Query(context.Background(), query, userId, paginationData.PerPage, paginationData.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[Order])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+	return orders, nil
+}
+
+func GetTotalOrdersByUserId(dbPool *pgxpool.Pool, userId int) (int, error) {
+	const query = `SELECT COUNT(*) FROM orders WHERE user_id = $1`
+	var count int
+	err := dbPool.QueryRow(context.Background(), query, userId).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// GetOrderByOrderNumber returns pgx.ErrNoRows if there is no such order
+func GetOrderByOrderNumber(dbPool *pgxpool.Pool, orderNumber string) (Order, error) {
+	return getOrderByOrderNumber(dbPool, orderNumber)
+}
+
+func getOrderByOrderNumber(db DBTX, orderNumber string) (Order, error) {
+	const query = `SELECT * FROM orders WHERE order_number = $1`
+	rows, err := db.Query(context.Background(), query, orderNumber)
+	if err != nil {
+		return Order{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Order])
+}
+
+func GetOrderItems(dbPool *pgxpool.Pool, orderId int) ([]OrderItem, error) {
+	return getOrderItems(dbPool, orderId)
+}
+
+func getOrderItems(db DBTX, orderId int) ([]OrderItem, error) {
+	const query = `
+		SELECT *
+		FROM order_items
+		WHERE order_id = $1
+		ORDER BY id
+	`
+	rows, err := db.Query(context.Background(), query, orderId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	shippingOptions, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[ShippingOption])
+	orderItems, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[OrderItem])
 	if collectRowsErr != nil {
 		return nil, collectRowsErr
 	}
-	return shippingOptions, nil
+	return orderItems, nil
 }
 
-func GetCouponByCode(dbPool *pgxpool.Pool, code string) (CouponCode, error) {
+func GetOrderStatusHistory(dbPool *pgxpool.Pool, orderId int) ([]OrderStatusHistoryEntry, error) {
 	const query = `
-		SELECT code, description, created_at, updated_at, expires_at, reduction_percent,
-		       ct.name AS coupon_type_name
-		FROM coupons
-		JOIN coupon_types ct ON ct.id = coupons.coupon_type_id
-		WHERE UPPER(code) = UPPER($1)
-		AND expires_at > NOW()
+		SELECT h.id,
+		       h.order_id,
+		       h.status,
+		       h.changed_by_user_id,
+		       u.username AS changed_by_username,
+		       h.created_at
+		FROM order_status_history h
+		LEFT JOIN users u ON u.id = h.changed_by_user_id
+		WHERE h.order_id = $1
+		ORDER BY h.created_at, h.id
 	`
-	row, err := dbPool.Query(context.Background(), query, code)
+	rows, err := dbPool.Query(context.Background(), query, orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[OrderStatusHistoryEntry])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+	return history, nil
+}
+
+func getAdminOrderFiltersClause(filters AdminOrderFilters) (string, []any) {
+	var whereClause strings.Builder
+	var args []any
+	if len(filters.Status) > 0 {
+		args = append(args, filters.Status)
+		whereClause.WriteString(fmt.Sprintf("AND o.status = $%d\n", len(args)))
+	}
+	if filters.UserId > 0 {
+		args = append(args, filters.UserId)
+		whereClause.WriteString(fmt.Sprintf("AND o.user_id = $%d\n", len(args)))
+	}
+	if filters.CreatedAfter != nil {
+		args = append(args, *filters.CreatedAfter)
+		whereClause.WriteString(fmt.Sprintf("AND o.created_at >= $%d\n", len(args)))
+	}
+	if filters.CreatedBefore != nil {
+		args = append(args, *filters.CreatedBefore)
+		whereClause.WriteString(fmt.Sprintf("AND o.created_at < $%d\n", len(args)))
+	}
+	return whereClause.String(), args
+}
+
+func GetOrders(
+	dbPool *pgxpool.Pool, filters AdminOrderFilters, paginationData PaginationData,
+) ([]AdminOrder, error) {
+	whereClause, args := getAdminOrderFiltersClause(filters)
+	args = append(args, paginationData.PerPage, paginationData.Offset)
+	query := fmt.Sprintf(`
+		SELECT o.*,
+		       u.username,
+		       u.slug AS user_slug
+		FROM orders o
+		JOIN users u ON u.id = o.user_id
+		WHERE 1=1
+		%s
+		ORDER BY o.created_at DESC
+		LIMIT $%d
+		OFFSET $%d
+	`, whereClause, len(args)-1, len(args))
+	rows, err := dbPool.Query(context.Background(), query, args...)
 	if err != nil {
-		return CouponCode{}, err
+		return nil, err
 	}
-	defer row.Close()
-	coupon, collectRowsErr := pgx.CollectExactlyOneRow(row, pgx.RowToStructByName[CouponCode])
+	defer rows.Close()
+	orders, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[AdminOrder])
 	if collectRowsErr != nil {
-		return CouponCode{}, collectRowsErr
+		return nil, collectRowsErr
+	}
+	return orders, nil
+}
+
+func GetTotalOrders(dbPool *pgxpool.Pool, filters AdminOrderFilters) (int, error) {
+	whereClause, args := getAdminOrderFiltersClause(filters)
+	query := fmt.Sprintf(`
+		SELECT COUNT(*)
+		FROM orders o
+		WHERE 1=1
+		%s
+	`, whereClause)
+	var count int
+	err := dbPool.QueryRow(context.Background(), query, args...).Scan(&count)
+	if err != nil {
+		return 0, err
 	}
-	return coupon, nil
+	return count, nil
 }
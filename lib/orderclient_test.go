@@ -0,0 +1,19 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateOrderNumber(t *testing.T) {
+	orderNumber, err := GenerateOrderNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(orderNumber, "HS-") || len(orderNumber) != 13 {
+		t.Fatalf("Unexpected order number format: %v", orderNumber)
+	}
+	if strings.ToUpper(orderNumber) != orderNumber {
+		t.Fatalf("Order number should be upper case: %v", orderNumber)
+	}
+}
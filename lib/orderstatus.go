@@ -0,0 +1,471 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	OrderStatusPendingPayment = "pending_payment"
+	OrderStatusPaid           = "paid"
+	OrderStatusPacking        = "packing"
+	OrderStatusShipped        = "shipped"
+	OrderStatusDelivered      = "delivered"
+	OrderStatusCancelled      = "cancelled"
+	OrderStatusRefunded       = "refunded"
+)
+
+const WebsocketMessageTypeOrderStatusUpdate = "orderStatusUpdate"
+
+// DefaultPendingPaymentTimeoutHours is used when orders.pendingPaymentTimeoutHours isn't set
+const DefaultPendingPaymentTimeoutHours = 24
+
+// PendingPaymentTimeout is how long an order waits for payment before it's cancelled and its stock released
+func PendingPaymentTimeout(config ConfigOrders) time.Duration {
+	timeoutHours := config.PendingPaymentTimeoutHours
+	if timeoutHours <= 0 {
+		timeoutHours = DefaultPendingPaymentTimeoutHours
+	}
+	return time.Duration(timeoutHours) * time.Hour
+}
+
+type UpdateOrderStatusRequest struct {
+	Status string `json:"status" validate:"required"`
+}
+
+// GetOrderStatusTransitionMap
+// Maps each status to the statuses an order may move to next. Cancelled and
+// refunded are terminal.
+func GetOrderStatusTransitionMap() map[string][]string {
+	transitionMap := make(map[string][]string)
+	transitionMap[OrderStatusPendingPayment] = []string{OrderStatusPaid, OrderStatusCancelled}
+	transitionMap[OrderStatusPaid] = []string{OrderStatusPacking, OrderStatusCancelled, OrderStatusRefunded}
+	transitionMap[OrderStatusPacking] = []string{OrderStatusShipped, OrderStatusCancelled}
+	transitionMap[OrderStatusShipped] = []string{OrderStatusDelivered}
+	transitionMap[OrderStatusDelivered] = []string{OrderStatusRefunded}
+	transitionMap[OrderStatusCancelled] = []string{}
+	transitionMap[OrderStatusRefunded] = []string{}
+	return transitionMap
+}
+
+func IsValidOrderStatus(status string) bool {
+	_, ok := GetOrderStatusTransitionMap()[status]
+	return ok
+}
+
+func ValidateOrderStatusTransition(fromStatus string, toStatus string) error {
+	if !IsValidOrderStatus(toStatus) {
+		return &StatusBadRequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("Unknown order status: %v", toStatus),
+			ErrorCode:  ErrorCodeInvalidOrderStatus,
+		}
+	}
+	allowedStatuses := GetOrderStatusTransitionMap()[fromStatus]
+	if !slices.Contains(allowedStatuses, toStatus) {
+		return &StatusBadRequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("Order cannot move from %v to %v", fromStatus, toStatus),
+			ErrorCode:  ErrorCodeInvalidOrderStatusTransition,
+		}
+	}
+	return nil
+}
+
+/*
+UpdateOrderStatus
+ 1. Lock the order row so concurrent transitions are serialized
+ 2. Validate the transition. An order waiting for payment can't be cancelled while a payment
+    for it is in flight.
+ 3. Update the order and record who changed it in the status history
+ 4. Put the order's stock back if it's been cancelled or refunded
+ 5. Give back everything paid for an order that's been cancelled or refunded, with startOrderRefund
+    and then sendOrderProviderRefund
+
+The provider is called after the status change is committed, as it is for returns. A refund it
+doesn't make is left pending on the order and retried by RefundPendingOrders.
+
+Returns the updated order and the status it moved from.
+*/
+func UpdateOrderStatus(
+	dbPool *pgxpool.Pool,
+	logger *slog.Logger,
+	provider PaymentProvider,
+	orderNumber string,
+	newStatus string,
+	changedByUserId int,
+) (Order, string, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return Order{}, "", beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("UpdateOrderStatus: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	order, previousStatus, orderErr := updateOrderStatus(tx, orderNumber, newStatus, &changedByUserId)
+	if orderErr != nil {
+		return Order{}, "", orderErr
+	}
+	if newStatus == OrderStatusCancelled || newStatus == OrderStatusRefunded {
+		order, orderErr = startOrderRefund(tx, provider.Name(), order)
+		if orderErr != nil {
+			return Order{}, "", orderErr
+		}
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return Order{}, "", commitErr
+	}
+	logger.Info(fmt.Sprintf("Order %v moved from %v to %v", orderNumber, previousStatus, newStatus))
+
+	if order.ProviderRefundPending {
+		refundedOrder, refundErr := sendOrderProviderRefund(dbPool, logger, provider, order)
+		if refundErr != nil {
+			logger.Error(fmt.Sprintf("Order %v left refund pending: %v", orderNumber, refundErr))
+			return order, previousStatus, nil
+		}
+		order = refundedOrder
+	}
+	return order, previousStatus, nil
+}
+
+// setOrderStatus - changedByUserId is nil when the system makes the change, e.g. a payment settling
+func setOrderStatus(
+	dbPool *pgxpool.Pool, logger *slog.Logger, orderNumber string, newStatus string, changedByUserId *int,
+) (Order, string, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return Order{}, "", beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("setOrderStatus: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	order, previousStatus, orderErr := updateOrderStatus(tx, orderNumber, newStatus, changedByUserId)
+	if orderErr != nil {
+		return Order{}, "", orderErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return Order{}, "", commitErr
+	}
+
+	logger.Info(fmt.Sprintf("Order %v moved from %v to %v", orderNumber, previousStatus, newStatus))
+
+	return order, previousStatus, nil
+}
+
+// updateOrderStatus must be called inside a transaction. changedByUserId is nil for system changes.
+func updateOrderStatus(
+	tx pgx.Tx, orderNumber string, newStatus string, changedByUserId *int,
+) (Order, string, error) {
+	const lockQuery = `SELECT * FROM orders WHERE order_number = $1 FOR UPDATE`
+	rows, err := tx.Query(context.Background(), lockQuery, orderNumber)
+	if err != nil {
+		return Order{}, "", err
+	}
+	order, collectErr := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Order])
+	if collectErr != nil {
+		return Order{}, "", collectErr
+	}
+
+	transitionErr := ValidateOrderStatusTransition(order.Status, newStatus)
+	if transitionErr != nil {
+		return Order{}, "", transitionErr
+	}
+	// A payment in flight, or captured but not yet recorded on the order, would be kept without the order
+	if newStatus == OrderStatusCancelled && order.Status == OrderStatusPendingPayment {
+		hasPendingPayment, pendingErr := orderHasPendingPayment(tx, order.Id)
+		if pendingErr != nil {
+			return Order{}, "", pendingErr
+		}
+		if hasPendingPayment {
+			return Order{}, "", newPaymentPendingError()
+		}
+	}
+
+	const updateQuery = `
+		UPDATE orders
+		SET status = $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING *
+	`
+	updatedRows, updateErr := tx.Query(context.Background(), updateQuery, newStatus, order.Id)
+	if updateErr != nil {
+		return Order{}, "", updateErr
+	}
+	updatedOrder, collectUpdatedErr := pgx.CollectExactlyOneRow(updatedRows, pgx.RowToStructByName[Order])
+	if collectUpdatedErr != nil {
+		return Order{}, "", collectUpdatedErr
+	}
+
+	historyErr := addOrderStatusHistory(tx, order.Id, newStatus, changedByUserId)
+	if historyErr != nil {
+		return Order{}, "", historyErr
+	}
+
+	// Cancelled and refunded are terminal, so the stock is only ever put back once
+	if newStatus == OrderStatusCancelled || newStatus == OrderStatusRefunded {
+		restockErr := restockOrderItems(tx, order.Id)
+		if restockErr != nil {
+			return Order{}, "", restockErr
+		}
+	}
+
+	return updatedOrder, order.Status, nil
+}
+
+/*
+startOrderRefund gives back everything paid for the order. Must be called in the transaction
+that cancels or refunds it.
+ 1. Check no return on the order is part way through being refunded, so nothing is refunded twice
+ 2. Credit what's still paid by gift cards back onto them
+ 3. Mark the order refund pending if the provider has captured payments for it that it hasn't
+    refunded in full
+
+Orders with no captured payment (e.g. marked paid by an admin) are refunded outside the shop.
+*/
+func startOrderRefund(tx pgx.Tx, providerName string, order Order) (Order, error) {
+	ctx := context.Background()
+	const returnsQuery = `SELECT EXISTS (SELECT 1 FROM returns WHERE order_id = $1 AND status = $2)`
+	var returnRefundPending bool
+	returnsErr := tx.QueryRow(ctx, returnsQuery, order.Id, ReturnStatusRefundPending).Scan(&returnRefundPending)
+	if returnsErr != nil {
+		return Order{}, returnsErr
+	}
+	if returnRefundPending {
+		return Order{}, &StatusBadRequestError{
+			StatusCode: http.StatusConflict,
+			Message:    "A return on this order is still being refunded",
+			ErrorCode:  ErrorCodeRefundPending,
+		}
+	}
+
+	giftCardPayments, giftCardPaymentsErr := getOrderGiftCardPayments(tx, order.Id)
+	if giftCardPaymentsErr != nil {
+		return Order{}, giftCardPaymentsErr
+	}
+	var giftCardTotal Cents
+	for _, payment := range giftCardPayments {
+		giftCardTotal += payment.AmountCents
+	}
+	_, giftCardRefundErr := refundOrderGiftCards(tx, order.UserId, order.Id, giftCardTotal)
+	if giftCardRefundErr != nil {
+		return Order{}, giftCardRefundErr
+	}
+
+	payments, paymentsErr := getCapturedPaymentAttempts(tx, providerName, order.Id)
+	if paymentsErr != nil {
+		return Order{}, paymentsErr
+	}
+	if !slices.ContainsFunc(payments, func(payment PaymentAttempt) bool {
+		return payment.AmountCents > payment.RefundedCents
+	}) {
+		return order, nil
+	}
+	return setOrderProviderRefundPending(tx, order.Id, true)
+}
+
+func setOrderProviderRefundPending(db DBTX, orderId int, pending bool) (Order, error) {
+	const query = `
+		UPDATE orders
+		SET provider_refund_pending = $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING *
+	`
+	rows, err := db.Query(context.Background(), query, pending, orderId)
+	if err != nil {
+		return Order{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Order])
+}
+
+/*
+sendOrderProviderRefund refunds what's left of each of the order's captured payments through the
+provider, recording each refund against its payment as soon as it's made, then clears the order's
+refund pending flag
+*/
+func sendOrderProviderRefund(
+	dbPool *pgxpool.Pool, logger *slog.Logger, provider PaymentProvider, order Order,
+) (Order, error) {
+	payments, paymentsErr := getCapturedPaymentAttempts(dbPool, provider.Name(), order.Id)
+	if paymentsErr != nil {
+		return Order{}, paymentsErr
+	}
+	for _, payment := range payments {
+		refundCents := payment.AmountCents - payment.RefundedCents
+		if refundCents <= 0 || payment.ProviderReference == nil {
+			continue
+		}
+		_, refundErr := provider.Refund(*payment.ProviderReference, refundCents)
+		if refundErr != nil {
+			return Order{}, refundErr
+		}
+		const query = `
+			UPDATE payment_attempts
+			SET refunded_cents = refunded_cents + $1, updated_at = NOW()
+			WHERE id = $2
+		`
+		_, recordErr := dbPool.Exec(context.Background(), query, refundCents, payment.Id)
+		if recordErr != nil {
+			logger.Error(fmt.Sprintf(
+				"Order %v: provider refunded %v cents on payment %v but it wasn't saved: %v",
+				order.OrderNumber, refundCents, payment.Id, recordErr,
+			))
+			return Order{}, recordErr
+		}
+	}
+	logger.Info(fmt.Sprintf("Order %v refunded through %v", order.OrderNumber, provider.Name()))
+	return setOrderProviderRefundPending(dbPool, order.Id, false)
+}
+
+// RefundPendingOrders retries the provider refunds of cancelled and refunded orders. Returns the number refunded.
+func RefundPendingOrders(dbPool *pgxpool.Pool, logger *slog.Logger, provider PaymentProvider) (int, error) {
+	const query = `SELECT * FROM orders WHERE provider_refund_pending ORDER BY updated_at, id`
+	rows, err := dbPool.Query(context.Background(), query)
+	if err != nil {
+		return 0, err
+	}
+	orders, collectErr := pgx.CollectRows(rows, pgx.RowToStructByName[Order])
+	if collectErr != nil {
+		return 0, collectErr
+	}
+
+	refunded := 0
+	var errs []error
+	for _, order := range orders {
+		_, refundErr := sendOrderProviderRefund(dbPool, logger, provider, order)
+		if refundErr != nil {
+			errs = append(errs, fmt.Errorf("order %v: %w", order.OrderNumber, refundErr))
+			continue
+		}
+		refunded++
+	}
+	return refunded, errors.Join(errs...)
+}
+
+/*
+CancelUnpaidOrders cancels orders that have waited longer than timeout for payment, putting their
+stock back and crediting any gift cards used on them. Orders with a payment in flight or captured are left for the payment to settle.
+Returns the number cancelled.
+*/
+func CancelUnpaidOrders(
+	dbPool *pgxpool.Pool, logger *slog.Logger, provider PaymentProvider, timeout time.Duration,
+) (int, error) {
+	const query = `
+		SELECT order_number
+		FROM orders o
+		WHERE o.status = $1
+		AND o.created_at <= $2
+		AND NOT EXISTS (SELECT 1 FROM payment_attempts pa WHERE pa.order_id = o.id AND pa.status = ANY($3))
+		ORDER BY o.created_at
+	`
+	rows, err := dbPool.Query(
+		context.Background(), query, OrderStatusPendingPayment, time.Now().Add(-timeout), inFlightPaymentStatuses,
+	)
+	if err != nil {
+		return 0, err
+	}
+	orderNumbers, collectErr := pgx.CollectRows(rows, pgx.RowTo[string])
+	if collectErr != nil {
+		return 0, collectErr
+	}
+
+	cancelled := 0
+	var errs []error
+	for _, orderNumber := range orderNumbers {
+		order, cancelErr := cancelUnpaidOrder(dbPool, logger, provider, orderNumber)
+		if cancelErr != nil {
+			errs = append(errs, fmt.Errorf("order %v: %w", orderNumber, cancelErr))
+			continue
+		}
+		if order == (Order{}) {
+			continue
+		}
+		cancelled++
+		sendErr := SendOrderStatusUpdate(order, OrderStatusPendingPayment, logger)
+		if sendErr != nil {
+			logger.Error(fmt.Sprintf("Error sending order status update: %v", sendErr))
+		}
+	}
+	return cancelled, errors.Join(errs...)
+}
+
+// cancelUnpaidOrder returns an empty order if it was paid for, or a payment started, since it was found
+func cancelUnpaidOrder(
+	dbPool *pgxpool.Pool, logger *slog.Logger, provider PaymentProvider, orderNumber string,
+) (Order, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return Order{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("cancelUnpaidOrder: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	order, orderErr := getOrderByOrderNumberForUpdate(tx, orderNumber)
+	if orderErr != nil {
+		return Order{}, orderErr
+	}
+	hasPendingPayment, pendingErr := orderHasPendingPayment(tx, order.Id)
+	if pendingErr != nil {
+		return Order{}, pendingErr
+	}
+	if order.Status != OrderStatusPendingPayment || hasPendingPayment {
+		return Order{}, nil
+	}
+
+	cancelledOrder, _, updateErr := updateOrderStatus(tx, orderNumber, OrderStatusCancelled, nil)
+	if updateErr != nil {
+		return Order{}, updateErr
+	}
+	// Nothing has been captured, so only gift cards have anything to give back
+	cancelledOrder, updateErr = startOrderRefund(tx, provider.Name(), cancelledOrder)
+	if updateErr != nil {
+		return Order{}, updateErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return Order{}, commitErr
+	}
+	logger.Info(fmt.Sprintf("Order %v cancelled after waiting too long for payment", orderNumber))
+	return cancelledOrder, nil
+}
+
+// SendOrderStatusUpdate notifies the order's owner so their order page updates live
+func SendOrderStatusUpdate(order Order, previousStatus string, logger *slog.Logger) error {
+	return SendWebsocketMessageToUser(order.UserId, WebsocketMessage{
+		MessageType: WebsocketMessageTypeOrderStatusUpdate,
+		Data: gin.H{
+			"orderNumber":    order.OrderNumber,
+			"status":         order.Status,
+			"previousStatus": previousStatus,
+			"updatedAt":      order.UpdatedAt,
+		},
+	}, logger)
+}
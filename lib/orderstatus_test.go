@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateOrderStatusTransition(t *testing.T) {
+	validTransitions := [][]string{
+		{OrderStatusPendingPayment, OrderStatusPaid},
+		{OrderStatusPaid, OrderStatusPacking},
+		{OrderStatusPacking, OrderStatusShipped},
+		{OrderStatusShipped, OrderStatusDelivered},
+		{OrderStatusDelivered, OrderStatusRefunded},
+		{OrderStatusPendingPayment, OrderStatusCancelled},
+	}
+	for _, transition := range validTransitions {
+		if err := ValidateOrderStatusTransition(transition[0], transition[1]); err != nil {
+			t.Fatalf("Expected %v -> %v to be allowed: %v", transition[0], transition[1], err)
+		}
+	}
+}
+
+func TestValidateOrderStatusTransitionRejectsIllegalJumps(t *testing.T) {
+	invalidTransitions := [][]string{
+		{OrderStatusPendingPayment, OrderStatusShipped},
+		{OrderStatusPaid, OrderStatusDelivered},
+		{OrderStatusShipped, OrderStatusCancelled},
+		{OrderStatusCancelled, OrderStatusPaid},
+		{OrderStatusRefunded, OrderStatusDelivered},
+		{OrderStatusPaid, OrderStatusPaid},
+	}
+	for _, transition := range invalidTransitions {
+		err := ValidateOrderStatusTransition(transition[0], transition[1])
+		var badRequestErr *StatusBadRequestError
+		if !errors.As(err, &badRequestErr) {
+			t.Fatalf("Expected %v -> %v to be rejected", transition[0], transition[1])
+		}
+		if badRequestErr.ErrorCode != ErrorCodeInvalidOrderStatusTransition {
+			t.Fatalf("Unexpected error code: %v", badRequestErr.ErrorCode)
+		}
+	}
+}
+
+func TestValidateOrderStatusTransitionUnknownStatus(t *testing.T) {
+	err := ValidateOrderStatusTransition(OrderStatusPaid, "lost_in_space")
+	var badRequestErr *StatusBadRequestError
+	if !errors.As(err, &badRequestErr) || badRequestErr.ErrorCode != ErrorCodeInvalidOrderStatus {
+		t.Fatalf("Expected unknown status to be rejected, got %v", err)
+	}
+}
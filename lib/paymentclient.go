@@ -0,0 +1,366 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type PaymentAttempt struct {
+	Id                int        `json:"id" db:"id"`
+	OrderId           int        `json:"orderId" db:"order_id"`
+	UserId            int        `json:"userId" db:"user_id"`
+	Provider          string     `json:"provider" db:"provider"`
+	ProviderReference *string    `json:"providerReference" db:"provider_reference"`
+	AmountCents       int64      `json:"amountCents" db:"amount_cents"`
+	RefundedCents     int64      `json:"refundedCents" db:"refunded_cents"`
+	Status            string     `json:"status" db:"status"`
+	DeclineReason     *string    `json:"declineReason" db:"decline_reason"`
+	CreatedAt         time.Time  `json:"createdAt" db:"created_at"`
+	UpdatedAt         *time.Time `json:"updatedAt" db:"updated_at"`
+}
+
+type ChargeOrderRequest struct {
+	Card PaymentCard `json:"card" validate:"required"`
+}
+
+func dollarsToCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// Attempts with these statuses hold an order's payment, so it can't be charged again
+var inFlightPaymentStatuses = []string{PaymentStatusPending, PaymentStatusAuthorized, PaymentStatusCaptured}
+
+/*
+ChargeOrder
+ 1. Lock the order, check it belongs to the user and is waiting for payment, and record a pending
+    attempt for it, refusing if another attempt is already in flight
+ 2. Authorize and capture the order total through the provider, voiding the authorization if
+    the capture fails
+ 3. Record the outcome on the attempt, and mark the order paid once captured
+
+Declines are recorded and returned as a StatusBadRequestError.
+*/
+func ChargeOrder(
+	dbPool *pgxpool.Pool,
+	logger *slog.Logger,
+	provider PaymentProvider,
+	userId int,
+	orderNumber string,
+	card PaymentCard,
+) (PaymentAttempt, error) {
+	attempt, startErr := startPaymentAttempt(dbPool, logger, provider.Name(), userId, orderNumber)
+	if startErr != nil {
+		return PaymentAttempt{}, startErr
+	}
+
+	result, authorizeErr := provider.Authorize(attempt.AmountCents, card)
+	if authorizeErr == nil {
+		result, authorizeErr = capturePayment(logger, provider, result, attempt.AmountCents)
+	}
+	if authorizeErr != nil {
+		logger.Error(fmt.Sprintf("Payment provider error for order %v: %v", orderNumber, authorizeErr))
+		updateErr := updatePaymentAttemptStatus(dbPool, attempt.Id, PaymentStatusFailed)
+		if updateErr != nil {
+			logger.Error(fmt.Sprintf("Error recording failed payment attempt %v: %v", attempt.Id, updateErr))
+		}
+		return PaymentAttempt{}, authorizeErr
+	}
+
+	savedAttempt, updateErr := updatePaymentAttemptResult(dbPool, attempt.Id, result)
+	if updateErr != nil {
+		return PaymentAttempt{}, updateErr
+	}
+
+	logger.Info(fmt.Sprintf("Payment attempt %v for order %v: %v", savedAttempt.Id, orderNumber, savedAttempt.Status))
+
+	switch savedAttempt.Status {
+	case PaymentStatusDeclined:
+		return savedAttempt, &StatusBadRequestError{
+			StatusCode: http.StatusPaymentRequired,
+			Message:    fmt.Sprintf("Payment declined: %v", result.DeclineReason),
+			ErrorCode:  ErrorCodePaymentDeclined,
+		}
+	case PaymentStatusCaptured:
+		markPaidErr := markOrderPaid(dbPool, logger, orderNumber)
+		if markPaidErr != nil {
+			return savedAttempt, markPaidErr
+		}
+	}
+
+	return savedAttempt, nil
+}
+
+// capturePayment captures an authorized payment. If the capture fails, the authorization is voided so
+// the hold doesn't sit on the customer's card. Results that aren't authorized are returned as they are.
+func capturePayment(
+	logger *slog.Logger, provider PaymentProvider, authorized PaymentResult, amountCents int64,
+) (PaymentResult, error) {
+	if authorized.Status != PaymentStatusAuthorized {
+		return authorized, nil
+	}
+	result, captureErr := provider.Capture(authorized.ProviderReference, amountCents)
+	if captureErr == nil {
+		return result, nil
+	}
+	_, voidErr := provider.Void(authorized.ProviderReference)
+	if voidErr != nil {
+		logger.Error(fmt.Sprintf(
+			"Error voiding payment %v after its capture failed: %v", authorized.ProviderReference, voidErr,
+		))
+	}
+	return PaymentResult{}, captureErr
+}
+
+func newPaymentPendingError() *StatusBadRequestError {
+	return &StatusBadRequestError{
+		StatusCode: http.StatusConflict,
+		Message:    "A payment for this order is still being processed",
+		ErrorCode:  ErrorCodePaymentPending,
+	}
+}
+
+// startPaymentAttempt records a pending attempt for the order total while the order is locked, so two
+// requests paying for the same order at once can't both go on to charge the card
+func startPaymentAttempt(
+	dbPool *pgxpool.Pool, logger *slog.Logger, providerName string, userId int, orderNumber string,
+) (PaymentAttempt, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return PaymentAttempt{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("startPaymentAttempt: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	order, orderErr := getOrderByOrderNumberForUpdate(tx, orderNumber)
+	if orderErr != nil {
+		return PaymentAttempt{}, orderErr
+	}
+	if order.UserId != userId {
+		return PaymentAttempt{}, pgx.ErrNoRows
+	}
+	if order.Status != OrderStatusPendingPayment {
+		return PaymentAttempt{}, &StatusBadRequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("Order is %v and can't be paid", order.Status),
+			ErrorCode:  ErrorCodeOrderNotPayable,
+		}
+	}
+
+	hasPendingPayment, pendingErr := orderHasPendingPayment(tx, order.Id)
+	if pendingErr != nil {
+		return PaymentAttempt{}, pendingErr
+	}
+	if hasPendingPayment {
+		return PaymentAttempt{}, newPaymentPendingError()
+	}
+
+	attempt, addErr := addPaymentAttempt(tx, PaymentAttempt{
+		OrderId:     order.Id,
+		UserId:      userId,
+		Provider:    providerName,
+		AmountCents: dollarsToCents(order.Total),
+		Status:      PaymentStatusPending,
+	})
+	// payment_attempts_in_flight_idx backs up the lock
+	if isPgError(addErr, pgErrorCodeUniqueViolation) {
+		return PaymentAttempt{}, newPaymentPendingError()
+	}
+	if addErr != nil {
+		return PaymentAttempt{}, addErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return PaymentAttempt{}, commitErr
+	}
+	return attempt, nil
+}
+
+func markOrderPaid(dbPool *pgxpool.Pool, logger *slog.Logger, orderNumber string) error {
+	order, previousStatus, err := setOrderStatus(dbPool, logger, orderNumber, OrderStatusPaid, nil)
+	if err != nil {
+		return err
+	}
+	sendErr := SendOrderStatusUpdate(order, previousStatus, logger)
+	if sendErr != nil {
+		logger.Error(fmt.Sprintf("Error sending order status update: %v", sendErr))
+	}
+	return nil
+}
+
+/*
+HandlePaymentWebhook settles or fails a pending payment. Events for payments that are no longer
+pending are ignored, so providers can safely retry deliveries. The exception is a settled payment
+whose order couldn't be marked paid at the time, which a retried delivery marks paid.
+*/
+func HandlePaymentWebhook(
+	dbPool *pgxpool.Pool, logger *slog.Logger, provider PaymentProvider, event PaymentWebhookEvent,
+) error {
+	attempt, attemptErr := getPaymentAttemptByProviderReference(dbPool, provider.Name(), event.ProviderReference)
+	if attemptErr != nil {
+		return attemptErr
+	}
+	settledRetry := attempt.Status == PaymentStatusCaptured && event.EventType == PaymentWebhookEventSettled
+	if attempt.Status != PaymentStatusPending && !settledRetry {
+		logger.Info(fmt.Sprintf("Ignoring %v for payment %v: already %v", event.EventType, attempt.Id, attempt.Status))
+		return nil
+	}
+
+	if attempt.Status == PaymentStatusPending {
+		newStatus := PaymentStatusFailed
+		if event.EventType == PaymentWebhookEventSettled {
+			newStatus = PaymentStatusCaptured
+		}
+		updateErr := updatePaymentAttemptStatus(dbPool, attempt.Id, newStatus)
+		if updateErr != nil {
+			return updateErr
+		}
+		if newStatus != PaymentStatusCaptured {
+			return nil
+		}
+	}
+
+	orderNumber, orderNumberErr := getOrderNumberById(dbPool, attempt.OrderId)
+	if orderNumberErr != nil {
+		return orderNumberErr
+	}
+	order, orderErr := getOrderByOrderNumber(dbPool, orderNumber)
+	if orderErr != nil {
+		return orderErr
+	}
+	if order.Status != OrderStatusPendingPayment {
+		logger.Info(fmt.Sprintf("Ignoring %v for payment %v: order already %v", event.EventType, attempt.Id, order.Status))
+		return nil
+	}
+	return markOrderPaid(dbPool, logger, orderNumber)
+}
+
+func addPaymentAttempt(db DBTX, attempt PaymentAttempt) (PaymentAttempt, error) {
+	const query = `
+		INSERT INTO payment_attempts (
+			order_id,
+			user_id,
+			provider,
+			provider_reference,
+			amount_cents,
+			status,
+			decline_reason,
+			created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		RETURNING *
+	`
+	rows, err := db.Query(
+		context.Background(),
+		query,
+		attempt.OrderId,
+		attempt.UserId,
+		attempt.Provider,
+		attempt.ProviderReference,
+		attempt.AmountCents,
+		attempt.Status,
+		attempt.DeclineReason,
+	)
+	if err != nil {
+		return PaymentAttempt{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[PaymentAttempt])
+}
+
+func updatePaymentAttemptResult(db DBTX, paymentAttemptId int, result PaymentResult) (PaymentAttempt, error) {
+	const query = `
+		UPDATE payment_attempts
+		SET provider_reference = $1,
+			status = $2,
+			decline_reason = $3,
+			updated_at = NOW()
+		WHERE id = $4
+		RETURNING *
+	`
+	var declineReason *string
+	if len(result.DeclineReason) > 0 {
+		declineReason = &result.DeclineReason
+	}
+	rows, err := db.Query(
+		context.Background(), query, result.ProviderReference, result.Status, declineReason, paymentAttemptId,
+	)
+	if err != nil {
+		return PaymentAttempt{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[PaymentAttempt])
+}
+
+func updatePaymentAttemptStatus(db DBTX, paymentAttemptId int, status string) error {
+	const query = `UPDATE payment_attempts SET status = $1, updated_at = NOW() WHERE id = $2`
+	_, err := db.Exec(context.Background(), query, status, paymentAttemptId)
+	return err
+}
+
+// orderHasPendingPayment - whether an attempt is still in flight, or has already been captured
+func orderHasPendingPayment(db DBTX, orderId int) (bool, error) {
+	const query = `
+		SELECT EXISTS (
+			SELECT 1 FROM payment_attempts WHERE order_id = $1 AND status = ANY($2)
+		)
+	`
+	var exists bool
+	err := db.QueryRow(context.Background(), query, orderId, inFlightPaymentStatuses).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func getPaymentAttemptByProviderReference(db DBTX, provider string, providerReference string) (PaymentAttempt, error) {
+	const query = `SELECT * FROM payment_attempts WHERE provider = $1 AND provider_reference = $2`
+	rows, err := db.Query(context.Background(), query, provider, providerReference)
+	if err != nil {
+		return PaymentAttempt{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[PaymentAttempt])
+}
+
+func GetPaymentAttemptsByOrderId(dbPool *pgxpool.Pool, orderId int) ([]PaymentAttempt, error) {
+	const query = `
+		SELECT *
+		FROM payment_attempts
+		WHERE order_id = $1
+		ORDER BY created_at, id
+	`
+	rows, err := dbPool.Query(context.Background(), query, orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attempts, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[PaymentAttempt])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+	return attempts, nil
+}
+
+func getOrderNumberById(db DBTX, orderId int) (string, error) {
+	const query = `SELECT order_number FROM orders WHERE id = $1`
+	var orderNumber string
+	err := db.QueryRow(context.Background(), query, orderId).Scan(&orderNumber)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("order %v not found", orderId)
+	}
+	return orderNumber, err
+}
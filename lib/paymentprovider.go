@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+)
+
+const PaymentProviderFake = "fake"
+
+// Payment statuses reported by providers and stored on payment attempts
+const (
+	PaymentStatusPending    = "pending"
+	PaymentStatusAuthorized = "authorized"
+	PaymentStatusCaptured   = "captured"
+	PaymentStatusDeclined   = "declined"
+	PaymentStatusFailed     = "failed"
+	PaymentStatusRefunded   = "refunded"
+	PaymentStatusVoided     = "voided"
+)
+
+// Webhook event types, normalized across providers
+const (
+	PaymentWebhookEventSettled = "payment.settled"
+	PaymentWebhookEventFailed  = "payment.failed"
+)
+
+type PaymentCard struct {
+	Number      string `json:"number" validate:"required,numeric,min=12,max=19"`
+	ExpiryMonth int    `json:"expiryMonth" validate:"required,min=1,max=12"`
+	ExpiryYear  int    `json:"expiryYear" validate:"required,min=2000,max=2100"`
+	Cvc         string `json:"cvc" validate:"required,numeric,min=3,max=4"`
+}
+
+// PaymentResult - Status is one of the PaymentStatus constants
+type PaymentResult struct {
+	ProviderReference string
+	Status            string
+	DeclineReason     string
+}
+
+type PaymentWebhookEvent struct {
+	EventType         string `json:"type"`
+	ProviderReference string `json:"providerReference"`
+}
+
+/*
+PaymentProvider is implemented by each payment processor we support. Amounts are in cents.
+
+  - Authorize places a hold on the card. The result may be pending for processors that
+    settle later, in which case the outcome arrives as a webhook.
+  - Capture takes an authorized payment.
+  - Void releases an authorized payment that won't be captured, so the hold comes off the card.
+  - Refund returns all or part of a captured payment.
+  - SaveCard keeps a card with the processor for charges made while the customer isn't
+    there, like subscription renewals, and returns its reference. We never store the card.
+  - AuthorizeSavedCard places a hold on a saved card, as Authorize does.
+  - VerifyWebhook checks a webhook's signature and returns the event it describes. The
+    signature is read from the request header named by WebhookSignatureHeader.
+*/
+type PaymentProvider interface {
+	Name() string
+	WebhookSignatureHeader() string
+	Authorize(amountCents int64, card PaymentCard) (PaymentResult, error)
+	Capture(providerReference string, amountCents int64) (PaymentResult, error)
+	Void(providerReference string) (PaymentResult, error)
+	Refund(providerReference string, amountCents int64) (PaymentResult, error)
+	SaveCard(card PaymentCard) (string, error)
+	AuthorizeSavedCard(cardReference string, amountCents int64) (PaymentResult, error)
+	VerifyWebhook(payload []byte, signature string) (PaymentWebhookEvent, error)
+}
+
+// NewPaymentProvider fails unless a provider is configured, so a missing setting can't fall back to the
+// fake provider, which approves every charge. Only the fake provider may run without a webhook secret.
+func NewPaymentProvider(config ConfigPayments) (PaymentProvider, error) {
+	if len(config.Provider) == 0 {
+		return nil, errors.New("payments.provider must be set")
+	}
+	if config.Provider != PaymentProviderFake && len(config.WebhookSecret) == 0 {
+		return nil, fmt.Errorf("payments.webhookSecret must be set for %v", config.Provider)
+	}
+	switch config.Provider {
+	case PaymentProviderFake:
+		return NewFakePaymentProvider(config.WebhookSecret), nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider: %v", config.Provider)
+	}
+}
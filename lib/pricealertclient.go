@@ -0,0 +1,258 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const NotificationTypePriceDrop = "price_drop"
+
+// PriceAlert - Price is what the item sells for now
+type PriceAlert struct {
+	Id              int        `json:"id" db:"id"`
+	UserId          int        `json:"userId" db:"user_id"`
+	InventoryItemId int        `json:"inventoryItemId" db:"inventory_item_id"`
+	ThresholdPrice  float32    `json:"thresholdPrice" db:"threshold_price"`
+	TriggeredAt     *time.Time `json:"triggeredAt" db:"triggered_at"`
+	CreatedAt       time.Time  `json:"createdAt" db:"created_at"`
+	UpdatedAt       *time.Time `json:"updatedAt" db:"updated_at"`
+	Name            string     `json:"name" db:"name"`
+	Slug            string     `json:"slug" db:"slug"`
+	Price           float32    `json:"price" db:"price"`
+}
+
+// PriceAlertRequest - saving an alert for an item that already has one replaces it and re-arms it
+type PriceAlertRequest struct {
+	InventoryItemId int     `json:"inventoryItemId" validate:"required,min=1"`
+	ThresholdPrice  float32 `json:"thresholdPrice" validate:"required,min=0.01,max=999999.99"`
+}
+
+const priceAlertColumns = `
+		SELECT pa.*,
+		       i.name,
+		       i.slug,
+		       ` + itemEffectivePriceColumn + ` AS price
+		FROM price_alerts pa
+		JOIN inventories i ON i.id = pa.inventory_item_id` + itemSaleJoin
+
+// validatePriceAlertThreshold - an alert has to be waiting for a price below the current one
+func validatePriceAlertThreshold(thresholdPrice float32, currentPrice float32) error {
+	if thresholdPrice > currentPrice {
+		return &StatusBadRequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("The price is already below $%.2f", thresholdPrice),
+			ErrorCode:  ErrorCodePriceAlreadyBelowThreshold,
+		}
+	}
+	return nil
+}
+
+func priceDropMessage(alert PriceAlert) string {
+	return fmt.Sprintf("%v is now $%.2f, below your alert price of $%.2f", alert.Name, alert.Price, alert.ThresholdPrice)
+}
+
+func GetPriceAlertsByUserId(dbPool *pgxpool.Pool, userId int) ([]PriceAlert, error) {
+	query := priceAlertColumns + `
+		WHERE pa.user_id = $1
+		ORDER BY pa.triggered_at DESC NULLS FIRST, pa.created_at DESC, pa.id DESC`
+	rows, err := dbPool.Query(context.Background(), query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[PriceAlert])
+}
+
+func getUserPriceAlert(db DBTX, userId int, priceAlertId int) (PriceAlert, error) {
+	query := priceAlertColumns + `
+		WHERE pa.id = $1
+		AND pa.user_id = $2`
+	rows, err := db.Query(context.Background(), query, priceAlertId, userId)
+	if err != nil {
+		return PriceAlert{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[PriceAlert])
+}
+
+/*
+SavePriceAlert
+ 1. Check the item exists and isn't already below the threshold
+ 2. Save the alert, one per user per item. Saving it again re-arms an alert that has fired.
+*/
+func SavePriceAlert(
+	dbPool *pgxpool.Pool, logger *slog.Logger, userId int, request PriceAlertRequest,
+) (PriceAlert, error) {
+	const priceQuery = `SELECT ` + itemEffectivePriceColumn + ` FROM inventories i` + itemSaleJoin + `
+		WHERE i.id = $1`
+	var currentPrice float32
+	priceErr := dbPool.QueryRow(context.Background(), priceQuery, request.InventoryItemId).Scan(&currentPrice)
+	if priceErr != nil {
+		return PriceAlert{}, priceErr
+	}
+	thresholdErr := validatePriceAlertThreshold(request.ThresholdPrice, currentPrice)
+	if thresholdErr != nil {
+		return PriceAlert{}, thresholdErr
+	}
+
+	const query = `
+		INSERT INTO price_alerts (user_id, inventory_item_id, threshold_price, created_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (user_id, inventory_item_id)
+		    DO UPDATE SET threshold_price = EXCLUDED.threshold_price, triggered_at = NULL, updated_at = NOW()
+		RETURNING id
+	`
+	var priceAlertId int
+	saveErr := dbPool.QueryRow(
+		context.Background(), query, userId, request.InventoryItemId, request.ThresholdPrice,
+	).Scan(&priceAlertId)
+	if saveErr != nil {
+		return PriceAlert{}, saveErr
+	}
+
+	logger.Info(fmt.Sprintf(
+		"User %v set a price alert on inventory item %v at $%.2f", userId, request.InventoryItemId, request.ThresholdPrice,
+	))
+	return getUserPriceAlert(dbPool, userId, priceAlertId)
+}
+
+func DeletePriceAlert(dbPool *pgxpool.Pool, userId int, priceAlertId int) error {
+	const query = `DELETE FROM price_alerts WHERE id = $1 AND user_id = $2`
+	result, err := dbPool.Exec(context.Background(), query, priceAlertId, userId)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+/*
+TriggerPriceAlerts is called whenever an item's price is saved and when a sale on it starts
+ 1. Mark the item's armed alerts whose threshold the sale or list price is now below as triggered. Marking
+    and selecting in one UPDATE means each alert fires once, even with concurrent saves.
+ 2. Store a notification for each
+ 3. After committing, send the notifications to any users that are connected
+*/
+func TriggerPriceAlerts(dbPool *pgxpool.Pool, logger *slog.Logger, inventoryItemId int) (int, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return 0, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("TriggerPriceAlerts: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	const triggerQuery = `
+		UPDATE price_alerts pa
+		SET triggered_at = NOW(), updated_at = NOW()
+		FROM inventories i` + itemSaleJoin + `
+		WHERE i.id = pa.inventory_item_id
+		AND pa.inventory_item_id = $1
+		AND pa.triggered_at IS NULL
+		AND ` + itemEffectivePriceColumn + ` < pa.threshold_price
+		RETURNING pa.*, i.name, i.slug, ` + itemEffectivePriceColumn + ` AS price
+	`
+	rows, triggerErr := tx.Query(ctx, triggerQuery, inventoryItemId)
+	if triggerErr != nil {
+		return 0, triggerErr
+	}
+	alerts, collectErr := pgx.CollectRows(rows, pgx.RowToStructByName[PriceAlert])
+	if collectErr != nil {
+		return 0, collectErr
+	}
+	if len(alerts) == 0 {
+		return 0, nil
+	}
+
+	notifications := make([]Notification, 0, len(alerts))
+	for _, alert := range alerts {
+		notification, notificationErr := addNotification(tx, alert.UserId, NotificationTypePriceDrop, priceDropMessage(alert),
+			map[string]any{
+				"priceAlertId":    alert.Id,
+				"inventoryItemId": alert.InventoryItemId,
+				"slug":            alert.Slug,
+				"price":           alert.Price,
+				"thresholdPrice":  alert.ThresholdPrice,
+			})
+		if notificationErr != nil {
+			return 0, notificationErr
+		}
+		notifications = append(notifications, notification)
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return 0, commitErr
+	}
+
+	logger.Info(fmt.Sprintf("Triggered %v price alerts on inventory item %v", len(alerts), inventoryItemId))
+	for _, notification := range notifications {
+		// The notification is stored either way, so a failed send only means it's seen later
+		sendErr := SendNotification(notification, logger)
+		if sendErr != nil {
+			logger.Error(fmt.Sprintf("TriggerPriceAlerts: error sending notification %v: %v", notification.Id, sendErr))
+		}
+	}
+	return len(alerts), nil
+}
+
+/*
+TriggerStartedSalePriceAlerts runs on a schedule, since a sale can start long after it's saved
+ 1. Find the items with sales that have started and not yet been checked
+ 2. Trigger each item's price alerts, then mark its started sales checked. An item whose
+    alerts fail is left unchecked and tried again on the next run.
+*/
+func TriggerStartedSalePriceAlerts(dbPool *pgxpool.Pool, logger *slog.Logger) (int, error) {
+	ctx := context.Background()
+	now := time.Now()
+	const startedQuery = `
+		SELECT DISTINCT inventory_item_id
+		FROM price_sales
+		WHERE alerts_checked_at IS NULL
+		AND starts_at <= $1
+	`
+	rows, startedErr := dbPool.Query(ctx, startedQuery, now)
+	if startedErr != nil {
+		return 0, startedErr
+	}
+	inventoryItemIds, collectErr := pgx.CollectRows(rows, pgx.RowTo[int])
+	if collectErr != nil {
+		return 0, collectErr
+	}
+
+	const checkedQuery = `
+		UPDATE price_sales
+		SET alerts_checked_at = NOW()
+		WHERE inventory_item_id = $1
+		AND alerts_checked_at IS NULL
+		AND starts_at <= $2
+	`
+	triggered := 0
+	var errs []error
+	for _, inventoryItemId := range inventoryItemIds {
+		itemTriggered, triggerErr := TriggerPriceAlerts(dbPool, logger, inventoryItemId)
+		if triggerErr != nil {
+			errs = append(errs, fmt.Errorf("inventory item %v: %w", inventoryItemId, triggerErr))
+			continue
+		}
+		triggered += itemTriggered
+		_, checkedErr := dbPool.Exec(ctx, checkedQuery, inventoryItemId, now)
+		if checkedErr != nil {
+			errs = append(errs, fmt.Errorf("inventory item %v: %w", inventoryItemId, checkedErr))
+		}
+	}
+	return triggered, errors.Join(errs...)
+}
@@ -0,0 +1,28 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidatePriceAlertThreshold(t *testing.T) {
+	if err := validatePriceAlertThreshold(9.99, 12.50); err != nil {
+		t.Fatalf("A threshold below the price should be accepted: %v", err)
+	}
+	if err := validatePriceAlertThreshold(12.50, 12.50); err != nil {
+		t.Fatalf("A threshold at the price should be accepted: %v", err)
+	}
+
+	err := validatePriceAlertThreshold(15, 12.50)
+	var badRequestErr *StatusBadRequestError
+	if !errors.As(err, &badRequestErr) || badRequestErr.ErrorCode != ErrorCodePriceAlreadyBelowThreshold {
+		t.Fatalf("Expected %v, got %v", ErrorCodePriceAlreadyBelowThreshold, err)
+	}
+}
+
+func TestPriceDropMessage(t *testing.T) {
+	message := priceDropMessage(PriceAlert{Name: "Reaper Relish", Price: 7.5, ThresholdPrice: 8})
+	if message != "Reaper Relish is now $7.50, below your alert price of $8.00" {
+		t.Fatalf("Unexpected message: %v", message)
+	}
+}
@@ -0,0 +1,302 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// runningSaleCondition - for use in queries with sales aliased as "ps"
+const runningSaleCondition = `ps.starts_at <= NOW() AND ps.ends_at > NOW()`
+
+// variantEffectivePriceColumn - what the variant sells for now, for queries with variants aliased as "v"
+const variantEffectivePriceColumn = `COALESCE(
+		       	(SELECT MIN(ps.sale_price) FROM price_sales ps WHERE ps.variant_id = v.id AND ` +
+	runningSaleCondition + `), v.price)`
+
+// itemSaleJoin - the running sale on the item's default variant, if any, as "sale".
+// For use in inventory item queries aliased as "i", with itemPriceColumns.
+const itemSaleJoin = `
+		LEFT JOIN LATERAL (
+			SELECT ps.sale_price, ps.ends_at
+			FROM price_sales ps
+			JOIN inventory_item_variants dv ON dv.id = ps.variant_id
+			WHERE ps.inventory_item_id = i.id
+			AND dv.is_default
+			AND ` + runningSaleCondition + `
+			ORDER BY ps.sale_price
+			LIMIT 1
+		) sale ON TRUE`
+
+// itemEffectivePriceColumn - what the item sells for now. For use with itemSaleJoin.
+const itemEffectivePriceColumn = `COALESCE(sale.sale_price, i.price)`
+
+// itemPriceColumns - price is what the item sells for now and original_price its list price
+const itemPriceColumns = itemEffectivePriceColumn + ` AS price,
+		       i.price AS original_price,
+		       sale.sale_price,
+		       sale.ends_at AS sale_ends_at`
+
+type PriceHistoryEntry struct {
+	Id              int       `json:"id" db:"id"`
+	InventoryItemId int       `json:"inventoryItemId" db:"inventory_item_id"`
+	VariantId       int       `json:"variantId" db:"variant_id"`
+	Price           float32   `json:"price" db:"price"`
+	CreatedAt       time.Time `json:"createdAt" db:"created_at"`
+	Sku             string    `json:"sku" db:"sku"`
+}
+
+type Sale struct {
+	Id              int        `json:"id" db:"id"`
+	InventoryItemId int        `json:"inventoryItemId" db:"inventory_item_id"`
+	VariantId       int        `json:"variantId" db:"variant_id"`
+	SalePrice       float32    `json:"salePrice" db:"sale_price"`
+	StartsAt        time.Time  `json:"startsAt" db:"starts_at"`
+	EndsAt          time.Time  `json:"endsAt" db:"ends_at"`
+	CreatedAt       time.Time  `json:"createdAt" db:"created_at"`
+	UpdatedAt       *time.Time `json:"updatedAt" db:"updated_at"`
+	AlertsCheckedAt *time.Time `json:"-" db:"alerts_checked_at"`
+	Sku             string     `json:"sku" db:"sku"`
+	OriginalPrice   float32    `json:"originalPrice" db:"original_price"`
+}
+
+// SaleRequest - the item's default variant goes on sale when VariantId is left out. StartsAt defaults to now.
+type SaleRequest struct {
+	VariantId int        `json:"variantId" validate:"min=0"`
+	SalePrice float32    `json:"salePrice" validate:"required,min=0.01,max=999999.99"`
+	StartsAt  *time.Time `json:"startsAt"`
+	EndsAt    time.Time  `json:"endsAt" validate:"required"`
+}
+
+const saleColumns = `
+		SELECT ps.*,
+		       v.sku,
+		       v.price AS original_price
+		FROM price_sales ps
+		JOIN inventory_item_variants v ON v.id = ps.variant_id`
+
+func newInvalidSaleError(message string) *StatusBadRequestError {
+	return &StatusBadRequestError{
+		StatusCode: http.StatusBadRequest,
+		Message:    message,
+		ErrorCode:  ErrorCodeInvalidSale,
+	}
+}
+
+// validateSale checks the sale makes sense against the variant's list price and the current time
+func validateSale(salePrice float32, listPrice float32, startsAt time.Time, endsAt time.Time, now time.Time) error {
+	if salePrice >= listPrice {
+		return newInvalidSaleError(fmt.Sprintf("The sale price must be below the list price of $%.2f", listPrice))
+	}
+	if !startsAt.Before(endsAt) {
+		return newInvalidSaleError("startsAt must be before endsAt")
+	}
+	if !endsAt.After(now) {
+		return newInvalidSaleError("endsAt must be in the future")
+	}
+	return nil
+}
+
+// recordPriceHistory adds a history row for each of the item's variants whose price has changed since the last one
+func recordPriceHistory(db DBTX, inventoryItemId int) error {
+	const query = `
+		INSERT INTO price_history (inventory_item_id, variant_id, price, created_at)
+		SELECT v.inventory_item_id, v.id, v.price, NOW()
+		FROM inventory_item_variants v
+		WHERE v.inventory_item_id = $1
+		AND v.price IS DISTINCT FROM (
+			SELECT ph.price
+			FROM price_history ph
+			WHERE ph.variant_id = v.id
+			ORDER BY ph.created_at DESC, ph.id DESC
+			LIMIT 1
+		)
+	`
+	_, err := db.Exec(context.Background(), query, inventoryItemId)
+	return err
+}
+
+// GetPriceHistory lists the item's list prices, newest first
+func GetPriceHistory(dbPool *pgxpool.Pool, inventoryItemId int) ([]PriceHistoryEntry, error) {
+	const query = `
+		SELECT ph.*,
+		       v.sku
+		FROM price_history ph
+		JOIN inventory_item_variants v ON v.id = ph.variant_id
+		WHERE ph.inventory_item_id = $1
+		ORDER BY ph.created_at DESC, ph.id DESC
+	`
+	rows, err := dbPool.Query(context.Background(), query, inventoryItemId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[PriceHistoryEntry])
+}
+
+// GetSales lists the item's sales, past, running and scheduled, latest first
+func GetSales(dbPool *pgxpool.Pool, inventoryItemId int) ([]Sale, error) {
+	query := saleColumns + `
+		WHERE ps.inventory_item_id = $1
+		ORDER BY ps.starts_at DESC, ps.id DESC`
+	rows, err := dbPool.Query(context.Background(), query, inventoryItemId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Sale])
+}
+
+func getSale(db DBTX, inventoryItemId int, saleId int) (Sale, error) {
+	query := saleColumns + `
+		WHERE ps.id = $1
+		AND ps.inventory_item_id = $2`
+	rows, err := db.Query(context.Background(), query, saleId, inventoryItemId)
+	if err != nil {
+		return Sale{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Sale])
+}
+
+/*
+ScheduleSale
+ 1. Lock the variant, so sales for it are scheduled one at a time
+ 2. Check the sale is below the list price and doesn't overlap another of the variant's sales
+ 3. Insert the sale
+ 4. If it's already running, fire any price alerts it takes the item below. Sales that start
+    later are picked up by TriggerStartedSalePriceAlerts.
+*/
+func ScheduleSale(dbPool *pgxpool.Pool, logger *slog.Logger, inventoryItemId int, request SaleRequest) (Sale, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return Sale{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("ScheduleSale: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	variant, variantErr := resolveVariant(tx, inventoryItemId, request.VariantId)
+	if errors.Is(variantErr, pgx.ErrNoRows) {
+		return Sale{}, newVariantNotFoundError()
+	}
+	if variantErr != nil {
+		return Sale{}, variantErr
+	}
+	_, lockErr := tx.Exec(ctx, `SELECT 1 FROM inventory_item_variants WHERE id = $1 FOR UPDATE`, variant.Id)
+	if lockErr != nil {
+		return Sale{}, lockErr
+	}
+
+	now := time.Now()
+	startsAt := now
+	if request.StartsAt != nil {
+		startsAt = *request.StartsAt
+	}
+	validationErr := validateSale(request.SalePrice, variant.Price, startsAt, request.EndsAt, now)
+	if validationErr != nil {
+		return Sale{}, validationErr
+	}
+
+	const overlapQuery = `
+		SELECT EXISTS (
+			SELECT 1
+			FROM price_sales
+			WHERE variant_id = $1
+			AND starts_at < $3
+			AND ends_at > $2
+		)
+	`
+	var overlaps bool
+	overlapErr := tx.QueryRow(ctx, overlapQuery, variant.Id, startsAt, request.EndsAt).Scan(&overlaps)
+	if overlapErr != nil {
+		return Sale{}, overlapErr
+	}
+	if overlaps {
+		return Sale{}, &StatusBadRequestError{
+			StatusCode: http.StatusConflict,
+			Message:    fmt.Sprintf("%v already has a sale during that time", variant.Sku),
+			ErrorCode:  ErrorCodeSaleOverlaps,
+		}
+	}
+
+	const insertQuery = `
+		INSERT INTO price_sales (inventory_item_id, variant_id, sale_price, starts_at, ends_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		RETURNING id
+	`
+	var saleId int
+	insertErr := tx.QueryRow(
+		ctx, insertQuery, inventoryItemId, variant.Id, request.SalePrice, startsAt, request.EndsAt,
+	).Scan(&saleId)
+	if insertErr != nil {
+		return Sale{}, insertErr
+	}
+	sale, saleErr := getSale(tx, inventoryItemId, saleId)
+	if saleErr != nil {
+		return Sale{}, saleErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return Sale{}, commitErr
+	}
+	logger.Info(fmt.Sprintf(
+		"Sale %v scheduled for %v at $%.2f from %v to %v", sale.Id, sale.Sku, sale.SalePrice, sale.StartsAt, sale.EndsAt,
+	))
+
+	// The sale is saved either way; TriggerStartedSalePriceAlerts checks it again on its next run
+	if !sale.StartsAt.After(now) {
+		_, alertsErr := TriggerPriceAlerts(dbPool, logger, inventoryItemId)
+		if alertsErr != nil {
+			logger.Error(fmt.Sprintf("ScheduleSale: error triggering price alerts: %v", alertsErr))
+		}
+	}
+	return sale, nil
+}
+
+// EndSale ends a running sale now and deletes one that hasn't started. Ended sales are kept as history.
+// Returns pgx.ErrNoRows if the item has no such sale still to come or running.
+func EndSale(dbPool *pgxpool.Pool, inventoryItemId int, saleId int) error {
+	ctx := context.Background()
+	const deleteQuery = `
+		DELETE FROM price_sales
+		WHERE id = $1
+		AND inventory_item_id = $2
+		AND starts_at > NOW()
+	`
+	deleteResult, deleteErr := dbPool.Exec(ctx, deleteQuery, saleId, inventoryItemId)
+	if deleteErr != nil {
+		return deleteErr
+	}
+	if deleteResult.RowsAffected() > 0 {
+		return nil
+	}
+
+	const endQuery = `
+		UPDATE price_sales
+		SET ends_at = NOW(), updated_at = NOW()
+		WHERE id = $1
+		AND inventory_item_id = $2
+		AND starts_at <= NOW()
+		AND ends_at > NOW()
+	`
+	endResult, endErr := dbPool.Exec(ctx, endQuery, saleId, inventoryItemId)
+	if endErr != nil {
+		return endErr
+	}
+	if endResult.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidateSale(t *testing.T) {
+	now := time.Now()
+	if err := validateSale(7.99, 9.99, now, now.Add(24*time.Hour), now); err != nil {
+		t.Fatalf("Sale should be valid: %v", err)
+	}
+
+	cases := map[string]error{
+		"sale price at list price": validateSale(9.99, 9.99, now, now.Add(time.Hour), now),
+		"ends before it starts":    validateSale(7.99, 9.99, now.Add(time.Hour), now, now),
+		"already over":             validateSale(7.99, 9.99, now.Add(-2*time.Hour), now.Add(-time.Hour), now),
+	}
+	for name, err := range cases {
+		var badRequestErr *StatusBadRequestError
+		if !errors.As(err, &badRequestErr) || badRequestErr.ErrorCode != ErrorCodeInvalidSale {
+			t.Fatalf("%v: expected %v, got %v", name, ErrorCodeInvalidSale, err)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+Cents is an amount of money in the smallest currency unit. All cart and order math is
+done in Cents so the totals shown to the customer are exactly the totals charged.
+Prices come out of NUMERIC(10, 2) columns, so converting them with ToCents is exact.
+*/
+type Cents int64
+
+func ToCents(amount float64) Cents {
+	return Cents(math.Round(amount * 100))
+}
+
+// Dollars converts back for storing in NUMERIC columns
+func (c Cents) Dollars() float64 {
+	return float64(c) / 100
+}
+
+func (c Cents) String() string {
+	sign := ""
+	if c < 0 {
+		sign = "-"
+		c = -c
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, c/100, c%100)
+}
+
+// Percent returns percent of c, rounding half cents up
+func (c Cents) Percent(percent int) Cents {
+	return Cents(math.Round(float64(c) * float64(percent) / 100))
+}
+
+/*
+LineTotal - DiscountCents is this line's share of the order discount, and TaxCents
+the tax on what's left after it.
+*/
+type LineTotal struct {
+	InventoryItemId    int    `json:"inventoryItemId"`
+	VariantId          int    `json:"variantId"`
+	Quantity           int    `json:"quantity"`
+	UnitPriceCents     Cents  `json:"unitPriceCents"`
+	LineTotalCents     Cents  `json:"lineTotalCents"`
+	DiscountCents      Cents  `json:"discountCents"`
+	TaxCategory        string `json:"taxCategory"`
+	TaxRateBasisPoints int    `json:"taxRateBasisPoints"`
+	TaxCents           Cents  `json:"taxCents"`
+}
+
+/*
+CartTotals - when PricesIncludeTax, TaxCents is already part of the line totals and
+is shown for the receipt only; otherwise it is added to TotalCents. GiftCardCents is
+paid by gift cards redeemed against the cart, and AmountDueCents what's left to charge.
+*/
+type CartTotals struct {
+	Lines            []LineTotal `json:"lines"`
+	SubtotalCents    Cents       `json:"subtotalCents"`
+	DiscountCents    Cents       `json:"discountCents"`
+	ShippingCents    Cents       `json:"shippingCents"`
+	TaxCents         Cents       `json:"taxCents"`
+	PricesIncludeTax bool        `json:"pricesIncludeTax"`
+	TaxLocation      TaxLocation `json:"taxLocation"`
+	TotalCents       Cents       `json:"totalCents"`
+	GiftCardCents    Cents       `json:"giftCardCents"`
+	AmountDueCents   Cents       `json:"amountDueCents"`
+}
+
+// CartTax is what's needed to tax a cart. Categories are by inventory item id.
+type CartTax struct {
+	Rules      TaxRules
+	Location   TaxLocation
+	Categories map[int]string
+}
+
+/*
+allocateCents splits amount across weights in proportion to them. Remainders go to the
+largest fractional shares first, so the parts always add up to exactly amount.
+*/
+func allocateCents(amount Cents, weights []Cents) []Cents {
+	parts := make([]Cents, len(weights))
+	var totalWeight Cents
+	for _, weight := range weights {
+		totalWeight += weight
+	}
+	if totalWeight <= 0 || amount == 0 {
+		return parts
+	}
+
+	type remainder struct {
+		index int
+		value int64
+	}
+	remainders := make([]remainder, len(weights))
+	var allocated Cents
+	for i, weight := range weights {
+		share := int64(amount) * int64(weight)
+		parts[i] = Cents(share / int64(totalWeight))
+		remainders[i] = remainder{index: i, value: share % int64(totalWeight)}
+		allocated += parts[i]
+	}
+	sort.SliceStable(remainders, func(a, b int) bool {
+		return remainders[a].value > remainders[b].value
+	})
+	for i := 0; allocated < amount; i++ {
+		parts[remainders[i%len(remainders)].index]++
+		allocated++
+	}
+	return parts
+}
+
+/*
+CalculateCartTotals
+ 1. Price each line as unit price × quantity
+ 2. Spread the coupon discount over the lines it applies to
+ 3. Add shipping, unless the coupon makes it free
+ 4. Tax each line on its discounted total
+
+shippingOption, couponEvaluation and cartTax are optional. Shipping isn't taxed.
+*/
+func CalculateCartTotals(
+	cartItems []CartItem, shippingOption *ShippingOption, couponEvaluation *CouponEvaluation, cartTax *CartTax,
+) CartTotals {
+	totals := CartTotals{Lines: make([]LineTotal, 0, len(cartItems))}
+	for _, cartItem := range cartItems {
+		unitPrice := ToCents(float64(cartItem.Price))
+		line := LineTotal{
+			InventoryItemId: cartItem.InventoryItemId,
+			VariantId:       cartItem.VariantId,
+			Quantity:        cartItem.Quantity,
+			UnitPriceCents:  unitPrice,
+			LineTotalCents:  unitPrice * Cents(cartItem.Quantity),
+		}
+		totals.SubtotalCents += line.LineTotalCents
+		totals.Lines = append(totals.Lines, line)
+	}
+
+	if shippingOption != nil {
+		totals.ShippingCents = ToCents(shippingOption.Price)
+	}
+
+	if couponEvaluation != nil {
+		if couponEvaluation.FreeShipping {
+			totals.ShippingCents = 0
+		}
+
+		eligibleLineTotals := make([]Cents, len(totals.Lines))
+		var eligibleSubtotal Cents
+		for i, line := range totals.Lines {
+			if couponEvaluation.AppliesTo(line.InventoryItemId) {
+				eligibleLineTotals[i] = line.LineTotalCents
+				eligibleSubtotal += line.LineTotalCents
+			}
+		}
+		totals.DiscountCents = min(couponEvaluation.DiscountCents, eligibleSubtotal)
+		for i, discount := range allocateCents(totals.DiscountCents, eligibleLineTotals) {
+			totals.Lines[i].DiscountCents = discount
+		}
+	}
+
+	if cartTax != nil {
+		totals.PricesIncludeTax = cartTax.Rules.PricesIncludeTax()
+		totals.TaxLocation = cartTax.Location
+		for i, line := range totals.Lines {
+			category := cartTax.Categories[line.InventoryItemId]
+			rate := cartTax.Rules.RateBasisPoints(cartTax.Location, category)
+			totals.Lines[i].TaxCategory = category
+			totals.Lines[i].TaxRateBasisPoints = rate
+			totals.Lines[i].TaxCents = TaxOn(line.LineTotalCents-line.DiscountCents, rate, totals.PricesIncludeTax)
+			totals.TaxCents += totals.Lines[i].TaxCents
+		}
+	}
+
+	totals.TotalCents = totals.SubtotalCents - totals.DiscountCents + totals.ShippingCents
+	if !totals.PricesIncludeTax {
+		totals.TotalCents += totals.TaxCents
+	}
+	totals.AmountDueCents = totals.TotalCents
+	return totals
+}
+
+// ApplyGiftCards pays as much of the total as giftCardCents covers
+func (t *CartTotals) ApplyGiftCards(giftCardCents Cents) {
+	t.GiftCardCents = max(min(giftCardCents, t.TotalCents), 0)
+	t.AmountDueCents = t.TotalCents - t.GiftCardCents
+}
+
+func newCartTax(db DBTX, taxRules TaxRules, location TaxLocation, cartItems []CartItem) (*CartTax, error) {
+	resolvedLocation, locationErr := taxRules.ResolveLocation(location)
+	if locationErr != nil {
+		return nil, locationErr
+	}
+	categories, categoriesErr := getTaxCategories(db, taxRules, cartItems)
+	if categoriesErr != nil {
+		return nil, categoriesErr
+	}
+	return &CartTax{Rules: taxRules, Location: resolvedLocation, Categories: categories}, nil
+}
+
+/*
+PriceCart prices the user's cart, optionally with a shipping option (0 for none) and a
+coupon code (empty for none), taxed for location, less any gift cards the user has
+redeemed against it. Unknown shipping options, bad locations and coupons the cart
+doesn't qualify for are returned as a StatusBadRequestError.
+*/
+func PriceCart(
+	dbPool *pgxpool.Pool,
+	taxRules TaxRules,
+	userId int,
+	cartItems []CartItem,
+	shippingOptionId int,
+	couponCode string,
+	location TaxLocation,
+) (CartTotals, error) {
+	var shippingOption *ShippingOption
+	if shippingOptionId > 0 {
+		option, shippingErr := getShippingOptionById(dbPool, shippingOptionId)
+		if errors.Is(shippingErr, pgx.ErrNoRows) {
+			return CartTotals{}, &StatusBadRequestError{
+				StatusCode: http.StatusBadRequest,
+				Message:    "Invalid shipping option",
+				ErrorCode:  ErrorCodeInvalidShippingOption,
+			}
+		}
+		if shippingErr != nil {
+			return CartTotals{}, shippingErr
+		}
+		shippingOption = &option
+	}
+
+	var couponEvaluation *CouponEvaluation
+	if len(couponCode) > 0 {
+		_, evaluation, couponErr := evaluateCoupon(dbPool, false, couponCode, userId, cartItems, shippingOption)
+		if errors.Is(couponErr, pgx.ErrNoRows) {
+			return CartTotals{}, newCouponError("Invalid coupon code", ErrorCodeInvalidCouponCode)
+		}
+		if couponErr != nil {
+			return CartTotals{}, couponErr
+		}
+		couponEvaluation = &evaluation
+	}
+
+	cartTax, cartTaxErr := newCartTax(dbPool, taxRules, location, cartItems)
+	if cartTaxErr != nil {
+		return CartTotals{}, cartTaxErr
+	}
+
+	totals := CalculateCartTotals(cartItems, shippingOption, couponEvaluation, cartTax)
+	if userId > 0 {
+		giftCardCents, giftCardErr := getPendingGiftCardCents(dbPool, userId)
+		if giftCardErr != nil {
+			return CartTotals{}, giftCardErr
+		}
+		totals.ApplyGiftCards(giftCardCents)
+	}
+	return totals, nil
+}
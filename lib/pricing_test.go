@@ -0,0 +1,94 @@
+package lib
+
+import "testing"
+
+func TestCents(t *testing.T) {
+	if ToCents(9.99) != 999 || ToCents(0.1+0.2) != 30 || ToCents(float64(float32(12.95))) != 1295 {
+		t.Fatal("ToCents should round to the nearest cent")
+	}
+	if Cents(-1205).String() != "-12.05" || Cents(7).String() != "0.07" {
+		t.Fatalf("Unexpected formatting: %v %v", Cents(-1205), Cents(7))
+	}
+	if Cents(2500).Percent(10) != 250 || Cents(105).Percent(50) != 53 {
+		t.Fatal("Percent should round half cents up")
+	}
+}
+
+func TestCalculateCartTotals(t *testing.T) {
+	cartItems := []CartItem{
+		{InventoryItemId: 1, Price: 9.99, Quantity: 2},
+		{InventoryItemId: 2, Price: 12.50, Quantity: 1},
+	}
+	shippingOption := ShippingOption{Price: 5.99}
+	totals := CalculateCartTotals(cartItems, &shippingOption, nil, nil)
+	if totals.SubtotalCents != 3248 || totals.ShippingCents != 599 || totals.TotalCents != 3847 {
+		t.Fatalf("Unexpected totals: %+v", totals)
+	}
+	if len(totals.Lines) != 2 || totals.Lines[0].LineTotalCents != 1998 {
+		t.Fatalf("Unexpected lines: %+v", totals.Lines)
+	}
+
+	totals = CalculateCartTotals(cartItems, nil, nil, nil)
+	if totals.ShippingCents != 0 || totals.TotalCents != 3248 {
+		t.Fatalf("Totals without shipping: %+v", totals)
+	}
+}
+
+func TestCalculateCartTotalsWithCoupons(t *testing.T) {
+	cartItems := []CartItem{{InventoryItemId: 1, Price: 20, Quantity: 1}}
+	shippingOption := ShippingOption{Price: 5}
+
+	percentDiscount := CouponEvaluation{EligibleInventoryItemIds: []int{1}, DiscountCents: 200}
+	totals := CalculateCartTotals(cartItems, &shippingOption, &percentDiscount, nil)
+	if totals.DiscountCents != 200 || totals.TotalCents != 2300 || totals.Lines[0].DiscountCents != 200 {
+		t.Fatalf("Percent coupon totals mismatch: %+v", totals)
+	}
+
+	freeShipping := CouponEvaluation{FreeShipping: true}
+	totals = CalculateCartTotals(cartItems, &shippingOption, &freeShipping, nil)
+	if totals.ShippingCents != 0 || totals.TotalCents != 2000 {
+		t.Fatalf("Free shipping coupon totals mismatch: %+v", totals)
+	}
+
+	oversizedDiscount := CouponEvaluation{EligibleInventoryItemIds: []int{1}, DiscountCents: 5000}
+	totals = CalculateCartTotals(cartItems, &shippingOption, &oversizedDiscount, nil)
+	if totals.DiscountCents != 2000 || totals.TotalCents != 500 {
+		t.Fatalf("Discount should be capped at the eligible subtotal: %+v", totals)
+	}
+}
+
+func TestCalculateCartTotalsSpreadsDiscount(t *testing.T) {
+	cartItems := []CartItem{
+		{InventoryItemId: 1, Price: 1, Quantity: 1},
+		{InventoryItemId: 2, Price: 1, Quantity: 1},
+		{InventoryItemId: 3, Price: 1, Quantity: 1},
+		{InventoryItemId: 4, Price: 50, Quantity: 1},
+	}
+	evaluation := CouponEvaluation{EligibleInventoryItemIds: []int{1, 2, 3}, DiscountCents: 100}
+	totals := CalculateCartTotals(cartItems, nil, &evaluation, nil)
+
+	var lineDiscounts Cents
+	for _, line := range totals.Lines {
+		lineDiscounts += line.DiscountCents
+	}
+	if lineDiscounts != 100 || totals.Lines[3].DiscountCents != 0 {
+		t.Fatalf("Line discounts should add up to the discount on eligible lines only: %+v", totals.Lines)
+	}
+}
+
+func TestApplyGiftCards(t *testing.T) {
+	totals := CalculateCartTotals([]CartItem{{InventoryItemId: 1, Price: 9.99, Quantity: 2}}, nil, nil, nil)
+	if totals.AmountDueCents != 1998 {
+		t.Fatalf("Amount due should default to the total: %+v", totals)
+	}
+
+	totals.ApplyGiftCards(500)
+	if totals.GiftCardCents != 500 || totals.AmountDueCents != 1498 {
+		t.Fatalf("Unexpected totals with gift card: %+v", totals)
+	}
+
+	totals.ApplyGiftCards(5000)
+	if totals.GiftCardCents != 1998 || totals.AmountDueCents != 0 {
+		t.Fatalf("Gift cards shouldn't pay more than the total: %+v", totals)
+	}
+}
@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const MinSpiceRating = 1
+const MaxSpiceRating = 5
+
+// ProductFilters - empty values are not filtered on. Prices are what items sell for now.
+type ProductFilters struct {
+	TagIds []int
+	// MatchAllTags only matches items with every one of TagIds, rather than any of them
+	MatchAllTags     bool
+	MinPrice         *float32
+	MaxPrice         *float32
+	MinSpiceRating   int
+	MaxSpiceRating   int
+	MinAverageRating float32
+	MinReviewCount   int
+}
+
+type TagFacet struct {
+	Id    int    `json:"id" db:"id"`
+	Name  string `json:"name" db:"name"`
+	Slug  string `json:"slug" db:"slug"`
+	Count int    `json:"count" db:"count"`
+}
+
+type SpiceRatingFacet struct {
+	SpiceRating int `json:"spiceRating" db:"spice_rating"`
+	Count       int `json:"count" db:"count"`
+}
+
+// ProductFacets - how many items each filter option would give. Each facet's counts take the
+// other filters into account but not its own, so choosing another option never looks like a dead end.
+type ProductFacets struct {
+	Tags         []TagFacet         `json:"tags"`
+	SpiceRatings []SpiceRatingFacet `json:"spiceRatings"`
+}
+
+// filteredItemsQuery selects InventoryItems, aliased as "items", for use with getProductFiltersClause
+func filteredItemsQuery(whereClause string) string {
+	return `
+		SELECT items.*
+		FROM (
+			SELECT ` + inventoryItemColumns + `
+			FROM inventories i` + itemSaleJoin + `
+		) items
+		WHERE 1=1
+		` + whereClause
+}
+
+func getProductFiltersClause(filters ProductFilters) (string, []any) {
+	var whereClause strings.Builder
+	var args []any
+	if len(filters.TagIds) > 0 {
+		tagIds := slices.Clone(filters.TagIds)
+		slices.Sort(tagIds)
+		tagIds = slices.Compact(tagIds)
+		args = append(args, tagIds)
+		if filters.MatchAllTags {
+			args = append(args, len(tagIds))
+			whereClause.WriteString(fmt.Sprintf(`AND (
+			SELECT COUNT(DISTINCT it.tag_id)
+			FROM inventory_tags it
+			WHERE it.inventory_id = items.id
+			AND it.tag_id = ANY($%d)
+		) = $%d
+		`, len(args)-1, len(args)))
+		} else {
+			whereClause.WriteString(fmt.Sprintf(`AND EXISTS (
+			SELECT 1
+			FROM inventory_tags it
+			WHERE it.inventory_id = items.id
+			AND it.tag_id = ANY($%d)
+		)
+		`, len(args)))
+		}
+	}
+	if filters.MinPrice != nil {
+		args = append(args, *filters.MinPrice)
+		whereClause.WriteString(fmt.Sprintf("AND items.price >= $%d\n", len(args)))
+	}
+	if filters.MaxPrice != nil {
+		args = append(args, *filters.MaxPrice)
+		whereClause.WriteString(fmt.Sprintf("AND items.price <= $%d\n", len(args)))
+	}
+	if filters.MinSpiceRating > 0 {
+		args = append(args, filters.MinSpiceRating)
+		whereClause.WriteString(fmt.Sprintf("AND items.spice_rating >= $%d\n", len(args)))
+	}
+	if filters.MaxSpiceRating > 0 {
+		args = append(args, filters.MaxSpiceRating)
+		whereClause.WriteString(fmt.Sprintf("AND items.spice_rating <= $%d\n", len(args)))
+	}
+	if filters.MinAverageRating > 0 {
+		args = append(args, filters.MinAverageRating)
+		whereClause.WriteString(fmt.Sprintf("AND items.average_rating >= $%d\n", len(args)))
+	}
+	if filters.MinReviewCount > 0 {
+		args = append(args, filters.MinReviewCount)
+		whereClause.WriteString(fmt.Sprintf("AND items.review_count >= $%d\n", len(args)))
+	}
+	return whereClause.String(), args
+}
+
+// GetProductFacets counts the items each tag and spice rating would give alongside the other filters
+func GetProductFacets(dbPool *pgxpool.Pool, filters ProductFilters) (ProductFacets, error) {
+	ctx := context.Background()
+	tagFilters := filters
+	// With all tags to match, choosing another narrows the results, so the tags already chosen still count
+	if !filters.MatchAllTags {
+		tagFilters.TagIds = nil
+	}
+	tagWhereClause, tagArgs := getProductFiltersClause(tagFilters)
+	tagQuery := `
+		SELECT t.id, t.name, t.slug, COUNT(matching.id) AS count
+		FROM tags t
+		LEFT JOIN inventory_tags it ON it.tag_id = t.id
+		LEFT JOIN (` + filteredItemsQuery(tagWhereClause) + `
+		) matching ON matching.id = it.inventory_id
+		GROUP BY t.id, t.name, t.slug
+		ORDER BY t.name
+	`
+	tagRows, tagErr := dbPool.Query(ctx, tagQuery, tagArgs...)
+	if tagErr != nil {
+		return ProductFacets{}, tagErr
+	}
+	tagFacets, tagCollectErr := pgx.CollectRows(tagRows, pgx.RowToStructByName[TagFacet])
+	if tagCollectErr != nil {
+		return ProductFacets{}, tagCollectErr
+	}
+
+	spiceFilters := filters
+	spiceFilters.MinSpiceRating = 0
+	spiceFilters.MaxSpiceRating = 0
+	spiceWhereClause, spiceArgs := getProductFiltersClause(spiceFilters)
+	spiceRatings := fmt.Sprintf("GENERATE_SERIES(%d, %d)", MinSpiceRating, MaxSpiceRating)
+	spiceQuery := `
+		SELECT s.spice_rating, COUNT(matching.id) AS count
+		FROM ` + spiceRatings + ` AS s(spice_rating)
+		LEFT JOIN (` + filteredItemsQuery(spiceWhereClause) + `
+		) matching ON matching.spice_rating = s.spice_rating
+		GROUP BY s.spice_rating
+		ORDER BY s.spice_rating
+	`
+	spiceRows, spiceErr := dbPool.Query(ctx, spiceQuery, spiceArgs...)
+	if spiceErr != nil {
+		return ProductFacets{}, spiceErr
+	}
+	spiceFacets, spiceCollectErr := pgx.CollectRows(spiceRows, pgx.RowToStructByName[SpiceRatingFacet])
+	if spiceCollectErr != nil {
+		return ProductFacets{}, spiceCollectErr
+	}
+
+	return ProductFacets{Tags: tagFacets, SpiceRatings: spiceFacets}, nil
+}
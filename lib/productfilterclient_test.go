@@ -0,0 +1,44 @@
+package lib
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGetProductFiltersClause(t *testing.T) {
+	whereClause, args := getProductFiltersClause(ProductFilters{})
+	if whereClause != "" || len(args) != 0 {
+		t.Fatalf("Expected no filters, got %q %v", whereClause, args)
+	}
+
+	minPrice := float32(5)
+	whereClause, args = getProductFiltersClause(ProductFilters{
+		TagIds:         []int{3, 1, 3},
+		MatchAllTags:   true,
+		MinPrice:       &minPrice,
+		MaxSpiceRating: 4,
+		MinReviewCount: 2,
+	})
+	if len(args) != 5 {
+		t.Fatalf("Expected 5 args, got %v", args)
+	}
+	if tagIds, ok := args[0].([]int); !ok || !slices.Equal(tagIds, []int{1, 3}) {
+		t.Fatalf("Expected deduplicated tag ids, got %v", args[0])
+	}
+	if args[1] != 2 {
+		t.Fatalf("Expected all 2 tags to be matched, got %v", args[1])
+	}
+	for _, expected := range []string{
+		"ANY($1)", ") = $2", "items.price >= $3", "items.spice_rating <= $4", "items.review_count >= $5",
+	} {
+		if !strings.Contains(whereClause, expected) {
+			t.Fatalf("Expected %q in %q", expected, whereClause)
+		}
+	}
+
+	whereClause, args = getProductFiltersClause(ProductFilters{TagIds: []int{2}})
+	if !strings.Contains(whereClause, "EXISTS") || len(args) != 1 {
+		t.Fatalf("Expected any tag to match, got %q %v", whereClause, args)
+	}
+}
@@ -0,0 +1,356 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const ProductImagePath = "ui/src/public/images/products/"
+
+// MaxProductImagesPerUpload caps how many images one upload can add to a gallery
+const MaxProductImagesPerUpload = 10
+
+type ProductImage struct {
+	Id                int       `json:"id" db:"id"`
+	InventoryItemId   int       `json:"inventoryItemId" db:"inventory_item_id"`
+	Filename          string    `json:"filename" db:"filename"`
+	ThumbnailFilename string    `json:"thumbnailFilename" db:"thumbnail_filename"`
+	MimeType          string    `json:"mimeType" db:"mime_type"`
+	OrigWidth         int       `json:"origWidth" db:"orig_width"`
+	OrigHeight        int       `json:"origHeight" db:"orig_height"`
+	ThumbnailWidth    int       `json:"thumbnailWidth" db:"thumbnail_width"`
+	ThumbnailHeight   int       `json:"thumbnailHeight" db:"thumbnail_height"`
+	Position          int       `json:"position" db:"position"`
+	IsPrimary         bool      `json:"isPrimary" db:"is_primary"`
+	CreatedAt         time.Time `json:"createdAt" db:"created_at"`
+}
+
+type ProductImageOrderRequest struct {
+	ImageIds []int `json:"imageIds" validate:"required,min=1"`
+}
+
+// primaryImageColumns - the primary image's thumbnail, for use in inventory item queries aliased as "i"
+const primaryImageColumns = `(SELECT pi.thumbnail_filename
+		        FROM inventory_item_images pi WHERE pi.inventory_item_id = i.id AND pi.is_primary) AS thumbnail_filename,
+		       (SELECT pi.thumbnail_width
+		        FROM inventory_item_images pi WHERE pi.inventory_item_id = i.id AND pi.is_primary) AS thumbnail_width,
+		       (SELECT pi.thumbnail_height
+		        FROM inventory_item_images pi WHERE pi.inventory_item_id = i.id AND pi.is_primary) AS thumbnail_height`
+
+// IsSupportedProductImageType - CreateThumbnail can make thumbnails of these
+func IsSupportedProductImageType(mimeType string) bool {
+	return slices.Contains([]string{"image/png", "image/jpeg", "image/gif"}, mimeType)
+}
+
+func newInvalidProductImageOrderError(message string) *StatusBadRequestError {
+	return &StatusBadRequestError{
+		StatusCode: http.StatusBadRequest,
+		Message:    message,
+		ErrorCode:  ErrorCodeInvalidProductImageOrder,
+	}
+}
+
+// validateProductImageOrder checks the new order lists every one of the gallery's images exactly once
+func validateProductImageOrder(imageIds []int, galleryImageIds []int) error {
+	if len(imageIds) != len(galleryImageIds) {
+		return newInvalidProductImageOrderError(
+			fmt.Sprintf("Expected all %v of the product's images, got %v", len(galleryImageIds), len(imageIds)),
+		)
+	}
+	seen := make(map[int]bool, len(imageIds))
+	for _, imageId := range imageIds {
+		if !slices.Contains(galleryImageIds, imageId) {
+			return newInvalidProductImageOrderError(fmt.Sprintf("Image %v isn't one of the product's", imageId))
+		}
+		if seen[imageId] {
+			return newInvalidProductImageOrderError(fmt.Sprintf("Image %v is listed more than once", imageId))
+		}
+		seen[imageId] = true
+	}
+	return nil
+}
+
+// lockProductGallery makes changes to the item's images wait for each other until the transaction ends
+func lockProductGallery(tx pgx.Tx, inventoryItemId int) error {
+	var id int
+	return tx.QueryRow(
+		context.Background(), `SELECT id FROM inventories WHERE id = $1 FOR UPDATE`, inventoryItemId,
+	).Scan(&id)
+}
+
+func getProductImages(db DBTX, inventoryItemId int) ([]ProductImage, error) {
+	const query = `
+		SELECT *
+		FROM inventory_item_images
+		WHERE inventory_item_id = $1
+		ORDER BY position, id
+	`
+	rows, err := db.Query(context.Background(), query, inventoryItemId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[ProductImage])
+}
+
+// GetProductImages lists the item's gallery in order
+func GetProductImages(dbPool *pgxpool.Pool, inventoryItemId int) ([]ProductImage, error) {
+	return getProductImages(dbPool, inventoryItemId)
+}
+
+// AddProductImages puts images that have been saved and thumbnailed at the end of the item's gallery, in
+// order. Either all of them are added or none are. The gallery's first image becomes its primary one.
+func AddProductImages(
+	dbPool *pgxpool.Pool, logger *slog.Logger, inventoryItemId int, imageInfos []SavedPostImageInfo,
+) ([]ProductImage, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return nil, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("AddProductImages: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	lockErr := lockProductGallery(tx, inventoryItemId)
+	if lockErr != nil {
+		return nil, lockErr
+	}
+
+	images := make([]ProductImage, 0, len(imageInfos))
+	for _, imageInfo := range imageInfos {
+		image, addErr := addProductImage(tx, inventoryItemId, imageInfo)
+		if addErr != nil {
+			return nil, addErr
+		}
+		images = append(images, image)
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return nil, commitErr
+	}
+	return images, nil
+}
+
+// addProductImage puts the image at the end of the item's gallery. The gallery has to be locked.
+func addProductImage(tx pgx.Tx, inventoryItemId int, imageInfo SavedPostImageInfo) (ProductImage, error) {
+
+	const query = `
+		INSERT INTO inventory_item_images (
+			inventory_item_id,
+			filename,
+			thumbnail_filename,
+			mime_type,
+			orig_width,
+			orig_height,
+			thumbnail_width,
+			thumbnail_height,
+			position,
+			is_primary,
+			created_at
+		)
+		SELECT $1, $2, $3, $4, $5, $6, $7, $8,
+		       COALESCE(MAX(position) + 1, 0),
+		       NOT COALESCE(BOOL_OR(is_primary), FALSE),
+		       NOW()
+		FROM inventory_item_images
+		WHERE inventory_item_id = $1
+		RETURNING *
+	`
+	rows, insertErr := tx.Query(
+		context.Background(),
+		query,
+		inventoryItemId,
+		imageInfo.Filename,
+		imageInfo.ThumbnailFilename,
+		imageInfo.MimeType,
+		imageInfo.ImageWidthHeight.Width,
+		imageInfo.ImageWidthHeight.Height,
+		imageInfo.ThumbnailWidthHeight.Width,
+		imageInfo.ThumbnailWidthHeight.Height,
+	)
+	if insertErr != nil {
+		return ProductImage{}, insertErr
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[ProductImage])
+}
+
+/*
+ReorderProductImages
+ 1. Lock the gallery and check the new order has every one of its images exactly once
+ 2. Number the images in the new order
+*/
+func ReorderProductImages(
+	dbPool *pgxpool.Pool, logger *slog.Logger, inventoryItemId int, imageIds []int,
+) ([]ProductImage, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return nil, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("ReorderProductImages: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	lockErr := lockProductGallery(tx, inventoryItemId)
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	images, imagesErr := getProductImages(tx, inventoryItemId)
+	if imagesErr != nil {
+		return nil, imagesErr
+	}
+	galleryImageIds := make([]int, len(images))
+	for i, image := range images {
+		galleryImageIds[i] = image.Id
+	}
+	validationErr := validateProductImageOrder(imageIds, galleryImageIds)
+	if validationErr != nil {
+		return nil, validationErr
+	}
+
+	const query = `
+		UPDATE inventory_item_images pi
+		SET position = ordered.position - 1
+		FROM UNNEST($2::INTEGER[]) WITH ORDINALITY AS ordered(id, position)
+		WHERE pi.id = ordered.id
+		AND pi.inventory_item_id = $1
+	`
+	_, updateErr := tx.Exec(ctx, query, inventoryItemId, imageIds)
+	if updateErr != nil {
+		return nil, updateErr
+	}
+	reordered, reorderedErr := getProductImages(tx, inventoryItemId)
+	if reorderedErr != nil {
+		return nil, reorderedErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return nil, commitErr
+	}
+	return reordered, nil
+}
+
+// SetPrimaryProductImage makes the image the one shown in product lists.
+// Returns pgx.ErrNoRows if the item has no such image.
+func SetPrimaryProductImage(dbPool *pgxpool.Pool, logger *slog.Logger, inventoryItemId int, imageId int) error {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("SetPrimaryProductImage: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	lockErr := lockProductGallery(tx, inventoryItemId)
+	if lockErr != nil {
+		return lockErr
+	}
+	// The old primary goes first, so the unique primary index is never broken part way through
+	const unsetQuery = `
+		UPDATE inventory_item_images
+		SET is_primary = FALSE
+		WHERE inventory_item_id = $1
+		AND is_primary
+		AND id <> $2
+	`
+	_, unsetErr := tx.Exec(ctx, unsetQuery, inventoryItemId, imageId)
+	if unsetErr != nil {
+		return unsetErr
+	}
+	const setQuery = `
+		UPDATE inventory_item_images
+		SET is_primary = TRUE
+		WHERE id = $2
+		AND inventory_item_id = $1
+	`
+	setResult, setErr := tx.Exec(ctx, setQuery, inventoryItemId, imageId)
+	if setErr != nil {
+		return setErr
+	}
+	if setResult.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return tx.Commit(ctx)
+}
+
+// DeleteProductImage removes the image from the gallery and returns it, so its files can be deleted too.
+// When it was the primary image, the first one left takes over. Returns pgx.ErrNoRows if the item has no such image.
+func DeleteProductImage(
+	dbPool *pgxpool.Pool, logger *slog.Logger, inventoryItemId int, imageId int,
+) (ProductImage, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return ProductImage{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("DeleteProductImage: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	lockErr := lockProductGallery(tx, inventoryItemId)
+	if lockErr != nil {
+		return ProductImage{}, lockErr
+	}
+	const deleteQuery = `
+		DELETE FROM inventory_item_images
+		WHERE id = $1
+		AND inventory_item_id = $2
+		RETURNING *
+	`
+	rows, deleteErr := tx.Query(ctx, deleteQuery, imageId, inventoryItemId)
+	if deleteErr != nil {
+		return ProductImage{}, deleteErr
+	}
+	image, collectErr := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[ProductImage])
+	if collectErr != nil {
+		return ProductImage{}, collectErr
+	}
+
+	if image.IsPrimary {
+		const promoteQuery = `
+			UPDATE inventory_item_images
+			SET is_primary = TRUE
+			WHERE id = (
+				SELECT id
+				FROM inventory_item_images
+				WHERE inventory_item_id = $1
+				ORDER BY position, id
+				LIMIT 1
+			)
+		`
+		_, promoteErr := tx.Exec(ctx, promoteQuery, inventoryItemId)
+		if promoteErr != nil {
+			return ProductImage{}, promoteErr
+		}
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return ProductImage{}, commitErr
+	}
+	return image, nil
+}
@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateProductImageOrder(t *testing.T) {
+	gallery := []int{4, 7, 9}
+	if err := validateProductImageOrder([]int{9, 4, 7}, gallery); err != nil {
+		t.Fatalf("Order should be valid: %v", err)
+	}
+
+	cases := map[string]error{
+		"missing an image": validateProductImageOrder([]int{9, 4}, gallery),
+		"another's image":  validateProductImageOrder([]int{9, 4, 8}, gallery),
+		"an image twice":   validateProductImageOrder([]int{9, 4, 4}, gallery),
+	}
+	for name, err := range cases {
+		var badRequestErr *StatusBadRequestError
+		if !errors.As(err, &badRequestErr) || badRequestErr.ErrorCode != ErrorCodeInvalidProductImageOrder {
+			t.Fatalf("%v: expected %v, got %v", name, ErrorCodeInvalidProductImageOrder, err)
+		}
+	}
+}
+
+func TestIsSupportedProductImageType(t *testing.T) {
+	for _, mimeType := range []string{"image/png", "image/jpeg", "image/gif"} {
+		if !IsSupportedProductImageType(mimeType) {
+			t.Fatalf("Expected %v to be supported", mimeType)
+		}
+	}
+	// Thumbnails can't be made of WebP images
+	for _, mimeType := range []string{"image/webp", "application/pdf"} {
+		if IsSupportedProductImageType(mimeType) {
+			t.Fatalf("Expected %v not to be supported", mimeType)
+		}
+	}
+}
@@ -32,6 +32,7 @@ const UserRoleMessageBoardAdmin = "Message Board Admin"
 const UserRoleSuperAdmin = "Super Message Board Admin"
 const UserRoleUserAdmin = "User Admin"
 const UserRoleMessageBoardModerator = "Message Board Moderator"
+const UserRoleShopAdmin = "Shop Admin"
 
 // UpdateUserRoles
 // - Delete existing user roles
@@ -174,6 +175,13 @@ func IsUserAdmin(c *gin.Context, dbPool *pgxpool.Pool, logger *slog.Logger) (boo
 	return UserHasRole(c, dbPool, logger, UserRoleUserAdmin)
 }
 
+// IsShopAdmin - may manage products and their variants, bundles, sales, images and stock, catalogue
+// imports, coupons, shipping options, gift cards and subscription plans, and see shop reports.
+// Sends JSON response upon failure
+func IsShopAdmin(c *gin.Context, dbPool *pgxpool.Pool, logger *slog.Logger) (bool, error) {
+	return UserHasRole(c, dbPool, logger, UserRoleShopAdmin)
+}
+
 // IsSuperMessageBoardAdmin Sends JSON response upon failure
 func IsSuperMessageBoardAdmin(c *gin.Context, dbPool *pgxpool.Pool, logger *slog.Logger) (bool, error) {
 	return UserHasRole(c, dbPool, logger, UserRoleSuperAdmin)
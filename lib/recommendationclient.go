@@ -0,0 +1,323 @@
+package lib
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const RecommendationsPerItem = 8
+
+// A review rated at least this means the customer liked the item
+const RecommendationLikeRating = 4
+
+// Items liked by fewer customers than this get recommendations by tags and heat instead
+const RecommendationMinLikes = 3
+
+// Where a recommendation came from
+const (
+	RecommendationSourceReviews = "reviews"
+	RecommendationSourceTags    = "tags"
+)
+
+type Recommendation struct {
+	InventoryItem
+	Score  float32 `json:"score" db:"score"`
+	Source string  `json:"source" db:"source"`
+}
+
+// productSimilarity is a row of product_similarities
+type productSimilarity struct {
+	InventoryItemId int
+	SimilarItemId   int
+	Score           float32
+	Source          string
+}
+
+// itemLike is a customer who liked an item
+type itemLike struct {
+	InventoryItemId int `db:"inventory_item_id"`
+	UserId          int `db:"user_id"`
+}
+
+// similarityItem is what the tag and heat fallback compares items on
+type similarityItem struct {
+	Id          int   `db:"id"`
+	SpiceRating int   `db:"spice_rating"`
+	TagIds      []int `db:"tag_ids"`
+}
+
+// coLikeScore - how many customers liked both items, relative to how many liked each
+func coLikeScore(likedBoth int, likesA int, likesB int) float32 {
+	return float32(float64(likedBoth) / math.Sqrt(float64(likesA)*float64(likesB)))
+}
+
+// contentSimilarityScore - how alike two items are without reviews to go on: the share of
+// their tags they have in common counts for 70%, and how close their spice ratings are for 30%
+func contentSimilarityScore(a similarityItem, b similarityItem) float32 {
+	shared := 0
+	for _, tagId := range a.TagIds {
+		if slices.Contains(b.TagIds, tagId) {
+			shared++
+		}
+	}
+	tagShare := 0.0
+	if allTags := len(a.TagIds) + len(b.TagIds) - shared; allTags > 0 {
+		tagShare = float64(shared) / float64(allTags)
+	}
+	heat := 1 - math.Abs(float64(a.SpiceRating-b.SpiceRating))/float64(MaxSpiceRating-MinSpiceRating)
+	return float32(0.7*tagShare + 0.3*heat)
+}
+
+// topSimilarities keeps the best scored, up to limit. Ties go to the lower item id.
+func topSimilarities(similarities []productSimilarity, limit int) []productSimilarity {
+	slices.SortFunc(similarities, func(a productSimilarity, b productSimilarity) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), cmp.Compare(a.SimilarItemId, b.SimilarItemId))
+	})
+	return similarities[:min(limit, len(similarities))]
+}
+
+// coLikeSimilarities scores each item liked by enough customers against the other items those customers
+// liked. likes holds the customers who liked each item, each once.
+func coLikeSimilarities(likes map[int][]int) map[int][]productSimilarity {
+	likedByUser := make(map[int][]int)
+	for inventoryItemId, userIds := range likes {
+		for _, userId := range userIds {
+			likedByUser[userId] = append(likedByUser[userId], inventoryItemId)
+		}
+	}
+
+	similarities := make(map[int][]productSimilarity)
+	for inventoryItemId, userIds := range likes {
+		if len(userIds) < RecommendationMinLikes {
+			continue
+		}
+		likedBoth := make(map[int]int)
+		for _, userId := range userIds {
+			for _, similarItemId := range likedByUser[userId] {
+				if similarItemId != inventoryItemId {
+					likedBoth[similarItemId]++
+				}
+			}
+		}
+		itemSimilarities := make([]productSimilarity, 0, len(likedBoth))
+		for similarItemId, count := range likedBoth {
+			itemSimilarities = append(itemSimilarities, productSimilarity{
+				InventoryItemId: inventoryItemId,
+				SimilarItemId:   similarItemId,
+				Score:           coLikeScore(count, len(userIds), len(likes[similarItemId])),
+				Source:          RecommendationSourceReviews,
+			})
+		}
+		similarities[inventoryItemId] = topSimilarities(itemSimilarities, RecommendationsPerItem)
+	}
+	return similarities
+}
+
+// contentSimilarities ranks the other items by how alike they are to item, leaving out those in exclude
+func contentSimilarities(
+	item similarityItem, items []similarityItem, exclude map[int]bool, limit int,
+) []productSimilarity {
+	similarities := make([]productSimilarity, 0, len(items))
+	for _, other := range items {
+		if other.Id == item.Id || exclude[other.Id] {
+			continue
+		}
+		similarities = append(similarities, productSimilarity{
+			InventoryItemId: item.Id,
+			SimilarItemId:   other.Id,
+			Score:           contentSimilarityScore(item, other),
+			Source:          RecommendationSourceTags,
+		})
+	}
+	return topSimilarities(similarities, limit)
+}
+
+// computeProductSimilarities - each item's co-liked items, topped up to RecommendationsPerItem with the
+// items most like it by tags and heat
+func computeProductSimilarities(likes map[int][]int, items []similarityItem) []productSimilarity {
+	coLiked := coLikeSimilarities(likes)
+	var similarities []productSimilarity
+	for _, item := range items {
+		itemSimilarities := coLiked[item.Id]
+		if missing := RecommendationsPerItem - len(itemSimilarities); missing > 0 {
+			exclude := make(map[int]bool, len(itemSimilarities))
+			for _, similarity := range itemSimilarities {
+				exclude[similarity.SimilarItemId] = true
+			}
+			itemSimilarities = append(itemSimilarities, contentSimilarities(item, items, exclude, missing)...)
+		}
+		similarities = append(similarities, itemSimilarities...)
+	}
+	return similarities
+}
+
+// getItemLikes returns the customers who liked each item
+func getItemLikes(db DBTX) (map[int][]int, error) {
+	const query = `
+		SELECT DISTINCT inventory_item_id, user_id
+		FROM inventory_item_reviews
+		WHERE rating >= $1
+	`
+	rows, err := db.Query(context.Background(), query, RecommendationLikeRating)
+	if err != nil {
+		return nil, err
+	}
+	itemLikes, collectErr := pgx.CollectRows(rows, pgx.RowToStructByName[itemLike])
+	if collectErr != nil {
+		return nil, collectErr
+	}
+	likes := make(map[int][]int)
+	for _, like := range itemLikes {
+		likes[like.InventoryItemId] = append(likes[like.InventoryItemId], like.UserId)
+	}
+	return likes, nil
+}
+
+func getSimilarityItems(db DBTX) ([]similarityItem, error) {
+	const query = `
+		SELECT i.id,
+		       i.spice_rating,
+		       ARRAY(SELECT DISTINCT tag_id FROM inventory_tags WHERE inventory_id = i.id ORDER BY tag_id) AS tag_ids
+		FROM inventories i
+		ORDER BY i.id
+	`
+	rows, err := db.Query(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[similarityItem])
+}
+
+/*
+RefreshProductSimilarities
+ 1. Load who liked what, and each item's tags and heat
+ 2. Score pairs of items by how many customers liked both, relative to how many liked each, and
+    fill up items without enough of those with the items most like them by tags and heat
+ 3. Replace the similarities, so items and reviews that have gone are forgotten
+*/
+func RefreshProductSimilarities(dbPool *pgxpool.Pool, logger *slog.Logger) (int, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return 0, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("RefreshProductSimilarities: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	likes, likesErr := getItemLikes(tx)
+	if likesErr != nil {
+		return 0, likesErr
+	}
+	items, itemsErr := getSimilarityItems(tx)
+	if itemsErr != nil {
+		return 0, itemsErr
+	}
+	similarities := computeProductSimilarities(likes, items)
+
+	_, deleteErr := tx.Exec(ctx, `DELETE FROM product_similarities`)
+	if deleteErr != nil {
+		return 0, deleteErr
+	}
+
+	inventoryItemIds := make([]int, 0, len(similarities))
+	similarItemIds := make([]int, 0, len(similarities))
+	scores := make([]float32, 0, len(similarities))
+	sources := make([]string, 0, len(similarities))
+	for _, similarity := range similarities {
+		inventoryItemIds = append(inventoryItemIds, similarity.InventoryItemId)
+		similarItemIds = append(similarItemIds, similarity.SimilarItemId)
+		scores = append(scores, similarity.Score)
+		sources = append(sources, similarity.Source)
+	}
+	const insertQuery = `
+		INSERT INTO product_similarities (inventory_item_id, similar_item_id, score, source, computed_at)
+		SELECT *, NOW()
+		FROM UNNEST($1::INTEGER[], $2::INTEGER[], $3::REAL[], $4::VARCHAR[])
+	`
+	insertResult, insertErr := tx.Exec(ctx, insertQuery, inventoryItemIds, similarItemIds, scores, sources)
+	if insertErr != nil {
+		return 0, insertErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return 0, commitErr
+	}
+	return int(insertResult.RowsAffected()), nil
+}
+
+// GetRecommendations lists what customers who liked the item also liked, best first. Items new since the
+// similarities were last refreshed get the items most like them by tags and heat straight away.
+// Returns pgx.ErrNoRows if there's no item with the slug.
+func GetRecommendations(dbPool *pgxpool.Pool, slug string) ([]Recommendation, error) {
+	ctx := context.Background()
+	var inventoryItemId int
+	itemErr := dbPool.QueryRow(ctx, `SELECT id FROM inventories WHERE slug = $1`, slug).Scan(&inventoryItemId)
+	if itemErr != nil {
+		return nil, itemErr
+	}
+
+	query := `
+		SELECT ` + inventoryItemColumns + `,
+		       ps.score,
+		       ps.source
+		FROM product_similarities ps
+		JOIN inventories i ON i.id = ps.similar_item_id` + itemSaleJoin + `
+		WHERE ps.inventory_item_id = $1
+		ORDER BY ps.source = 'reviews' DESC, ps.score DESC, i.id
+		LIMIT $2
+	`
+	rows, err := dbPool.Query(ctx, query, inventoryItemId, RecommendationsPerItem)
+	if err != nil {
+		return nil, err
+	}
+	recommendations, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[Recommendation])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+	if len(recommendations) > 0 {
+		return recommendations, nil
+	}
+
+	items, itemsErr := getSimilarityItems(dbPool)
+	if itemsErr != nil {
+		return nil, itemsErr
+	}
+	itemIndex := slices.IndexFunc(items, func(item similarityItem) bool { return item.Id == inventoryItemId })
+	if itemIndex < 0 {
+		return []Recommendation{}, nil
+	}
+	similarities := contentSimilarities(items[itemIndex], items, nil, RecommendationsPerItem)
+	similarItemIds := make([]int, 0, len(similarities))
+	scores := make([]float32, 0, len(similarities))
+	for _, similarity := range similarities {
+		similarItemIds = append(similarItemIds, similarity.SimilarItemId)
+		scores = append(scores, similarity.Score)
+	}
+
+	fallbackQuery := `
+		SELECT ` + inventoryItemColumns + `,
+		       s.score,
+		       'tags' AS source
+		FROM UNNEST($1::INTEGER[], $2::REAL[]) WITH ORDINALITY AS s(id, score, position)
+		JOIN inventories i ON i.id = s.id` + itemSaleJoin + `
+		ORDER BY s.position
+	`
+	fallbackRows, fallbackErr := dbPool.Query(ctx, fallbackQuery, similarItemIds, scores)
+	if fallbackErr != nil {
+		return nil, fallbackErr
+	}
+	return pgx.CollectRows(fallbackRows, pgx.RowToStructByName[Recommendation])
+}
@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"math"
+	"testing"
+)
+
+func expectScore(t *testing.T, name string, score float32, expected float64) {
+	t.Helper()
+	if math.Abs(float64(score)-expected) > 0.0001 {
+		t.Fatalf("%v: expected score %v, got %v", name, expected, score)
+	}
+}
+
+func TestCoLikeSimilarities(t *testing.T) {
+	likes := map[int][]int{
+		1: {10, 11, 12},
+		2: {10, 11},
+		3: {12},
+		4: {20},
+	}
+	similarities := coLikeSimilarities(likes)
+
+	itemSimilarities := similarities[1]
+	if len(itemSimilarities) != 2 {
+		t.Fatalf("Expected item 1 to be scored against the 2 items its fans liked, got %+v", itemSimilarities)
+	}
+	if itemSimilarities[0].SimilarItemId != 2 || itemSimilarities[1].SimilarItemId != 3 {
+		t.Fatalf("Expected the item liked by more of the same customers first, got %+v", itemSimilarities)
+	}
+	expectScore(t, "liked by 2 of 3 and 2 of 2", itemSimilarities[0].Score, 2/math.Sqrt(6))
+	expectScore(t, "liked by 1 of 3 and 1 of 1", itemSimilarities[1].Score, 1/math.Sqrt(3))
+	for _, similarity := range itemSimilarities {
+		if similarity.Source != RecommendationSourceReviews {
+			t.Fatalf("Expected co-liked items to come from reviews, got %v", similarity.Source)
+		}
+	}
+
+	if _, ok := similarities[2]; ok {
+		t.Fatalf("Expected an item with fewer than %v likes to be left to the fallback", RecommendationMinLikes)
+	}
+}
+
+func TestContentSimilarityScore(t *testing.T) {
+	item := similarityItem{Id: 1, SpiceRating: 3, TagIds: []int{1, 2}}
+
+	same := similarityItem{Id: 2, SpiceRating: 3, TagIds: []int{1, 2}}
+	expectScore(t, "same tags and heat", contentSimilarityScore(item, same), 1)
+	halfTags := similarityItem{Id: 3, SpiceRating: 3, TagIds: []int{2, 3}}
+	expectScore(t, "one of three tags in common, same heat", contentSimilarityScore(item, halfTags), 0.7/3+0.3)
+	hotter := similarityItem{Id: 4, SpiceRating: 5, TagIds: []int{4}}
+	expectScore(t, "no tags in common, heat 2 apart", contentSimilarityScore(item, hotter), 0.15)
+	untagged := similarityItem{Id: 5, SpiceRating: 1}
+	expectScore(t, "untagged, heat at opposite ends", contentSimilarityScore(untagged, similarityItem{SpiceRating: 5}), 0)
+}
+
+func TestContentSimilaritiesExcludesItemItself(t *testing.T) {
+	items := []similarityItem{
+		{Id: 1, SpiceRating: 3, TagIds: []int{1}},
+		{Id: 2, SpiceRating: 1, TagIds: []int{}},
+		{Id: 3, SpiceRating: 3, TagIds: []int{1}},
+		{Id: 4, SpiceRating: 3, TagIds: []int{1}},
+	}
+
+	similarities := contentSimilarities(items[0], items, map[int]bool{4: true}, RecommendationsPerItem)
+	if len(similarities) != 2 {
+		t.Fatalf("Expected the item itself and excluded items to be left out, got %+v", similarities)
+	}
+	if similarities[0].SimilarItemId != 3 || similarities[1].SimilarItemId != 2 {
+		t.Fatalf("Expected the most alike item first, got %+v", similarities)
+	}
+
+	limited := contentSimilarities(items[0], items, nil, 1)
+	if len(limited) != 1 || limited[0].SimilarItemId != 3 {
+		t.Fatalf("Expected only the best item, ties going to the lower id, got %+v", limited)
+	}
+}
+
+func TestComputeProductSimilaritiesFallsBackToTagsAndHeat(t *testing.T) {
+	items := make([]similarityItem, 0, RecommendationsPerItem+3)
+	for id := 1; id <= RecommendationsPerItem+3; id++ {
+		items = append(items, similarityItem{Id: id, SpiceRating: id%MaxSpiceRating + 1, TagIds: []int{id % 2}})
+	}
+	likes := map[int][]int{
+		1: {10, 11, 12},
+		2: {10, 11},
+	}
+
+	similarItemIds := make(map[int][]int)
+	sources := make(map[int][]string)
+	for _, similarity := range computeProductSimilarities(likes, items) {
+		if similarity.SimilarItemId == similarity.InventoryItemId {
+			t.Fatalf("Item %v was recommended for itself", similarity.InventoryItemId)
+		}
+		itemId := similarity.InventoryItemId
+		similarItemIds[itemId] = append(similarItemIds[itemId], similarity.SimilarItemId)
+		sources[itemId] = append(sources[itemId], similarity.Source)
+	}
+
+	for _, item := range items {
+		if len(similarItemIds[item.Id]) != RecommendationsPerItem {
+			t.Fatalf("Expected item %v to be filled up to %v, got %v", item.Id, RecommendationsPerItem, similarItemIds[item.Id])
+		}
+		seen := make(map[int]bool)
+		for _, similarItemId := range similarItemIds[item.Id] {
+			if seen[similarItemId] {
+				t.Fatalf("Item %v was recommended twice for item %v", similarItemId, item.Id)
+			}
+			seen[similarItemId] = true
+		}
+	}
+	if similarItemIds[1][0] != 2 || sources[1][0] != RecommendationSourceReviews {
+		t.Fatalf("Expected the co-liked item first, got %v %v", similarItemIds[1], sources[1])
+	}
+	for _, source := range sources[1][1:] {
+		if source != RecommendationSourceTags {
+			t.Fatalf("Expected the rest to come from tags and heat, got %v", sources[1])
+		}
+	}
+	for _, source := range sources[2] {
+		if source != RecommendationSourceTags {
+			t.Fatalf("Expected an item with too few likes to fall back on tags and heat, got %v", sources[2])
+		}
+	}
+}
@@ -0,0 +1,1018 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	ReturnStatusRequested = "requested"
+	ReturnStatusApproved  = "approved"
+	ReturnStatusRejected  = "rejected"
+	ReturnStatusReceived  = "received"
+	// ReturnStatusRefundPending - the refund is recorded but the provider hasn't refunded all of it yet
+	ReturnStatusRefundPending = "refund_pending"
+	ReturnStatusRefunded      = "refunded"
+)
+
+// Return - ProviderRefundCents is how much of the refund goes back through the payment provider,
+// and ProviderRefundedCents how much of that the provider has refunded so far
+type Return struct {
+	Id                    int        `json:"id" db:"id"`
+	ReturnNumber          string     `json:"returnNumber" db:"return_number"`
+	OrderId               int        `json:"orderId" db:"order_id"`
+	UserId                int        `json:"userId" db:"user_id"`
+	Status                string     `json:"status" db:"status"`
+	Reason                string     `json:"reason" db:"reason"`
+	ProviderRefundCents   int64      `json:"providerRefundCents" db:"provider_refund_cents"`
+	ProviderRefundedCents int64      `json:"providerRefundedCents" db:"provider_refunded_cents"`
+	CreatedAt             time.Time  `json:"createdAt" db:"created_at"`
+	UpdatedAt             *time.Time `json:"updatedAt" db:"updated_at"`
+}
+
+// ReturnItem is a returned order line, with the name, price, discount and tax it was ordered at
+type ReturnItem struct {
+	Id                int       `json:"id" db:"id"`
+	ReturnId          int       `json:"returnId" db:"return_id"`
+	OrderItemId       int       `json:"orderItemId" db:"order_item_id"`
+	Name              string    `json:"name" db:"name"`
+	Slug              string    `json:"slug" db:"slug"`
+	PriceCents        Cents     `json:"priceCents" db:"price_cents"`
+	Quantity          int       `json:"quantity" db:"quantity"`
+	OrderedQuantity   int       `json:"orderedQuantity" db:"ordered_quantity"`
+	LineDiscountCents Cents     `json:"lineDiscountCents" db:"line_discount_cents"`
+	LineTaxCents      Cents     `json:"lineTaxCents" db:"line_tax_cents"`
+	RefundedCents     Cents     `json:"refundedCents" db:"refunded_cents"`
+	CreatedAt         time.Time `json:"createdAt" db:"created_at"`
+}
+
+// returnItemColumns - the columns of ReturnItem, for use in queries on return_items aliased as "ri"
+// joined to order_items as "oi". Amounts are converted to cents from their NUMERIC columns.
+const returnItemColumns = `ri.id,
+		       ri.return_id,
+		       ri.order_item_id,
+		       oi.name,
+		       oi.slug,
+		       ROUND(oi.price * 100)::BIGINT AS price_cents,
+		       ri.quantity,
+		       oi.quantity AS ordered_quantity,
+		       ROUND(oi.discount_amount * 100)::BIGINT AS line_discount_cents,
+		       ROUND(oi.tax_amount * 100)::BIGINT AS line_tax_cents,
+		       ROUND(ri.refunded_amount * 100)::BIGINT AS refunded_cents,
+		       ri.created_at`
+
+type ReturnStatusHistoryEntry struct {
+	Id                int       `json:"id" db:"id"`
+	ReturnId          int       `json:"returnId" db:"return_id"`
+	Status            string    `json:"status" db:"status"`
+	Note              *string   `json:"note" db:"note"`
+	ChangedByUserId   *int      `json:"changedByUserId" db:"changed_by_user_id"`
+	ChangedByUsername *string   `json:"changedByUsername" db:"changed_by_username"`
+	CreatedAt         time.Time `json:"createdAt" db:"created_at"`
+}
+
+type ReturnDetail struct {
+	Return        Return                     `json:"return"`
+	Items         []ReturnItem               `json:"items"`
+	StatusHistory []ReturnStatusHistoryEntry `json:"statusHistory"`
+}
+
+// AdminReturn is a return along with its order and customer, for the admin return list
+type AdminReturn struct {
+	Return
+	OrderNumber string `json:"orderNumber" db:"order_number"`
+	Username    string `json:"username" db:"username"`
+}
+
+type ReturnItemRequest struct {
+	OrderItemId int `json:"orderItemId" validate:"required,min=1"`
+	Quantity    int `json:"quantity" validate:"required,min=1"`
+}
+
+type RequestReturnRequest struct {
+	Reason string              `json:"reason" validate:"required,min=3,max=1000"`
+	Items  []ReturnItemRequest `json:"items" validate:"required,min=1,dive"`
+}
+
+type UpdateReturnStatusRequest struct {
+	Status string `json:"status" validate:"required"`
+	Note   string `json:"note" validate:"omitempty,max=1000"`
+}
+
+type RefundLineRequest struct {
+	ReturnItemId int   `json:"returnItemId" validate:"required,min=1"`
+	AmountCents  int64 `json:"amountCents" validate:"required,gt=0"`
+}
+
+// RefundReturnRequest - leave Lines empty to refund every line in full
+type RefundReturnRequest struct {
+	Lines []RefundLineRequest `json:"lines" validate:"omitempty,dive"`
+	Note  string              `json:"note" validate:"omitempty,max=1000"`
+}
+
+// GetReturnStatusTransitionMap
+// Maps each return status to the statuses it may move to next. Rejected and
+// refunded are terminal. Refund pending and refunded are only reached through RefundReturn.
+func GetReturnStatusTransitionMap() map[string][]string {
+	transitionMap := make(map[string][]string)
+	transitionMap[ReturnStatusRequested] = []string{ReturnStatusApproved, ReturnStatusRejected}
+	transitionMap[ReturnStatusApproved] = []string{ReturnStatusReceived, ReturnStatusRejected}
+	transitionMap[ReturnStatusReceived] = []string{ReturnStatusRefundPending}
+	transitionMap[ReturnStatusRefundPending] = []string{ReturnStatusRefunded}
+	transitionMap[ReturnStatusRejected] = []string{}
+	transitionMap[ReturnStatusRefunded] = []string{}
+	return transitionMap
+}
+
+func ValidateReturnStatusTransition(fromStatus string, toStatus string) error {
+	allowedStatuses := GetReturnStatusTransitionMap()[fromStatus]
+	if !slices.Contains(allowedStatuses, toStatus) {
+		return &StatusBadRequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("Return cannot move from %v to %v", fromStatus, toStatus),
+			ErrorCode:  ErrorCodeInvalidReturnStatusTransition,
+		}
+	}
+	return nil
+}
+
+func newInvalidReturnItemsError(message string) *StatusBadRequestError {
+	return &StatusBadRequestError{
+		StatusCode: http.StatusBadRequest,
+		Message:    message,
+		ErrorCode:  ErrorCodeInvalidReturnItems,
+	}
+}
+
+func newInvalidRefundAmountError(message string) *StatusBadRequestError {
+	return &StatusBadRequestError{
+		StatusCode: http.StatusBadRequest,
+		Message:    message,
+		ErrorCode:  ErrorCodeInvalidRefundAmount,
+	}
+}
+
+/*
+ValidateReturnItems checks each requested line is on the order, appears once, and
+doesn't take the returned quantity past what was ordered. alreadyReturned holds
+the quantities on earlier returns that weren't rejected, by order item id.
+*/
+func ValidateReturnItems(orderItems []OrderItem, alreadyReturned map[int]int, items []ReturnItemRequest) error {
+	orderedQuantities := make(map[int]OrderItem)
+	for _, orderItem := range orderItems {
+		orderedQuantities[orderItem.Id] = orderItem
+	}
+
+	seen := make(map[int]bool)
+	for _, item := range items {
+		orderItem, ok := orderedQuantities[item.OrderItemId]
+		if !ok {
+			return newInvalidReturnItemsError(fmt.Sprintf("Item %v is not on this order", item.OrderItemId))
+		}
+		if seen[item.OrderItemId] {
+			return newInvalidReturnItemsError(fmt.Sprintf("%v is listed more than once", orderItem.Name))
+		}
+		seen[item.OrderItemId] = true
+
+		returnable := orderItem.Quantity - alreadyReturned[item.OrderItemId]
+		if item.Quantity > returnable {
+			return newInvalidReturnItemsError(fmt.Sprintf("Only %d of %v can be returned", returnable, orderItem.Name))
+		}
+	}
+	return nil
+}
+
+// returnedShare is the returned units' share of a line amount, split with allocateCents so
+// the shares of the returned and kept units add up to exactly the amount
+func returnedShare(amount Cents, returnItem ReturnItem) Cents {
+	kept := max(returnItem.OrderedQuantity-returnItem.Quantity, 0)
+	return allocateCents(amount, []Cents{Cents(returnItem.Quantity), Cents(kept)})[0]
+}
+
+/*
+GetRefundableLineAmount is what was actually paid for the returned units of a line: their price
+less their share of the discount the line was given when the order was placed. Coupons only
+discount the lines they apply to, so lines they didn't apply to are refunded in full.
+Shipping isn't refundable.
+*/
+func GetRefundableLineAmount(returnItem ReturnItem) Cents {
+	lineAmount := returnItem.PriceCents * Cents(returnItem.Quantity)
+	if returnItem.LineDiscountCents <= 0 || returnItem.OrderedQuantity <= 0 {
+		return lineAmount
+	}
+	return lineAmount - returnedShare(returnItem.LineDiscountCents, returnItem)
+}
+
+/*
+GetRefundableReturnItemAmount - on orders where tax was added on top of the prices,
+the returned units' share of the line's tax is refundable too.
+*/
+func GetRefundableReturnItemAmount(order Order, returnItem ReturnItem) Cents {
+	amount := GetRefundableLineAmount(returnItem)
+	if order.PricesIncludeTax || returnItem.OrderedQuantity <= 0 {
+		return amount
+	}
+	return amount + returnedShare(returnItem.LineTaxCents, returnItem)
+}
+
+/*
+ResolveRefundAmounts works out how much to refund on each return item, by return
+item id. With no lines every item is refunded in full, otherwise only the listed
+lines are, and each may be refunded up to its refundable amount.
+*/
+func ResolveRefundAmounts(order Order, returnItems []ReturnItem, lines []RefundLineRequest) (map[int]Cents, error) {
+	refundAmounts := make(map[int]Cents)
+	if len(lines) == 0 {
+		for _, returnItem := range returnItems {
+			refundAmounts[returnItem.Id] = GetRefundableReturnItemAmount(order, returnItem)
+		}
+		return refundAmounts, nil
+	}
+
+	returnItemsById := make(map[int]ReturnItem)
+	for _, returnItem := range returnItems {
+		returnItemsById[returnItem.Id] = returnItem
+	}
+	for _, line := range lines {
+		returnItem, ok := returnItemsById[line.ReturnItemId]
+		if !ok {
+			return nil, newInvalidRefundAmountError(fmt.Sprintf("Item %v is not on this return", line.ReturnItemId))
+		}
+		if _, duplicate := refundAmounts[line.ReturnItemId]; duplicate {
+			return nil, newInvalidRefundAmountError(fmt.Sprintf("%v is listed more than once", returnItem.Name))
+		}
+		amount := Cents(line.AmountCents)
+		refundable := GetRefundableReturnItemAmount(order, returnItem)
+		if amount <= 0 || amount > refundable {
+			return nil, newInvalidRefundAmountError(
+				fmt.Sprintf("Refund for %v must be between 0.01 and %v", returnItem.Name, refundable),
+			)
+		}
+		refundAmounts[line.ReturnItemId] = amount
+	}
+	return refundAmounts, nil
+}
+
+/*
+RequestReturn
+ 1. Lock the order, check it belongs to the user and has been delivered
+ 2. Validate the lines against what was ordered and already returned
+ 3. Insert the return, its items and the first status history entry
+*/
+func RequestReturn(
+	dbPool *pgxpool.Pool, logger *slog.Logger, userId int, orderNumber string, request RequestReturnRequest,
+) (Return, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return Return{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("RequestReturn: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	order, orderErr := getOrderByOrderNumberForUpdate(tx, orderNumber)
+	if orderErr != nil {
+		return Return{}, orderErr
+	}
+	if order.UserId != userId {
+		return Return{}, pgx.ErrNoRows
+	}
+	if order.Status != OrderStatusDelivered {
+		return Return{}, &StatusBadRequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "Only delivered orders can be returned",
+			ErrorCode:  ErrorCodeOrderNotReturnable,
+		}
+	}
+
+	orderItems, orderItemsErr := getOrderItems(tx, order.Id)
+	if orderItemsErr != nil {
+		return Return{}, orderItemsErr
+	}
+	alreadyReturned, alreadyReturnedErr := getReturnedQuantitiesByOrderId(tx, order.Id)
+	if alreadyReturnedErr != nil {
+		return Return{}, alreadyReturnedErr
+	}
+	validationErr := ValidateReturnItems(orderItems, alreadyReturned, request.Items)
+	if validationErr != nil {
+		return Return{}, validationErr
+	}
+
+	returnNumber, returnNumberErr := generateReferenceNumber("RMA")
+	if returnNumberErr != nil {
+		return Return{}, returnNumberErr
+	}
+
+	newReturn, addReturnErr := addReturn(tx, returnNumber, order.Id, userId, request.Reason)
+	if addReturnErr != nil {
+		return Return{}, addReturnErr
+	}
+	for _, item := range request.Items {
+		addItemErr := addReturnItem(tx, newReturn.Id, item)
+		if addItemErr != nil {
+			return Return{}, addItemErr
+		}
+	}
+	historyErr := addReturnStatusHistory(tx, newReturn.Id, ReturnStatusRequested, "", &userId)
+	if historyErr != nil {
+		return Return{}, historyErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return Return{}, commitErr
+	}
+
+	logger.Info(fmt.Sprintf("Return %v requested for order %v", newReturn.ReturnNumber, orderNumber))
+
+	return newReturn, nil
+}
+
+/*
+UpdateReturnStatus approves, rejects or marks a return as received. Refunds go
+through RefundReturn so the amounts are recorded.
+*/
+func UpdateReturnStatus(
+	dbPool *pgxpool.Pool,
+	logger *slog.Logger,
+	returnNumber string,
+	newStatus string,
+	note string,
+	changedByUserId int,
+) (Return, error) {
+	if newStatus == ReturnStatusRefundPending || newStatus == ReturnStatusRefunded {
+		return Return{}, &StatusBadRequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "Returns are refunded by recording a refund",
+			ErrorCode:  ErrorCodeInvalidReturnStatusTransition,
+		}
+	}
+
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return Return{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("UpdateReturnStatus: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	updatedReturn, updateErr := updateReturnStatus(tx, returnNumber, newStatus, note, changedByUserId)
+	if updateErr != nil {
+		return Return{}, updateErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return Return{}, commitErr
+	}
+
+	logger.Info(fmt.Sprintf("Return %v moved to %v", returnNumber, newStatus))
+
+	return updatedReturn, nil
+}
+
+/*
+RefundReturn
+ 1. Record the refund and move the return to refund pending, with startReturnRefund
+ 2. Refund the provider's share through the payment provider, with sendReturnProviderRefund
+ 3. Move the return, and the order once it's all been refunded, to refunded, with finishReturnRefund
+
+The provider is called between transactions, so no rows are locked while it's waiting on the
+network and a failure to save afterwards can't lose the record of a refund it has made.
+A return left refund pending, e.g. because the provider was down, is retried by refunding it
+again: the lines recorded the first time stand, and only what the provider hasn't refunded yet is sent.
+*/
+func RefundReturn(
+	dbPool *pgxpool.Pool,
+	logger *slog.Logger,
+	provider PaymentProvider,
+	returnNumber string,
+	request RefundReturnRequest,
+	changedByUserId int,
+) (Return, Cents, error) {
+	pendingReturn, refundTotal, startErr := startReturnRefund(
+		dbPool, logger, provider, returnNumber, request, changedByUserId,
+	)
+	if startErr != nil {
+		return Return{}, 0, startErr
+	}
+
+	providerErr := sendReturnProviderRefund(dbPool, logger, provider, pendingReturn)
+	if providerErr != nil {
+		return Return{}, 0, providerErr
+	}
+
+	refundedReturn, finishErr := finishReturnRefund(dbPool, logger, returnNumber, changedByUserId)
+	if finishErr != nil {
+		return Return{}, 0, finishErr
+	}
+
+	logger.Info(fmt.Sprintf("Return %v refunded %v", returnNumber, refundTotal))
+
+	return refundedReturn, refundTotal, nil
+}
+
+/*
+startReturnRefund
+ 1. Lock the return and check it has been received. One already refund pending is returned as it is.
+ 2. Lock the order, and work out the amount for each line, in full or as given
+ 3. Record the refunded amount on each line
+ 4. Credit the total back onto any gift cards that paid for the order, and record the rest
+    as the provider's share, checking the order's captured payments cover it
+ 5. Move the return to refund pending
+
+Orders with no captured payment (e.g. marked paid by an admin) are refunded outside
+the shop, so the provider's share is left at nothing.
+*/
+func startReturnRefund(
+	dbPool *pgxpool.Pool,
+	logger *slog.Logger,
+	provider PaymentProvider,
+	returnNumber string,
+	request RefundReturnRequest,
+	changedByUserId int,
+) (Return, Cents, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return Return{}, 0, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("startReturnRefund: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	existingReturn, returnErr := getReturnByReturnNumberForUpdate(tx, returnNumber)
+	if returnErr != nil {
+		return Return{}, 0, returnErr
+	}
+	if existingReturn.Status == ReturnStatusRefundPending {
+		returnItems, returnItemsErr := getReturnItems(tx, existingReturn.Id)
+		if returnItemsErr != nil {
+			return Return{}, 0, returnItemsErr
+		}
+		var refundTotal Cents
+		for _, returnItem := range returnItems {
+			refundTotal += returnItem.RefundedCents
+		}
+		return existingReturn, refundTotal, nil
+	}
+	transitionErr := ValidateReturnStatusTransition(existingReturn.Status, ReturnStatusRefundPending)
+	if transitionErr != nil {
+		return Return{}, 0, transitionErr
+	}
+
+	orderNumber, orderNumberErr := getOrderNumberById(tx, existingReturn.OrderId)
+	if orderNumberErr != nil {
+		return Return{}, 0, orderNumberErr
+	}
+	order, orderErr := getOrderByOrderNumberForUpdate(tx, orderNumber)
+	if orderErr != nil {
+		return Return{}, 0, orderErr
+	}
+
+	returnItems, returnItemsErr := getReturnItems(tx, existingReturn.Id)
+	if returnItemsErr != nil {
+		return Return{}, 0, returnItemsErr
+	}
+	refundAmounts, refundAmountsErr := ResolveRefundAmounts(order, returnItems, request.Lines)
+	if refundAmountsErr != nil {
+		return Return{}, 0, refundAmountsErr
+	}
+
+	var refundTotal Cents
+	for returnItemId, amount := range refundAmounts {
+		const query = `UPDATE return_items SET refunded_amount = $1 WHERE id = $2`
+		_, updateErr := tx.Exec(ctx, query, amount.Dollars(), returnItemId)
+		if updateErr != nil {
+			return Return{}, 0, updateErr
+		}
+		refundTotal += amount
+	}
+
+	providerRefund, giftCardRefundErr := refundOrderGiftCards(tx, order.UserId, order.Id, refundTotal)
+	if giftCardRefundErr != nil {
+		return Return{}, 0, giftCardRefundErr
+	}
+	providerRefundCents, providerRefundErr := getProviderRefundCents(tx, provider, order.Id, int64(providerRefund))
+	if providerRefundErr != nil {
+		return Return{}, 0, providerRefundErr
+	}
+	const providerRefundQuery = `UPDATE returns SET provider_refund_cents = $1 WHERE id = $2`
+	_, providerRefundUpdateErr := tx.Exec(ctx, providerRefundQuery, providerRefundCents, existingReturn.Id)
+	if providerRefundUpdateErr != nil {
+		return Return{}, 0, providerRefundUpdateErr
+	}
+
+	pendingReturn, updateErr := updateReturnStatus(
+		tx, returnNumber, ReturnStatusRefundPending, request.Note, changedByUserId,
+	)
+	if updateErr != nil {
+		return Return{}, 0, updateErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return Return{}, 0, commitErr
+	}
+	return pendingReturn, refundTotal, nil
+}
+
+/*
+getProviderRefundCents checks the order's captured payments through the provider can cover amountCents,
+less what other returns on the order are still waiting to have refunded. Returns 0 if the order has none.
+*/
+func getProviderRefundCents(tx pgx.Tx, provider PaymentProvider, orderId int, amountCents int64) (int64, error) {
+	payments, paymentsErr := getCapturedPaymentAttempts(tx, provider.Name(), orderId)
+	if paymentsErr != nil {
+		return 0, paymentsErr
+	}
+	if len(payments) == 0 || amountCents == 0 {
+		return 0, nil
+	}
+
+	const pendingQuery = `
+		SELECT COALESCE(SUM(provider_refund_cents - provider_refunded_cents), 0)
+		FROM returns
+		WHERE order_id = $1 AND status = $2
+	`
+	var refundable int64
+	pendingErr := tx.QueryRow(context.Background(), pendingQuery, orderId, ReturnStatusRefundPending).
+		Scan(&refundable)
+	if pendingErr != nil {
+		return 0, pendingErr
+	}
+	refundable = -refundable
+	for _, payment := range payments {
+		refundable += payment.AmountCents - payment.RefundedCents
+	}
+
+	if amountCents > refundable {
+		return 0, newInvalidRefundAmountError(
+			fmt.Sprintf("Refund exceeds the amount paid by %.2f", float64(amountCents-refundable)/100),
+		)
+	}
+	return amountCents, nil
+}
+
+/*
+sendReturnProviderRefund refunds what's left of the return's provider share, spread over the order's
+captured payments oldest first. Each refund is recorded against its payment and the return as soon
+as the provider makes it.
+*/
+func sendReturnProviderRefund(
+	dbPool *pgxpool.Pool, logger *slog.Logger, provider PaymentProvider, pendingReturn Return,
+) error {
+	remaining := pendingReturn.ProviderRefundCents - pendingReturn.ProviderRefundedCents
+	if remaining <= 0 {
+		return nil
+	}
+	payments, paymentsErr := getCapturedPaymentAttempts(dbPool, provider.Name(), pendingReturn.OrderId)
+	if paymentsErr != nil {
+		return paymentsErr
+	}
+
+	for _, payment := range payments {
+		if remaining == 0 {
+			break
+		}
+		refundable := payment.AmountCents - payment.RefundedCents
+		if refundable <= 0 || payment.ProviderReference == nil {
+			continue
+		}
+		refundCents := min(refundable, remaining)
+		_, refundErr := provider.Refund(*payment.ProviderReference, refundCents)
+		if refundErr != nil {
+			logger.Error(fmt.Sprintf("Return %v left refund pending: %v", pendingReturn.ReturnNumber, refundErr))
+			return refundErr
+		}
+		recordErr := recordProviderRefund(dbPool, payment.Id, pendingReturn.Id, refundCents)
+		if recordErr != nil {
+			logger.Error(fmt.Sprintf(
+				"Return %v: provider refunded %v cents on payment %v but it wasn't saved: %v",
+				pendingReturn.ReturnNumber, refundCents, payment.Id, recordErr,
+			))
+			return recordErr
+		}
+		remaining -= refundCents
+	}
+
+	if remaining > 0 {
+		return newInvalidRefundAmountError(
+			fmt.Sprintf("Refund exceeds the amount paid by %.2f", float64(remaining)/100),
+		)
+	}
+	return nil
+}
+
+// getCapturedPaymentAttempts - the order's captured payments through the provider, oldest first
+func getCapturedPaymentAttempts(db DBTX, providerName string, orderId int) ([]PaymentAttempt, error) {
+	const query = `
+		SELECT *
+		FROM payment_attempts
+		WHERE order_id = $1 AND status = $2 AND provider = $3
+		ORDER BY created_at, id
+	`
+	rows, err := db.Query(context.Background(), query, orderId, PaymentStatusCaptured, providerName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[PaymentAttempt])
+}
+
+// recordProviderRefund adds a refund to both the payment and the return in one statement
+func recordProviderRefund(db DBTX, paymentAttemptId int, returnId int, refundCents int64) error {
+	const query = `
+		WITH payment AS (
+			UPDATE payment_attempts
+			SET refunded_cents = refunded_cents + $1, updated_at = NOW()
+			WHERE id = $2
+		)
+		UPDATE returns
+		SET provider_refunded_cents = provider_refunded_cents + $1, updated_at = NOW()
+		WHERE id = $3
+	`
+	_, err := db.Exec(context.Background(), query, refundCents, paymentAttemptId, returnId)
+	return err
+}
+
+/*
+finishReturnRefund
+ 1. Lock the return and check the provider has refunded all of its share
+ 2. Move the return to refunded
+ 3. Move the order to refunded once every line on it has been refunded in full
+*/
+func finishReturnRefund(
+	dbPool *pgxpool.Pool, logger *slog.Logger, returnNumber string, changedByUserId int,
+) (Return, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return Return{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("finishReturnRefund: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	existingReturn, returnErr := getReturnByReturnNumberForUpdate(tx, returnNumber)
+	if returnErr != nil {
+		return Return{}, returnErr
+	}
+	if existingReturn.ProviderRefundedCents < existingReturn.ProviderRefundCents {
+		return Return{}, fmt.Errorf(
+			"return %v has %v cents left for the provider to refund",
+			returnNumber, existingReturn.ProviderRefundCents-existingReturn.ProviderRefundedCents,
+		)
+	}
+
+	orderNumber, orderNumberErr := getOrderNumberById(tx, existingReturn.OrderId)
+	if orderNumberErr != nil {
+		return Return{}, orderNumberErr
+	}
+	order, orderErr := getOrderByOrderNumberForUpdate(tx, orderNumber)
+	if orderErr != nil {
+		return Return{}, orderErr
+	}
+
+	refundedReturn, updateErr := updateReturnStatus(tx, returnNumber, ReturnStatusRefunded, "", changedByUserId)
+	if updateErr != nil {
+		return Return{}, updateErr
+	}
+
+	fullyRefunded, fullyRefundedErr := isOrderFullyRefunded(tx, order)
+	if fullyRefundedErr != nil {
+		return Return{}, fullyRefundedErr
+	}
+	var refundedOrder Order
+	if fullyRefunded && order.Status != OrderStatusRefunded {
+		var orderStatusErr error
+		refundedOrder, _, orderStatusErr = updateOrderStatus(tx, orderNumber, OrderStatusRefunded, &changedByUserId)
+		if orderStatusErr != nil {
+			return Return{}, orderStatusErr
+		}
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return Return{}, commitErr
+	}
+
+	if refundedOrder != (Order{}) {
+		sendErr := SendOrderStatusUpdate(refundedOrder, order.Status, logger)
+		if sendErr != nil {
+			logger.Error(fmt.Sprintf("Error sending order status update: %v", sendErr))
+		}
+	}
+	return refundedReturn, nil
+}
+
+/*
+IsOrderFullyRefunded - every unit on the order is on a refunded return, and every one of
+those return lines was refunded in full. refundedReturnItems are the lines of the
+order's refunded returns.
+*/
+func IsOrderFullyRefunded(order Order, orderItems []OrderItem, refundedReturnItems []ReturnItem) bool {
+	refundedQuantities := make(map[int]int)
+	for _, returnItem := range refundedReturnItems {
+		if returnItem.RefundedCents < GetRefundableReturnItemAmount(order, returnItem) {
+			return false
+		}
+		refundedQuantities[returnItem.OrderItemId] += returnItem.Quantity
+	}
+	for _, orderItem := range orderItems {
+		if refundedQuantities[orderItem.Id] < orderItem.Quantity {
+			return false
+		}
+	}
+	return len(orderItems) > 0
+}
+
+func isOrderFullyRefunded(db DBTX, order Order) (bool, error) {
+	orderItems, orderItemsErr := getOrderItems(db, order.Id)
+	if orderItemsErr != nil {
+		return false, orderItemsErr
+	}
+	const query = `
+		SELECT ` + returnItemColumns + `
+		FROM return_items ri
+		JOIN returns r ON r.id = ri.return_id
+		JOIN order_items oi ON oi.id = ri.order_item_id
+		WHERE r.order_id = $1 AND r.status = $2
+	`
+	rows, err := db.Query(context.Background(), query, order.Id, ReturnStatusRefunded)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	refundedReturnItems, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[ReturnItem])
+	if collectRowsErr != nil {
+		return false, collectRowsErr
+	}
+	return IsOrderFullyRefunded(order, orderItems, refundedReturnItems), nil
+}
+
+func updateReturnStatus(
+	tx pgx.Tx, returnNumber string, newStatus string, note string, changedByUserId int,
+) (Return, error) {
+	existingReturn, returnErr := getReturnByReturnNumberForUpdate(tx, returnNumber)
+	if returnErr != nil {
+		return Return{}, returnErr
+	}
+	transitionErr := ValidateReturnStatusTransition(existingReturn.Status, newStatus)
+	if transitionErr != nil {
+		return Return{}, transitionErr
+	}
+
+	const query = `
+		UPDATE returns
+		SET status = $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING *
+	`
+	rows, err := tx.Query(context.Background(), query, newStatus, existingReturn.Id)
+	if err != nil {
+		return Return{}, err
+	}
+	updatedReturn, collectErr := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Return])
+	if collectErr != nil {
+		return Return{}, collectErr
+	}
+
+	historyErr := addReturnStatusHistory(tx, existingReturn.Id, newStatus, note, &changedByUserId)
+	if historyErr != nil {
+		return Return{}, historyErr
+	}
+	return updatedReturn, nil
+}
+
+func getOrderByOrderNumberForUpdate(tx pgx.Tx, orderNumber string) (Order, error) {
+	const query = `SELECT * FROM orders WHERE order_number = $1 FOR UPDATE`
+	rows, err := tx.Query(context.Background(), query, orderNumber)
+	if err != nil {
+		return Order{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Order])
+}
+
+func getReturnByReturnNumberForUpdate(tx pgx.Tx, returnNumber string) (Return, error) {
+	const query = `SELECT * FROM returns WHERE return_number = $1 FOR UPDATE`
+	rows, err := tx.Query(context.Background(), query, returnNumber)
+	if err != nil {
+		return Return{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Return])
+}
+
+// getReturnedQuantitiesByOrderId - quantities on returns that haven't been rejected, by order item id
+func getReturnedQuantitiesByOrderId(db DBTX, orderId int) (map[int]int, error) {
+	const query = `
+		SELECT ri.order_item_id, SUM(ri.quantity)
+		FROM return_items ri
+		JOIN returns r ON r.id = ri.return_id
+		WHERE r.order_id = $1 AND r.status <> $2
+		GROUP BY ri.order_item_id
+	`
+	rows, err := db.Query(context.Background(), query, orderId, ReturnStatusRejected)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	returned := make(map[int]int)
+	for rows.Next() {
+		var orderItemId, quantity int
+		scanErr := rows.Scan(&orderItemId, &quantity)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		returned[orderItemId] = quantity
+	}
+	return returned, rows.Err()
+}
+
+func addReturn(db DBTX, returnNumber string, orderId int, userId int, reason string) (Return, error) {
+	const query = `
+		INSERT INTO returns (return_number, order_id, user_id, status, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		RETURNING *
+	`
+	rows, err := db.Query(context.Background(), query, returnNumber, orderId, userId, ReturnStatusRequested, reason)
+	if err != nil {
+		return Return{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Return])
+}
+
+func addReturnItem(db DBTX, returnId int, item ReturnItemRequest) error {
+	const query = `
+		INSERT INTO return_items (return_id, order_item_id, quantity, created_at)
+		VALUES ($1, $2, $3, NOW())
+	`
+	_, err := db.Exec(context.Background(), query, returnId, item.OrderItemId, item.Quantity)
+	return err
+}
+
+// addReturnStatusHistory - an empty note is stored as null
+func addReturnStatusHistory(db DBTX, returnId int, status string, note string, changedByUserId *int) error {
+	const query = `
+		INSERT INTO return_status_history (return_id, status, note, changed_by_user_id, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, NOW())
+	`
+	_, err := db.Exec(context.Background(), query, returnId, status, note, changedByUserId)
+	return err
+}
+
+// GetReturnByReturnNumber returns pgx.ErrNoRows if there is no such return
+func GetReturnByReturnNumber(dbPool *pgxpool.Pool, returnNumber string) (Return, error) {
+	const query = `SELECT * FROM returns WHERE return_number = $1`
+	rows, err := dbPool.Query(context.Background(), query, returnNumber)
+	if err != nil {
+		return Return{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Return])
+}
+
+func GetReturnsByOrderId(dbPool *pgxpool.Pool, orderId int) ([]Return, error) {
+	const query = `
+		SELECT *
+		FROM returns
+		WHERE order_id = $1
+		ORDER BY created_at DESC
+	`
+	rows, err := dbPool.Query(context.Background(), query, orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	returns, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[Return])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+	return returns, nil
+}
+
+// GetReturnDetail loads a return's lines and status history
+func GetReturnDetail(dbPool *pgxpool.Pool, existingReturn Return) (ReturnDetail, error) {
+	returnItems, returnItemsErr := getReturnItems(dbPool, existingReturn.Id)
+	if returnItemsErr != nil {
+		return ReturnDetail{}, returnItemsErr
+	}
+	statusHistory, statusHistoryErr := GetReturnStatusHistory(dbPool, existingReturn.Id)
+	if statusHistoryErr != nil {
+		return ReturnDetail{}, statusHistoryErr
+	}
+	return ReturnDetail{
+		Return:        existingReturn,
+		Items:         returnItems,
+		StatusHistory: statusHistory,
+	}, nil
+}
+
+func getReturnItems(db DBTX, returnId int) ([]ReturnItem, error) {
+	const query = `
+		SELECT ` + returnItemColumns + `
+		FROM return_items ri
+		JOIN order_items oi ON oi.id = ri.order_item_id
+		WHERE ri.return_id = $1
+		ORDER BY ri.id
+	`
+	rows, err := db.Query(context.Background(), query, returnId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	returnItems, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[ReturnItem])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+	return returnItems, nil
+}
+
+func GetReturnStatusHistory(dbPool *pgxpool.Pool, returnId int) ([]ReturnStatusHistoryEntry, error) {
+	const query = `
+		SELECT h.id,
+		       h.return_id,
+		       h.status,
+		       h.note,
+		       h.changed_by_user_id,
+		       u.username AS changed_by_username,
+		       h.created_at
+		FROM return_status_history h
+		LEFT JOIN users u ON u.id = h.changed_by_user_id
+		WHERE h.return_id = $1
+		ORDER BY h.created_at, h.id
+	`
+	rows, err := dbPool.Query(context.Background(), query, returnId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[ReturnStatusHistoryEntry])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+	return history, nil
+}
+
+// GetReturns lists returns for admins, newest first. An empty status isn't filtered on.
+func GetReturns(dbPool *pgxpool.Pool, status string, paginationData PaginationData) ([]AdminReturn, error) {
+	const query = `
+		SELECT r.*, o.order_number, u.username
+		FROM returns r
+		JOIN orders o ON o.id = r.order_id
+		JOIN users u ON u.id = r.user_id
+		WHERE ($1 = '' OR r.status = $1)
+		ORDER BY r.created_at DESC
+		LIMIT $2
+		OFFSET $3
+	`
+	rows, err := dbPool.Query(context.Background(), query, status, paginationData.PerPage, paginationData.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	returns, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[AdminReturn])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+	return returns, nil
+}
+
+func GetTotalReturns(dbPool *pgxpool.Pool, status string) (int, error) {
+	const query = `SELECT COUNT(*) FROM returns WHERE ($1 = '' OR status = $1)`
+	var count int
+	err := dbPool.QueryRow(context.Background(), query, status).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func IsValidReturnStatus(status string) bool {
+	_, ok := GetReturnStatusTransitionMap()[status]
+	return ok
+}
@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+)
+
+func getTestReturnOrderItems() []OrderItem {
+	return []OrderItem{
+		{Id: 1, Name: "Ghost Pepper Sauce", Price: 10.00, Quantity: 2},
+		{Id: 2, Name: "Habanero Sauce", Price: 5.50, Quantity: 1},
+	}
+}
+
+func expectErrorCode(t *testing.T, err error, errorCode string) {
+	t.Helper()
+	var badRequestErr *StatusBadRequestError
+	if !errors.As(err, &badRequestErr) {
+		t.Fatalf("Expected a bad request error, got %v", err)
+	}
+	if badRequestErr.ErrorCode != errorCode {
+		t.Fatalf("Expected error code %v, got %v", errorCode, badRequestErr.ErrorCode)
+	}
+}
+
+func TestValidateReturnItems(t *testing.T) {
+	orderItems := getTestReturnOrderItems()
+
+	err := ValidateReturnItems(orderItems, map[int]int{}, []ReturnItemRequest{
+		{OrderItemId: 1, Quantity: 2},
+		{OrderItemId: 2, Quantity: 1},
+	})
+	if err != nil {
+		t.Fatalf("Expected whole order to be returnable: %v", err)
+	}
+
+	err = ValidateReturnItems(orderItems, map[int]int{1: 1}, []ReturnItemRequest{{OrderItemId: 1, Quantity: 2}})
+	expectErrorCode(t, err, ErrorCodeInvalidReturnItems)
+
+	err = ValidateReturnItems(orderItems, map[int]int{}, []ReturnItemRequest{{OrderItemId: 3, Quantity: 1}})
+	expectErrorCode(t, err, ErrorCodeInvalidReturnItems)
+
+	err = ValidateReturnItems(orderItems, map[int]int{}, []ReturnItemRequest{
+		{OrderItemId: 1, Quantity: 1},
+		{OrderItemId: 1, Quantity: 1},
+	})
+	expectErrorCode(t, err, ErrorCodeInvalidReturnItems)
+}
+
+func TestGetRefundableLineAmountUsesLineDiscount(t *testing.T) {
+	discounted := ReturnItem{PriceCents: 1000, Quantity: 1, OrderedQuantity: 2, LineDiscountCents: 400}
+	if amount := GetRefundableLineAmount(discounted); amount != 800 {
+		t.Fatalf("Expected the returned unit's share of the line discount off, got %v", amount)
+	}
+	// Lines the coupon didn't apply to were paid in full, whatever the order's discount
+	undiscounted := ReturnItem{PriceCents: 550, Quantity: 1, OrderedQuantity: 1}
+	if amount := GetRefundableLineAmount(undiscounted); amount != 550 {
+		t.Fatalf("Expected 5.50 without a line discount, got %v", amount)
+	}
+}
+
+func TestResolveRefundAmounts(t *testing.T) {
+	order := Order{Subtotal: 25.50}
+	returnItems := []ReturnItem{
+		{Id: 10, OrderItemId: 1, Name: "Ghost Pepper Sauce", PriceCents: 1000, Quantity: 2},
+		{Id: 11, OrderItemId: 2, Name: "Habanero Sauce", PriceCents: 550, Quantity: 1},
+	}
+
+	full, err := ResolveRefundAmounts(order, returnItems, nil)
+	if err != nil || full[10] != 2000 || full[11] != 550 {
+		t.Fatalf("Unexpected full refund: %v %v", full, err)
+	}
+
+	partial, err := ResolveRefundAmounts(order, returnItems, []RefundLineRequest{{ReturnItemId: 10, AmountCents: 750}})
+	if err != nil || len(partial) != 1 || partial[10] != 750 {
+		t.Fatalf("Unexpected partial refund: %v %v", partial, err)
+	}
+
+	_, err = ResolveRefundAmounts(order, returnItems, []RefundLineRequest{{ReturnItemId: 11, AmountCents: 600}})
+	expectErrorCode(t, err, ErrorCodeInvalidRefundAmount)
+
+	_, err = ResolveRefundAmounts(order, returnItems, []RefundLineRequest{{ReturnItemId: 12, AmountCents: 100}})
+	expectErrorCode(t, err, ErrorCodeInvalidRefundAmount)
+}
+
+func TestIsOrderFullyRefunded(t *testing.T) {
+	order := Order{Subtotal: 25.50}
+	orderItems := getTestReturnOrderItems()
+	fullyRefunded := []ReturnItem{
+		{OrderItemId: 1, PriceCents: 1000, Quantity: 1, RefundedCents: 1000},
+		{OrderItemId: 1, PriceCents: 1000, Quantity: 1, RefundedCents: 1000},
+		{OrderItemId: 2, PriceCents: 550, Quantity: 1, RefundedCents: 550},
+	}
+	if !IsOrderFullyRefunded(order, orderItems, fullyRefunded) {
+		t.Fatal("Expected order to be fully refunded")
+	}
+	if IsOrderFullyRefunded(order, orderItems, fullyRefunded[:2]) {
+		t.Fatal("Expected order with an unreturned line not to be fully refunded")
+	}
+	partiallyRefunded := append([]ReturnItem{}, fullyRefunded...)
+	partiallyRefunded[2].RefundedCents = 200
+	if IsOrderFullyRefunded(order, orderItems, partiallyRefunded) {
+		t.Fatal("Expected order with a partial refund not to be fully refunded")
+	}
+}
+
+func TestValidateReturnStatusTransition(t *testing.T) {
+	if err := ValidateReturnStatusTransition(ReturnStatusRequested, ReturnStatusApproved); err != nil {
+		t.Fatalf("Expected requested -> approved to be allowed: %v", err)
+	}
+	expectErrorCode(
+		t,
+		ValidateReturnStatusTransition(ReturnStatusRequested, ReturnStatusRefunded),
+		ErrorCodeInvalidReturnStatusTransition,
+	)
+	expectErrorCode(
+		t,
+		ValidateReturnStatusTransition(ReturnStatusRejected, ReturnStatusApproved),
+		ErrorCodeInvalidReturnStatusTransition,
+	)
+	// Refunds are recorded as pending before the provider is called
+	expectErrorCode(
+		t,
+		ValidateReturnStatusTransition(ReturnStatusReceived, ReturnStatusRefunded),
+		ErrorCodeInvalidReturnStatusTransition,
+	)
+	if err := ValidateReturnStatusTransition(ReturnStatusRefundPending, ReturnStatusRefunded); err != nil {
+		t.Fatalf("Expected refund_pending -> refunded to be allowed: %v", err)
+	}
+}
+
+func TestGetRefundableReturnItemAmountIncludesTax(t *testing.T) {
+	returnItem := ReturnItem{PriceCents: 1000, Quantity: 1, OrderedQuantity: 2, LineTaxCents: 145}
+	if amount := GetRefundableReturnItemAmount(Order{Subtotal: 20}, returnItem); amount != 1073 {
+		t.Fatalf("Expected the returned unit's share of tax, got %v", amount)
+	}
+	taxIncluded := Order{Subtotal: 20, PricesIncludeTax: true}
+	if amount := GetRefundableReturnItemAmount(taxIncluded, returnItem); amount != 1000 {
+		t.Fatalf("Included tax is already in the price, got %v", amount)
+	}
+}
+
+func TestGetRefundableLineAmountSplitsDiscountExactly(t *testing.T) {
+	// A third of 1.00 off each unit: the shares of every return of the line add up to the discount
+	first := ReturnItem{PriceCents: 1000, Quantity: 1, OrderedQuantity: 3, LineDiscountCents: 100}
+	rest := ReturnItem{PriceCents: 1000, Quantity: 2, OrderedQuantity: 3, LineDiscountCents: 100}
+	total := GetRefundableLineAmount(first) + GetRefundableLineAmount(rest)
+	if total != 2900 {
+		t.Fatalf("Expected the whole line less its discount, 2900, got %v", total)
+	}
+}
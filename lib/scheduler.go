@@ -0,0 +1,21 @@
+package lib
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// RunPeriodically runs job every interval in the background for the life of the process.
+// Errors are logged and the job keeps running on the next tick.
+func RunPeriodically(name string, interval time.Duration, logger *slog.Logger, job func() error) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			if err := job(); err != nil {
+				logger.Error(fmt.Sprintf("Scheduled job '%v' failed: %v", name, err))
+			}
+		}
+	}()
+	logger.Info(fmt.Sprintf("Scheduled job '%v' every %v", name, interval))
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// searchHighlightOptions wraps matched words in <mark> for ts_headline
+const searchHighlightOptions = `StartSel=<mark>, StopSel=</mark>`
+
+// searchSnippetOptions - up to two fragments of the descriptions around the matches
+const searchSnippetOptions = searchHighlightOptions + `, MaxWords=30, MinWords=10, MaxFragments=2, FragmentDelimiter=" … "`
+
+// productSearchCondition matches the full-text query in $1, or a fuzzy match on the name and tag names for typos
+const productSearchCondition = `(i.search_vector @@ WEBSEARCH_TO_TSQUERY('english', $1)
+		OR LOWER($1) <% i.search_text)`
+
+type ProductSearchResult struct {
+	InventoryItem
+	Rank float32 `json:"rank" db:"rank"`
+	// NameHighlight and Snippet are HTML with matched words in <mark>. The text is escaped, so the
+	// <mark> tags are the only markup. Matches only found because of typo tolerance aren't highlighted.
+	NameHighlight string `json:"nameHighlight" db:"name_highlight"`
+	Snippet       string `json:"snippet" db:"snippet"`
+}
+
+// prefixTsQuery turns what's been typed so far into a to_tsquery where every word, including the
+// unfinished last one, is a prefix. Anything but letters and digits is dropped, so the result is
+// always valid tsquery syntax; it's empty when nothing is left.
+func prefixTsQuery(searchQuery string) string {
+	words := strings.FieldsFunc(searchQuery, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		words[i] = strings.ToLower(word) + ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+/*
+SearchInventoryItems
+ 1. Match items whose name, tags or descriptions contain the search, or whose name or tags nearly do
+ 2. Rank full-text matches by where they matched, name first, plus how closely the name and tags match
+ 3. Highlight the matches in the name and a snippet of the descriptions
+*/
+func SearchInventoryItems(
+	dbPool *pgxpool.Pool, logger *slog.Logger, searchQuery string, limit int, offset int,
+) ([]ProductSearchResult, int, error) {
+	ctx := context.Background()
+	const countQuery = `SELECT COUNT(*) FROM inventories i WHERE ` + productSearchCondition
+	var total int
+	countErr := dbPool.QueryRow(ctx, countQuery, searchQuery).Scan(&total)
+	if countErr != nil {
+		logger.Error(fmt.Sprintf("Error counting search results: %v", countErr))
+		return nil, 0, countErr
+	}
+	if total == 0 {
+		return []ProductSearchResult{}, 0, nil
+	}
+
+	query := `
+		SELECT ` + inventoryItemColumns + `,
+		       TS_RANK_CD(i.search_vector, WEBSEARCH_TO_TSQUERY('english', $1))
+		           + WORD_SIMILARITY(LOWER($1), i.search_text) AS rank,
+		       TS_HEADLINE('english', HTML_ESCAPE(i.name), WEBSEARCH_TO_TSQUERY('english', $1),
+		           '` + searchHighlightOptions + `, HighlightAll=true') AS name_highlight,
+		       TS_HEADLINE('english', HTML_ESCAPE(i.short_description || ' ' || i.description),
+		           WEBSEARCH_TO_TSQUERY('english', $1),
+		           '` + searchSnippetOptions + `') AS snippet
+		FROM inventories i` + itemSaleJoin + `
+		WHERE ` + productSearchCondition + `
+		ORDER BY rank DESC, i.name
+		LIMIT $2
+		OFFSET $3
+	`
+	rows, err := dbPool.Query(ctx, query, searchQuery, limit, offset)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error running product search query: %v", err))
+		return nil, 0, err
+	}
+	defer rows.Close()
+	results, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[ProductSearchResult])
+	if collectRowsErr != nil {
+		logger.Error(fmt.Sprintf("Error collecting product search results: %v", collectRowsErr))
+		return nil, 0, collectRowsErr
+	}
+	return results, total, nil
+}
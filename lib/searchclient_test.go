@@ -0,0 +1,18 @@
+package lib
+
+import "testing"
+
+func TestPrefixTsQuery(t *testing.T) {
+	cases := map[string]string{
+		"Haban":             "haban:*",
+		"ghost pep":         "ghost:* & pep:*",
+		"  jalapeño!  hot ": "jalapeño:* & hot:*",
+		"scorpion's & | !":  "scorpion:* & s:*",
+		"':*()":             "",
+	}
+	for input, expected := range cases {
+		if got := prefixTsQuery(input); got != expected {
+			t.Fatalf("prefixTsQuery(%q): expected %q, got %q", input, expected, got)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ShippingOption - TimeToShipUnit is a dayjs unit, used by the UI to show delivery dates
+type ShippingOption struct {
+	Id                     int     `json:"id"`
+	Name                   string  `json:"name"`
+	Description            string  `json:"description"`
+	Price                  float64 `json:"price"`
+	TimeToShipUnitQuantity int     `json:"timeToShipUnitQuantity"`
+	TimeToShipUnit         string  `json:"timeToShipUnit"`
+}
+
+type ShippingOptionRequest struct {
+	Name                   string  `json:"name" validate:"required,min=2,max=255"`
+	Description            string  `json:"description" validate:"max=1000"`
+	Price                  float64 `json:"price" validate:"min=0,max=10000"`
+	TimeToShipUnitQuantity int     `json:"timeToShipUnitQuantity" validate:"required,min=1,max=365"`
+	TimeToShipUnit         string  `json:"timeToShipUnit" validate:"required,oneof=hour hours day days week weeks month months"`
+}
+
+func GetShippingOptions(dbPool *pgxpool.Pool) ([]ShippingOption, error) {
+	const query = `SELECT * FROM shipping_options ORDER BY price DESC`
+	rows, err := dbPool.Query(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shippingOptions, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[ShippingOption])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+	return shippingOptions, nil
+}
+
+func getShippingOptionById(db DBTX, shippingOptionId int) (ShippingOption, error) {
+	const query = `SELECT * FROM shipping_options WHERE id = $1`
+	rows, err := db.Query(context.Background(), query, shippingOptionId)
+	if err != nil {
+		return ShippingOption{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[ShippingOption])
+}
+
+func GetShippingOptionById(dbPool *pgxpool.Pool, shippingOptionId int) (ShippingOption, error) {
+	return getShippingOptionById(dbPool, shippingOptionId)
+}
+
+func AddShippingOption(dbPool *pgxpool.Pool, request ShippingOptionRequest) (ShippingOption, error) {
+	const query = `
+		INSERT INTO shipping_options (name, description, price, time_to_ship_unit_quantity, time_to_ship_unit)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING *
+	`
+	rows, err := dbPool.Query(
+		context.Background(),
+		query,
+		request.Name,
+		request.Description,
+		ToCents(request.Price).Dollars(),
+		request.TimeToShipUnitQuantity,
+		request.TimeToShipUnit,
+	)
+	if err != nil {
+		return ShippingOption{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[ShippingOption])
+}
+
+// UpdateShippingOption returns pgx.ErrNoRows if there is no such option. Placed orders
+// keep the price they were charged.
+func UpdateShippingOption(
+	dbPool *pgxpool.Pool, shippingOptionId int, request ShippingOptionRequest,
+) (ShippingOption, error) {
+	const query = `
+		UPDATE shipping_options
+		SET name = $1,
+		    description = $2,
+		    price = $3,
+		    time_to_ship_unit_quantity = $4,
+		    time_to_ship_unit = $5
+		WHERE id = $6
+		RETURNING *
+	`
+	rows, err := dbPool.Query(
+		context.Background(),
+		query,
+		request.Name,
+		request.Description,
+		ToCents(request.Price).Dollars(),
+		request.TimeToShipUnitQuantity,
+		request.TimeToShipUnit,
+		shippingOptionId,
+	)
+	if err != nil {
+		return ShippingOption{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[ShippingOption])
+}
+
+// DeleteShippingOption fails with a StatusBadRequestError if orders or coupons still use the option
+func DeleteShippingOption(dbPool *pgxpool.Pool, shippingOptionId int) error {
+	const query = `DELETE FROM shipping_options WHERE id = $1`
+	result, err := dbPool.Exec(context.Background(), query, shippingOptionId)
+	if isPgError(err, pgErrorCodeForeignKeyViolation) {
+		return &StatusBadRequestError{
+			StatusCode: http.StatusConflict,
+			Message:    "Shipping option is used by orders or coupons",
+			ErrorCode:  ErrorCodeShippingOptionInUse,
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
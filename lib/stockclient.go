@@ -0,0 +1,447 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// StockReservationTimeout is how long a checkout hold lasts before the stock is released
+const StockReservationTimeout = 15 * time.Minute
+
+// variantStockRemainingSql is stock minus active holds for the variant aliased as alias, or NULL if its
+// stock isn't tracked. holdsFilter narrows the holds counted, e.g. to leave out the current user's.
+func variantStockRemainingSql(alias string, holdsFilter string) string {
+	return `CASE WHEN ` + alias + `.stock_quantity IS NOT NULL THEN GREATEST(` + alias + `.stock_quantity - COALESCE(
+		       	(SELECT SUM(sr.quantity) FROM stock_reservations sr
+		       	 WHERE sr.variant_id = ` + alias + `.id AND sr.expires_at > NOW()` + holdsFilter + `), 0), 0) END`
+}
+
+// isBundleSql is whether the item itemId is made up of other items' variants
+func isBundleSql(itemId string) string {
+	return `EXISTS (SELECT 1 FROM bundle_components bc WHERE bc.bundle_item_id = ` + itemId + `)`
+}
+
+// bundleStockRemainingSql is how many complete sets of the bundle itemId the component stock
+// makes up. Components whose stock isn't tracked don't limit it, so it's NULL if none are tracked.
+func bundleStockRemainingSql(itemId string, holdsFilter string) string {
+	return `(SELECT MIN(` + variantStockRemainingSql("cv", holdsFilter) + ` / bc.quantity)
+		       	 FROM bundle_components bc
+		       	 JOIN inventory_item_variants cv ON cv.id = bc.variant_id
+		       	 WHERE bc.bundle_item_id = ` + itemId + `)`
+}
+
+// itemStockUntrackedSql is whether any of the variants of the item aliased as "i" has untracked stock
+const itemStockUntrackedSql = `EXISTS (
+		       	SELECT 1 FROM inventory_item_variants v WHERE v.inventory_item_id = i.id AND v.stock_quantity IS NULL)`
+
+// inStockSql - items whose stock isn't tracked are always in stock
+func inStockSql(stockRemaining string) string {
+	return `COALESCE(` + stockRemaining + ` > 0, TRUE)`
+}
+
+// variantStockRemainingColumn is stock minus active holds, for use in variant queries aliased as "v"
+var variantStockRemainingColumn = `CASE WHEN ` + isBundleSql("v.inventory_item_id") + `
+		       	THEN ` + bundleStockRemainingSql("v.inventory_item_id", "") + `
+		       	ELSE ` + variantStockRemainingSql("v", "") + ` END`
+
+/*
+stockQuantityColumn is stock across all of an item's variants, for use in inventory item queries
+aliased as "i". NULL when stock isn't tracked for any of them, since those can be bought regardless.
+*/
+var stockQuantityColumn = `CASE WHEN ` + isBundleSql("i.id") + `
+		       	THEN (SELECT MIN(cv.stock_quantity / bc.quantity)
+		       	 FROM bundle_components bc
+		       	 JOIN inventory_item_variants cv ON cv.id = bc.variant_id
+		       	 WHERE bc.bundle_item_id = i.id)
+		       	WHEN ` + itemStockUntrackedSql + ` THEN NULL
+		       	ELSE COALESCE(
+		       	(SELECT SUM(v.stock_quantity) FROM inventory_item_variants v WHERE v.inventory_item_id = i.id), 0) END`
+
+// stockRemainingColumn is stock minus active holds across all of an item's variants, NULL the same as stockQuantityColumn
+var stockRemainingColumn = `CASE WHEN ` + isBundleSql("i.id") + `
+		       	THEN ` + bundleStockRemainingSql("i.id", "") + `
+		       	WHEN ` + itemStockUntrackedSql + ` THEN NULL
+		       	ELSE COALESCE(
+		       	(SELECT SUM(` + variantStockRemainingSql("v", "") + `)
+		       	 FROM inventory_item_variants v WHERE v.inventory_item_id = i.id), 0) END`
+
+type StockReservation struct {
+	Id              int       `json:"id" db:"id"`
+	UserId          int       `json:"userId" db:"user_id"`
+	InventoryItemId int       `json:"inventoryItemId" db:"inventory_item_id"`
+	VariantId       int       `json:"variantId" db:"variant_id"`
+	Quantity        int       `json:"quantity" db:"quantity"`
+	CreatedAt       time.Time `json:"createdAt" db:"created_at"`
+	ExpiresAt       time.Time `json:"expiresAt" db:"expires_at"`
+}
+
+func newInsufficientStockError(itemName string, available int) *StatusBadRequestError {
+	return &StatusBadRequestError{
+		StatusCode: http.StatusBadRequest,
+		Message:    fmt.Sprintf("Only %d of %v available", available, itemName),
+		ErrorCode:  ErrorCodeInsufficientStock,
+	}
+}
+
+/*
+getAvailableStock - stock of the variant that isn't held by anyone other than userId. For a bundle,
+that's the number of complete sets its components make up. nil when the stock isn't tracked, so
+any quantity is available.
+*/
+func getAvailableStock(db DBTX, variantId int, userId int) (*int, error) {
+	const holdsFilter = " AND sr.user_id <> $2"
+	query := `
+		SELECT CASE WHEN ` + isBundleSql("v.inventory_item_id") + `
+		       	THEN ` + bundleStockRemainingSql("v.inventory_item_id", holdsFilter) + `
+		       	ELSE ` + variantStockRemainingSql("v", holdsFilter) + ` END
+		FROM inventory_item_variants v
+		WHERE v.id = $1
+	`
+	var available *int
+	err := db.QueryRow(context.Background(), query, variantId, userId).Scan(&available)
+	if err != nil {
+		return nil, err
+	}
+	return available, nil
+}
+
+// lockVariants locks the given variants in id order so concurrent checkouts can't deadlock
+func lockVariants(tx pgx.Tx, variantIds []int) error {
+	const query = `SELECT id FROM inventory_item_variants WHERE id = ANY($1) ORDER BY id FOR UPDATE`
+	rows, err := tx.Query(context.Background(), query, variantIds)
+	if err != nil {
+		return err
+	}
+	rows.Close()
+	return rows.Err()
+}
+
+func getCartInventoryItemIds(cartItems []CartItem) []int {
+	var inventoryItemIds []int
+	for _, cartItem := range cartItems {
+		inventoryItemIds = append(inventoryItemIds, cartItem.InventoryItemId)
+	}
+	return inventoryItemIds
+}
+
+// StockDemand is how much of one variant a cart takes, with bundles expanded into their components
+type StockDemand struct {
+	VariantId       int
+	InventoryItemId int
+	Name            string
+	Quantity        int
+}
+
+/*
+GetCartStockDemand merges cart lines that draw on the same variant, e.g. a sauce bought on
+its own and again as part of a bundle, so the two can't each pass the stock check alone.
+Sorted by variant id, the order stock rows are locked in.
+*/
+func GetCartStockDemand(cartItems []CartItem) []StockDemand {
+	demandByVariantId := make(map[int]*StockDemand)
+	var variantIds []int
+	addDemand := func(variantId int, inventoryItemId int, name string, quantity int) {
+		if demand, found := demandByVariantId[variantId]; found {
+			demand.Quantity += quantity
+			return
+		}
+		demandByVariantId[variantId] = &StockDemand{variantId, inventoryItemId, name, quantity}
+		variantIds = append(variantIds, variantId)
+	}
+
+	for _, cartItem := range cartItems {
+		if len(cartItem.BundleComponents) == 0 {
+			addDemand(cartItem.VariantId, cartItem.InventoryItemId, cartItem.DisplayName(), cartItem.Quantity)
+			continue
+		}
+		for _, component := range cartItem.BundleComponents {
+			addDemand(
+				component.VariantId,
+				component.InventoryItemId,
+				component.DisplayName(),
+				component.Quantity*cartItem.Quantity,
+			)
+		}
+	}
+
+	slices.Sort(variantIds)
+	stockDemand := make([]StockDemand, 0, len(variantIds))
+	for _, variantId := range variantIds {
+		stockDemand = append(stockDemand, *demandByVariantId[variantId])
+	}
+	return stockDemand
+}
+
+func getStockDemandVariantIds(stockDemand []StockDemand) []int {
+	var variantIds []int
+	for _, demand := range stockDemand {
+		variantIds = append(variantIds, demand.VariantId)
+	}
+	return variantIds
+}
+
+// CheckStockAvailable returns an insufficient stock error if quantity of the variant can't be fulfilled
+func CheckStockAvailable(dbPool *pgxpool.Pool, variantId int, userId int, quantity int) error {
+	return checkStockAvailable(dbPool, variantId, userId, quantity)
+}
+
+func checkStockAvailable(db DBTX, variantId int, userId int, quantity int) error {
+	available, err := getAvailableStock(db, variantId, userId)
+	if err != nil {
+		return err
+	}
+	if available != nil && quantity > *available {
+		name, nameErr := getVariantDisplayName(db, variantId)
+		if nameErr != nil {
+			return nameErr
+		}
+		return newInsufficientStockError(name, *available)
+	}
+	return nil
+}
+
+// getVariantDisplayName - the item name, followed by the variant name unless it's the only variant
+func getVariantDisplayName(db DBTX, variantId int) (string, error) {
+	const query = `
+		SELECT i.name, v.name, v.is_default
+		FROM inventory_item_variants v
+		JOIN inventories i ON i.id = v.inventory_item_id
+		WHERE v.id = $1
+	`
+	var itemName, variantName string
+	var isDefault bool
+	err := db.QueryRow(context.Background(), query, variantId).Scan(&itemName, &variantName, &isDefault)
+	if err != nil {
+		return "", err
+	}
+	return VariantDisplayName(itemName, variantName, isDefault), nil
+}
+
+// VariantDisplayName leaves the name of an item's default variant off, since most items only have one
+func VariantDisplayName(itemName string, variantName string, isDefault bool) string {
+	if isDefault {
+		return itemName
+	}
+	return fmt.Sprintf("%v (%v)", itemName, variantName)
+}
+
+/*
+ReserveCartStock
+ 1. Lock the variant rows for everything in the cart, bundles expanded into their components
+ 2. Replace any existing hold the user has
+ 3. Hold each variant, failing if any exceeds what's available
+
+The hold expires after StockReservationTimeout unless the order is placed first.
+*/
+func ReserveCartStock(dbPool *pgxpool.Pool, logger *slog.Logger, userId int) ([]StockReservation, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return nil, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("ReserveCartStock: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	cartItems, cartErr := getCartItemsForUpdate(tx, userId)
+	if cartErr != nil {
+		return nil, cartErr
+	}
+	if len(cartItems) == 0 {
+		return nil, &StatusBadRequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "Cart is empty",
+			ErrorCode:  ErrorCodeCartEmpty,
+		}
+	}
+
+	stockDemand := GetCartStockDemand(cartItems)
+	lockErr := lockVariants(tx, getStockDemandVariantIds(stockDemand))
+	if lockErr != nil {
+		return nil, lockErr
+	}
+
+	deleteErr := deleteStockReservationsByUserId(tx, userId)
+	if deleteErr != nil {
+		return nil, deleteErr
+	}
+
+	expiresAt := time.Now().Add(StockReservationTimeout)
+	reservations := make([]StockReservation, 0, len(stockDemand))
+	for _, demand := range stockDemand {
+		available, availableErr := getAvailableStock(tx, demand.VariantId, userId)
+		if availableErr != nil {
+			return nil, availableErr
+		}
+		if available != nil && demand.Quantity > *available {
+			return nil, newInsufficientStockError(demand.Name, *available)
+		}
+		reservation, reservationErr := addStockReservation(
+			tx, userId, demand.InventoryItemId, demand.VariantId, demand.Quantity, expiresAt,
+		)
+		if reservationErr != nil {
+			return nil, reservationErr
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return nil, commitErr
+	}
+
+	logger.Info(fmt.Sprintf("Reserved stock for user %v until %v", userId, expiresAt))
+
+	return reservations, nil
+}
+
+func addStockReservation(
+	db DBTX, userId int, inventoryItemId int, variantId int, quantity int, expiresAt time.Time,
+) (StockReservation, error) {
+	const query = `
+		INSERT INTO stock_reservations (user_id, inventory_item_id, variant_id, quantity, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, NOW(), $5)
+		RETURNING *
+	`
+	rows, err := db.Query(context.Background(), query, userId, inventoryItemId, variantId, quantity, expiresAt)
+	if err != nil {
+		return StockReservation{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[StockReservation])
+}
+
+func ReleaseStockReservations(dbPool *pgxpool.Pool, userId int) error {
+	return deleteStockReservationsByUserId(dbPool, userId)
+}
+
+func deleteStockReservationsByUserId(db DBTX, userId int) error {
+	const query = `DELETE FROM stock_reservations WHERE user_id = $1`
+	_, err := db.Exec(context.Background(), query, userId)
+	return err
+}
+
+// ReleaseExpiredStockReservations deletes abandoned holds. Returns the number released.
+func ReleaseExpiredStockReservations(dbPool *pgxpool.Pool) (int64, error) {
+	const query = `DELETE FROM stock_reservations WHERE expires_at <= NOW()`
+	result, err := dbPool.Exec(context.Background(), query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// confirmStockReservations turns the user's hold into a stock decrement. Must be called in
+// the order transaction. Lines without a hold are still checked against what's available.
+func confirmStockReservations(tx pgx.Tx, userId int, cartItems []CartItem) error {
+	takeErr := takeStock(tx, userId, GetCartStockDemand(cartItems))
+	if takeErr != nil {
+		return takeErr
+	}
+	return deleteStockReservationsByUserId(tx, userId)
+}
+
+// takeStock decrements stock for the demand, failing if any of it isn't available outside
+// holds by users other than userId (0 counts every hold)
+func takeStock(tx pgx.Tx, userId int, stockDemand []StockDemand) error {
+	lockErr := lockVariants(tx, getStockDemandVariantIds(stockDemand))
+	if lockErr != nil {
+		return lockErr
+	}
+
+	for _, demand := range stockDemand {
+		available, availableErr := getAvailableStock(tx, demand.VariantId, userId)
+		if availableErr != nil {
+			return availableErr
+		}
+		if available != nil && demand.Quantity > *available {
+			return newInsufficientStockError(demand.Name, *available)
+		}
+		// Untracked stock stays NULL
+		const query = `
+			UPDATE inventory_item_variants
+			SET stock_quantity = stock_quantity - $1
+			WHERE id = $2
+		`
+		_, updateErr := tx.Exec(context.Background(), query, demand.Quantity, demand.VariantId)
+		if updateErr != nil {
+			return updateErr
+		}
+	}
+	return nil
+}
+
+/*
+restockOrderItems puts the stock an order took back, e.g. when it's cancelled. Bundles are expanded
+into their components the same way as GetCartStockDemand. Lines from before variants have no
+variant to go back to and are left out. Must be called in the order transaction.
+*/
+func restockOrderItems(tx pgx.Tx, orderId int) error {
+	orderItems, orderItemsErr := getOrderItems(tx, orderId)
+	if orderItemsErr != nil {
+		return orderItemsErr
+	}
+	cartItems := make([]CartItem, 0, len(orderItems))
+	for _, orderItem := range orderItems {
+		if orderItem.VariantId == nil {
+			continue
+		}
+		cartItems = append(cartItems, CartItem{
+			InventoryItemId: orderItem.InventoryItemId,
+			VariantId:       *orderItem.VariantId,
+			Name:            orderItem.Name,
+			VariantName:     orderItem.VariantName,
+			Quantity:        orderItem.Quantity,
+		})
+	}
+	bundleErr := addBundleComponents(tx, cartItems)
+	if bundleErr != nil {
+		return bundleErr
+	}
+
+	stockDemand := GetCartStockDemand(cartItems)
+	lockErr := lockVariants(tx, getStockDemandVariantIds(stockDemand))
+	if lockErr != nil {
+		return lockErr
+	}
+	for _, demand := range stockDemand {
+		// Untracked stock stays NULL
+		const query = `
+			UPDATE inventory_item_variants
+			SET stock_quantity = stock_quantity + $1
+			WHERE id = $2
+		`
+		_, updateErr := tx.Exec(context.Background(), query, demand.Quantity, demand.VariantId)
+		if updateErr != nil {
+			return updateErr
+		}
+	}
+	return nil
+}
+
+// UpdateInventoryItemStock sets the stock of the item's default variant
+func UpdateInventoryItemStock(dbPool *pgxpool.Pool, inventoryItemId int, stockQuantity int) error {
+	return updateInventoryItemStock(dbPool, inventoryItemId, stockQuantity)
+}
+
+func updateInventoryItemStock(db DBTX, inventoryItemId int, stockQuantity int) error {
+	const query = `
+		UPDATE inventory_item_variants
+		SET stock_quantity = $1, updated_at = NOW()
+		WHERE inventory_item_id = $2
+		AND is_default
+	`
+	_, err := db.Exec(context.Background(), query, stockQuantity, inventoryItemId)
+	return err
+}
@@ -0,0 +1,1318 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	SubscriptionStatusActive    = "active"
+	SubscriptionStatusPaused    = "paused"
+	SubscriptionStatusCancelled = "cancelled"
+)
+
+const (
+	SubscriptionIntervalMonthly   = "monthly"
+	SubscriptionIntervalQuarterly = "quarterly"
+)
+
+const (
+	SubscriptionShipmentStatusPending   = "pending"
+	SubscriptionShipmentStatusFulfilled = "fulfilled"
+	SubscriptionShipmentStatusFailed    = "failed"
+	SubscriptionShipmentStatusSkipped   = "skipped"
+)
+
+// SubscriptionShipmentMaxAttempts is how many times a shipment is tried before the subscription is paused
+const SubscriptionShipmentMaxAttempts = 3
+
+// SubscriptionShipmentRetryDelay is multiplied by the number of attempts so far
+const SubscriptionShipmentRetryDelay = 24 * time.Hour
+
+// subscriptionShipmentBatchSize caps the shipments fulfilled, and refunded, per run of the job
+const subscriptionShipmentBatchSize = 100
+
+// subscriptionPaymentStatusRefundPending marks a shipment's charge while the provider refunds it
+const subscriptionPaymentStatusRefundPending = "refund_pending"
+
+type SubscriptionPlan struct {
+	Id              int                    `json:"id" db:"id"`
+	Slug            string                 `json:"slug" db:"slug"`
+	Name            string                 `json:"name" db:"name"`
+	Description     string                 `json:"description" db:"description"`
+	BillingInterval string                 `json:"billingInterval" db:"billing_interval"`
+	Price           float64                `json:"price" db:"price"`
+	IsActive        bool                   `json:"isActive" db:"is_active"`
+	CreatedAt       time.Time              `json:"createdAt" db:"created_at"`
+	UpdatedAt       *time.Time             `json:"updatedAt" db:"updated_at"`
+	Items           []SubscriptionPlanItem `json:"items" db:"-"`
+}
+
+// SubscriptionPlanItem is a variant that ships in every box of the plan
+type SubscriptionPlanItem struct {
+	PlanId           int    `json:"planId" db:"plan_id"`
+	VariantId        int    `json:"variantId" db:"variant_id"`
+	InventoryItemId  int    `json:"inventoryItemId" db:"inventory_item_id"`
+	Name             string `json:"name" db:"name"`
+	VariantName      string `json:"variantName" db:"variant_name"`
+	IsDefaultVariant bool   `json:"isDefaultVariant" db:"is_default_variant"`
+	Sku              string `json:"sku" db:"sku"`
+	Slug             string `json:"slug" db:"slug"`
+	Quantity         int    `json:"quantity" db:"quantity"`
+}
+
+type Subscription struct {
+	Id               int        `json:"id" db:"id"`
+	UserId           int        `json:"userId" db:"user_id"`
+	PlanId           int        `json:"planId" db:"plan_id"`
+	ShippingOptionId int        `json:"shippingOptionId" db:"shipping_option_id"`
+	Status           string     `json:"status" db:"status"`
+	NextShipmentOn   time.Time  `json:"nextShipmentOn" db:"next_shipment_on"`
+	PausedAt         *time.Time `json:"pausedAt" db:"paused_at"`
+	CancelledAt      *time.Time `json:"cancelledAt" db:"cancelled_at"`
+	CreatedAt        time.Time  `json:"createdAt" db:"created_at"`
+	UpdatedAt        *time.Time `json:"updatedAt" db:"updated_at"`
+	PaymentProvider  *string    `json:"-" db:"payment_provider"`
+	CardReference    *string    `json:"-" db:"card_reference"`
+}
+
+// UserSubscription is a subscription along with its plan, for the user's subscription pages
+type UserSubscription struct {
+	Subscription
+	PlanName        string  `json:"planName" db:"plan_name"`
+	PlanSlug        string  `json:"planSlug" db:"plan_slug"`
+	BillingInterval string  `json:"billingInterval" db:"billing_interval"`
+	Price           float64 `json:"price" db:"price"`
+}
+
+type SubscriptionShipment struct {
+	Id               int                        `json:"id" db:"id"`
+	SubscriptionId   int                        `json:"subscriptionId" db:"subscription_id"`
+	CycleOn          time.Time                  `json:"cycleOn" db:"cycle_on"`
+	Status           string                     `json:"status" db:"status"`
+	Attempts         int                        `json:"attempts" db:"attempts"`
+	LastError        *string                    `json:"lastError" db:"last_error"`
+	NextAttemptAt    *time.Time                 `json:"nextAttemptAt" db:"next_attempt_at"`
+	Price            float64                    `json:"price" db:"price"`
+	ShippingPrice    float64                    `json:"shippingPrice" db:"shipping_price"`
+	FulfilledAt      *time.Time                 `json:"fulfilledAt" db:"fulfilled_at"`
+	CreatedAt        time.Time                  `json:"createdAt" db:"created_at"`
+	UpdatedAt        *time.Time                 `json:"updatedAt" db:"updated_at"`
+	PaymentStatus    *string                    `json:"paymentStatus" db:"payment_status"`
+	PaymentReference *string                    `json:"-" db:"payment_reference"`
+	Items            []SubscriptionShipmentItem `json:"items" db:"-"`
+}
+
+type SubscriptionShipmentItem struct {
+	Id         int    `json:"id" db:"id"`
+	ShipmentId int    `json:"shipmentId" db:"shipment_id"`
+	VariantId  *int   `json:"variantId" db:"variant_id"`
+	Name       string `json:"name" db:"name"`
+	Sku        string `json:"sku" db:"sku"`
+	Quantity   int    `json:"quantity" db:"quantity"`
+}
+
+// SubscribeRequest - the card is saved with the payment provider and charged for each cycle
+type SubscribeRequest struct {
+	PlanId           int         `json:"planId" validate:"required,min=1"`
+	ShippingOptionId int         `json:"shippingOptionId" validate:"required,min=1"`
+	Card             PaymentCard `json:"card" validate:"required"`
+}
+
+type SubscriptionCardRequest struct {
+	Card PaymentCard `json:"card" validate:"required"`
+}
+
+// ChangeSubscriptionPlanRequest - ShippingOptionId 0 keeps the current shipping option
+type ChangeSubscriptionPlanRequest struct {
+	PlanId           int `json:"planId" validate:"required,min=1"`
+	ShippingOptionId int `json:"shippingOptionId" validate:"min=0"`
+}
+
+type SubscriptionPlanItemRequest struct {
+	VariantId int `json:"variantId" validate:"required,min=1"`
+	Quantity  int `json:"quantity" validate:"required,min=1,max=100"`
+}
+
+type SubscriptionPlanRequest struct {
+	Slug            string                        `json:"slug" validate:"required,min=2,max=255"`
+	Name            string                        `json:"name" validate:"required,min=2,max=255"`
+	Description     string                        `json:"description" validate:"max=1000"`
+	BillingInterval string                        `json:"billingInterval" validate:"required,oneof=monthly quarterly"`
+	Price           float64                       `json:"price" validate:"required,min=0.01,max=10000"`
+	IsActive        bool                          `json:"isActive"`
+	Items           []SubscriptionPlanItemRequest `json:"items" validate:"required,min=1,max=50,dive"`
+}
+
+// DisplayName is the name to show customers, e.g. in shipment records
+func (s SubscriptionPlanItem) DisplayName() string {
+	return VariantDisplayName(s.Name, s.VariantName, s.IsDefaultVariant)
+}
+
+// SubscriptionIntervalMonths is the number of months between cycles of a plan
+func SubscriptionIntervalMonths(billingInterval string) int {
+	if billingInterval == SubscriptionIntervalQuarterly {
+		return 3
+	}
+	return 1
+}
+
+/*
+NextSubscriptionCycleOn is the date of the cycle after cycleOn. Cycles fall on the same
+day of the month, capped at the 28th so every month has one.
+*/
+func NextSubscriptionCycleOn(cycleOn time.Time, billingInterval string) time.Time {
+	year, month, day := cycleOn.Date()
+	month += time.Month(SubscriptionIntervalMonths(billingInterval))
+	return time.Date(year, month, min(day, 28), 0, 0, 0, 0, time.UTC)
+}
+
+// subscriptionShipmentRetryAt is when to try a shipment again after attempts failures, or false once it's failed for good
+func subscriptionShipmentRetryAt(attempts int, now time.Time) (time.Time, bool) {
+	if attempts >= SubscriptionShipmentMaxAttempts {
+		return time.Time{}, false
+	}
+	return now.Add(time.Duration(attempts) * SubscriptionShipmentRetryDelay), true
+}
+
+// GetSubscriptionStatusTransitionMap
+// Maps each subscription status to the statuses it may move to next. Cancelled is terminal.
+func GetSubscriptionStatusTransitionMap() map[string][]string {
+	transitionMap := make(map[string][]string)
+	transitionMap[SubscriptionStatusActive] = []string{SubscriptionStatusPaused, SubscriptionStatusCancelled}
+	transitionMap[SubscriptionStatusPaused] = []string{SubscriptionStatusActive, SubscriptionStatusCancelled}
+	transitionMap[SubscriptionStatusCancelled] = []string{}
+	return transitionMap
+}
+
+func ValidateSubscriptionStatusTransition(fromStatus string, toStatus string) error {
+	allowedStatuses := GetSubscriptionStatusTransitionMap()[fromStatus]
+	if !slices.Contains(allowedStatuses, toStatus) {
+		return &StatusBadRequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("Subscription cannot move from %v to %v", fromStatus, toStatus),
+			ErrorCode:  ErrorCodeInvalidSubscriptionStatusTransition,
+		}
+	}
+	return nil
+}
+
+func newSubscriptionError(statusCode int, message string, errorCode string) *StatusBadRequestError {
+	return &StatusBadRequestError{
+		StatusCode: statusCode,
+		Message:    message,
+		ErrorCode:  errorCode,
+	}
+}
+
+// getSubscriptionPlanItems returns the items of each of the given plans, keyed by plan id
+func getSubscriptionPlanItems(db DBTX, planIds []int) (map[int][]SubscriptionPlanItem, error) {
+	const query = `
+		SELECT pi.plan_id,
+		       pi.variant_id,
+		       v.inventory_item_id,
+		       i.name,
+		       v.name AS variant_name,
+		       v.is_default AS is_default_variant,
+		       v.sku,
+		       i.slug,
+		       pi.quantity
+		FROM subscription_plan_items pi
+		JOIN inventory_item_variants v ON v.id = pi.variant_id
+		JOIN inventories i ON i.id = v.inventory_item_id
+		WHERE pi.plan_id = ANY($1)
+		ORDER BY pi.plan_id, pi.sort_order, pi.id
+	`
+	rows, err := db.Query(context.Background(), query, planIds)
+	if err != nil {
+		return nil, err
+	}
+	items, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[SubscriptionPlanItem])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+
+	planItems := make(map[int][]SubscriptionPlanItem)
+	for _, item := range items {
+		planItems[item.PlanId] = append(planItems[item.PlanId], item)
+	}
+	return planItems, nil
+}
+
+func addSubscriptionPlanItems(db DBTX, plans []SubscriptionPlan) error {
+	planIds := make([]int, 0, len(plans))
+	for _, plan := range plans {
+		planIds = append(planIds, plan.Id)
+	}
+	planItems, err := getSubscriptionPlanItems(db, planIds)
+	if err != nil {
+		return err
+	}
+	for i := range plans {
+		plans[i].Items = planItems[plans[i].Id]
+	}
+	return nil
+}
+
+// GetSubscriptionPlans returns plans with their items. Inactive plans are only included for admins.
+func GetSubscriptionPlans(dbPool *pgxpool.Pool, includeInactive bool) ([]SubscriptionPlan, error) {
+	const query = `
+		SELECT * FROM subscription_plans
+		WHERE is_active OR $1
+		ORDER BY price, id
+	`
+	rows, err := dbPool.Query(context.Background(), query, includeInactive)
+	if err != nil {
+		return nil, err
+	}
+	plans, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[SubscriptionPlan])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+	itemsErr := addSubscriptionPlanItems(dbPool, plans)
+	if itemsErr != nil {
+		return nil, itemsErr
+	}
+	return plans, nil
+}
+
+func getSubscriptionPlanById(db DBTX, planId int) (SubscriptionPlan, error) {
+	const query = `SELECT * FROM subscription_plans WHERE id = $1`
+	rows, err := db.Query(context.Background(), query, planId)
+	if err != nil {
+		return SubscriptionPlan{}, err
+	}
+	plan, collectErr := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[SubscriptionPlan])
+	if collectErr != nil {
+		return SubscriptionPlan{}, collectErr
+	}
+	plans := []SubscriptionPlan{plan}
+	itemsErr := addSubscriptionPlanItems(db, plans)
+	return plans[0], itemsErr
+}
+
+// getActiveSubscriptionPlan returns a not found error for plans that don't exist or can't be subscribed to
+func getActiveSubscriptionPlan(db DBTX, planId int) (SubscriptionPlan, error) {
+	plan, err := getSubscriptionPlanById(db, planId)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !plan.IsActive) {
+		return SubscriptionPlan{}, newSubscriptionError(
+			http.StatusNotFound, "Subscription plan not found", ErrorCodeSubscriptionPlanNotFound,
+		)
+	}
+	return plan, err
+}
+
+// GetSubscriptionPlanIdBySlug returns pgx.ErrNoRows if there's no plan with the slug
+func GetSubscriptionPlanIdBySlug(dbPool *pgxpool.Pool, slug string) (int, error) {
+	const query = `SELECT id FROM subscription_plans WHERE slug = $1`
+	var id int
+	err := dbPool.QueryRow(context.Background(), query, slug).Scan(&id)
+	return id, err
+}
+
+/*
+SaveSubscriptionPlan creates a plan when planId is 0, and updates it otherwise
+ 1. Check every item is a variant that exists and none is listed twice
+ 2. Insert or update the plan, rejecting slugs already in use
+ 3. Replace the plan's items, in the order given
+
+Subscribers get the new items from their next shipment on.
+*/
+func SaveSubscriptionPlan(
+	dbPool *pgxpool.Pool, logger *slog.Logger, planId int, request SubscriptionPlanRequest,
+) (SubscriptionPlan, error) {
+	variantIds := make([]int, 0, len(request.Items))
+	for _, item := range request.Items {
+		if slices.Contains(variantIds, item.VariantId) {
+			return SubscriptionPlan{}, newSubscriptionError(
+				http.StatusBadRequest,
+				fmt.Sprintf("Variant %v is listed more than once", item.VariantId),
+				ErrorCodeInvalidSubscriptionPlan,
+			)
+		}
+		variantIds = append(variantIds, item.VariantId)
+	}
+
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return SubscriptionPlan{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("SaveSubscriptionPlan: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	var variantCount int
+	countErr := tx.QueryRow(
+		ctx, `SELECT COUNT(*) FROM inventory_item_variants WHERE id = ANY($1)`, variantIds,
+	).Scan(&variantCount)
+	if countErr != nil {
+		return SubscriptionPlan{}, countErr
+	}
+	if variantCount != len(variantIds) {
+		return SubscriptionPlan{}, newSubscriptionError(
+			http.StatusBadRequest, "Some of the variants don't exist", ErrorCodeInvalidSubscriptionPlan,
+		)
+	}
+
+	var savedId int
+	var saveErr error
+	if planId == 0 {
+		const insertQuery = `
+			INSERT INTO subscription_plans (slug, name, description, billing_interval, price, is_active, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, NOW())
+			RETURNING id
+		`
+		saveErr = tx.QueryRow(
+			ctx, insertQuery, request.Slug, request.Name, request.Description,
+			request.BillingInterval, request.Price, request.IsActive,
+		).Scan(&savedId)
+	} else {
+		const updateQuery = `
+			UPDATE subscription_plans
+			SET slug = $2,
+			    name = $3,
+			    description = $4,
+			    billing_interval = $5,
+			    price = $6,
+			    is_active = $7,
+			    updated_at = NOW()
+			WHERE id = $1
+			RETURNING id
+		`
+		saveErr = tx.QueryRow(
+			ctx, updateQuery, planId, request.Slug, request.Name, request.Description,
+			request.BillingInterval, request.Price, request.IsActive,
+		).Scan(&savedId)
+	}
+	if isPgError(saveErr, pgErrorCodeUniqueViolation) {
+		return SubscriptionPlan{}, newSubscriptionError(
+			http.StatusConflict,
+			fmt.Sprintf("Subscription plan %v already exists", request.Slug),
+			ErrorCodeSubscriptionPlanExists,
+		)
+	}
+	if saveErr != nil {
+		return SubscriptionPlan{}, saveErr
+	}
+
+	_, deleteErr := tx.Exec(ctx, `DELETE FROM subscription_plan_items WHERE plan_id = $1`, savedId)
+	if deleteErr != nil {
+		return SubscriptionPlan{}, deleteErr
+	}
+	for i, item := range request.Items {
+		const query = `
+			INSERT INTO subscription_plan_items (plan_id, variant_id, quantity, sort_order)
+			VALUES ($1, $2, $3, $4)
+		`
+		_, insertErr := tx.Exec(ctx, query, savedId, item.VariantId, item.Quantity, i)
+		if insertErr != nil {
+			return SubscriptionPlan{}, insertErr
+		}
+	}
+
+	plan, planErr := getSubscriptionPlanById(tx, savedId)
+	if planErr != nil {
+		return SubscriptionPlan{}, planErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return SubscriptionPlan{}, commitErr
+	}
+	logger.Info(fmt.Sprintf("Saved subscription plan %v (%v) with %v items", plan.Id, plan.Slug, len(plan.Items)))
+	return plan, nil
+}
+
+const userSubscriptionColumns = `
+		SELECT s.*,
+		       p.name AS plan_name,
+		       p.slug AS plan_slug,
+		       p.billing_interval,
+		       p.price
+		FROM subscriptions s
+		JOIN subscription_plans p ON p.id = s.plan_id`
+
+func GetSubscriptionsByUserId(dbPool *pgxpool.Pool, userId int) ([]UserSubscription, error) {
+	query := userSubscriptionColumns + `
+		WHERE s.user_id = $1
+		ORDER BY s.status = 'cancelled', s.created_at DESC`
+	rows, err := dbPool.Query(context.Background(), query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[UserSubscription])
+}
+
+// getUserSubscription returns pgx.ErrNoRows if the subscription isn't the user's
+func getUserSubscription(db DBTX, userId int, subscriptionId int, lockClause string) (UserSubscription, error) {
+	query := userSubscriptionColumns + `
+		WHERE s.id = $1
+		AND s.user_id = $2` + lockClause
+	rows, err := db.Query(context.Background(), query, subscriptionId, userId)
+	if err != nil {
+		return UserSubscription{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[UserSubscription])
+}
+
+func GetUserSubscription(dbPool *pgxpool.Pool, userId int, subscriptionId int) (UserSubscription, error) {
+	return getUserSubscription(dbPool, userId, subscriptionId, "")
+}
+
+// GetSubscriptionShipments returns the subscription's shipments, newest first, with what each contained
+func GetSubscriptionShipments(dbPool *pgxpool.Pool, subscriptionId int) ([]SubscriptionShipment, error) {
+	const query = `
+		SELECT * FROM subscription_shipments
+		WHERE subscription_id = $1
+		ORDER BY cycle_on DESC
+	`
+	rows, err := dbPool.Query(context.Background(), query, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+	shipments, collectRowsErr := pgx.CollectRows(rows, pgx.RowToStructByName[SubscriptionShipment])
+	if collectRowsErr != nil {
+		return nil, collectRowsErr
+	}
+
+	const itemsQuery = `
+		SELECT si.*
+		FROM subscription_shipment_items si
+		JOIN subscription_shipments sh ON sh.id = si.shipment_id
+		WHERE sh.subscription_id = $1
+		ORDER BY si.id
+	`
+	itemRows, itemsErr := dbPool.Query(context.Background(), itemsQuery, subscriptionId)
+	if itemsErr != nil {
+		return nil, itemsErr
+	}
+	items, collectItemsErr := pgx.CollectRows(itemRows, pgx.RowToStructByName[SubscriptionShipmentItem])
+	if collectItemsErr != nil {
+		return nil, collectItemsErr
+	}
+	for i := range shipments {
+		for _, item := range items {
+			if item.ShipmentId == shipments[i].Id {
+				shipments[i].Items = append(shipments[i].Items, item)
+			}
+		}
+	}
+	return shipments, nil
+}
+
+func checkShippingOptionExists(db DBTX, shippingOptionId int) error {
+	_, err := getShippingOptionById(db, shippingOptionId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newSubscriptionError(http.StatusBadRequest, "Invalid shipping option", ErrorCodeInvalidShippingOption)
+	}
+	return err
+}
+
+// Subscribe saves the card and starts a subscription. The first box is charged for and goes out on the next
+// run of the subscription job.
+func Subscribe(
+	dbPool *pgxpool.Pool, logger *slog.Logger, provider PaymentProvider, userId int, request SubscribeRequest,
+) (Subscription, error) {
+	plan, planErr := getActiveSubscriptionPlan(dbPool, request.PlanId)
+	if planErr != nil {
+		return Subscription{}, planErr
+	}
+	shippingErr := checkShippingOptionExists(dbPool, request.ShippingOptionId)
+	if shippingErr != nil {
+		return Subscription{}, shippingErr
+	}
+
+	cardReference, saveCardErr := provider.SaveCard(request.Card)
+	if saveCardErr != nil {
+		return Subscription{}, saveCardErr
+	}
+
+	const query = `
+		INSERT INTO subscriptions (
+			user_id, plan_id, shipping_option_id, status, next_shipment_on, payment_provider, card_reference, created_at
+		)
+		VALUES ($1, $2, $3, $4, CURRENT_DATE, $5, $6, NOW())
+		RETURNING *
+	`
+	rows, insertErr := dbPool.Query(
+		context.Background(), query, userId, plan.Id, request.ShippingOptionId, SubscriptionStatusActive,
+		provider.Name(), cardReference,
+	)
+	if insertErr != nil {
+		return Subscription{}, insertErr
+	}
+	subscription, collectErr := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Subscription])
+	if isPgError(collectErr, pgErrorCodeUniqueViolation) {
+		return Subscription{}, newSubscriptionError(
+			http.StatusConflict, "You're already subscribed to this plan", ErrorCodeAlreadySubscribed,
+		)
+	}
+	if collectErr != nil {
+		return Subscription{}, collectErr
+	}
+	logger.Info(fmt.Sprintf("User %v subscribed to plan %v", userId, plan.Slug))
+	return subscription, nil
+}
+
+// UpdateSubscriptionCard saves a new card to charge from the next attempt on, such as after the old one was declined
+func UpdateSubscriptionCard(
+	dbPool *pgxpool.Pool, logger *slog.Logger, provider PaymentProvider, userId int, subscriptionId int, card PaymentCard,
+) (UserSubscription, error) {
+	subscription, subscriptionErr := GetUserSubscription(dbPool, userId, subscriptionId)
+	if subscriptionErr != nil {
+		return UserSubscription{}, subscriptionErr
+	}
+	if subscription.Status == SubscriptionStatusCancelled {
+		return UserSubscription{}, newSubscriptionError(
+			http.StatusBadRequest, "This subscription has been cancelled", ErrorCodeSubscriptionNotActive,
+		)
+	}
+
+	cardReference, saveCardErr := provider.SaveCard(card)
+	if saveCardErr != nil {
+		return UserSubscription{}, saveCardErr
+	}
+	const query = `
+		UPDATE subscriptions
+		SET payment_provider = $3, card_reference = $4, updated_at = NOW()
+		WHERE id = $1
+		AND user_id = $2
+		AND status <> 'cancelled'
+	`
+	result, updateErr := dbPool.Exec(context.Background(), query, subscriptionId, userId, provider.Name(), cardReference)
+	if updateErr != nil {
+		return UserSubscription{}, updateErr
+	}
+	if result.RowsAffected() == 0 {
+		return UserSubscription{}, pgx.ErrNoRows
+	}
+	logger.Info(fmt.Sprintf("Subscription %v card updated", subscriptionId))
+	return GetUserSubscription(dbPool, userId, subscriptionId)
+}
+
+/*
+UpdateSubscriptionStatus pauses, resumes or cancels the user's subscription
+  - Pausing stops new cycles and holds back pending shipments
+  - Resuming picks up from today if cycles were missed while paused
+  - Cancelling skips any shipment that's still pending. The job refunds any it already charged for.
+*/
+func UpdateSubscriptionStatus(
+	dbPool *pgxpool.Pool, logger *slog.Logger, userId int, subscriptionId int, toStatus string,
+) (UserSubscription, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return UserSubscription{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("UpdateSubscriptionStatus: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	subscription, subscriptionErr := getUserSubscription(tx, userId, subscriptionId, "\n\t\tFOR UPDATE OF s")
+	if subscriptionErr != nil {
+		return UserSubscription{}, subscriptionErr
+	}
+	transitionErr := ValidateSubscriptionStatusTransition(subscription.Status, toStatus)
+	if transitionErr != nil {
+		return UserSubscription{}, transitionErr
+	}
+
+	const query = `
+		UPDATE subscriptions
+		SET status = $2,
+		    paused_at = CASE WHEN $2 = 'paused' THEN NOW() END,
+		    cancelled_at = CASE WHEN $2 = 'cancelled' THEN NOW() END,
+		    next_shipment_on = CASE WHEN $2 = 'active' THEN GREATEST(next_shipment_on, CURRENT_DATE)
+		                            ELSE next_shipment_on END,
+		    updated_at = NOW()
+		WHERE id = $1
+	`
+	_, updateErr := tx.Exec(ctx, query, subscriptionId, toStatus)
+	if updateErr != nil {
+		return UserSubscription{}, updateErr
+	}
+
+	if toStatus == SubscriptionStatusCancelled {
+		const skipQuery = `
+			UPDATE subscription_shipments
+			SET status = 'skipped', next_attempt_at = NULL, updated_at = NOW()
+			WHERE subscription_id = $1
+			AND status = 'pending'
+		`
+		_, skipErr := tx.Exec(ctx, skipQuery, subscriptionId)
+		if skipErr != nil {
+			return UserSubscription{}, skipErr
+		}
+	}
+
+	updatedSubscription, updatedErr := getUserSubscription(tx, userId, subscriptionId, "")
+	if updatedErr != nil {
+		return UserSubscription{}, updatedErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return UserSubscription{}, commitErr
+	}
+	logger.Info(fmt.Sprintf("Subscription %v moved from %v to %v", subscriptionId, subscription.Status, toStatus))
+	return updatedSubscription, nil
+}
+
+// dueSubscription is a subscription whose next cycle has arrived, with what that cycle costs
+type dueSubscription struct {
+	Id              int       `db:"id"`
+	Status          string    `db:"status"`
+	NextShipmentOn  time.Time `db:"next_shipment_on"`
+	BillingInterval string    `db:"billing_interval"`
+	Price           float64   `db:"price"`
+	ShippingPrice   float64   `db:"shipping_price"`
+}
+
+const dueSubscriptionColumns = `
+		SELECT s.id, s.status, s.next_shipment_on, p.billing_interval, p.price, so.price AS shipping_price
+		FROM subscriptions s
+		JOIN subscription_plans p ON p.id = s.plan_id
+		JOIN shipping_options so ON so.id = s.shipping_option_id`
+
+// startSubscriptionCycle records the cycle due on subscription's next shipment date with status, and moves the date on
+func startSubscriptionCycle(db DBTX, subscription dueSubscription, status string) (SubscriptionShipment, error) {
+	ctx := context.Background()
+	var nextAttemptAt *time.Time
+	if status == SubscriptionShipmentStatusPending {
+		now := time.Now()
+		nextAttemptAt = &now
+	}
+	const query = `
+		INSERT INTO subscription_shipments (
+			subscription_id, cycle_on, status, next_attempt_at, price, shipping_price, created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		RETURNING *
+	`
+	rows, insertErr := db.Query(
+		ctx, query, subscription.Id, subscription.NextShipmentOn, status, nextAttemptAt,
+		subscription.Price, subscription.ShippingPrice,
+	)
+	if insertErr != nil {
+		return SubscriptionShipment{}, insertErr
+	}
+	shipment, collectErr := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[SubscriptionShipment])
+	if collectErr != nil {
+		return SubscriptionShipment{}, collectErr
+	}
+
+	const advanceQuery = `
+		UPDATE subscriptions
+		SET next_shipment_on = $2, updated_at = NOW()
+		WHERE id = $1
+	`
+	nextShipmentOn := NextSubscriptionCycleOn(subscription.NextShipmentOn, subscription.BillingInterval)
+	_, advanceErr := db.Exec(ctx, advanceQuery, subscription.Id, nextShipmentOn)
+	if advanceErr != nil {
+		return SubscriptionShipment{}, advanceErr
+	}
+	return shipment, nil
+}
+
+// SkipSubscriptionCycle records the user's next cycle as skipped, so nothing ships or is charged for it
+func SkipSubscriptionCycle(
+	dbPool *pgxpool.Pool, logger *slog.Logger, userId int, subscriptionId int,
+) (SubscriptionShipment, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return SubscriptionShipment{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("SkipSubscriptionCycle: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	query := dueSubscriptionColumns + `
+		WHERE s.id = $1
+		AND s.user_id = $2
+		FOR UPDATE OF s`
+	rows, queryErr := tx.Query(ctx, query, subscriptionId, userId)
+	if queryErr != nil {
+		return SubscriptionShipment{}, queryErr
+	}
+	subscription, collectErr := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[dueSubscription])
+	if collectErr != nil {
+		return SubscriptionShipment{}, collectErr
+	}
+
+	if subscription.Status != SubscriptionStatusActive {
+		return SubscriptionShipment{}, newSubscriptionError(
+			http.StatusBadRequest,
+			fmt.Sprintf("Only active subscriptions can skip a cycle, this one is %v", subscription.Status),
+			ErrorCodeSubscriptionNotActive,
+		)
+	}
+
+	shipment, shipmentErr := startSubscriptionCycle(tx, subscription, SubscriptionShipmentStatusSkipped)
+	if shipmentErr != nil {
+		return SubscriptionShipment{}, shipmentErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return SubscriptionShipment{}, commitErr
+	}
+	logger.Info(fmt.Sprintf("Subscription %v skipped the cycle on %v", subscriptionId, shipment.CycleOn.Format(time.DateOnly)))
+	return shipment, nil
+}
+
+// ChangeSubscriptionPlan moves the subscription to another plan from the next cycle on
+func ChangeSubscriptionPlan(
+	dbPool *pgxpool.Pool, logger *slog.Logger, userId int, subscriptionId int, request ChangeSubscriptionPlanRequest,
+) (UserSubscription, error) {
+	subscription, subscriptionErr := GetUserSubscription(dbPool, userId, subscriptionId)
+	if subscriptionErr != nil {
+		return UserSubscription{}, subscriptionErr
+	}
+	if subscription.Status == SubscriptionStatusCancelled {
+		return UserSubscription{}, newSubscriptionError(
+			http.StatusBadRequest, "This subscription has been cancelled", ErrorCodeSubscriptionNotActive,
+		)
+	}
+	plan, planErr := getActiveSubscriptionPlan(dbPool, request.PlanId)
+	if planErr != nil {
+		return UserSubscription{}, planErr
+	}
+	shippingOptionId := subscription.ShippingOptionId
+	if request.ShippingOptionId > 0 {
+		shippingErr := checkShippingOptionExists(dbPool, request.ShippingOptionId)
+		if shippingErr != nil {
+			return UserSubscription{}, shippingErr
+		}
+		shippingOptionId = request.ShippingOptionId
+	}
+
+	const query = `
+		UPDATE subscriptions
+		SET plan_id = $3, shipping_option_id = $4, updated_at = NOW()
+		WHERE id = $1
+		AND user_id = $2
+		AND status <> 'cancelled'
+	`
+	result, updateErr := dbPool.Exec(context.Background(), query, subscriptionId, userId, plan.Id, shippingOptionId)
+	if isPgError(updateErr, pgErrorCodeUniqueViolation) {
+		return UserSubscription{}, newSubscriptionError(
+			http.StatusConflict, "You're already subscribed to this plan", ErrorCodeAlreadySubscribed,
+		)
+	}
+	if updateErr != nil {
+		return UserSubscription{}, updateErr
+	}
+	if result.RowsAffected() == 0 {
+		return UserSubscription{}, pgx.ErrNoRows
+	}
+	logger.Info(fmt.Sprintf("Subscription %v changed from plan %v to %v", subscriptionId, subscription.PlanSlug, plan.Slug))
+	return GetUserSubscription(dbPool, userId, subscriptionId)
+}
+
+// CreateDueSubscriptionShipments starts every active subscription's cycle that has come due. Returns the number started.
+func CreateDueSubscriptionShipments(dbPool *pgxpool.Pool, logger *slog.Logger) (int, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return 0, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("CreateDueSubscriptionShipments: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	query := dueSubscriptionColumns + `
+		WHERE s.status = 'active'
+		AND s.next_shipment_on <= CURRENT_DATE
+		ORDER BY s.id
+		FOR UPDATE OF s SKIP LOCKED`
+	rows, queryErr := tx.Query(ctx, query)
+	if queryErr != nil {
+		return 0, queryErr
+	}
+	dueSubscriptions, collectErr := pgx.CollectRows(rows, pgx.RowToStructByName[dueSubscription])
+	if collectErr != nil {
+		return 0, collectErr
+	}
+
+	for _, subscription := range dueSubscriptions {
+		_, shipmentErr := startSubscriptionCycle(tx, subscription, SubscriptionShipmentStatusPending)
+		if shipmentErr != nil {
+			return 0, shipmentErr
+		}
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return 0, commitErr
+	}
+	return len(dueSubscriptions), nil
+}
+
+/*
+FulfilPendingSubscriptionShipments charges for and then ships each pending shipment that's due,
+for subscriptions that are still active. A declined charge is a failed attempt like short stock.
+Returns how many were fulfilled and how many failed this attempt.
+*/
+func FulfilPendingSubscriptionShipments(
+	dbPool *pgxpool.Pool, logger *slog.Logger, provider PaymentProvider,
+) (int, int, error) {
+	const query = `
+		SELECT sh.id
+		FROM subscription_shipments sh
+		JOIN subscriptions s ON s.id = sh.subscription_id
+		WHERE sh.status = 'pending'
+		AND sh.next_attempt_at <= NOW()
+		AND s.status = 'active'
+		ORDER BY sh.next_attempt_at, sh.id
+		LIMIT $1
+	`
+	rows, queryErr := dbPool.Query(context.Background(), query, subscriptionShipmentBatchSize)
+	if queryErr != nil {
+		return 0, 0, queryErr
+	}
+	shipmentIds, collectErr := pgx.CollectRows(rows, pgx.RowTo[int])
+	if collectErr != nil {
+		return 0, 0, collectErr
+	}
+
+	fulfilled := 0
+	failed := 0
+	for _, shipmentId := range shipmentIds {
+		fulfilErr := chargeSubscriptionShipment(dbPool, logger, provider, shipmentId)
+		if fulfilErr == nil {
+			fulfilErr = fulfilSubscriptionShipment(dbPool, logger, shipmentId)
+		}
+		var badRequestErr *StatusBadRequestError
+		if errors.As(fulfilErr, &badRequestErr) {
+			failureErr := recordSubscriptionShipmentFailure(dbPool, logger, shipmentId, badRequestErr.Message)
+			if failureErr != nil {
+				return fulfilled, failed, failureErr
+			}
+			failed++
+			continue
+		}
+		if errors.Is(fulfilErr, pgx.ErrNoRows) {
+			// Another run got to it first
+			continue
+		}
+		if fulfilErr != nil {
+			return fulfilled, failed, fulfilErr
+		}
+		fulfilled++
+	}
+	return fulfilled, failed, nil
+}
+
+// subscriptionShipmentCharge is what a pending shipment is to be charged, and to which card
+type subscriptionShipmentCharge struct {
+	AmountCents   int64
+	CardReference string
+	IsPaid        bool
+}
+
+/*
+chargeSubscriptionShipment takes payment for a pending shipment before it's fulfilled
+ 1. Lock the shipment and mark its charge pending, so two runs of the job can't both charge it
+ 2. Authorize and capture the cycle's price and shipping on the subscription's saved card
+ 3. Record the outcome on the shipment
+
+A shipment that's already paid for, from an attempt that then failed on stock, isn't charged
+again. Declines and provider errors come back as a StatusBadRequestError.
+*/
+func chargeSubscriptionShipment(
+	dbPool *pgxpool.Pool, logger *slog.Logger, provider PaymentProvider, shipmentId int,
+) error {
+	charge, startErr := startSubscriptionShipmentCharge(dbPool, logger, provider.Name(), shipmentId)
+	if startErr != nil || charge.IsPaid {
+		return startErr
+	}
+
+	result, authorizeErr := provider.AuthorizeSavedCard(charge.CardReference, charge.AmountCents)
+	if authorizeErr == nil {
+		result, authorizeErr = capturePayment(logger, provider, result, charge.AmountCents)
+	}
+	if authorizeErr != nil {
+		logger.Error(fmt.Sprintf("Payment provider error for subscription shipment %v: %v", shipmentId, authorizeErr))
+		result = PaymentResult{Status: PaymentStatusFailed}
+	}
+	updateErr := updateSubscriptionShipmentPayment(dbPool, shipmentId, result.Status, result.ProviderReference)
+	if updateErr != nil {
+		return updateErr
+	}
+	logger.Info(fmt.Sprintf("Charge for subscription shipment %v: %v", shipmentId, result.Status))
+
+	switch result.Status {
+	case PaymentStatusCaptured:
+		return nil
+	case PaymentStatusDeclined:
+		return newSubscriptionError(
+			http.StatusPaymentRequired, fmt.Sprintf("Payment declined: %v", result.DeclineReason), ErrorCodePaymentDeclined,
+		)
+	case PaymentStatusFailed:
+		return newSubscriptionError(http.StatusBadGateway, "The payment couldn't be taken", ErrorCodePaymentDeclined)
+	default:
+		return newSubscriptionPaymentPendingError()
+	}
+}
+
+// A charge that's still with the provider may yet go through, so it isn't tried again. It's left for an admin.
+func newSubscriptionPaymentPendingError() *StatusBadRequestError {
+	return newSubscriptionError(
+		http.StatusConflict, "The charge for this shipment hasn't settled", ErrorCodePaymentPending,
+	)
+}
+
+// startSubscriptionShipmentCharge locks the shipment, and unless it's already paid for marks its charge pending
+func startSubscriptionShipmentCharge(
+	dbPool *pgxpool.Pool, logger *slog.Logger, providerName string, shipmentId int,
+) (subscriptionShipmentCharge, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return subscriptionShipmentCharge{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("startSubscriptionShipmentCharge: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	const query = `
+		SELECT sh.payment_status, sh.price + sh.shipping_price, s.payment_provider, s.card_reference
+		FROM subscription_shipments sh
+		JOIN subscriptions s ON s.id = sh.subscription_id
+		WHERE sh.id = $1
+		AND sh.status = 'pending'
+		FOR UPDATE OF sh SKIP LOCKED
+	`
+	var paymentStatus *string
+	var amount float64
+	var paymentProvider *string
+	var cardReference *string
+	queryErr := tx.QueryRow(ctx, query, shipmentId).Scan(&paymentStatus, &amount, &paymentProvider, &cardReference)
+	if queryErr != nil {
+		return subscriptionShipmentCharge{}, queryErr
+	}
+	if paymentStatus != nil && *paymentStatus == PaymentStatusCaptured {
+		return subscriptionShipmentCharge{IsPaid: true}, nil
+	}
+	if paymentStatus != nil && slices.Contains(inFlightPaymentStatuses, *paymentStatus) {
+		return subscriptionShipmentCharge{}, newSubscriptionPaymentPendingError()
+	}
+	if cardReference == nil || paymentProvider == nil || *paymentProvider != providerName {
+		return subscriptionShipmentCharge{}, newSubscriptionError(
+			http.StatusPaymentRequired, "There's no card saved for this subscription", ErrorCodePaymentDeclined,
+		)
+	}
+
+	updateErr := updateSubscriptionShipmentPayment(tx, shipmentId, PaymentStatusPending, "")
+	if updateErr != nil {
+		return subscriptionShipmentCharge{}, updateErr
+	}
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return subscriptionShipmentCharge{}, commitErr
+	}
+	return subscriptionShipmentCharge{AmountCents: dollarsToCents(amount), CardReference: *cardReference}, nil
+}
+
+// updateSubscriptionShipmentPayment keeps the shipment's payment reference unless a new one is given
+func updateSubscriptionShipmentPayment(db DBTX, shipmentId int, paymentStatus string, paymentReference string) error {
+	const query = `
+		UPDATE subscription_shipments
+		SET payment_status = $2,
+		    payment_reference = COALESCE(NULLIF($3, ''), payment_reference),
+		    updated_at = NOW()
+		WHERE id = $1
+	`
+	_, err := db.Exec(context.Background(), query, shipmentId, paymentStatus, paymentReference)
+	return err
+}
+
+/*
+fulfilSubscriptionShipment
+ 1. Lock the shipment if it's still pending and has been paid for
+ 2. Take stock for the plan's current items, with bundles expanded into their components
+ 3. Record what was shipped and mark the shipment fulfilled
+
+Stock that's short comes back as a StatusBadRequestError, with nothing taken.
+*/
+func fulfilSubscriptionShipment(dbPool *pgxpool.Pool, logger *slog.Logger, shipmentId int) error {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("fulfilSubscriptionShipment: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	const shipmentQuery = `
+		SELECT s.plan_id
+		FROM subscription_shipments sh
+		JOIN subscriptions s ON s.id = sh.subscription_id
+		WHERE sh.id = $1
+		AND sh.status = 'pending'
+		AND sh.payment_status = 'captured'
+		FOR UPDATE OF sh SKIP LOCKED
+	`
+	var planId int
+	shipmentErr := tx.QueryRow(ctx, shipmentQuery, shipmentId).Scan(&planId)
+	if shipmentErr != nil {
+		return shipmentErr
+	}
+
+	planItems, planItemsErr := getSubscriptionPlanItems(tx, []int{planId})
+	if planItemsErr != nil {
+		return planItemsErr
+	}
+	items := planItems[planId]
+	if len(items) == 0 {
+		return newSubscriptionError(http.StatusBadRequest, "The plan has no items", ErrorCodeInvalidSubscriptionPlan)
+	}
+
+	cartItems := make([]CartItem, 0, len(items))
+	for _, item := range items {
+		cartItems = append(cartItems, CartItem{
+			InventoryItemId:  item.InventoryItemId,
+			VariantId:        item.VariantId,
+			Name:             item.Name,
+			VariantName:      item.VariantName,
+			IsDefaultVariant: item.IsDefaultVariant,
+			Sku:              item.Sku,
+			Quantity:         item.Quantity,
+		})
+	}
+	bundleErr := addBundleComponents(tx, cartItems)
+	if bundleErr != nil {
+		return bundleErr
+	}
+	stockErr := takeStock(tx, 0, GetCartStockDemand(cartItems))
+	if stockErr != nil {
+		return stockErr
+	}
+
+	for _, item := range items {
+		const itemQuery = `
+			INSERT INTO subscription_shipment_items (shipment_id, variant_id, name, sku, quantity)
+			VALUES ($1, $2, $3, $4, $5)
+		`
+		_, itemErr := tx.Exec(ctx, itemQuery, shipmentId, item.VariantId, item.DisplayName(), item.Sku, item.Quantity)
+		if itemErr != nil {
+			return itemErr
+		}
+	}
+
+	const fulfilQuery = `
+		UPDATE subscription_shipments
+		SET status = 'fulfilled',
+		    attempts = attempts + 1,
+		    next_attempt_at = NULL,
+		    fulfilled_at = NOW(),
+		    updated_at = NOW()
+		WHERE id = $1
+	`
+	_, fulfilErr := tx.Exec(ctx, fulfilQuery, shipmentId)
+	if fulfilErr != nil {
+		return fulfilErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return commitErr
+	}
+	logger.Info(fmt.Sprintf("Fulfilled subscription shipment %v", shipmentId))
+	return nil
+}
+
+// recordSubscriptionShipmentFailure schedules a retry, or after the last attempt fails the shipment and pauses the
+// subscription. A failed shipment that was paid for is refunded by RefundUnshippedSubscriptionShipments.
+func recordSubscriptionShipmentFailure(dbPool *pgxpool.Pool, logger *slog.Logger, shipmentId int, reason string) error {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("recordSubscriptionShipmentFailure: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	var attempts int
+	var subscriptionId int
+	const attemptsQuery = `
+		UPDATE subscription_shipments
+		SET attempts = attempts + 1, last_error = $2, updated_at = NOW()
+		WHERE id = $1
+		RETURNING attempts, subscription_id
+	`
+	attemptsErr := tx.QueryRow(ctx, attemptsQuery, shipmentId, reason).Scan(&attempts, &subscriptionId)
+	if attemptsErr != nil {
+		return attemptsErr
+	}
+
+	retryAt, retry := subscriptionShipmentRetryAt(attempts, time.Now())
+	if retry {
+		const retryQuery = `UPDATE subscription_shipments SET next_attempt_at = $2 WHERE id = $1`
+		_, retryErr := tx.Exec(ctx, retryQuery, shipmentId, retryAt)
+		if retryErr != nil {
+			return retryErr
+		}
+		logger.Warn(fmt.Sprintf(
+			"Subscription shipment %v failed (attempt %v), retrying at %v: %v", shipmentId, attempts, retryAt, reason,
+		))
+	} else {
+		const failQuery = `
+			UPDATE subscription_shipments
+			SET status = 'failed', next_attempt_at = NULL
+			WHERE id = $1
+		`
+		_, failErr := tx.Exec(ctx, failQuery, shipmentId)
+		if failErr != nil {
+			return failErr
+		}
+		const pauseQuery = `
+			UPDATE subscriptions
+			SET status = 'paused', paused_at = NOW(), updated_at = NOW()
+			WHERE id = $1
+			AND status = 'active'
+		`
+		_, pauseErr := tx.Exec(ctx, pauseQuery, subscriptionId)
+		if pauseErr != nil {
+			return pauseErr
+		}
+		logger.Warn(fmt.Sprintf(
+			"Subscription shipment %v failed after %v attempts, pausing subscription %v: %v",
+			shipmentId, attempts, subscriptionId, reason,
+		))
+	}
+
+	return tx.Commit(ctx)
+}
+
+/*
+RefundUnshippedSubscriptionShipments refunds cycles that were charged for but won't ship: shipments
+that failed after being paid for, and pending ones skipped when their subscription was cancelled.
+Returns how many were refunded. One that can't be refunded now is tried again on the next run.
+*/
+func RefundUnshippedSubscriptionShipments(dbPool *pgxpool.Pool, logger *slog.Logger, provider PaymentProvider) (int, error) {
+	const query = `
+		SELECT id
+		FROM subscription_shipments
+		WHERE status IN ('failed', 'skipped')
+		AND payment_status = 'captured'
+		ORDER BY id
+		LIMIT $1
+	`
+	rows, queryErr := dbPool.Query(context.Background(), query, subscriptionShipmentBatchSize)
+	if queryErr != nil {
+		return 0, queryErr
+	}
+	shipmentIds, collectErr := pgx.CollectRows(rows, pgx.RowTo[int])
+	if collectErr != nil {
+		return 0, collectErr
+	}
+
+	refunded := 0
+	var errs []error
+	for _, shipmentId := range shipmentIds {
+		refundErr := refundSubscriptionShipment(dbPool, logger, provider, shipmentId)
+		if errors.Is(refundErr, pgx.ErrNoRows) {
+			// Another run got to it first
+			continue
+		}
+		if refundErr != nil {
+			errs = append(errs, fmt.Errorf("subscription shipment %v: %w", shipmentId, refundErr))
+			continue
+		}
+		refunded++
+	}
+	return refunded, errors.Join(errs...)
+}
+
+/*
+refundSubscriptionShipment
+ 1. Lock the shipment and mark its refund pending, so two runs of the job can't both refund it
+ 2. Refund the whole charge through the provider
+ 3. Record it refunded, or put it back as captured to be tried again if the provider failed
+*/
+func refundSubscriptionShipment(
+	dbPool *pgxpool.Pool, logger *slog.Logger, provider PaymentProvider, shipmentId int,
+) error {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("refundSubscriptionShipment: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	const query = `
+		SELECT price + shipping_price, payment_reference
+		FROM subscription_shipments
+		WHERE id = $1
+		AND status IN ('failed', 'skipped')
+		AND payment_status = 'captured'
+		FOR UPDATE SKIP LOCKED
+	`
+	var amount float64
+	var paymentReference string
+	queryErr := tx.QueryRow(ctx, query, shipmentId).Scan(&amount, &paymentReference)
+	if queryErr != nil {
+		return queryErr
+	}
+	pendingErr := updateSubscriptionShipmentPayment(tx, shipmentId, subscriptionPaymentStatusRefundPending, "")
+	if pendingErr != nil {
+		return pendingErr
+	}
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return commitErr
+	}
+
+	_, refundErr := provider.Refund(paymentReference, dollarsToCents(amount))
+	if refundErr != nil {
+		restoreErr := updateSubscriptionShipmentPayment(dbPool, shipmentId, PaymentStatusCaptured, "")
+		return errors.Join(refundErr, restoreErr)
+	}
+	refundedErr := updateSubscriptionShipmentPayment(dbPool, shipmentId, PaymentStatusRefunded, "")
+	if refundedErr != nil {
+		return refundedErr
+	}
+	logger.Info(fmt.Sprintf("Refunded subscription shipment %v", shipmentId))
+	return nil
+}
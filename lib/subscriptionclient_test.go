@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextSubscriptionCycleOn(t *testing.T) {
+	cases := []struct {
+		cycleOn         string
+		billingInterval string
+		expected        string
+	}{
+		{"2026-01-15", SubscriptionIntervalMonthly, "2026-02-15"},
+		{"2026-01-31", SubscriptionIntervalMonthly, "2026-02-28"},
+		{"2026-11-30", SubscriptionIntervalQuarterly, "2027-02-28"},
+		{"2026-12-05", SubscriptionIntervalMonthly, "2027-01-05"},
+	}
+	for _, tc := range cases {
+		cycleOn, _ := time.Parse(time.DateOnly, tc.cycleOn)
+		next := NextSubscriptionCycleOn(cycleOn, tc.billingInterval)
+		if next.Format(time.DateOnly) != tc.expected {
+			t.Fatalf("NextSubscriptionCycleOn(%v, %v) = %v, expected %v", tc.cycleOn, tc.billingInterval, next, tc.expected)
+		}
+	}
+}
+
+func TestSubscriptionShipmentRetryAt(t *testing.T) {
+	now := time.Now()
+	retryAt, retry := subscriptionShipmentRetryAt(1, now)
+	if !retry || !retryAt.Equal(now.Add(SubscriptionShipmentRetryDelay)) {
+		t.Fatalf("First failure should retry after one delay, got %v %v", retryAt, retry)
+	}
+	retryAt, retry = subscriptionShipmentRetryAt(2, now)
+	if !retry || !retryAt.Equal(now.Add(2*SubscriptionShipmentRetryDelay)) {
+		t.Fatalf("Second failure should back off, got %v %v", retryAt, retry)
+	}
+	if _, retry = subscriptionShipmentRetryAt(SubscriptionShipmentMaxAttempts, now); retry {
+		t.Fatalf("Shipment should fail for good after %v attempts", SubscriptionShipmentMaxAttempts)
+	}
+}
+
+func TestValidateSubscriptionStatusTransition(t *testing.T) {
+	if err := ValidateSubscriptionStatusTransition(SubscriptionStatusActive, SubscriptionStatusPaused); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateSubscriptionStatusTransition(SubscriptionStatusPaused, SubscriptionStatusActive); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateSubscriptionStatusTransition(SubscriptionStatusActive, SubscriptionStatusActive); err == nil {
+		t.Fatal("Resuming an active subscription should be rejected")
+	}
+	if err := ValidateSubscriptionStatusTransition(SubscriptionStatusCancelled, SubscriptionStatusActive); err == nil {
+		t.Fatal("Cancelled subscriptions shouldn't be resumable")
+	}
+}
@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// TaxCategoryStandard is the category of items with no tag in tax.tagCategories
+const TaxCategoryStandard = ""
+
+const basisPointsPerUnit = 10000
+
+type TaxLocation struct {
+	Country string `json:"country"`
+	Region  string `json:"region"`
+}
+
+/*
+TaxRules resolves tax rates from the [tax] config. Rates are kept in basis points
+(hundredths of a percent) so tax can be worked out in integer cents.
+*/
+type TaxRules struct {
+	pricesIncludeTax bool
+	defaultLocation  TaxLocation
+	rates            map[string]int
+	tagCategories    map[string]string
+}
+
+// NewTaxRules validates the [tax] config. An empty config charges no tax.
+func NewTaxRules(config ConfigTax) (TaxRules, error) {
+	rules := TaxRules{
+		pricesIncludeTax: config.PricesIncludeTax,
+		defaultLocation:  normaliseTaxLocation(TaxLocation{Country: config.DefaultCountry, Region: config.DefaultRegion}),
+		rates:            make(map[string]int),
+		tagCategories:    make(map[string]string),
+	}
+	for _, rate := range config.Rates {
+		if len(strings.TrimSpace(rate.Country)) == 0 {
+			return TaxRules{}, fmt.Errorf("tax rate for region %q has no country", rate.Region)
+		}
+		if rate.Rate < 0 || rate.Rate >= 100 {
+			return TaxRules{}, fmt.Errorf("tax rate %v for %v is out of range", rate.Rate, rate.Country)
+		}
+		key := taxRateKey(normaliseTaxLocation(TaxLocation{Country: rate.Country, Region: rate.Region}), rate.Category)
+		if _, exists := rules.rates[key]; exists {
+			return TaxRules{}, fmt.Errorf("duplicate tax rate for %v", key)
+		}
+		rules.rates[key] = int(math.Round(rate.Rate * 100))
+	}
+	for tagSlug, category := range config.TagCategories {
+		rules.tagCategories[tagSlug] = category
+	}
+	return rules, nil
+}
+
+func (rules TaxRules) PricesIncludeTax() bool {
+	return rules.pricesIncludeTax
+}
+
+func normaliseTaxLocation(location TaxLocation) TaxLocation {
+	return TaxLocation{
+		Country: strings.ToUpper(strings.TrimSpace(location.Country)),
+		Region:  strings.ToUpper(strings.TrimSpace(location.Region)),
+	}
+}
+
+func taxRateKey(location TaxLocation, category string) string {
+	return fmt.Sprintf("%s/%s/%s", location.Country, location.Region, category)
+}
+
+/*
+ResolveLocation fills in the configured default when no country is given. A region
+without a country is rejected since regions are only meaningful within a country.
+*/
+func (rules TaxRules) ResolveLocation(location TaxLocation) (TaxLocation, error) {
+	location = normaliseTaxLocation(location)
+	if len(location.Country) == 0 {
+		if len(location.Region) > 0 {
+			return TaxLocation{}, &StatusBadRequestError{
+				StatusCode: http.StatusBadRequest,
+				Message:    "A region needs a country",
+				ErrorCode:  ErrorCodeInvalidTaxLocation,
+			}
+		}
+		return rules.defaultLocation, nil
+	}
+	return location, nil
+}
+
+/*
+RateBasisPoints looks the rate up most specific first:
+ 1. country, region and category
+ 2. country and category
+ 3. country and region at the standard rate
+ 4. country at the standard rate
+
+Anywhere without a rate is untaxed.
+*/
+func (rules TaxRules) RateBasisPoints(location TaxLocation, category string) int {
+	location = normaliseTaxLocation(location)
+	countryOnly := TaxLocation{Country: location.Country}
+	keys := []string{
+		taxRateKey(location, category),
+		taxRateKey(countryOnly, category),
+		taxRateKey(location, TaxCategoryStandard),
+		taxRateKey(countryOnly, TaxCategoryStandard),
+	}
+	for _, key := range keys {
+		if rate, ok := rules.rates[key]; ok {
+			return rate
+		}
+	}
+	return 0
+}
+
+/*
+CategoryForTags - an item takes the category of the first of its tags (by slug) that
+has one, so items tagged into two categories are taxed predictably.
+*/
+func (rules TaxRules) CategoryForTags(tagSlugs []string) string {
+	sortedTagSlugs := slices.Clone(tagSlugs)
+	slices.Sort(sortedTagSlugs)
+	for _, tagSlug := range sortedTagSlugs {
+		if category, ok := rules.tagCategories[tagSlug]; ok {
+			return category
+		}
+	}
+	return TaxCategoryStandard
+}
+
+/*
+TaxOn is the tax on amount at rateBasisPoints. When prices include tax, the tax is the
+part of amount above its pre-tax value; otherwise it is added on top. Half cents round up.
+*/
+func TaxOn(amount Cents, rateBasisPoints int, pricesIncludeTax bool) Cents {
+	if amount <= 0 || rateBasisPoints <= 0 {
+		return 0
+	}
+	if pricesIncludeTax {
+		preTax := divideRoundingHalfUp(int64(amount)*basisPointsPerUnit, int64(basisPointsPerUnit+rateBasisPoints))
+		return amount - Cents(preTax)
+	}
+	return Cents(divideRoundingHalfUp(int64(amount)*int64(rateBasisPoints), basisPointsPerUnit))
+}
+
+// divideRoundingHalfUp - numerator and denominator must be positive
+func divideRoundingHalfUp(numerator int64, denominator int64) int64 {
+	return (2*numerator + denominator) / (2 * denominator)
+}
+
+// getInventoryItemTagSlugs returns the tag slugs of each item, by inventory item id
+func getInventoryItemTagSlugs(db DBTX, inventoryItemIds []int) (map[int][]string, error) {
+	const query = `
+		SELECT it.inventory_id, t.slug
+		FROM inventory_tags it
+		JOIN tags t ON t.id = it.tag_id
+		WHERE it.inventory_id = ANY($1)
+	`
+	rows, err := db.Query(context.Background(), query, inventoryItemIds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	itemTagSlugs := make(map[int][]string)
+	for rows.Next() {
+		var inventoryItemId int
+		var tagSlug string
+		scanErr := rows.Scan(&inventoryItemId, &tagSlug)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		itemTagSlugs[inventoryItemId] = append(itemTagSlugs[inventoryItemId], tagSlug)
+	}
+	return itemTagSlugs, rows.Err()
+}
+
+// getTaxCategories returns the tax category of each cart item, by inventory item id
+func getTaxCategories(db DBTX, taxRules TaxRules, cartItems []CartItem) (map[int]string, error) {
+	itemTagSlugs, tagSlugsErr := getInventoryItemTagSlugs(db, getCartInventoryItemIds(cartItems))
+	if tagSlugsErr != nil {
+		return nil, tagSlugsErr
+	}
+	taxCategories := make(map[int]string, len(cartItems))
+	for _, cartItem := range cartItems {
+		taxCategories[cartItem.InventoryItemId] = taxRules.CategoryForTags(itemTagSlugs[cartItem.InventoryItemId])
+	}
+	return taxCategories, nil
+}
@@ -0,0 +1,103 @@
+package lib
+
+import "testing"
+
+func getTestTaxRules(t *testing.T, pricesIncludeTax bool) TaxRules {
+	rules, err := NewTaxRules(ConfigTax{
+		PricesIncludeTax: pricesIncludeTax,
+		DefaultCountry:   "us",
+		DefaultRegion:    "ca",
+		Rates: []ConfigTaxRate{
+			{Country: "US", Region: "CA", Rate: 7.25},
+			{Country: "GB", Rate: 20},
+			{Country: "GB", Category: "food", Rate: 0},
+			{Country: "DE", Rate: 19},
+			{Country: "DE", Category: "food", Rate: 7},
+		},
+		TagCategories: map[string]string{"garlic": "food"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestNewTaxRulesValidation(t *testing.T) {
+	if _, err := NewTaxRules(ConfigTax{Rates: []ConfigTaxRate{{Region: "CA", Rate: 5}}}); err == nil {
+		t.Fatal("A rate without a country should be rejected")
+	}
+	if _, err := NewTaxRules(ConfigTax{Rates: []ConfigTaxRate{{Country: "US", Rate: 100}}}); err == nil {
+		t.Fatal("A rate of 100% should be rejected")
+	}
+	duplicateRates := []ConfigTaxRate{{Country: "us", Rate: 5}, {Country: "US", Rate: 6}}
+	if _, err := NewTaxRules(ConfigTax{Rates: duplicateRates}); err == nil {
+		t.Fatal("Duplicate rates should be rejected")
+	}
+}
+
+func TestTaxRateResolution(t *testing.T) {
+	rules := getTestTaxRules(t, false)
+	if rate := rules.RateBasisPoints(TaxLocation{Country: "us", Region: "ca"}, TaxCategoryStandard); rate != 725 {
+		t.Fatalf("Expected the region rate, got %v", rate)
+	}
+	if rate := rules.RateBasisPoints(TaxLocation{Country: "US", Region: "CA"}, "food"); rate != 725 {
+		t.Fatalf("Categories without a rate should fall back to the standard rate, got %v", rate)
+	}
+	if rate := rules.RateBasisPoints(TaxLocation{Country: "GB", Region: "SCT"}, "food"); rate != 0 {
+		t.Fatalf("Expected the country category rate, got %v", rate)
+	}
+	if rate := rules.RateBasisPoints(TaxLocation{Country: "FR"}, TaxCategoryStandard); rate != 0 {
+		t.Fatalf("Countries without a rate should be untaxed, got %v", rate)
+	}
+
+	location, err := rules.ResolveLocation(TaxLocation{})
+	if err != nil || location != (TaxLocation{Country: "US", Region: "CA"}) {
+		t.Fatalf("Expected the default location, got %v %v", location, err)
+	}
+	_, err = rules.ResolveLocation(TaxLocation{Region: "CA"})
+	expectErrorCode(t, err, ErrorCodeInvalidTaxLocation)
+
+	if category := rules.CategoryForTags([]string{"habanero", "garlic"}); category != "food" {
+		t.Fatalf("Expected the tag's category, got %q", category)
+	}
+}
+
+func TestTaxOn(t *testing.T) {
+	if tax := TaxOn(1000, 725, false); tax != 73 {
+		t.Fatalf("Expected 0.73 added on top, got %v", tax)
+	}
+	if tax := TaxOn(1200, 2000, true); tax != 200 {
+		t.Fatalf("Expected 2.00 included in 12.00, got %v", tax)
+	}
+	if tax := TaxOn(-100, 2000, false); tax != 0 {
+		t.Fatalf("Negative amounts shouldn't be taxed, got %v", tax)
+	}
+}
+
+func TestCalculateCartTotalsWithTax(t *testing.T) {
+	cartItems := []CartItem{
+		{InventoryItemId: 1, Price: 10, Quantity: 2},
+		{InventoryItemId: 2, Price: 5, Quantity: 1},
+	}
+	shippingOption := ShippingOption{Price: 4}
+	evaluation := CouponEvaluation{EligibleInventoryItemIds: []int{1}, DiscountCents: 1000}
+	cartTax := CartTax{
+		Rules:      getTestTaxRules(t, false),
+		Location:   TaxLocation{Country: "DE"},
+		Categories: map[int]string{2: "food"},
+	}
+
+	totals := CalculateCartTotals(cartItems, &shippingOption, &evaluation, &cartTax)
+	if totals.Lines[0].TaxCents != 190 || totals.Lines[1].TaxCents != 35 || totals.Lines[1].TaxCategory != "food" {
+		t.Fatalf("Lines should be taxed after their discount at their category's rate: %+v", totals.Lines)
+	}
+	if totals.TaxCents != 225 || totals.TotalCents != 2500-1000+400+225 {
+		t.Fatalf("Tax should be added to the total: %+v", totals)
+	}
+
+	cartTax.Rules = getTestTaxRules(t, true)
+	totals = CalculateCartTotals(cartItems, &shippingOption, &evaluation, &cartTax)
+	if !totals.PricesIncludeTax || totals.TaxCents != 160+33 || totals.TotalCents != 2500-1000+400 {
+		t.Fatalf("Included tax shouldn't change the total: %+v", totals)
+	}
+}
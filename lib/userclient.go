@@ -28,9 +28,11 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+// SignInResponseResults - MergedCartItems counts guest cart lines moved into the user's cart
 type SignInResponseResults struct {
-	SessionId string `json:"sessionId"`
-	User      User   `json:"user"`
+	SessionId       string `json:"sessionId"`
+	User            User   `json:"user"`
+	MergedCartItems int    `json:"mergedCartItems"`
 }
 
 type SignInResponse struct {
@@ -74,6 +76,8 @@ type UserProfileResponseResults struct {
 	UserPostCount       int     `json:"userPostCount"`
 	UserPostVoteSum     int     `json:"userPostVoteSum"`
 	UserModeratedBoards []Board `json:"userModeratedBoards"`
+	// HeatProfile is only there for users looking at their own profile
+	HeatProfile *HeatProfile `json:"heatProfile,omitempty"`
 }
 
 type UserProfileResponse struct {
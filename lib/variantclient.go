@@ -0,0 +1,357 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultVariantName is used for the variant every item starts with
+const DefaultVariantName = "Standard"
+
+// MaxSkuLength is the length of inventory_item_variants.sku
+const MaxSkuLength = 64
+
+var variantColumns = `
+		SELECT v.id,
+		       v.inventory_item_id,
+		       v.sku,
+		       v.name,
+		       v.price,
+		       (SELECT MIN(ps.sale_price) FROM price_sales ps WHERE ps.variant_id = v.id AND ` + runningSaleCondition + `)
+		           AS sale_price,
+		       v.weight_grams,
+		       v.stock_quantity,
+		       ` + variantStockRemainingColumn + ` AS stock_remaining,
+		       ` + inStockSql(variantStockRemainingColumn) + ` AS in_stock,
+		       v.is_default,
+		       v.sort_order,
+		       v.created_at,
+		       v.updated_at
+		FROM inventory_item_variants v`
+
+// Variant - StockQuantity and StockRemaining are nil when the variant's stock isn't tracked
+type Variant struct {
+	Id              int        `json:"id" db:"id"`
+	InventoryItemId int        `json:"inventoryItemId" db:"inventory_item_id"`
+	Sku             string     `json:"sku" db:"sku"`
+	Name            string     `json:"name" db:"name"`
+	Price           float32    `json:"price" db:"price"`
+	SalePrice       *float32   `json:"salePrice" db:"sale_price"`
+	WeightGrams     int        `json:"weightGrams" db:"weight_grams"`
+	StockQuantity   *int       `json:"stockQuantity" db:"stock_quantity"`
+	StockRemaining  *int       `json:"stockRemaining" db:"stock_remaining"`
+	InStock         bool       `json:"inStock" db:"in_stock"`
+	IsDefault       bool       `json:"isDefault" db:"is_default"`
+	SortOrder       int        `json:"sortOrder" db:"sort_order"`
+	CreatedAt       time.Time  `json:"createdAt" db:"created_at"`
+	UpdatedAt       *time.Time `json:"updatedAt" db:"updated_at"`
+}
+
+/*
+VariantRequest - making a variant the default moves the default flag off the item's other variant.
+A new variant without a StockQuantity starts with none in stock, and an update without one leaves
+the stock alone. Set Untracked to stop tracking the variant's stock, so it can always be bought;
+StockQuantity is then ignored. Giving a StockQuantity tracks it again.
+*/
+type VariantRequest struct {
+	Sku           string  `json:"sku" validate:"required,min=1,max=64"`
+	Name          string  `json:"name" validate:"required,min=1,max=100"`
+	Price         float32 `json:"price" validate:"required,min=0.01,max=999999.99"`
+	WeightGrams   int     `json:"weightGrams" validate:"min=0,max=100000"`
+	StockQuantity *int    `json:"stockQuantity" validate:"omitempty,min=0,max=1000000"`
+	Untracked     bool    `json:"untracked"`
+	IsDefault     bool    `json:"isDefault"`
+	SortOrder     int     `json:"sortOrder" validate:"min=0,max=1000"`
+}
+
+// DefaultVariantSku is the SKU given to an item's first variant: the upper-cased slug, cut short
+// to fit, then the item's id so no two items' default SKUs are the same
+func DefaultVariantSku(itemSlug string, inventoryItemId int) string {
+	suffix := fmt.Sprintf("-%v", inventoryItemId)
+	slug := []rune(strings.ToUpper(itemSlug))
+	return string(slug[:min(len(slug), MaxSkuLength-len(suffix))]) + suffix
+}
+
+func newVariantNotFoundError() *StatusBadRequestError {
+	return &StatusBadRequestError{
+		StatusCode: http.StatusNotFound,
+		Message:    "Variant not found",
+		ErrorCode:  ErrorCodeVariantNotFound,
+	}
+}
+
+func GetVariantsByInventoryItemId(dbPool *pgxpool.Pool, inventoryItemId int) ([]Variant, error) {
+	query := variantColumns + `
+		WHERE v.inventory_item_id = $1
+		ORDER BY v.is_default DESC, v.sort_order, v.price, v.id`
+	rows, err := dbPool.Query(context.Background(), query, inventoryItemId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Variant])
+}
+
+func getVariantById(db DBTX, variantId int) (Variant, error) {
+	query := variantColumns + `
+		WHERE v.id = $1`
+	rows, err := db.Query(context.Background(), query, variantId)
+	if err != nil {
+		return Variant{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Variant])
+}
+
+func getDefaultVariant(db DBTX, inventoryItemId int) (Variant, error) {
+	query := variantColumns + `
+		WHERE v.inventory_item_id = $1
+		AND v.is_default`
+	rows, err := db.Query(context.Background(), query, inventoryItemId)
+	if err != nil {
+		return Variant{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Variant])
+}
+
+/*
+resolveVariant finds the variant a cart request means: variantId when it's given, or the
+item's default variant otherwise. A variantId that doesn't belong to inventoryItemId, when
+both are given, is treated as not found.
+*/
+func resolveVariant(db DBTX, inventoryItemId int, variantId int) (Variant, error) {
+	var variant Variant
+	var err error
+	if variantId > 0 {
+		variant, err = getVariantById(db, variantId)
+	} else {
+		variant, err = getDefaultVariant(db, inventoryItemId)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Variant{}, newVariantNotFoundError()
+	}
+	if err != nil {
+		return Variant{}, err
+	}
+	if inventoryItemId > 0 && variant.InventoryItemId != inventoryItemId {
+		return Variant{}, newVariantNotFoundError()
+	}
+	return variant, nil
+}
+
+// saveDefaultVariant keeps the default variant's price in line with the item, creating it for new items
+func saveDefaultVariant(db DBTX, inventoryItemId int, itemSlug string, price float32) error {
+	const query = `
+		INSERT INTO inventory_item_variants (inventory_item_id, sku, name, price, is_default, created_at)
+		SELECT $1, $2, $3, $4, TRUE, NOW()
+		WHERE NOT EXISTS (SELECT 1 FROM inventory_item_variants WHERE inventory_item_id = $1 AND is_default)
+	`
+	result, err := db.Exec(
+		context.Background(), query, inventoryItemId, DefaultVariantSku(itemSlug, inventoryItemId), DefaultVariantName, price,
+	)
+	if err != nil || result.RowsAffected() > 0 {
+		return err
+	}
+
+	const updateQuery = `
+		UPDATE inventory_item_variants
+		SET price = $2, updated_at = NOW()
+		WHERE inventory_item_id = $1
+		AND is_default
+	`
+	_, err = db.Exec(context.Background(), updateQuery, inventoryItemId, price)
+	return err
+}
+
+/*
+saveVariant writes a variant inside tx
+ 1. Take the default flag off the item's other variants if this one is becoming the default
+ 2. Insert or update the variant, rejecting SKUs already in use
+ 3. Copy the default variant's price onto the item, so the item's price stays its "from" price
+*/
+func saveVariant(tx pgx.Tx, inventoryItemId int, variantId int, request VariantRequest) (int, error) {
+	ctx := context.Background()
+	if request.IsDefault {
+		const clearDefaultQuery = `
+			UPDATE inventory_item_variants
+			SET is_default = FALSE, updated_at = NOW()
+			WHERE inventory_item_id = $1
+			AND id <> $2
+			AND is_default
+		`
+		_, clearErr := tx.Exec(ctx, clearDefaultQuery, inventoryItemId, variantId)
+		if clearErr != nil {
+			return 0, clearErr
+		}
+	}
+
+	stockQuantity := request.StockQuantity
+	if request.Untracked {
+		stockQuantity = nil
+	}
+	var savedId int
+	var saveErr error
+	if variantId == 0 {
+		if stockQuantity == nil && !request.Untracked {
+			stockQuantity = new(int)
+		}
+		const insertQuery = `
+			INSERT INTO inventory_item_variants (
+				inventory_item_id, sku, name, price, weight_grams, stock_quantity, is_default, sort_order, created_at
+			)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW())
+			RETURNING id
+		`
+		saveErr = tx.QueryRow(
+			ctx, insertQuery, inventoryItemId, request.Sku, request.Name, request.Price,
+			request.WeightGrams, stockQuantity, request.IsDefault, request.SortOrder,
+		).Scan(&savedId)
+	} else {
+		// The default flag can only be moved, not cleared, so every item keeps one
+		const updateQuery = `
+			UPDATE inventory_item_variants
+			SET sku = $3,
+			    name = $4,
+			    price = $5,
+			    weight_grams = $6,
+			    stock_quantity = CASE WHEN $10 THEN NULL ELSE COALESCE($7, stock_quantity) END,
+			    is_default = is_default OR $8,
+			    sort_order = $9,
+			    updated_at = NOW()
+			WHERE id = $1
+			AND inventory_item_id = $2
+			RETURNING id
+		`
+		saveErr = tx.QueryRow(
+			ctx, updateQuery, variantId, inventoryItemId, request.Sku, request.Name, request.Price,
+			request.WeightGrams, stockQuantity, request.IsDefault, request.SortOrder, request.Untracked,
+		).Scan(&savedId)
+	}
+	if isPgError(saveErr, pgErrorCodeUniqueViolation) {
+		return 0, &StatusBadRequestError{
+			StatusCode: http.StatusConflict,
+			Message:    fmt.Sprintf("SKU %v is already in use", request.Sku),
+			ErrorCode:  ErrorCodeSkuExists,
+		}
+	}
+	if errors.Is(saveErr, pgx.ErrNoRows) {
+		return 0, newVariantNotFoundError()
+	}
+	if saveErr != nil {
+		return 0, saveErr
+	}
+
+	const itemPriceQuery = `
+		UPDATE inventories i
+		SET price = v.price
+		FROM inventory_item_variants v
+		WHERE v.inventory_item_id = i.id
+		AND v.is_default
+		AND i.id = $1
+	`
+	_, priceErr := tx.Exec(ctx, itemPriceQuery, inventoryItemId)
+	if priceErr != nil {
+		return 0, priceErr
+	}
+	historyErr := recordPriceHistory(tx, inventoryItemId)
+	if historyErr != nil {
+		return 0, historyErr
+	}
+	return savedId, nil
+}
+
+// SaveVariant adds a variant to the item when variantId is 0, and updates it otherwise
+func SaveVariant(
+	dbPool *pgxpool.Pool, logger *slog.Logger, inventoryItemId int, variantId int, request VariantRequest,
+) (Variant, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return Variant{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("SaveVariant: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	savedId, saveErr := saveVariant(tx, inventoryItemId, variantId, request)
+	if saveErr != nil {
+		return Variant{}, saveErr
+	}
+	variant, variantErr := getVariantById(tx, savedId)
+	if variantErr != nil {
+		return Variant{}, variantErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return Variant{}, commitErr
+	}
+	logger.Info(fmt.Sprintf("Saved variant %v (%v) of inventory item %v", variant.Id, variant.Sku, inventoryItemId))
+
+	// The default variant's price is the item's price, which price alerts watch
+	if variant.IsDefault {
+		_, alertsErr := TriggerPriceAlerts(dbPool, logger, inventoryItemId)
+		if alertsErr != nil {
+			logger.Error(fmt.Sprintf("SaveVariant: error triggering price alerts: %v", alertsErr))
+		}
+	}
+	return variant, nil
+}
+
+// DeleteVariant removes a variant from carts and holds too. The default variant, and variants
+// that are part of a bundle, can't be deleted.
+func DeleteVariant(dbPool *pgxpool.Pool, inventoryItemId int, variantId int) error {
+	const query = `
+		DELETE FROM inventory_item_variants
+		WHERE id = $1
+		AND inventory_item_id = $2
+		AND NOT is_default
+	`
+	result, err := dbPool.Exec(context.Background(), query, variantId, inventoryItemId)
+	if isPgError(err, pgErrorCodeForeignKeyViolation) {
+		return &StatusBadRequestError{
+			StatusCode: http.StatusConflict,
+			Message:    "Variant is part of a bundle",
+			ErrorCode:  ErrorCodeVariantInBundle,
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() > 0 {
+		return nil
+	}
+
+	variant, variantErr := resolveVariant(dbPool, inventoryItemId, variantId)
+	if variantErr != nil {
+		return variantErr
+	}
+	if variant.IsDefault {
+		return &StatusBadRequestError{
+			StatusCode: http.StatusConflict,
+			Message:    "The default variant can't be deleted",
+			ErrorCode:  ErrorCodeDefaultVariant,
+		}
+	}
+	return pgx.ErrNoRows
+}
+
+// GetInventoryItemIdBySlug returns pgx.ErrNoRows if there's no item with the slug
+func GetInventoryItemIdBySlug(dbPool *pgxpool.Pool, itemSlug string) (int, error) {
+	const query = `SELECT id FROM inventories WHERE slug = $1`
+	var id int
+	err := dbPool.QueryRow(context.Background(), query, itemSlug).Scan(&id)
+	return id, err
+}
@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVariantDisplayName(t *testing.T) {
+	if name := VariantDisplayName("Ghost Pepper Sauce", DefaultVariantName, true); name != "Ghost Pepper Sauce" {
+		t.Fatalf("Expected the default variant to show the item name only, got %v", name)
+	}
+	if name := VariantDisplayName("Ghost Pepper Sauce", "3-pack", false); name != "Ghost Pepper Sauce (3-pack)" {
+		t.Fatalf("Expected the variant name after the item name, got %v", name)
+	}
+}
+
+func TestCartItemDisplayName(t *testing.T) {
+	cartItem := CartItem{Name: "Habanero Gold", VariantName: "10oz"}
+	if cartItem.DisplayName() != "Habanero Gold (10oz)" {
+		t.Fatalf("Unexpected display name: %v", cartItem.DisplayName())
+	}
+	cartItem.IsDefaultVariant = true
+	if cartItem.DisplayName() != "Habanero Gold" {
+		t.Fatalf("Unexpected display name: %v", cartItem.DisplayName())
+	}
+}
+
+func TestDefaultVariantSku(t *testing.T) {
+	if sku := DefaultVariantSku("habanero-gold", 12); sku != "HABANERO-GOLD-12" {
+		t.Fatalf("Expected the SKU to be the upper-cased slug and item id, got %v", sku)
+	}
+	longSku := DefaultVariantSku(strings.Repeat("ghost-", 20), 12345)
+	if len(longSku) != MaxSkuLength || !strings.HasSuffix(longSku, "-12345") {
+		t.Fatalf("Expected a long slug to be cut short before the item id, got %v", longSku)
+	}
+}
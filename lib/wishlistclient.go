@@ -0,0 +1,464 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// SavedForLaterWishlistName is the list cart items are saved to when no wishlist is given
+const SavedForLaterWishlistName = "Saved for later"
+
+// MaxWishlistsPerUser keeps users from creating lists without end
+const MaxWishlistsPerUser = 25
+
+type Wishlist struct {
+	Id        int        `json:"id" db:"id"`
+	UserId    int        `json:"userId" db:"user_id"`
+	Name      string     `json:"name" db:"name"`
+	ShareSlug string     `json:"shareSlug" db:"share_slug"`
+	IsPublic  bool       `json:"isPublic" db:"is_public"`
+	ItemCount int        `json:"itemCount" db:"item_count"`
+	CreatedAt time.Time  `json:"createdAt" db:"created_at"`
+	UpdatedAt *time.Time `json:"updatedAt" db:"updated_at"`
+}
+
+// SharedWishlist is a public wishlist as seen by anyone with its share slug
+type SharedWishlist struct {
+	Wishlist
+	OwnerUsername string `json:"ownerUsername" db:"owner_username"`
+}
+
+// WishlistItem is a saved variant with what it currently sells for
+type WishlistItem struct {
+	Id                            int        `json:"id" db:"id"`
+	WishlistId                    int        `json:"wishlistId" db:"wishlist_id"`
+	InventoryItemId               int        `json:"inventoryItemId" db:"inventory_item_id"`
+	VariantId                     int        `json:"variantId" db:"variant_id"`
+	Quantity                      int        `json:"quantity" db:"quantity"`
+	CreatedAt                     time.Time  `json:"createdAt" db:"created_at"`
+	UpdatedAt                     *time.Time `json:"updatedAt" db:"updated_at"`
+	Name                          string     `json:"name" db:"name"`
+	InventoryItemSlug             string     `json:"inventoryItemSlug" db:"slug"`
+	InventoryItemShortDescription string     `json:"inventoryItemShortDescription" db:"short_description"`
+	VariantName                   string     `json:"variantName" db:"variant_name"`
+	IsDefaultVariant              bool       `json:"isDefaultVariant" db:"is_default_variant"`
+	Sku                           string     `json:"sku" db:"sku"`
+	Price                         float32    `json:"price" db:"price"`
+	InStock                       bool       `json:"inStock" db:"in_stock"`
+}
+
+type WishlistRequest struct {
+	Name     string `json:"name" validate:"required,min=1,max=100"`
+	IsPublic bool   `json:"isPublic"`
+}
+
+// AddWishlistItemRequest - the item's default variant is used when VariantId is left out
+type AddWishlistItemRequest struct {
+	InventoryItemId int `json:"inventoryItemId" validate:"required_without=VariantId,min=0"`
+	VariantId       int `json:"variantId" validate:"min=0"`
+	Quantity        int `json:"quantity" validate:"min=0,max=100"`
+}
+
+// SaveForLaterRequest moves a cart line to a wishlist, or to the "Saved for later" list when WishlistId is 0
+type SaveForLaterRequest struct {
+	InventoryItemId int `json:"inventoryItemId" validate:"required_without=VariantId,min=0"`
+	VariantId       int `json:"variantId" validate:"min=0"`
+	WishlistId      int `json:"wishlistId" validate:"min=0"`
+}
+
+const wishlistColumns = `
+		SELECT w.*,
+		       (SELECT COUNT(*) FROM wishlist_items wi WHERE wi.wishlist_id = w.id) AS item_count
+		FROM wishlists w`
+
+var wishlistItemColumns = `
+		SELECT wi.*,
+		       i.name,
+		       i.slug,
+		       i.short_description,
+		       v.name AS variant_name,
+		       v.is_default AS is_default_variant,
+		       v.sku,
+		       ` + variantEffectivePriceColumn + ` AS price,
+		       ` + inStockSql(variantStockRemainingColumn) + ` AS in_stock
+		FROM wishlist_items wi
+		JOIN inventory_item_variants v ON v.id = wi.variant_id
+		JOIN inventories i ON i.id = wi.inventory_item_id`
+
+// GenerateWishlistShareSlug returns a random, hard to guess slug for sharing a wishlist
+func GenerateWishlistShareSlug() (string, error) {
+	slugUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(slugUUID.String(), "-", "")[:16], nil
+}
+
+func newWishlistError(statusCode int, message string, errorCode string) *StatusBadRequestError {
+	return &StatusBadRequestError{
+		StatusCode: statusCode,
+		Message:    message,
+		ErrorCode:  errorCode,
+	}
+}
+
+func GetWishlistsByUserId(dbPool *pgxpool.Pool, userId int) ([]Wishlist, error) {
+	query := wishlistColumns + `
+		WHERE w.user_id = $1
+		ORDER BY w.created_at, w.id`
+	rows, err := dbPool.Query(context.Background(), query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Wishlist])
+}
+
+// getUserWishlist returns pgx.ErrNoRows if the wishlist isn't the user's
+func getUserWishlist(db DBTX, userId int, wishlistId int) (Wishlist, error) {
+	query := wishlistColumns + `
+		WHERE w.id = $1
+		AND w.user_id = $2`
+	rows, err := db.Query(context.Background(), query, wishlistId, userId)
+	if err != nil {
+		return Wishlist{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Wishlist])
+}
+
+func GetUserWishlist(dbPool *pgxpool.Pool, userId int, wishlistId int) (Wishlist, error) {
+	return getUserWishlist(dbPool, userId, wishlistId)
+}
+
+// GetSharedWishlist returns pgx.ErrNoRows unless the wishlist exists and is public
+func GetSharedWishlist(dbPool *pgxpool.Pool, shareSlug string) (SharedWishlist, error) {
+	const query = `
+		SELECT w.*,
+		       (SELECT COUNT(*) FROM wishlist_items wi WHERE wi.wishlist_id = w.id) AS item_count,
+		       u.username AS owner_username
+		FROM wishlists w
+		JOIN users u ON u.id = w.user_id
+		WHERE w.share_slug = $1
+		AND w.is_public
+	`
+	rows, err := dbPool.Query(context.Background(), query, shareSlug)
+	if err != nil {
+		return SharedWishlist{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[SharedWishlist])
+}
+
+func GetWishlistItems(dbPool *pgxpool.Pool, wishlistId int) ([]WishlistItem, error) {
+	query := wishlistItemColumns + `
+		WHERE wi.wishlist_id = $1
+		ORDER BY wi.created_at DESC, wi.id DESC`
+	rows, err := dbPool.Query(context.Background(), query, wishlistId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[WishlistItem])
+}
+
+func getWishlistItem(db DBTX, wishlistId int, wishlistItemId int) (WishlistItem, error) {
+	query := wishlistItemColumns + `
+		WHERE wi.id = $1
+		AND wi.wishlist_id = $2`
+	rows, err := db.Query(context.Background(), query, wishlistItemId, wishlistId)
+	if err != nil {
+		return WishlistItem{}, err
+	}
+	defer rows.Close()
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[WishlistItem])
+}
+
+// CreateWishlist - names are unique per user
+func CreateWishlist(dbPool *pgxpool.Pool, logger *slog.Logger, userId int, request WishlistRequest) (Wishlist, error) {
+	var wishlistCount int
+	countErr := dbPool.QueryRow(
+		context.Background(), `SELECT COUNT(*) FROM wishlists WHERE user_id = $1`, userId,
+	).Scan(&wishlistCount)
+	if countErr != nil {
+		return Wishlist{}, countErr
+	}
+	if wishlistCount >= MaxWishlistsPerUser {
+		return Wishlist{}, newWishlistError(
+			http.StatusBadRequest,
+			fmt.Sprintf("You can have at most %v wishlists", MaxWishlistsPerUser),
+			ErrorCodeTooManyWishlists,
+		)
+	}
+
+	wishlistId, createErr := createWishlist(dbPool, userId, request)
+	if createErr != nil {
+		return Wishlist{}, createErr
+	}
+	logger.Info(fmt.Sprintf("User %v created wishlist %v", userId, wishlistId))
+	return getUserWishlist(dbPool, userId, wishlistId)
+}
+
+func createWishlist(db DBTX, userId int, request WishlistRequest) (int, error) {
+	shareSlug, slugErr := GenerateWishlistShareSlug()
+	if slugErr != nil {
+		return 0, slugErr
+	}
+	const query = `
+		INSERT INTO wishlists (user_id, name, share_slug, is_public, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		RETURNING id
+	`
+	var wishlistId int
+	err := db.QueryRow(context.Background(), query, userId, request.Name, shareSlug, request.IsPublic).
+		Scan(&wishlistId)
+	if isPgError(err, pgErrorCodeUniqueViolation) {
+		return 0, newWishlistError(
+			http.StatusConflict,
+			fmt.Sprintf("You already have a wishlist called %v", request.Name),
+			ErrorCodeWishlistExists,
+		)
+	}
+	return wishlistId, err
+}
+
+// UpdateWishlist renames the wishlist, or shares or stops sharing it
+func UpdateWishlist(dbPool *pgxpool.Pool, userId int, wishlistId int, request WishlistRequest) (Wishlist, error) {
+	const query = `
+		UPDATE wishlists
+		SET name = $3, is_public = $4, updated_at = NOW()
+		WHERE id = $1
+		AND user_id = $2
+	`
+	result, err := dbPool.Exec(context.Background(), query, wishlistId, userId, request.Name, request.IsPublic)
+	if isPgError(err, pgErrorCodeUniqueViolation) {
+		return Wishlist{}, newWishlistError(
+			http.StatusConflict,
+			fmt.Sprintf("You already have a wishlist called %v", request.Name),
+			ErrorCodeWishlistExists,
+		)
+	}
+	if err != nil {
+		return Wishlist{}, err
+	}
+	if result.RowsAffected() == 0 {
+		return Wishlist{}, pgx.ErrNoRows
+	}
+	return getUserWishlist(dbPool, userId, wishlistId)
+}
+
+// DeleteWishlist returns pgx.ErrNoRows if the wishlist isn't the user's
+func DeleteWishlist(dbPool *pgxpool.Pool, userId int, wishlistId int) error {
+	const query = `DELETE FROM wishlists WHERE id = $1 AND user_id = $2`
+	result, err := dbPool.Exec(context.Background(), query, wishlistId, userId)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// addWishlistItem saves the variant to the wishlist, replacing the quantity if it's already there
+func addWishlistItem(db DBTX, wishlistId int, variant Variant, quantity int) (int, error) {
+	const query = `
+		INSERT INTO wishlist_items (wishlist_id, inventory_item_id, variant_id, quantity, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (wishlist_id, variant_id)
+		    DO UPDATE SET quantity = EXCLUDED.quantity, updated_at = NOW()
+		RETURNING id
+	`
+	var wishlistItemId int
+	err := db.QueryRow(context.Background(), query, wishlistId, variant.InventoryItemId, variant.Id, quantity).
+		Scan(&wishlistItemId)
+	return wishlistItemId, err
+}
+
+// AddWishlistItem saves a variant, defaulting to the item's default variant and a quantity of 1
+func AddWishlistItem(
+	dbPool *pgxpool.Pool, logger *slog.Logger, userId int, wishlistId int, request AddWishlistItemRequest,
+) (WishlistItem, error) {
+	wishlist, wishlistErr := getUserWishlist(dbPool, userId, wishlistId)
+	if wishlistErr != nil {
+		return WishlistItem{}, wishlistErr
+	}
+	variant, variantErr := resolveVariant(dbPool, request.InventoryItemId, request.VariantId)
+	if variantErr != nil {
+		return WishlistItem{}, variantErr
+	}
+
+	wishlistItemId, addErr := addWishlistItem(dbPool, wishlist.Id, variant, max(request.Quantity, 1))
+	if addErr != nil {
+		return WishlistItem{}, addErr
+	}
+	logger.Info(fmt.Sprintf("User %v saved variant %v to wishlist %v", userId, variant.Id, wishlist.Id))
+	return getWishlistItem(dbPool, wishlist.Id, wishlistItemId)
+}
+
+// DeleteWishlistItem returns pgx.ErrNoRows if the item isn't on one of the user's wishlists
+func DeleteWishlistItem(dbPool *pgxpool.Pool, userId int, wishlistId int, wishlistItemId int) error {
+	return deleteWishlistItem(dbPool, userId, wishlistId, wishlistItemId)
+}
+
+func deleteWishlistItem(db DBTX, userId int, wishlistId int, wishlistItemId int) error {
+	const query = `
+		DELETE FROM wishlist_items wi
+		USING wishlists w
+		WHERE wi.wishlist_id = w.id
+		AND wi.id = $1
+		AND w.id = $2
+		AND w.user_id = $3
+	`
+	result, err := db.Exec(context.Background(), query, wishlistItemId, wishlistId, userId)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+/*
+MoveWishlistItemToCart
+ 1. Check the item is on one of the user's wishlists
+ 2. Add its quantity to whatever of the variant is already in the cart, if there's the stock
+ 3. Take it off the wishlist
+
+All in one transaction, so the item is never in both places or neither. A concurrent move of
+the same item finds it already gone and rolls back.
+*/
+func MoveWishlistItemToCart(
+	dbPool *pgxpool.Pool, logger *slog.Logger, userId int, wishlistId int, wishlistItemId int,
+) (CartItem, error) {
+	ctx := context.Background()
+	tx, beginErr := dbPool.Begin(ctx)
+	if beginErr != nil {
+		return CartItem{}, beginErr
+	}
+	defer func() {
+		rollbackErr := tx.Rollback(ctx)
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			logger.Error(fmt.Sprintf("MoveWishlistItemToCart: error rolling back: %v", rollbackErr))
+		}
+	}()
+
+	wishlist, wishlistErr := getUserWishlist(tx, userId, wishlistId)
+	if wishlistErr != nil {
+		return CartItem{}, wishlistErr
+	}
+	wishlistItem, wishlistItemErr := getWishlistItem(tx, wishlist.Id, wishlistItemId)
+	if wishlistItemErr != nil {
+		return CartItem{}, wishlistItemErr
+	}
+
+	existingCartItem, cartErr := getCartItemByVariantIdAndUserId(tx, wishlistItem.VariantId, userId)
+	if cartErr != nil {
+		return CartItem{}, cartErr
+	}
+	quantity := existingCartItem.Quantity + wishlistItem.Quantity
+	if quantity > MaxCartItemQuantity {
+		return CartItem{}, newWishlistError(
+			http.StatusBadRequest,
+			fmt.Sprintf("A cart can hold at most %v of %v", MaxCartItemQuantity, wishlistItem.Name),
+			ErrorCodeInvalidCartQuantity,
+		)
+	}
+	stockErr := checkStockAvailable(tx, wishlistItem.VariantId, userId, quantity)
+	if stockErr != nil {
+		return CartItem{}, stockErr
+	}
+
+	setErr := setCartItemQuantity(tx, wishlistItem.InventoryItemId, wishlistItem.VariantId, userId, quantity)
+	if setErr != nil {
+		return CartItem{}, setErr
+	}
+	deleteErr := deleteWishlistItem(tx, userId, wishlist.Id, wishlistItem.Id)
+	if deleteErr != nil {
+		return CartItem{}, deleteErr
+	}
+	cartItem, cartItemErr := getCartItemByVariantIdAndUserId(tx, wishlistItem.VariantId, userId)
+	if cartItemErr != nil {
+		return CartItem{}, cartItemErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return CartItem{}, commitErr
+	}
+	logger.Info(fmt.Sprintf("User %v moved variant %v from wishlist %v to cart", userId, wishlistItem.VariantId, wishlist.Id))
+	return cartItem, nil
+}
+
+// getSavedForLaterWishlistId finds the user's "Saved for later" list, creating it the first time
+func getSavedForLaterWishlistId(dbPool *pgxpool.Pool, userId int) (int, error) {
+	const query = `SELECT id FROM wishlists WHERE user_id = $1 AND name = $2`
+	var wishlistId int
+	err := dbPool.QueryRow(context.Background(), query, userId, SavedForLaterWishlistName).Scan(&wishlistId)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return wishlistId, err
+	}
+
+	wishlistId, createErr := createWishlist(dbPool, userId, WishlistRequest{Name: SavedForLaterWishlistName})
+	var badRequestErr *StatusBadRequestError
+	if errors.As(createErr, &badRequestErr) {
+		// Created by a concurrent request
+		retryErr := dbPool.QueryRow(context.Background(), query, userId, SavedForLaterWishlistName).Scan(&wishlistId)
+		return wishlistId, retryErr
+	}
+	return wishlistId, createErr
+}
+
+/*
+SaveCartItemForLater
+ 1. Find the cart line, resolving the item's default variant if no variant is given
+ 2. Save it, with its quantity, to the wishlist given or the "Saved for later" list
+ 3. Take it out of the cart
+*/
+func SaveCartItemForLater(
+	dbPool *pgxpool.Pool, logger *slog.Logger, userId int, request SaveForLaterRequest,
+) (WishlistItem, error) {
+	variant, variantErr := resolveVariant(dbPool, request.InventoryItemId, request.VariantId)
+	if variantErr != nil {
+		return WishlistItem{}, variantErr
+	}
+	cartItem, cartErr := GetCartItemByVariantIdAndUserId(dbPool, variant.Id, userId)
+	if cartErr != nil {
+		return WishlistItem{}, cartErr
+	}
+	if cartItem.Id == 0 {
+		return WishlistItem{}, newWishlistError(http.StatusNotFound, "Item isn't in your cart", ErrorCodeCartItemNotFound)
+	}
+
+	wishlistId := request.WishlistId
+	if wishlistId == 0 {
+		savedForLaterId, savedForLaterErr := getSavedForLaterWishlistId(dbPool, userId)
+		if savedForLaterErr != nil {
+			return WishlistItem{}, savedForLaterErr
+		}
+		wishlistId = savedForLaterId
+	} else if _, wishlistErr := getUserWishlist(dbPool, userId, wishlistId); wishlistErr != nil {
+		return WishlistItem{}, wishlistErr
+	}
+
+	wishlistItemId, addErr := addWishlistItem(dbPool, wishlistId, variant, cartItem.Quantity)
+	if addErr != nil {
+		return WishlistItem{}, addErr
+	}
+	deleteErr := DeleteCartItem(dbPool, DeleteCartItemRequest{VariantId: variant.Id}, userId)
+	if deleteErr != nil {
+		return WishlistItem{}, deleteErr
+	}
+	logger.Info(fmt.Sprintf("User %v saved variant %v for later in wishlist %v", userId, variant.Id, wishlistId))
+	return getWishlistItem(dbPool, wishlistId, wishlistItemId)
+}
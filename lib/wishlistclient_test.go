@@ -0,0 +1,23 @@
+package lib
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGenerateWishlistShareSlug(t *testing.T) {
+	first, err := GenerateWishlistShareSlug()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(first) {
+		t.Fatalf("Unexpected share slug: %v", first)
+	}
+	second, err := GenerateWishlistShareSlug()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("Share slugs should be random, got %v twice", first)
+	}
+}
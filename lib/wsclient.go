@@ -1,9 +1,11 @@
 package lib
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -24,7 +26,35 @@ type WebsocketMessage struct {
 
 var clients = make(map[*websocket.Conn]bool)
 
-func HandleWSConnection(c *gin.Context, logger *slog.Logger) {
+// clientUserIds maps connections to the signed-in user that opened them, so messages
+// can be sent to a single user. Anonymous connections are not in this map.
+var clientUserIds = make(map[*websocket.Conn]int)
+var clientsMutex sync.Mutex
+
+// clientWriteMutexes - a connection only supports one writer at a time, so writes made
+// without holding clientsMutex take the connection's own lock
+var clientWriteMutexes = make(map[*websocket.Conn]*sync.Mutex)
+
+func addClient(conn *websocket.Conn, userId int) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	clients[conn] = true
+	clientWriteMutexes[conn] = &sync.Mutex{}
+	if userId > 0 {
+		clientUserIds[conn] = userId
+	}
+}
+
+func removeClient(conn *websocket.Conn) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	delete(clients, conn)
+	delete(clientUserIds, conn)
+	delete(clientWriteMutexes, conn)
+}
+
+// HandleWSConnection - userId is 0 for anonymous connections
+func HandleWSConnection(c *gin.Context, logger *slog.Logger, userId int) {
 	upgrader.CheckOrigin = func(r *http.Request) bool {
 		return c.Request.Header.Get("Origin") == "http://localhost:5173"
 	}
@@ -40,32 +70,45 @@ func HandleWSConnection(c *gin.Context, logger *slog.Logger) {
 			logger.Error(fmt.Sprintf("Error closing WS connection: %v", err.Error()))
 		}
 	}(conn)
-	clients[conn] = true
+	addClient(conn, userId)
 	logger.Info(fmt.Sprintf("Client connected: %v", conn.RemoteAddr()))
 
 	for {
 		_, msg, err := conn.ReadMessage()
 		if err != nil {
 			logger.Error(fmt.Sprintf("WS read error: %v", err))
-			delete(clients, conn)
+			removeClient(conn)
 			break
 		}
+		clientsMutex.Lock()
 		for client := range clients {
-			if err := client.WriteMessage(websocket.TextMessage, msg); err != nil {
+			writeMutex := clientWriteMutexes[client]
+			writeMutex.Lock()
+			err := client.WriteMessage(websocket.TextMessage, msg)
+			writeMutex.Unlock()
+			if err != nil {
 				logger.Error(fmt.Sprintf("WS write error: %v", err))
 				closeErr := client.Close()
 				if closeErr != nil {
 					logger.Error(fmt.Sprintf("Error closing WS connection: %v", err.Error()))
 				}
 				delete(clients, client)
+				delete(clientUserIds, client)
+				delete(clientWriteMutexes, client)
 			}
 		}
+		clientsMutex.Unlock()
 	}
 }
 
 func SendWebsocketMessage(message WebsocketMessage, logger *slog.Logger) error {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
 	for client := range clients {
+		writeMutex := clientWriteMutexes[client]
+		writeMutex.Lock()
 		err := client.WriteJSON(message)
+		writeMutex.Unlock()
 		if err != nil {
 			logger.Error(fmt.Sprintf("WS write error: %v", err))
 			err := client.Close()
@@ -73,7 +116,41 @@ func SendWebsocketMessage(message WebsocketMessage, logger *slog.Logger) error {
 				return err
 			}
 			delete(clients, client)
+			delete(clientUserIds, client)
+			delete(clientWriteMutexes, client)
 		}
 	}
 	return nil
 }
+
+// SendWebsocketMessageToUser sends to every connection the user has open (e.g. multiple tabs).
+// The connections are copied under the lock and written to outside it, so one slow connection
+// doesn't hold up every other send. A failed connection is closed and dropped, and the rest still
+// get the message; the errors are joined.
+func SendWebsocketMessageToUser(userId int, message WebsocketMessage, logger *slog.Logger) error {
+	clientsMutex.Lock()
+	userClients := make(map[*websocket.Conn]*sync.Mutex)
+	for client, clientUserId := range clientUserIds {
+		if clientUserId == userId {
+			userClients[client] = clientWriteMutexes[client]
+		}
+	}
+	clientsMutex.Unlock()
+
+	var errs []error
+	for client, writeMutex := range userClients {
+		writeMutex.Lock()
+		err := client.WriteJSON(message)
+		writeMutex.Unlock()
+		if err != nil {
+			logger.Error(fmt.Sprintf("WS write error: %v", err))
+			errs = append(errs, err)
+			removeClient(client)
+			closeErr := client.Close()
+			if closeErr != nil {
+				errs = append(errs, closeErr)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -20,3 +20,16 @@ func TestSendReceiveChatMessage(t *testing.T) {
 		t.Fatal(sendErr)
 	}
 }
+
+func TestSendWebsocketMessageToUser(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	sendErr := SendWebsocketMessageToUser(1, WebsocketMessage{
+		MessageType: WebsocketMessageTypeOrderStatusUpdate,
+		Data: gin.H{
+			"orderNumber": "HS-0000000000",
+		},
+	}, logger)
+	if sendErr != nil {
+		t.Fatal(sendErr)
+	}
+}
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -11,6 +12,8 @@ import (
 	"github.com/gin-contrib/cache"
 	"github.com/gin-contrib/cache/persistence"
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -19,7 +22,14 @@ type AdminUpdateUserRequest struct {
 	Roles []lib.Role `json:"roles"`
 }
 
-func Admin(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger, store *persistence.InMemoryStore) {
+//nolint:funlen
+func Admin(
+	r *gin.Engine,
+	dbPool *pgxpool.Pool,
+	logger *slog.Logger,
+	paymentProvider lib.PaymentProvider,
+	store *persistence.InMemoryStore,
+) {
 	r.PUT("/api/v1/admin/user/:slug", func(c *gin.Context) {
 		userSlug := c.Param("slug")
 
@@ -162,4 +172,163 @@ func Admin(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger, store *pers
 			"user":   user,
 		})
 	})
+
+	// All orders, filterable by status, user and date range
+	r.GET("/api/v1/admin/orders", func(c *gin.Context) {
+		if !isOrderAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		filters, filtersErr := getAdminOrderFilters(c, dbPool, logger)
+		if filtersErr != nil {
+			logger.Error(fmt.Sprintf("Invalid order filters: %v", filtersErr))
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": filtersErr.Error(),
+			})
+			return
+		}
+
+		paginationData := lib.GetValidPaginationData(c)
+		orders, ordersErr := lib.GetOrders(dbPool, filters, paginationData)
+		if ordersErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching orders: %v", ordersErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": "Error fetching orders",
+			})
+			return
+		}
+
+		total, totalErr := lib.GetTotalOrders(dbPool, filters)
+		if totalErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching total orders: %v", totalErr))
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"orders": orders,
+				"total":  total,
+			},
+		})
+	})
+
+	r.GET("/api/v1/admin/orders/:orderNumber", func(c *gin.Context) {
+		if !isOrderAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		order, orderErr := lib.GetOrderByOrderNumber(dbPool, c.Param("orderNumber"))
+		if orderErr != nil {
+			if errors.Is(orderErr, pgx.ErrNoRows) {
+				c.JSON(http.StatusNotFound, gin.H{
+					"status":  "ERROR",
+					"message": "Order not found",
+				})
+				return
+			}
+			logger.Error(fmt.Sprintf("Error fetching order: %v", orderErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": "Error fetching order",
+			})
+			return
+		}
+
+		orderDetail, orderDetailErr := getOrderDetailResults(dbPool, order)
+		if orderDetailErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching order detail: %v", orderDetailErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": "Error fetching order",
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"results": orderDetail,
+		})
+	})
+
+	/*
+		Move an order to a new status
+		- Transitions are validated in lib.UpdateOrderStatus
+		- Cancelling or refunding gives back the stock and what was paid
+		- The order's owner is notified over the websocket
+	*/
+	r.PUT("/api/v1/admin/orders/:orderNumber/status", func(c *gin.Context) {
+		var updateOrderStatusRequest lib.UpdateOrderStatusRequest
+		if err := c.ShouldBindJSON(&updateOrderStatusRequest); err != nil {
+			logger.Error(err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Update request malformed: %v", err.Error()),
+			})
+			return
+		}
+
+		validate := validator.New(validator.WithRequiredStructEnabled())
+		validationErr := validate.Struct(updateOrderStatusRequest)
+		if validationErr != nil {
+			logger.Error(validationErr.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Validation failed: %v", validationErr),
+			})
+			return
+		}
+
+		if !isOrderAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		adminUserId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || adminUserId == 0 {
+			return
+		}
+
+		order, previousStatus, updateErr := lib.UpdateOrderStatus(
+			dbPool, logger, paymentProvider, c.Param("orderNumber"), updateOrderStatusRequest.Status, adminUserId,
+		)
+		if updateErr != nil {
+			var badRequestErr *lib.StatusBadRequestError
+			if errors.As(updateErr, &badRequestErr) {
+				logger.Error(fmt.Sprintf("Order status update rejected: %v", badRequestErr.Message))
+				c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+					Status:    "ERROR",
+					Message:   badRequestErr.Message,
+					ErrorCode: badRequestErr.ErrorCode,
+				})
+				return
+			}
+			if errors.Is(updateErr, pgx.ErrNoRows) {
+				c.JSON(http.StatusNotFound, gin.H{
+					"status":  "ERROR",
+					"message": "Order not found",
+				})
+				return
+			}
+			logger.Error(fmt.Sprintf("Error updating order status: %v", updateErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": "Error updating order status",
+			})
+			return
+		}
+
+		sendErr := lib.SendOrderStatusUpdate(order, previousStatus, logger)
+		if sendErr != nil {
+			logger.Error(fmt.Sprintf("Error sending order status update: %v", sendErr))
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Order %v moved to %v", order.OrderNumber, order.Status),
+			"results": gin.H{
+				"order": order,
+			},
+		})
+	})
 }
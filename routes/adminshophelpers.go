@@ -0,0 +1,82 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// isShopAdminOrError responds with 403 unless the signed-in user is a shop admin
+func isShopAdminOrError(c *gin.Context, dbPool *pgxpool.Pool, logger *slog.Logger) bool {
+	isShopAdmin, isShopAdminErr := lib.IsShopAdmin(c, dbPool, logger)
+	if isShopAdminErr != nil {
+		return false
+	}
+	if !isShopAdmin {
+		c.JSON(http.StatusForbidden, lib.GenericResponseWithErrorCode{
+			Status:    "ERROR",
+			Message:   "Permission denied",
+			ErrorCode: lib.ErrorCodePermissionDenied,
+		})
+		return false
+	}
+	return true
+}
+
+// respondWithShopAdminError maps errors from shop management onto responses
+func respondWithShopAdminError(c *gin.Context, logger *slog.Logger, err error, notFoundMessage string) {
+	var badRequestErr *lib.StatusBadRequestError
+	if errors.As(err, &badRequestErr) {
+		logger.Error(fmt.Sprintf("Shop admin request rejected: %v", badRequestErr.Message))
+		c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+			Status:    "ERROR",
+			Message:   badRequestErr.Message,
+			ErrorCode: badRequestErr.ErrorCode,
+		})
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status":  "ERROR",
+			"message": notFoundMessage,
+		})
+		return
+	}
+	logger.Error(fmt.Sprintf("Shop admin request failed: %v", err))
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"status":  "ERROR",
+		"message": "Internal server error",
+	})
+}
+
+// bindAndValidate responds with 400 if the body is malformed or fails validation
+func bindAndValidate(c *gin.Context, logger *slog.Logger, request any) bool {
+	if err := c.ShouldBindJSON(request); err != nil {
+		logger.Error(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "ERROR",
+			"message": fmt.Sprintf("Request malformed: %v", err.Error()),
+		})
+		return false
+	}
+
+	validate := validator.New(validator.WithRequiredStructEnabled())
+	validationErr := validate.Struct(request)
+	if validationErr != nil {
+		logger.Error(validationErr.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "ERROR",
+			"message": fmt.Sprintf("Validation failed: %v", validationErr),
+		})
+		return false
+	}
+	return true
+}
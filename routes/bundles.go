@@ -0,0 +1,44 @@
+package routes
+
+import (
+	"log/slog"
+	"net/http"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func Bundles(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+	// Replaces the bundle's components. An empty list makes the item an ordinary product again.
+	r.PUT("/api/v1/admin/products/:slug/bundle", func(c *gin.Context) {
+		var bundleRequest lib.BundleRequest
+		if !bindAndValidate(c, logger, &bundleRequest) {
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		inventoryItemId, itemErr := lib.GetInventoryItemIdBySlug(dbPool, c.Param("slug"))
+		if itemErr != nil {
+			respondWithShopAdminError(c, logger, itemErr, "Product not found")
+			return
+		}
+
+		bundle, saveErr := lib.SaveBundle(dbPool, logger, inventoryItemId, bundleRequest)
+		if saveErr != nil {
+			respondWithShopAdminError(c, logger, saveErr, "Product not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Bundle updated",
+			"results": gin.H{
+				"bundle": bundle,
+			},
+		})
+	})
+}
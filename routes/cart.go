@@ -1,9 +1,11 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
 
 	"hotsauceshop/lib"
 
@@ -12,14 +14,51 @@ import (
 )
 
 //nolint:funlen
-func Cart(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+func Cart(
+	r *gin.Engine,
+	dbPool *pgxpool.Pool,
+	logger *slog.Logger,
+	taxRules lib.TaxRules,
+	guestCarts lib.GuestCarts,
+) {
+	/*
+		Get cart
+		- Visitors who aren't signed in get the guest cart from their cookie, if any
+		- shippingOptionId and couponCode are optional and only change the totals
+		- country and region pick the tax rates, defaulting to the shop's location
+		- totals come from lib.PriceCart, the same numbers PlaceOrder charges
+	*/
 	r.GET("/api/v1/cart", func(c *gin.Context) {
-		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
-		if userSessionErr != nil || userId == 0 {
+		shippingOptionId, shippingOptionIdErr := strconv.Atoi(c.DefaultQuery("shippingOptionId", "0"))
+		if shippingOptionIdErr != nil || shippingOptionId < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Invalid shipping option id",
+			})
+			return
+		}
+
+		userId, userSessionErr := getCartUserId(c, dbPool, logger)
+		if userSessionErr != nil {
+			logger.Error(fmt.Sprintf("Error getting cart user: %v", userSessionErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": "Error fetching cart",
+			})
 			return
 		}
 
-		cartItems, err := lib.GetCartItems(dbPool, userId)
+		cartItems := []lib.CartItem{}
+		var err error
+		if userId > 0 {
+			cartItems, err = lib.GetCartItems(dbPool, userId)
+		} else {
+			guestCart, found, guestCartErr := getGuestCart(c, dbPool, guestCarts, false)
+			err = guestCartErr
+			if found {
+				cartItems, err = lib.GetGuestCartItems(dbPool, guestCart.Id)
+			}
+		}
 		if err != nil {
 			logger.Error(fmt.Sprintf("Error getting cart items: %v", err))
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -29,10 +68,39 @@ func Cart(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
 			return
 		}
 
+		totals, totalsErr := lib.PriceCart(
+			dbPool,
+			taxRules,
+			userId,
+			cartItems,
+			shippingOptionId,
+			c.Query("couponCode"),
+			lib.TaxLocation{Country: c.Query("country"), Region: c.Query("region")},
+		)
+		if totalsErr != nil {
+			var badRequestErr *lib.StatusBadRequestError
+			if errors.As(totalsErr, &badRequestErr) {
+				c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+					Status:    "ERROR",
+					Message:   badRequestErr.Message,
+					ErrorCode: badRequestErr.ErrorCode,
+				})
+				return
+			}
+			logger.Error(fmt.Sprintf("Error pricing cart: %v", totalsErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": "Error pricing cart",
+			})
+			return
+		}
+
 		c.JSON(http.StatusOK, gin.H{
 			"status": "OK",
 			"results": gin.H{
 				"cartItems": cartItems,
+				"totals":    totals,
+				"guestCart": userId == 0,
 			},
 		})
 	})
@@ -40,11 +108,12 @@ func Cart(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
 	/**
 	Add cart item
 	1. Verify cart request
-	2. Verify referenced user
+	2. Verify referenced user, or start a guest cart for visitors
 	3. Verify referenced item
 	*/
-	var newCart lib.AddCartItemRequest
 	r.POST("/api/v1/cart", func(c *gin.Context) {
+		// Declared per request, so a variantId left out doesn't carry over from the last one
+		var newCart lib.AddCartItemRequest
 		if err := c.ShouldBindJSON(&newCart); err != nil {
 			logger.Error(err.Error())
 			c.JSON(http.StatusBadRequest, gin.H{
@@ -54,14 +123,39 @@ func Cart(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
 			return
 		}
 
-		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
-		if userSessionErr != nil || userId == 0 {
+		userId, userSessionErr := getCartUserId(c, dbPool, logger)
+		if userSessionErr != nil {
+			logger.Error(fmt.Sprintf("Error getting cart user: %v", userSessionErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": userSessionErr.Error(),
+			})
 			return
 		}
 
 		// Create cart item
-		err := lib.UpdateCart(dbPool, logger, newCart)
+		var err error
+		if userId > 0 {
+			newCart.UserId = userId
+			err = lib.UpdateCart(dbPool, logger, newCart)
+		} else {
+			guestCart, _, guestCartErr := getGuestCart(c, dbPool, guestCarts, true)
+			err = guestCartErr
+			if guestCartErr == nil {
+				err = lib.UpdateGuestCart(dbPool, logger, guestCarts, guestCart.Id, newCart)
+			}
+		}
 		if err != nil {
+			var badRequestErr *lib.StatusBadRequestError
+			if errors.As(err, &badRequestErr) {
+				logger.Error(fmt.Sprintf("Cart update rejected: %v", badRequestErr.Message))
+				c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+					Status:    "ERROR",
+					Message:   badRequestErr.Message,
+					ErrorCode: badRequestErr.ErrorCode,
+				})
+				return
+			}
 			logger.Error(err.Error())
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"status":  "ERROR",
@@ -75,8 +169,8 @@ func Cart(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
 		})
 	})
 
-	var deleteRequest lib.DeleteCartItemRequest
 	r.DELETE("/api/v1/cart", func(c *gin.Context) {
+		var deleteRequest lib.DeleteCartItemRequest
 		if err := c.ShouldBindJSON(&deleteRequest); err != nil {
 			logger.Error(err.Error())
 			c.JSON(http.StatusBadRequest, gin.H{
@@ -86,12 +180,26 @@ func Cart(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
 			return
 		}
 
-		userId, err := GetUserIdFromSessionOrError(c, dbPool, logger)
-		if err != nil || userId == 0 {
+		userId, userSessionErr := getCartUserId(c, dbPool, logger)
+		if userSessionErr != nil {
+			logger.Error(fmt.Sprintf("Error getting cart user: %v", userSessionErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": userSessionErr.Error(),
+			})
 			return
 		}
 
-		deleteErr := lib.DeleteCartItem(dbPool, deleteRequest.InventoryItemId, userId)
+		var deleteErr error
+		if userId > 0 {
+			deleteErr = lib.DeleteCartItem(dbPool, deleteRequest, userId)
+		} else {
+			guestCart, found, guestCartErr := getGuestCart(c, dbPool, guestCarts, false)
+			deleteErr = guestCartErr
+			if found {
+				deleteErr = lib.DeleteGuestCartItem(dbPool, guestCart.Id, deleteRequest)
+			}
+		}
 		if deleteErr != nil {
 			logger.Error(deleteErr.Error())
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -105,4 +213,65 @@ func Cart(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
 			"status": "OK",
 		})
 	})
+
+	/*
+		Checkout hold
+		Reserves stock for everything in the cart. The hold is released automatically
+		if the order isn't placed before it expires.
+	*/
+	r.POST("/api/v1/cart/hold", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		reservations, reserveErr := lib.ReserveCartStock(dbPool, logger, userId)
+		if reserveErr != nil {
+			var badRequestErr *lib.StatusBadRequestError
+			if errors.As(reserveErr, &badRequestErr) {
+				logger.Error(fmt.Sprintf("Checkout hold rejected: %v", badRequestErr.Message))
+				c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+					Status:    "ERROR",
+					Message:   badRequestErr.Message,
+					ErrorCode: badRequestErr.ErrorCode,
+				})
+				return
+			}
+			logger.Error(fmt.Sprintf("Error reserving stock: %v", reserveErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": "Error reserving stock",
+			})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"reservations": reservations,
+				"expiresAt":    reservations[0].ExpiresAt,
+			},
+		})
+	})
+
+	r.DELETE("/api/v1/cart/hold", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		releaseErr := lib.ReleaseStockReservations(dbPool, userId)
+		if releaseErr != nil {
+			logger.Error(fmt.Sprintf("Error releasing stock: %v", releaseErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": "Error releasing stock",
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+		})
+	})
 }
@@ -0,0 +1,34 @@
+package routes
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gavv/httpexpect/v2"
+)
+
+func TestCartHoldWithoutSession(t *testing.T) {
+	e := httpexpect.Default(t, config.Server.AddressWithProtocol)
+	e.POST("/api/v1/cart/hold").
+		Expect().
+		Status(http.StatusUnauthorized)
+}
+
+func TestGuestCartWithoutCookieIsEmpty(t *testing.T) {
+	e := httpexpect.Default(t, config.Server.AddressWithProtocol)
+	results := e.GET("/api/v1/cart").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().Value("results").Object()
+	results.Value("guestCart").Boolean().IsTrue()
+	results.Value("cartItems").Array().IsEmpty()
+}
+
+func TestGuestCartIgnoresUnsignedCookie(t *testing.T) {
+	e := httpexpect.Default(t, config.Server.AddressWithProtocol)
+	e.GET("/api/v1/cart").
+		WithCookie("guestCartId", "00000000-0000-0000-0000-000000000000.forged").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().Value("results").Object().Value("cartItems").Array().IsEmpty()
+}
@@ -0,0 +1,103 @@
+package routes
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// maxImportBytes caps the size of a product import file
+const maxImportBytes = 10 << 20
+
+//nolint:funlen
+func CatalogueImports(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+	// Every inventory item with its tags, as a CSV or JSON download
+	r.GET("/api/v1/admin/products/export", func(c *gin.Context) {
+		format := c.DefaultQuery("format", lib.CatalogueFormatCsv)
+		if !lib.IsValidCatalogueFormat(format) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Unknown format: %v", format),
+			})
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		items, itemsErr := lib.GetCatalogueItems(dbPool)
+		if itemsErr != nil {
+			respondWithShopAdminError(c, logger, itemsErr, "Product not found")
+			return
+		}
+
+		contentType := "text/csv"
+		if format == lib.CatalogueFormatJson {
+			contentType = "application/json"
+		}
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=products.%v", format))
+		writeErr := lib.WriteCatalogue(c.Writer, format, items)
+		if writeErr != nil {
+			logger.Error(fmt.Sprintf("Error writing product export: %v", writeErr))
+		}
+	})
+
+	/*
+		Import products from a CSV or JSON request body, matching existing items by name
+		1. Parse the file, noting values that can't be read on their row
+		2. Validate every row. If any is invalid nothing is saved and the rows are returned with their errors.
+		3. With ?dryRun=true, report what each row would do without saving
+	*/
+	r.POST("/api/v1/admin/products/import", func(c *gin.Context) {
+		format := c.DefaultQuery("format", lib.CatalogueFormatCsv)
+		if !lib.IsValidCatalogueFormat(format) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Unknown format: %v", format),
+			})
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		catalogueRows, readErr := lib.ReadCatalogue(http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes), format)
+		if readErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Could not read the file: %v", readErr),
+			})
+			return
+		}
+
+		result, importErr := lib.ImportCatalogue(dbPool, logger, catalogueRows, c.Query("dryRun") == "true")
+		if importErr != nil {
+			respondWithShopAdminError(c, logger, importErr, "Product not found")
+			return
+		}
+		if !result.Valid {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Some rows are invalid; nothing was imported",
+				"results": result,
+			})
+			return
+		}
+
+		message := fmt.Sprintf("%v products created, %v updated", result.Created, result.Updated)
+		if result.DryRun {
+			message = fmt.Sprintf("%v rows are valid; nothing was imported", len(result.Rows))
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": message,
+			"results": result,
+		})
+	})
+}
@@ -0,0 +1,110 @@
+package routes
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//nolint:funlen
+func Coupons(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+	r.GET("/api/v1/admin/coupons", func(c *gin.Context) {
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		paginationData := lib.GetValidPaginationData(c)
+		coupons, couponsErr := lib.GetAdminCoupons(dbPool, paginationData)
+		if couponsErr != nil {
+			respondWithShopAdminError(c, logger, couponsErr, "Coupons not found")
+			return
+		}
+
+		total, totalErr := lib.GetTotalCoupons(dbPool)
+		if totalErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching total coupons: %v", totalErr))
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"coupons": coupons,
+				"total":   total,
+			},
+		})
+	})
+
+	r.POST("/api/v1/admin/coupons", func(c *gin.Context) {
+		var createCouponRequest lib.CreateCouponRequest
+		if !bindAndValidate(c, logger, &createCouponRequest) {
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		coupon, createErr := lib.CreateCoupon(dbPool, logger, createCouponRequest)
+		if createErr != nil {
+			respondWithShopAdminError(c, logger, createErr, "Coupon not found")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Coupon %v created", coupon.Code),
+			"results": gin.H{
+				"coupon": coupon,
+			},
+		})
+	})
+
+	r.PUT("/api/v1/admin/coupons/:code", func(c *gin.Context) {
+		var couponRequest lib.CouponRequest
+		if !bindAndValidate(c, logger, &couponRequest) {
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		coupon, updateErr := lib.UpdateCoupon(dbPool, logger, c.Param("code"), couponRequest)
+		if updateErr != nil {
+			respondWithShopAdminError(c, logger, updateErr, "Coupon not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Coupon %v updated", coupon.Code),
+			"results": gin.H{
+				"coupon": coupon,
+			},
+		})
+	})
+
+	// Coupons are expired rather than deleted so past orders keep their redemptions
+	r.PUT("/api/v1/admin/coupons/:code/expire", func(c *gin.Context) {
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		coupon, expireErr := lib.ExpireCoupon(dbPool, c.Param("code"))
+		if expireErr != nil {
+			respondWithShopAdminError(c, logger, expireErr, "Coupon not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Coupon %v expired", coupon.Code),
+			"results": gin.H{
+				"coupon": coupon,
+			},
+		})
+	})
+}
@@ -0,0 +1,97 @@
+package routes
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//nolint:funlen
+func GiftCards(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+	// Gift card detail with its ledger
+	r.GET("/api/v1/admin/gift-cards/:code", func(c *gin.Context) {
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		giftCard, giftCardErr := lib.GetGiftCardByCode(dbPool, c.Param("code"))
+		if giftCardErr != nil {
+			respondWithShopAdminError(c, logger, giftCardErr, "Gift card not found")
+			return
+		}
+		transactions, transactionsErr := lib.GetGiftCardTransactions(dbPool, giftCard.Id)
+		if transactionsErr != nil {
+			respondWithShopAdminError(c, logger, transactionsErr, "Gift card not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"giftCard":     giftCard,
+				"transactions": transactions,
+			},
+		})
+	})
+
+	// Issue a gift card. A code is generated unless one is given.
+	r.POST("/api/v1/admin/gift-cards", func(c *gin.Context) {
+		var issueRequest lib.IssueGiftCardRequest
+		if !bindAndValidate(c, logger, &issueRequest) {
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		adminUserId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || adminUserId == 0 {
+			return
+		}
+
+		giftCard, issueErr := lib.IssueGiftCard(dbPool, logger, adminUserId, issueRequest)
+		if issueErr != nil {
+			respondWithShopAdminError(c, logger, issueErr, "Gift card not found")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Gift card %v issued", giftCard.Code),
+			"results": gin.H{
+				"giftCard": giftCard,
+			},
+		})
+	})
+
+	// Void a gift card, zeroing its balance
+	r.PUT("/api/v1/admin/gift-cards/:code/void", func(c *gin.Context) {
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		adminUserId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || adminUserId == 0 {
+			return
+		}
+
+		giftCard, voidErr := lib.VoidGiftCard(dbPool, logger, c.Param("code"), adminUserId)
+		if voidErr != nil {
+			respondWithShopAdminError(c, logger, voidErr, "Gift card not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Gift card %v voided", giftCard.Code),
+			"results": gin.H{
+				"giftCard": giftCard,
+			},
+		})
+	})
+}
@@ -0,0 +1,99 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// getCartUserId - 0 with no error means the visitor isn't signed in and uses a guest cart
+func getCartUserId(c *gin.Context, dbPool *pgxpool.Pool, logger *slog.Logger) (int, error) {
+	userId, err := lib.GetUserIdFromSession(c, dbPool, logger)
+	if errors.Is(err, http.ErrNoCookie) {
+		return 0, nil
+	}
+	return userId, err
+}
+
+func setGuestCartCookie(c *gin.Context, guestCarts lib.GuestCarts, guestCart lib.GuestCart) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(
+		lib.GuestCartCookieName,
+		guestCarts.CookieValue(guestCart.Token),
+		int(guestCarts.Expiry.Seconds()),
+		"/",
+		"",
+		false,
+		true,
+	)
+}
+
+func clearGuestCartCookie(c *gin.Context) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(lib.GuestCartCookieName, "", -1, "/", "", false, true)
+}
+
+/*
+getGuestCart returns the cart in the visitor's guest cart cookie. found is false if
+there's no cookie, it isn't signed by us, or the cart has expired. With create, a new
+cart is started and the cookie set instead.
+*/
+func getGuestCart(
+	c *gin.Context, dbPool *pgxpool.Pool, guestCarts lib.GuestCarts, create bool,
+) (lib.GuestCart, bool, error) {
+	cookieValue, cookieErr := c.Cookie(lib.GuestCartCookieName)
+	if cookieErr == nil {
+		if token, ok := guestCarts.TokenFromCookieValue(cookieValue); ok {
+			guestCart, guestCartErr := lib.GetGuestCartByToken(dbPool, token)
+			if guestCartErr == nil {
+				return guestCart, true, nil
+			}
+			if !errors.Is(guestCartErr, pgx.ErrNoRows) {
+				return lib.GuestCart{}, false, guestCartErr
+			}
+		}
+	}
+	if !create {
+		return lib.GuestCart{}, false, nil
+	}
+
+	guestCart, addErr := lib.AddGuestCart(dbPool, guestCarts.Expiry)
+	if addErr != nil {
+		return lib.GuestCart{}, false, addErr
+	}
+	setGuestCartCookie(c, guestCarts, guestCart)
+	return guestCart, true, nil
+}
+
+/*
+mergeGuestCartOnSignIn moves the visitor's guest cart into their user cart and clears
+the cookie. Sign-in shouldn't fail because of the cart, so errors are only logged.
+*/
+func mergeGuestCartOnSignIn(
+	c *gin.Context, dbPool *pgxpool.Pool, logger *slog.Logger, guestCarts lib.GuestCarts, userId int,
+) int {
+	cookieValue, cookieErr := c.Cookie(lib.GuestCartCookieName)
+	if cookieErr != nil {
+		return 0
+	}
+	clearGuestCartCookie(c)
+
+	token, ok := guestCarts.TokenFromCookieValue(cookieValue)
+	if !ok {
+		logger.Error(fmt.Sprintf("Ignoring guest cart cookie with a bad signature for user %v", userId))
+		return 0
+	}
+	merged, mergeErr := lib.MergeGuestCart(dbPool, logger, token, userId)
+	if mergeErr != nil {
+		logger.Error(fmt.Sprintf("Error merging guest cart for user %v: %v", userId, mergeErr))
+		return 0
+	}
+	return merged
+}
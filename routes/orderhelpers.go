@@ -0,0 +1,159 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// getOrderDetailResults assembles everything the order detail pages need. Used by both
+// the customer and admin order detail endpoints.
+func getOrderDetailResults(dbPool *pgxpool.Pool, order lib.Order) (gin.H, error) {
+	orderItems, orderItemsErr := lib.GetOrderItems(dbPool, order.Id)
+	if orderItemsErr != nil {
+		return nil, orderItemsErr
+	}
+
+	shippingOption, shippingOptionErr := lib.GetShippingOptionById(dbPool, order.ShippingOptionId)
+	if shippingOptionErr != nil {
+		return nil, shippingOptionErr
+	}
+
+	statusHistory, statusHistoryErr := lib.GetOrderStatusHistory(dbPool, order.Id)
+	if statusHistoryErr != nil {
+		return nil, statusHistoryErr
+	}
+
+	payments, paymentsErr := lib.GetPaymentAttemptsByOrderId(dbPool, order.Id)
+	if paymentsErr != nil {
+		return nil, paymentsErr
+	}
+
+	return gin.H{
+		"order":          order,
+		"orderItems":     orderItems,
+		"shippingOption": shippingOption,
+		"couponCode":     order.CouponCode,
+		"totals": gin.H{
+			"subtotal":         order.Subtotal,
+			"discountAmount":   order.DiscountAmount,
+			"shippingPrice":    order.ShippingPrice,
+			"taxAmount":        order.TaxAmount,
+			"pricesIncludeTax": order.PricesIncludeTax,
+			"giftCardAmount":   order.GiftCardAmount,
+			"total":            order.Total,
+		},
+		"statusHistory": statusHistory,
+		"payments":      payments,
+	}, nil
+}
+
+// isOrderAdminOrError responds with 403 unless the signed-in user may manage orders
+func isOrderAdminOrError(c *gin.Context, dbPool *pgxpool.Pool, logger *slog.Logger) bool {
+	isUserAdmin, isUserAdminErr := lib.IsUserAdmin(c, dbPool, logger)
+	if isUserAdminErr != nil {
+		return false
+	}
+	if !isUserAdmin {
+		c.JSON(http.StatusForbidden, lib.GenericResponseWithErrorCode{
+			Status:    "ERROR",
+			Message:   "Permission denied",
+			ErrorCode: lib.ErrorCodePermissionDenied,
+		})
+		return false
+	}
+	return true
+}
+
+const OrderFilterDateLayout = "2006-01-02"
+
+// getAdminOrderFilters reads status, userSlug, from and to (YYYY-MM-DD, inclusive) from the query
+func getAdminOrderFilters(c *gin.Context, dbPool *pgxpool.Pool, logger *slog.Logger) (lib.AdminOrderFilters, error) {
+	var filters lib.AdminOrderFilters
+	filters.Status = c.DefaultQuery("status", "")
+	if len(filters.Status) > 0 && !lib.IsValidOrderStatus(filters.Status) {
+		return filters, fmt.Errorf("invalid status: %v", filters.Status)
+	}
+
+	userSlug := c.DefaultQuery("userSlug", "")
+	if len(userSlug) > 0 {
+		user, userErr := lib.GetUserBySlug(dbPool, logger, userSlug)
+		if userErr != nil {
+			return filters, userErr
+		}
+		if user == (lib.User{}) {
+			return filters, fmt.Errorf("user not found: %v", userSlug)
+		}
+		filters.UserId = user.Id
+	}
+
+	createdAfter, createdBefore, dateRangeErr := getDateRangeFilter(c)
+	if dateRangeErr != nil {
+		return filters, dateRangeErr
+	}
+	filters.CreatedAfter = createdAfter
+	filters.CreatedBefore = createdBefore
+
+	return filters, nil
+}
+
+// getDateRangeFilter reads the optional from and to query dates. to includes the whole day.
+func getDateRangeFilter(c *gin.Context) (*time.Time, *time.Time, error) {
+	var createdAfter, createdBefore *time.Time
+	from := c.DefaultQuery("from", "")
+	if len(from) > 0 {
+		after, parseErr := time.ParseInLocation(OrderFilterDateLayout, from, time.Local)
+		if parseErr != nil {
+			return nil, nil, fmt.Errorf("invalid from date: %v", from)
+		}
+		createdAfter = &after
+	}
+
+	to := c.DefaultQuery("to", "")
+	if len(to) > 0 {
+		before, parseErr := time.ParseInLocation(OrderFilterDateLayout, to, time.Local)
+		if parseErr != nil {
+			return nil, nil, fmt.Errorf("invalid to date: %v", to)
+		}
+		// Include the whole "to" day
+		before = before.AddDate(0, 0, 1)
+		createdBefore = &before
+	}
+
+	return createdAfter, createdBefore, nil
+}
+
+// respondWithGiftCardError maps errors from gift card lookups and redemptions onto responses
+func respondWithGiftCardError(c *gin.Context, logger *slog.Logger, err error) {
+	var badRequestErr *lib.StatusBadRequestError
+	if errors.As(err, &badRequestErr) {
+		logger.Error(fmt.Sprintf("Gift card request rejected: %v", badRequestErr.Message))
+		c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+			Status:    "ERROR",
+			Message:   badRequestErr.Message,
+			ErrorCode: badRequestErr.ErrorCode,
+		})
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, lib.GenericResponseWithErrorCode{
+			Status:    "ERROR",
+			Message:   "Gift card not found",
+			ErrorCode: lib.ErrorCodeGiftCardNotFound,
+		})
+		return
+	}
+	logger.Error(fmt.Sprintf("Gift card request failed: %v", err))
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"status":  "ERROR",
+		"message": "Internal server error",
+	})
+}
@@ -1,20 +1,33 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
 	"hotsauceshop/lib"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 const CouponCodeMaxLength = 25
 const CouponCodeMinLength = 4
 
-func Orders(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+//nolint:funlen
+func Orders(
+	r *gin.Engine,
+	dbPool *pgxpool.Pool,
+	logger *slog.Logger,
+	paymentProvider lib.PaymentProvider,
+	taxRules lib.TaxRules,
+) {
 	r.GET("/api/v1/orders/shipping-options", func(c *gin.Context) {
 		shippingOptions, err := lib.GetShippingOptions(dbPool)
 		if err != nil {
@@ -33,6 +46,12 @@ func Orders(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
 		})
 	})
 
+	/*
+		Coupon lookup
+		- Anyone can check a coupon exists and is running
+		- For signed-in users it's also evaluated against their cart. Pass shippingOptionId
+		  to see the shipping discount for a free shipping coupon.
+	*/
 	r.GET("/api/v1/coupons/:code", func(c *gin.Context) {
 		couponCode := c.Param("code")
 		if len(couponCode) < CouponCodeMinLength || len(couponCode) > CouponCodeMaxLength {
@@ -44,9 +63,68 @@ func Orders(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
 			return
 		}
 
-		validCouponCode, couponCodeErr := lib.GetCouponByCode(dbPool, couponCode)
-		if couponCodeErr != nil || validCouponCode == (lib.CouponCode{}) {
-			logger.Error(fmt.Sprintf("GetCouponByCode error: %v", couponCodeErr))
+		shippingOptionId, shippingOptionIdErr := strconv.Atoi(c.DefaultQuery("shippingOptionId", "0"))
+		if shippingOptionIdErr != nil || shippingOptionId < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Invalid shipping option",
+			})
+			return
+		}
+
+		// Signing in is optional here, so a missing session isn't an error
+		userId, userSessionErr := lib.GetUserIdFromSession(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			validCouponCode, couponCodeErr := lib.GetCouponByCode(dbPool, couponCode)
+			if couponCodeErr != nil || validCouponCode == (lib.CouponCode{}) {
+				logger.Error(fmt.Sprintf("GetCouponByCode error: %v", couponCodeErr))
+				c.JSON(http.StatusNotFound, gin.H{
+					"status":  "ERROR",
+					"message": "Invalid coupon code",
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"status": "OK",
+				"results": gin.H{
+					"couponCode": validCouponCode,
+				},
+			})
+			return
+		}
+
+		validCouponCode, evaluation, evaluationErr := lib.EvaluateCouponForCart(
+			dbPool, couponCode, userId, shippingOptionId,
+		)
+		if evaluationErr != nil {
+			var badRequestErr *lib.StatusBadRequestError
+			if errors.As(evaluationErr, &badRequestErr) && validCouponCode != (lib.CouponCode{}) {
+				// The coupon exists but the cart doesn't qualify; say why so checkout can show it
+				c.JSON(http.StatusOK, gin.H{
+					"status": "OK",
+					"results": gin.H{
+						"couponCode": validCouponCode,
+						"evaluation": gin.H{
+							"eligible":  false,
+							"message":   badRequestErr.Message,
+							"errorCode": badRequestErr.ErrorCode,
+						},
+					},
+				})
+				return
+			}
+			if errors.As(evaluationErr, &badRequestErr) {
+				c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+					Status:    "ERROR",
+					Message:   badRequestErr.Message,
+					ErrorCode: badRequestErr.ErrorCode,
+				})
+				return
+			}
+			if !errors.Is(evaluationErr, pgx.ErrNoRows) {
+				logger.Error(fmt.Sprintf("Error evaluating coupon: %v", evaluationErr))
+			}
 			c.JSON(http.StatusNotFound, gin.H{
 				"status":  "ERROR",
 				"message": "Invalid coupon code",
@@ -58,7 +136,368 @@ func Orders(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
 			"status": "OK",
 			"results": gin.H{
 				"couponCode": validCouponCode,
+				"evaluation": gin.H{
+					"eligible":              true,
+					"eligibleSubtotalCents": evaluation.EligibleSubtotalCents,
+					"discountCents":         evaluation.DiscountCents,
+					"freeShipping":          evaluation.FreeShipping,
+					"shippingDiscountCents": evaluation.ShippingDiscountCents,
+				},
+			},
+		})
+	})
+
+	// Gift card balance - signed-in users holding the code can check it
+	r.GET("/api/v1/gift-cards/:code", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		giftCard, giftCardErr := lib.GetGiftCardByCode(dbPool, c.Param("code"))
+		if giftCardErr != nil {
+			respondWithGiftCardError(c, logger, giftCardErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"giftCard": gin.H{
+					"code":         giftCard.Code,
+					"balanceCents": giftCard.BalanceCents,
+					"expiresAt":    giftCard.ExpiresAt,
+					"voided":       giftCard.VoidedAt != nil,
+					"usable":       giftCard.IsUsable(time.Now()),
+				},
+			},
+		})
+	})
+
+	/*
+		Redeem a gift card against the signed-in user's cart
+		1. Validate request. Without amountCents, as much as the card and cart allow is taken.
+		2. Get user from sessionId
+		3. Debit the card; the amount comes off the cart total until the order is placed
+	*/
+	r.POST("/api/v1/gift-cards/:code/redeem", func(c *gin.Context) {
+		var redeemRequest lib.RedeemGiftCardRequest
+		if !bindAndValidate(c, logger, &redeemRequest) {
+			return
+		}
+
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		redemption, giftCard, redeemErr := lib.RedeemGiftCard(
+			dbPool, logger, taxRules, userId, c.Param("code"), redeemRequest,
+		)
+		if redeemErr != nil {
+			respondWithGiftCardError(c, logger, redeemErr)
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("%v redeemed from gift card", redemption.AmountCents),
+			"results": gin.H{
+				"redemption":   redemption,
+				"balanceCents": giftCard.BalanceCents,
+			},
+		})
+	})
+
+	// Take a gift card off the signed-in user's cart, putting what was redeemed back on the card
+	r.DELETE("/api/v1/gift-cards/:code/redeem", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		released, releaseErr := lib.ReleaseGiftCardRedemptions(dbPool, logger, userId, c.Param("code"))
+		if releaseErr != nil {
+			respondWithGiftCardError(c, logger, releaseErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("%v returned to gift card", released),
+			"results": gin.H{
+				"releasedCents": released,
+			},
+		})
+	})
+
+	/*
+		Place order
+		1. Validate request
+		2. Get user from sessionId
+		3. Turn the user's cart into an order
+	*/
+	r.POST("/api/v1/orders", func(c *gin.Context) {
+		var placeOrderRequest lib.PlaceOrderRequest
+		if err := c.ShouldBindJSON(&placeOrderRequest); err != nil {
+			logger.Error(fmt.Sprintf("Malformed order request: %v", err.Error()))
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Malformed request body.",
+			})
+			return
+		}
+
+		validate := validator.New(validator.WithRequiredStructEnabled())
+		err := validate.Struct(placeOrderRequest)
+		if err != nil {
+			logger.Error(err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Validation failed: %v", err),
+			})
+			return
+		}
+
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		order, orderItems, placeOrderErr := lib.PlaceOrder(dbPool, logger, taxRules, userId, placeOrderRequest)
+		if placeOrderErr != nil {
+			var badRequestErr *lib.StatusBadRequestError
+			if errors.As(placeOrderErr, &badRequestErr) {
+				logger.Error(fmt.Sprintf("Order rejected: %v", badRequestErr.Message))
+				c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+					Status:    "ERROR",
+					Message:   badRequestErr.Message,
+					ErrorCode: badRequestErr.ErrorCode,
+				})
+				return
+			}
+			logger.Error(fmt.Sprintf("Error placing order: %v", placeOrderErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": "Error placing order",
+			})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Order %v placed", order.OrderNumber),
+			"results": gin.H{
+				"order":      order,
+				"orderItems": orderItems,
+			},
+		})
+	})
+
+	// Order history for the signed-in user
+	r.GET("/api/v1/orders", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		paginationData := lib.GetValidPaginationData(c)
+		orders, ordersErr := lib.GetOrdersByUserId(dbPool, userId, paginationData)
+		if ordersErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching orders: %v", ordersErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": "Error fetching orders",
+			})
+			return
+		}
+
+		total, totalErr := lib.GetTotalOrdersByUserId(dbPool, userId)
+		if totalErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching total orders: %v", totalErr))
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"orders": orders,
+				"total":  total,
+			},
+		})
+	})
+
+	// Order detail - users can only see their own orders
+	r.GET("/api/v1/orders/:orderNumber", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		order, orderErr := lib.GetOrderByOrderNumber(dbPool, c.Param("orderNumber"))
+		if orderErr != nil && !errors.Is(orderErr, pgx.ErrNoRows) {
+			logger.Error(fmt.Sprintf("Error fetching order: %v", orderErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": "Error fetching order",
+			})
+			return
+		}
+
+		// Someone else's order is reported as not found, so order numbers can't be probed
+		if errors.Is(orderErr, pgx.ErrNoRows) || order.UserId != userId {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "ERROR",
+				"message": "Order not found",
+			})
+			return
+		}
+
+		orderDetail, orderDetailErr := getOrderDetailResults(dbPool, order)
+		if orderDetailErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching order detail: %v", orderDetailErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": "Error fetching order",
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"results": orderDetail,
+		})
+	})
+
+	/*
+		Pay for an order
+		1. Validate the card details
+		2. Get user from sessionId
+		3. Charge the order total; the order moves to paid once the payment is captured
+	*/
+	r.POST("/api/v1/orders/:orderNumber/payments", func(c *gin.Context) {
+		var chargeOrderRequest lib.ChargeOrderRequest
+		if err := c.ShouldBindJSON(&chargeOrderRequest); err != nil {
+			logger.Error(fmt.Sprintf("Malformed payment request: %v", err.Error()))
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Malformed request body.",
+			})
+			return
+		}
+
+		validate := validator.New(validator.WithRequiredStructEnabled())
+		err := validate.Struct(chargeOrderRequest)
+		if err != nil {
+			logger.Error(err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Validation failed: %v", err),
+			})
+			return
+		}
+
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		orderNumber := c.Param("orderNumber")
+		paymentAttempt, chargeErr := lib.ChargeOrder(
+			dbPool, logger, paymentProvider, userId, orderNumber, chargeOrderRequest.Card,
+		)
+		if chargeErr != nil {
+			var badRequestErr *lib.StatusBadRequestError
+			if errors.As(chargeErr, &badRequestErr) {
+				logger.Error(fmt.Sprintf("Payment rejected: %v", badRequestErr.Message))
+				c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+					Status:    "ERROR",
+					Message:   badRequestErr.Message,
+					ErrorCode: badRequestErr.ErrorCode,
+				})
+				return
+			}
+			if errors.Is(chargeErr, pgx.ErrNoRows) {
+				c.JSON(http.StatusNotFound, gin.H{
+					"status":  "ERROR",
+					"message": "Order not found",
+				})
+				return
+			}
+			logger.Error(fmt.Sprintf("Error charging order %v: %v", orderNumber, chargeErr))
+			c.JSON(http.StatusBadGateway, gin.H{
+				"status":  "ERROR",
+				"message": "Payment could not be processed",
+			})
+			return
+		}
+
+		// Delayed settlement - the outcome arrives later via webhook
+		statusCode := http.StatusCreated
+		if paymentAttempt.Status == lib.PaymentStatusPending {
+			statusCode = http.StatusAccepted
+		}
+
+		c.JSON(statusCode, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Payment %v", paymentAttempt.Status),
+			"results": gin.H{
+				"payment": paymentAttempt,
 			},
 		})
 	})
+
+	// Payment provider webhooks - authenticated by the provider's signature, not a session
+	r.POST("/api/v1/payments/webhooks/:provider", func(c *gin.Context) {
+		if c.Param("provider") != paymentProvider.Name() {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "ERROR",
+				"message": "Unknown payment provider",
+			})
+			return
+		}
+
+		payload, readErr := io.ReadAll(c.Request.Body)
+		if readErr != nil {
+			logger.Error(fmt.Sprintf("Error reading payment webhook: %v", readErr))
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Malformed request body.",
+			})
+			return
+		}
+
+		event, verifyErr := paymentProvider.VerifyWebhook(
+			payload, c.GetHeader(paymentProvider.WebhookSignatureHeader()),
+		)
+		if verifyErr != nil {
+			logger.Error(fmt.Sprintf("Rejected payment webhook: %v", verifyErr))
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"status":  "ERROR",
+				"message": "Invalid webhook",
+			})
+			return
+		}
+
+		webhookErr := lib.HandlePaymentWebhook(dbPool, logger, paymentProvider, event)
+		if errors.Is(webhookErr, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "ERROR",
+				"message": "Payment not found",
+			})
+			return
+		}
+		if webhookErr != nil {
+			logger.Error(fmt.Sprintf("Error handling payment webhook: %v", webhookErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": "Error handling webhook",
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Webhook processed",
+		})
+	})
 }
@@ -0,0 +1,103 @@
+package routes
+
+import (
+	"net/http"
+	"testing"
+
+	"hotsauceshop/lib"
+
+	"github.com/gavv/httpexpect/v2"
+)
+
+func TestGetOrdersWithoutSession(t *testing.T) {
+	e := httpexpect.Default(t, config.Server.AddressWithProtocol)
+	e.GET("/api/v1/orders").
+		Expect().
+		Status(http.StatusUnauthorized)
+}
+
+func TestGetOrderDetailNotFound(t *testing.T) {
+	e := httpexpect.Default(t, config.Server.AddressWithProtocol)
+	sessionID := signInAndGetSessionId(t, e, config.TestUsers.UnprivilegedUsername, config.TestUsers.UnprivilegedPassword)
+	var response lib.GenericResponse
+	e.GET("/api/v1/orders/HS-0000000000").
+		WithCookie("sessionId", sessionID).
+		Expect().
+		Status(http.StatusNotFound).
+		JSON().
+		Decode(&response)
+	if response.Status != "ERROR" {
+		t.Fatal("Order detail response status should have been ERROR")
+	}
+}
+
+func TestGetAdminOrdersWithUnprivilegedUser(t *testing.T) {
+	e := httpexpect.Default(t, config.Server.AddressWithProtocol)
+	sessionID := signInAndGetSessionId(t, e, config.TestUsers.UnprivilegedUsername, config.TestUsers.UnprivilegedPassword)
+	var response lib.GenericResponseWithErrorCode
+	e.GET("/api/v1/admin/orders").
+		WithCookie("sessionId", sessionID).
+		Expect().
+		Status(http.StatusForbidden).
+		JSON().
+		Decode(&response)
+	if response.ErrorCode != lib.ErrorCodePermissionDenied {
+		t.Fatalf("Expected error code %s, got %s", lib.ErrorCodePermissionDenied, response.ErrorCode)
+	}
+}
+
+func TestPaymentWebhookWithInvalidSignature(t *testing.T) {
+	e := httpexpect.Default(t, config.Server.AddressWithProtocol)
+	var response lib.GenericResponse
+	e.POST("/api/v1/payments/webhooks/fake").
+		WithHeader(lib.FakePaymentWebhookSignatureHeader, "invalid").
+		WithJSON(lib.PaymentWebhookEvent{EventType: lib.PaymentWebhookEventSettled, ProviderReference: "fake_123"}).
+		Expect().
+		Status(http.StatusUnauthorized).
+		JSON().
+		Decode(&response)
+	if response.Status != "ERROR" {
+		t.Fatal("Webhook response status should have been ERROR")
+	}
+}
+
+func TestRequestReturnWithoutSession(t *testing.T) {
+	e := httpexpect.Default(t, config.Server.AddressWithProtocol)
+	e.POST("/api/v1/orders/HS-0000000000/returns").
+		WithJSON(lib.RequestReturnRequest{
+			Reason: "Too hot",
+			Items:  []lib.ReturnItemRequest{{OrderItemId: 1, Quantity: 1}},
+		}).
+		Expect().
+		Status(http.StatusUnauthorized)
+}
+
+func TestGetAdminReturnsWithUnprivilegedUser(t *testing.T) {
+	e := httpexpect.Default(t, config.Server.AddressWithProtocol)
+	sessionID := signInAndGetSessionId(t, e, config.TestUsers.UnprivilegedUsername, config.TestUsers.UnprivilegedPassword)
+	var response lib.GenericResponseWithErrorCode
+	e.GET("/api/v1/admin/returns").
+		WithCookie("sessionId", sessionID).
+		Expect().
+		Status(http.StatusForbidden).
+		JSON().
+		Decode(&response)
+	if response.ErrorCode != lib.ErrorCodePermissionDenied {
+		t.Fatalf("Expected error code %s, got %s", lib.ErrorCodePermissionDenied, response.ErrorCode)
+	}
+}
+
+func TestGetAdminCouponsWithUnprivilegedUser(t *testing.T) {
+	e := httpexpect.Default(t, config.Server.AddressWithProtocol)
+	sessionID := signInAndGetSessionId(t, e, config.TestUsers.UnprivilegedUsername, config.TestUsers.UnprivilegedPassword)
+	var response lib.GenericResponseWithErrorCode
+	e.GET("/api/v1/admin/coupons").
+		WithCookie("sessionId", sessionID).
+		Expect().
+		Status(http.StatusForbidden).
+		JSON().
+		Decode(&response)
+	if response.ErrorCode != lib.ErrorCodePermissionDenied {
+		t.Fatalf("Expected error code %s, got %s", lib.ErrorCodePermissionDenied, response.ErrorCode)
+	}
+}
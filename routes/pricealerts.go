@@ -0,0 +1,166 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// respondWithPriceAlertError maps errors from price alerts and notifications onto responses
+func respondWithPriceAlertError(c *gin.Context, logger *slog.Logger, err error, notFoundMessage string) {
+	var badRequestErr *lib.StatusBadRequestError
+	if errors.As(err, &badRequestErr) {
+		logger.Error(fmt.Sprintf("Price alert request rejected: %v", badRequestErr.Message))
+		c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+			Status:    "ERROR",
+			Message:   badRequestErr.Message,
+			ErrorCode: badRequestErr.ErrorCode,
+		})
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status":  "ERROR",
+			"message": notFoundMessage,
+		})
+		return
+	}
+	logger.Error(fmt.Sprintf("Error processing price alert: %v", err))
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"status":  "ERROR",
+		"message": "Error processing price alert",
+	})
+}
+
+//nolint:funlen
+func PriceAlerts(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+	// The signed-in user's price alerts, armed ones first
+	r.GET("/api/v1/price-alerts", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		priceAlerts, priceAlertsErr := lib.GetPriceAlertsByUserId(dbPool, userId)
+		if priceAlertsErr != nil {
+			respondWithPriceAlertError(c, logger, priceAlertsErr, "Price alert not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"priceAlerts": priceAlerts,
+			},
+		})
+	})
+
+	// Get told when an item's price drops below thresholdPrice. Saving an alert again re-arms it.
+	r.POST("/api/v1/price-alerts", func(c *gin.Context) {
+		var priceAlertRequest lib.PriceAlertRequest
+		if !bindAndValidate(c, logger, &priceAlertRequest) {
+			return
+		}
+
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		priceAlert, saveErr := lib.SavePriceAlert(dbPool, logger, userId, priceAlertRequest)
+		if saveErr != nil {
+			respondWithPriceAlertError(c, logger, saveErr, "Inventory item not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Price alert set for %v", priceAlert.Name),
+			"results": gin.H{
+				"priceAlert": priceAlert,
+			},
+		})
+	})
+
+	r.DELETE("/api/v1/price-alerts/:id", func(c *gin.Context) {
+		priceAlertId, userId, ok := getIdParamAndUserIdOrError(c, dbPool, logger, "price alert")
+		if !ok {
+			return
+		}
+
+		deleteErr := lib.DeletePriceAlert(dbPool, userId, priceAlertId)
+		if deleteErr != nil {
+			respondWithPriceAlertError(c, logger, deleteErr, "Price alert not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Price alert removed",
+		})
+	})
+
+	// Notifications the user has been sent, newest first. ?unread=true leaves out read ones.
+	r.GET("/api/v1/notifications", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		notifications, notificationsErr := lib.GetNotificationsByUserId(dbPool, userId, c.Query("unread") == "true")
+		if notificationsErr != nil {
+			respondWithPriceAlertError(c, logger, notificationsErr, "Notification not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"notifications": notifications,
+			},
+		})
+	})
+
+	r.PUT("/api/v1/notifications/read", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		markedCount, markErr := lib.MarkAllNotificationsRead(dbPool, userId)
+		if markErr != nil {
+			respondWithPriceAlertError(c, logger, markErr, "Notification not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("%v notifications marked as read", markedCount),
+		})
+	})
+
+	r.PUT("/api/v1/notifications/:id/read", func(c *gin.Context) {
+		notificationId, userId, ok := getIdParamAndUserIdOrError(c, dbPool, logger, "notification")
+		if !ok {
+			return
+		}
+
+		markErr := lib.MarkNotificationRead(dbPool, userId, notificationId)
+		if markErr != nil {
+			respondWithPriceAlertError(c, logger, markErr, "Notification not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Notification marked as read",
+		})
+	})
+}
@@ -0,0 +1,224 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+
+	"hotsauceshop/lib"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// getProductFilters reads tags (comma separated ids), tagMatch (any or all), minPrice, maxPrice,
+// minSpice, maxSpice, minRating and minReviews from the query
+func getProductFilters(c *gin.Context) (lib.ProductFilters, error) {
+	var filters lib.ProductFilters
+	filters.TagIds = lib.ToIntArray(c.DefaultQuery("tags", ""))
+
+	switch tagMatch := c.DefaultQuery("tagMatch", "any"); tagMatch {
+	case "any":
+	case "all":
+		filters.MatchAllTags = true
+	default:
+		return filters, fmt.Errorf("invalid tagMatch: %v", tagMatch)
+	}
+
+	var priceErr error
+	if filters.MinPrice, priceErr = getPriceQuery(c, "minPrice"); priceErr != nil {
+		return filters, priceErr
+	}
+	if filters.MaxPrice, priceErr = getPriceQuery(c, "maxPrice"); priceErr != nil {
+		return filters, priceErr
+	}
+	if filters.MinPrice != nil && filters.MaxPrice != nil && *filters.MinPrice > *filters.MaxPrice {
+		return filters, fmt.Errorf("minPrice must not be more than maxPrice")
+	}
+
+	var spiceErr error
+	if filters.MinSpiceRating, spiceErr = getSpiceRatingQuery(c, "minSpice"); spiceErr != nil {
+		return filters, spiceErr
+	}
+	if filters.MaxSpiceRating, spiceErr = getSpiceRatingQuery(c, "maxSpice"); spiceErr != nil {
+		return filters, spiceErr
+	}
+	if filters.MinSpiceRating > 0 && filters.MaxSpiceRating > 0 && filters.MinSpiceRating > filters.MaxSpiceRating {
+		return filters, fmt.Errorf("minSpice must not be more than maxSpice")
+	}
+
+	minRating := c.DefaultQuery("minRating", "")
+	if len(minRating) > 0 {
+		parsed, parseErr := strconv.ParseFloat(minRating, 32)
+		if parseErr != nil || !(parsed >= 0 && parsed <= 5) {
+			return filters, fmt.Errorf("minRating must be 0-5")
+		}
+		filters.MinAverageRating = float32(parsed)
+	}
+
+	minReviews := c.DefaultQuery("minReviews", "")
+	if len(minReviews) > 0 {
+		parsed, parseErr := strconv.Atoi(minReviews)
+		if parseErr != nil || parsed < 0 {
+			return filters, fmt.Errorf("invalid minReviews: %v", minReviews)
+		}
+		filters.MinReviewCount = parsed
+	}
+
+	return filters, nil
+}
+
+// getPriceQuery returns nil when the price isn't in the query
+func getPriceQuery(c *gin.Context, name string) (*float32, error) {
+	value := c.DefaultQuery(name, "")
+	if len(value) == 0 {
+		return nil, nil
+	}
+	parsed, parseErr := strconv.ParseFloat(value, 32)
+	if parseErr != nil || !(parsed >= 0 && parsed <= 999999.99) {
+		return nil, fmt.Errorf("invalid %v: %v", name, value)
+	}
+	price := float32(parsed)
+	return &price, nil
+}
+
+// getSpiceRatingQuery returns 0 when the spice rating isn't in the query
+func getSpiceRatingQuery(c *gin.Context, name string) (int, error) {
+	value := c.DefaultQuery(name, "")
+	if len(value) == 0 {
+		return 0, nil
+	}
+	parsed, parseErr := strconv.Atoi(value)
+	if parseErr != nil || parsed < lib.MinSpiceRating || parsed > lib.MaxSpiceRating {
+		return 0, fmt.Errorf("%v must be %d-%d", name, lib.MinSpiceRating, lib.MaxSpiceRating)
+	}
+	return parsed, nil
+}
+
+// getRecommendedInventoryItems orders items by the signed-in user's heat profile. Without one to go
+// on, the best rated come first.
+func getRecommendedInventoryItems(
+	c *gin.Context, dbPool *pgxpool.Pool, logger *slog.Logger, paginationData lib.PaginationData,
+	filters lib.ProductFilters,
+) ([]lib.InventoryItem, error) {
+	userId, _ := lib.GetUserIdFromSession(c, dbPool, logger)
+	if userId > 0 {
+		heatProfile, heatProfileErr := lib.GetHeatProfile(dbPool, userId)
+		if heatProfileErr != nil {
+			return nil, heatProfileErr
+		}
+		if heatProfile.PreferredSpiceRating != nil {
+			return lib.GetInventoryItemsForHeatProfile(
+				dbPool, logger, paginationData.PerPage, paginationData.Offset, *heatProfile.PreferredSpiceRating,
+				filters,
+			)
+		}
+	}
+	return lib.GetInventoryItemsOrderedBySortKey(
+		dbPool, logger, paginationData.PerPage, paginationData.Offset, "average_rating", filters,
+	)
+}
+
+// getProductImageUploadMimeType reads the upload's type from its contents, rejecting any CreateThumbnail can't handle
+func getProductImageUploadMimeType(upload *multipart.FileHeader) (string, error) {
+	file, openErr := upload.Open()
+	if openErr != nil {
+		return "", openErr
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	mimeType, detectErr := mimetype.DetectReader(file)
+	if detectErr != nil {
+		return "", detectErr
+	}
+	if !lib.IsSupportedProductImageType(mimeType.String()) {
+		return "", &lib.StatusBadRequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("%v is %v; images must be PNG, JPEG or GIF", upload.Filename, mimeType.String()),
+			ErrorCode:  lib.ErrorCodeInvalidProductImage,
+		}
+	}
+	return mimeType.String(), nil
+}
+
+// respondWithProductImageUploadError responds with 400 for uploads that aren't usable images, otherwise 500
+func respondWithProductImageUploadError(c *gin.Context, logger *slog.Logger, err error) {
+	var badRequestErr *lib.StatusBadRequestError
+	if errors.As(err, &badRequestErr) {
+		logger.Error(fmt.Sprintf("Product image upload rejected: %v", badRequestErr.Message))
+		c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+			Status:    "ERROR",
+			Message:   badRequestErr.Message,
+			ErrorCode: badRequestErr.ErrorCode,
+		})
+		return
+	}
+	logger.Error(fmt.Sprintf("Error saving product image: %v", err))
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"status":  "ERROR",
+		"message": "Error saving product image",
+	})
+}
+
+/*
+saveProductImage
+ 1. Save the upload under a new name for the product, with the extension of its real type
+ 2. Create its thumbnail and measure both, the same way as post images
+
+The files are removed again if anything fails.
+*/
+func saveProductImage(
+	c *gin.Context, logger *slog.Logger, itemSlug string, upload *multipart.FileHeader, mimeType string,
+) (lib.SavedPostImageInfo, error) {
+	extension, extensionErr := lib.GetExtensionByMimeType(mimeType)
+	if extensionErr != nil {
+		return lib.SavedPostImageInfo{}, extensionErr
+	}
+	imageId, uuidErr := uuid.NewRandom()
+	if uuidErr != nil {
+		return lib.SavedPostImageInfo{}, uuidErr
+	}
+	filename := fmt.Sprintf("%s-%s.%s", itemSlug, imageId.String(), extension)
+	imageInfo := lib.SavedPostImageInfo{
+		Filename:          filename,
+		FullImagePath:     lib.ProductImagePath + filename,
+		ThumbnailFilename: lib.GetThumbnailFilename(filename),
+		ThumbnailFullPath: lib.ProductImagePath + lib.GetThumbnailFilename(filename),
+		MimeType:          mimeType,
+	}
+
+	saveErr := c.SaveUploadedFile(upload, imageInfo.FullImagePath)
+	if saveErr != nil {
+		return lib.SavedPostImageInfo{}, saveErr
+	}
+	var sizeErr, thumbnailErr, thumbnailSizeErr error
+	imageInfo.ImageWidthHeight, sizeErr = lib.GetImageWidthAndHeight(imageInfo.FullImagePath, logger)
+	if sizeErr == nil {
+		thumbnailErr = lib.CreateThumbnail(imageInfo.FullImagePath, imageInfo.ThumbnailFullPath, mimeType, logger)
+	}
+	if sizeErr == nil && thumbnailErr == nil {
+		imageInfo.ThumbnailWidthHeight, thumbnailSizeErr = lib.GetImageWidthAndHeight(imageInfo.ThumbnailFullPath, logger)
+	}
+	if err := errors.Join(sizeErr, thumbnailErr, thumbnailSizeErr); err != nil {
+		removeProductImageFiles(logger, imageInfo.Filename, imageInfo.ThumbnailFilename)
+		return lib.SavedPostImageInfo{}, err
+	}
+	return imageInfo, nil
+}
+
+// removeProductImageFiles deletes an image and its thumbnail, logging any that can't be
+func removeProductImageFiles(logger *slog.Logger, filename string, thumbnailFilename string) {
+	for _, name := range []string{filename, thumbnailFilename} {
+		removeErr := os.Remove(lib.ProductImagePath + name)
+		if removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+			logger.Error(fmt.Sprintf("Error removing product image %v: %v", name, removeErr))
+		}
+	}
+}
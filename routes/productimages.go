@@ -0,0 +1,183 @@
+package routes
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// maxProductImageUploadBytes caps the size of one upload of product images
+const maxProductImageUploadBytes = 50 << 20
+
+//nolint:funlen
+func ProductImages(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+	// Adds the uploaded "images" to the end of the product's gallery
+	r.POST("/api/v1/admin/products/:slug/images", func(c *gin.Context) {
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		itemSlug := c.Param("slug")
+		inventoryItemId, itemErr := lib.GetInventoryItemIdBySlug(dbPool, itemSlug)
+		if itemErr != nil {
+			respondWithShopAdminError(c, logger, itemErr, "Product not found")
+			return
+		}
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxProductImageUploadBytes)
+		form, formErr := c.MultipartForm()
+		if formErr != nil || len(form.File["images"]) == 0 || len(form.File["images"]) > lib.MaxProductImagesPerUpload {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "ERROR",
+				"message": fmt.Sprintf(
+					"Upload 1-%v images of up to %vMB in all", lib.MaxProductImagesPerUpload, maxProductImageUploadBytes>>20,
+				),
+			})
+			return
+		}
+
+		// Check them all first, then save them all and add them in one go, so a bad one doesn't leave
+		// the gallery half uploaded. Every file saved so far is removed if anything fails.
+		uploads := form.File["images"]
+		mimeTypes := make([]string, len(uploads))
+		for i, upload := range uploads {
+			mimeType, mimeTypeErr := getProductImageUploadMimeType(upload)
+			if mimeTypeErr != nil {
+				respondWithProductImageUploadError(c, logger, mimeTypeErr)
+				return
+			}
+			mimeTypes[i] = mimeType
+		}
+
+		imageInfos := make([]lib.SavedPostImageInfo, 0, len(uploads))
+		removeSavedFiles := func() {
+			for _, imageInfo := range imageInfos {
+				removeProductImageFiles(logger, imageInfo.Filename, imageInfo.ThumbnailFilename)
+			}
+		}
+		for i, upload := range uploads {
+			imageInfo, saveErr := saveProductImage(c, logger, itemSlug, upload, mimeTypes[i])
+			if saveErr != nil {
+				removeSavedFiles()
+				respondWithProductImageUploadError(c, logger, saveErr)
+				return
+			}
+			imageInfos = append(imageInfos, imageInfo)
+		}
+
+		images, addErr := lib.AddProductImages(dbPool, logger, inventoryItemId, imageInfos)
+		if addErr != nil {
+			removeSavedFiles()
+			respondWithShopAdminError(c, logger, addErr, "Product not found")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("%v images added", len(images)),
+			"results": gin.H{
+				"images": images,
+			},
+		})
+	})
+
+	// imageIds lists every one of the product's images in their new order
+	r.PUT("/api/v1/admin/products/:slug/images/order", func(c *gin.Context) {
+		var orderRequest lib.ProductImageOrderRequest
+		if !bindAndValidate(c, logger, &orderRequest) {
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		inventoryItemId, itemErr := lib.GetInventoryItemIdBySlug(dbPool, c.Param("slug"))
+		if itemErr != nil {
+			respondWithShopAdminError(c, logger, itemErr, "Product not found")
+			return
+		}
+
+		images, reorderErr := lib.ReorderProductImages(dbPool, logger, inventoryItemId, orderRequest.ImageIds)
+		if reorderErr != nil {
+			respondWithShopAdminError(c, logger, reorderErr, "Product not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Images reordered",
+			"results": gin.H{
+				"images": images,
+			},
+		})
+	})
+
+	r.PUT("/api/v1/admin/products/:slug/images/:id/primary", func(c *gin.Context) {
+		imageId, idErr := strconv.Atoi(c.Param("id"))
+		if idErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Invalid image id",
+			})
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		inventoryItemId, itemErr := lib.GetInventoryItemIdBySlug(dbPool, c.Param("slug"))
+		if itemErr != nil {
+			respondWithShopAdminError(c, logger, itemErr, "Product not found")
+			return
+		}
+
+		primaryErr := lib.SetPrimaryProductImage(dbPool, logger, inventoryItemId, imageId)
+		if primaryErr != nil {
+			respondWithShopAdminError(c, logger, primaryErr, "Image not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Primary image set",
+		})
+	})
+
+	r.DELETE("/api/v1/admin/products/:slug/images/:id", func(c *gin.Context) {
+		imageId, idErr := strconv.Atoi(c.Param("id"))
+		if idErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Invalid image id",
+			})
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		inventoryItemId, itemErr := lib.GetInventoryItemIdBySlug(dbPool, c.Param("slug"))
+		if itemErr != nil {
+			respondWithShopAdminError(c, logger, itemErr, "Product not found")
+			return
+		}
+
+		image, deleteErr := lib.DeleteProductImage(dbPool, logger, inventoryItemId, imageId)
+		if deleteErr != nil {
+			respondWithShopAdminError(c, logger, deleteErr, "Image not found")
+			return
+		}
+		removeProductImageFiles(logger, image.Filename, image.ThumbnailFilename)
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Image deleted",
+		})
+	})
+}
@@ -1,11 +1,13 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
 	"net/http"
 	"slices"
+	"strings"
 	"time"
 
 	"hotsauceshop/lib"
@@ -14,12 +16,16 @@ import (
 	"github.com/gin-contrib/cache/persistence"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 const CacheTimeProductPage = 15 * time.Minute
 const CacheTimeProductList = 15 * time.Minute
 
+// SortRecommended orders products by the signed-in user's heat profile
+const SortRecommended = "recommended"
+
 //nolint:funlen
 func Products(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger, store *persistence.InMemoryStore) {
 	r.GET("/api/v1/products/:slug", cache.CachePage(store, CacheTimeProductPage, func(c *gin.Context) {
@@ -46,39 +52,96 @@ func Products(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger, store *p
 			return
 		}
 
+		variants, variantsErr := lib.GetVariantsByInventoryItemId(dbPool, product.Id)
+		if variantsErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching variants: %v", variantsErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Error fetching variants: %v", variantsErr),
+			})
+			return
+		}
+
+		images, imagesErr := lib.GetProductImages(dbPool, product.Id)
+		if imagesErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching images: %v", imagesErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Error fetching images: %v", imagesErr),
+			})
+			return
+		}
+
+		results := gin.H{
+			"product":  product,
+			"tags":     tags,
+			"variants": variants,
+			"images":   images,
+		}
+		if product.IsBundle {
+			bundle, _, bundleErr := lib.GetBundle(dbPool, product)
+			if bundleErr != nil {
+				logger.Error(fmt.Sprintf("Error fetching bundle: %v", bundleErr))
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"status":  "ERROR",
+					"message": fmt.Sprintf("Error fetching bundle: %v", bundleErr),
+				})
+				return
+			}
+			results["bundle"] = bundle
+		}
+
 		c.JSON(http.StatusOK, gin.H{
-			"status": "OK",
-			"results": gin.H{
-				"product": product,
-				"tags":    tags,
-			},
+			"status":  "OK",
+			"results": results,
 		})
 	}))
 
-	r.GET("/api/v1/products", cache.CachePage(store, CacheTimeProductList, func(c *gin.Context) {
+	productList := func(c *gin.Context) {
 		paginationData := lib.GetValidPaginationData(c)
-		filterTags := c.DefaultQuery("tags", "")
-
-		tagIds := lib.ToIntArray(filterTags)
+		filters, filtersErr := getProductFilters(c)
+		if filtersErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": filtersErr.Error(),
+			})
+			return
+		}
 
 		// Validate sort
 		sort := c.DefaultQuery("sort", "name")
 		sorts := []string{
 			"name", "price", "spice_rating", "created_at",
-			"review_count", "average_rating", "average_spice_rating"}
+			"review_count", "average_rating", "average_spice_rating", SortRecommended}
 		if !slices.Contains(sorts, sort) {
 			sort = "name"
 		}
 
-		total, totalErr := lib.GetTotalInventoryItems(dbPool)
+		total, totalErr := lib.GetTotalInventoryItems(dbPool, filters)
 		if totalErr != nil {
 			log.Printf("Error getting total inventory items: %v", totalErr)
 		}
 
+		facets, facetsErr := lib.GetProductFacets(dbPool, filters)
+		if facetsErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching product facets: %v", facetsErr))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Error fetching product facets: %v", facetsErr),
+			})
+			return
+		}
+
 		var res gin.H
-		inventoryResults, err := lib.GetInventoryItemsOrderedBySortKey(
-			dbPool, logger, paginationData.PerPage, paginationData.Offset, sort, tagIds,
-		)
+		var inventoryResults []lib.InventoryItem
+		var err error
+		if sort == SortRecommended {
+			inventoryResults, err = getRecommendedInventoryItems(c, dbPool, logger, paginationData, filters)
+		} else {
+			inventoryResults, err = lib.GetInventoryItemsOrderedBySortKey(
+				dbPool, logger, paginationData.PerPage, paginationData.Offset, sort, filters,
+			)
+		}
 		if err != nil {
 			res = gin.H{
 				"status":  "ERROR",
@@ -93,9 +156,19 @@ func Products(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger, store *p
 			"results": gin.H{
 				"inventory": inventoryResults,
 				"total":     total,
+				"facets":    facets,
 			},
 		})
-	}))
+	}
+	cachedProductList := cache.CachePage(store, CacheTimeProductList, productList)
+	r.GET("/api/v1/products", func(c *gin.Context) {
+		// The recommended order is different for everyone, so it isn't cached
+		if c.Query("sort") == SortRecommended {
+			productList(c)
+			return
+		}
+		cachedProductList(c)
+	})
 
 	r.GET("/api/v1/products/autocomplete", func(c *gin.Context) {
 		searchQuery := c.DefaultQuery("q", "")
@@ -130,6 +203,37 @@ func Products(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger, store *p
 		})
 	})
 
+	r.GET("/api/v1/products/search", cache.CachePage(store, CacheTimeProductList, func(c *gin.Context) {
+		searchQuery := strings.TrimSpace(c.DefaultQuery("q", ""))
+		if len(searchQuery) == 0 || len(searchQuery) > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Search query must be between 1-100 characters",
+			})
+			return
+		}
+
+		paginationData := lib.GetValidPaginationData(c)
+		results, total, err := lib.SearchInventoryItems(
+			dbPool, logger, searchQuery, paginationData.PerPage, paginationData.Offset,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Error searching products: %v", err),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"products": results,
+				"total":    total,
+			},
+		})
+	}))
+
 	/*
 		- Attempt to parse request JSON
 		- Validate request
@@ -232,8 +336,38 @@ func Products(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger, store *p
 		})
 	})
 
-	// TODO: add product admin role check here
+	r.GET("/api/v1/products/:slug/recommendations", cache.CachePage(store, CacheTimeProductPage, func(c *gin.Context) {
+		recommendations, err := lib.GetRecommendations(dbPool, c.Param("slug"))
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "ERROR",
+				"message": "Inventory item not found.",
+			})
+			return
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("Error fetching recommendations: %v", err))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Error fetching recommendations: %v", err),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"recommendations": recommendations,
+			},
+		})
+	}))
+
+	// Shop admins only - saving a product also sets its stock
 	r.POST("/api/v1/products", func(c *gin.Context) {
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
 		itemUpdateRequest := lib.InventoryItemUpdateRequest{}
 		itemUpdateRequest, validationErr := lib.ValidateInventoryItemAddOrUpdateRequest(c, logger, itemUpdateRequest)
 		// Error responses handled in the above func
@@ -255,6 +389,13 @@ func Products(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger, store *p
 			logger.Error(fmt.Sprintf("Error updating product tags: %v", tagUpdateErr.Error()))
 		}
 
+		if itemUpdateRequest.StockQuantity != nil {
+			stockErr := lib.UpdateInventoryItemStock(dbPool, itemId, *itemUpdateRequest.StockQuantity)
+			if stockErr != nil {
+				logger.Error(fmt.Sprintf("Error updating product stock: %v", stockErr.Error()))
+			}
+		}
+
 		logger.Info(fmt.Sprintf("Inventory item tags updated: %v", itemUpdateRequest.TagIds))
 
 		c.JSON(http.StatusOK, gin.H{
@@ -267,6 +408,10 @@ func Products(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger, store *p
 	})
 
 	r.PUT("/api/v1/products/:slug", func(c *gin.Context) {
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
 		itemUpdateRequest := lib.InventoryItemUpdateRequest{}
 		itemUpdateRequest, validationErr := lib.ValidateInventoryItemAddOrUpdateRequest(c, logger, itemUpdateRequest)
 		if validationErr != nil {
@@ -308,6 +453,13 @@ func Products(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger, store *p
 			logger.Error(fmt.Sprintf("Error updating product tags: %v", tagUpdateErr.Error()))
 		}
 
+		if itemUpdateRequest.StockQuantity != nil {
+			stockErr := lib.UpdateInventoryItemStock(dbPool, itemId, *itemUpdateRequest.StockQuantity)
+			if stockErr != nil {
+				logger.Error(fmt.Sprintf("Error updating product stock: %v", stockErr.Error()))
+			}
+		}
+
 		// TODO: add websocket event for item updates here
 
 		c.JSON(http.StatusOK, gin.H{
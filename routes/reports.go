@@ -0,0 +1,42 @@
+package routes
+
+import (
+	"log/slog"
+	"net/http"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func Reports(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+	// Carts abandoned, and recovered by an order, between the optional from and to dates (YYYY-MM-DD, inclusive)
+	r.GET("/api/v1/admin/reports/abandoned-carts", func(c *gin.Context) {
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		createdAfter, createdBefore, dateRangeErr := getDateRangeFilter(c)
+		if dateRangeErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": dateRangeErr.Error(),
+			})
+			return
+		}
+
+		report, reportErr := lib.GetAbandonedCartReport(dbPool, createdAfter, createdBefore)
+		if reportErr != nil {
+			respondWithShopAdminError(c, logger, reportErr, "Report not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"report": report,
+			},
+		})
+	})
+}
@@ -0,0 +1,310 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// respondWithReturnError maps errors from the return workflow onto responses
+func respondWithReturnError(c *gin.Context, logger *slog.Logger, err error, notFoundMessage string) {
+	var badRequestErr *lib.StatusBadRequestError
+	if errors.As(err, &badRequestErr) {
+		logger.Error(fmt.Sprintf("Return rejected: %v", badRequestErr.Message))
+		c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+			Status:    "ERROR",
+			Message:   badRequestErr.Message,
+			ErrorCode: badRequestErr.ErrorCode,
+		})
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status":  "ERROR",
+			"message": notFoundMessage,
+		})
+		return
+	}
+	logger.Error(fmt.Sprintf("Error processing return: %v", err))
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"status":  "ERROR",
+		"message": "Error processing return",
+	})
+}
+
+//nolint:funlen
+func Returns(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger, paymentProvider lib.PaymentProvider) {
+	/*
+		Request a return
+		1. Validate request
+		2. Get user from sessionId
+		3. Check the order is delivered and the lines can still be returned
+	*/
+	r.POST("/api/v1/orders/:orderNumber/returns", func(c *gin.Context) {
+		var requestReturnRequest lib.RequestReturnRequest
+		if err := c.ShouldBindJSON(&requestReturnRequest); err != nil {
+			logger.Error(fmt.Sprintf("Malformed return request: %v", err.Error()))
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Malformed request body.",
+			})
+			return
+		}
+
+		validate := validator.New(validator.WithRequiredStructEnabled())
+		err := validate.Struct(requestReturnRequest)
+		if err != nil {
+			logger.Error(err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Validation failed: %v", err),
+			})
+			return
+		}
+
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		newReturn, returnErr := lib.RequestReturn(
+			dbPool, logger, userId, c.Param("orderNumber"), requestReturnRequest,
+		)
+		if returnErr != nil {
+			respondWithReturnError(c, logger, returnErr, "Order not found")
+			return
+		}
+
+		returnDetail, returnDetailErr := lib.GetReturnDetail(dbPool, newReturn)
+		if returnDetailErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching return detail: %v", returnDetailErr))
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Return %v requested", newReturn.ReturnNumber),
+			"results": returnDetail,
+		})
+	})
+
+	// Returns on one of the signed-in user's orders
+	r.GET("/api/v1/orders/:orderNumber/returns", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		order, orderErr := lib.GetOrderByOrderNumber(dbPool, c.Param("orderNumber"))
+		if orderErr == nil && order.UserId != userId {
+			orderErr = pgx.ErrNoRows
+		}
+		if orderErr != nil {
+			respondWithReturnError(c, logger, orderErr, "Order not found")
+			return
+		}
+
+		returns, returnsErr := lib.GetReturnsByOrderId(dbPool, order.Id)
+		if returnsErr != nil {
+			respondWithReturnError(c, logger, returnsErr, "Order not found")
+			return
+		}
+
+		returnDetails := make([]lib.ReturnDetail, 0, len(returns))
+		for _, existingReturn := range returns {
+			returnDetail, returnDetailErr := lib.GetReturnDetail(dbPool, existingReturn)
+			if returnDetailErr != nil {
+				respondWithReturnError(c, logger, returnDetailErr, "Return not found")
+				return
+			}
+			returnDetails = append(returnDetails, returnDetail)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"returns": returnDetails,
+			},
+		})
+	})
+
+	// All returns, optionally filtered by status
+	r.GET("/api/v1/admin/returns", func(c *gin.Context) {
+		if !isOrderAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		status := c.DefaultQuery("status", "")
+		if len(status) > 0 && !lib.IsValidReturnStatus(status) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("invalid status: %v", status),
+			})
+			return
+		}
+
+		paginationData := lib.GetValidPaginationData(c)
+		returns, returnsErr := lib.GetReturns(dbPool, status, paginationData)
+		if returnsErr != nil {
+			respondWithReturnError(c, logger, returnsErr, "Returns not found")
+			return
+		}
+
+		total, totalErr := lib.GetTotalReturns(dbPool, status)
+		if totalErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching total returns: %v", totalErr))
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"returns": returns,
+				"total":   total,
+			},
+		})
+	})
+
+	r.GET("/api/v1/admin/returns/:returnNumber", func(c *gin.Context) {
+		if !isOrderAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		existingReturn, returnErr := lib.GetReturnByReturnNumber(dbPool, c.Param("returnNumber"))
+		if returnErr != nil {
+			respondWithReturnError(c, logger, returnErr, "Return not found")
+			return
+		}
+
+		returnDetail, returnDetailErr := lib.GetReturnDetail(dbPool, existingReturn)
+		if returnDetailErr != nil {
+			respondWithReturnError(c, logger, returnDetailErr, "Return not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"results": returnDetail,
+		})
+	})
+
+	// Approve, reject or mark a return as received
+	r.PUT("/api/v1/admin/returns/:returnNumber/status", func(c *gin.Context) {
+		var updateReturnStatusRequest lib.UpdateReturnStatusRequest
+		if err := c.ShouldBindJSON(&updateReturnStatusRequest); err != nil {
+			logger.Error(err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Update request malformed: %v", err.Error()),
+			})
+			return
+		}
+
+		validate := validator.New(validator.WithRequiredStructEnabled())
+		validationErr := validate.Struct(updateReturnStatusRequest)
+		if validationErr != nil {
+			logger.Error(validationErr.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Validation failed: %v", validationErr),
+			})
+			return
+		}
+
+		if !isOrderAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		adminUserId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || adminUserId == 0 {
+			return
+		}
+
+		updatedReturn, updateErr := lib.UpdateReturnStatus(
+			dbPool,
+			logger,
+			c.Param("returnNumber"),
+			updateReturnStatusRequest.Status,
+			updateReturnStatusRequest.Note,
+			adminUserId,
+		)
+		if updateErr != nil {
+			respondWithReturnError(c, logger, updateErr, "Return not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Return %v moved to %v", updatedReturn.ReturnNumber, updatedReturn.Status),
+			"results": gin.H{
+				"return": updatedReturn,
+			},
+		})
+	})
+
+	/*
+		Record a refund for a received return
+		- With no lines every line is refunded in full
+		- The refund goes back onto any gift cards the order was paid with, then through the payment provider
+		- A return left refund pending by a provider error is retried by posting again
+	*/
+	r.POST("/api/v1/admin/returns/:returnNumber/refunds", func(c *gin.Context) {
+		var refundReturnRequest lib.RefundReturnRequest
+		if err := c.ShouldBindJSON(&refundReturnRequest); err != nil {
+			logger.Error(err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Refund request malformed: %v", err.Error()),
+			})
+			return
+		}
+
+		validate := validator.New(validator.WithRequiredStructEnabled())
+		validationErr := validate.Struct(refundReturnRequest)
+		if validationErr != nil {
+			logger.Error(validationErr.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": fmt.Sprintf("Validation failed: %v", validationErr),
+			})
+			return
+		}
+
+		if !isOrderAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		adminUserId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || adminUserId == 0 {
+			return
+		}
+
+		refundedReturn, refundTotal, refundErr := lib.RefundReturn(
+			dbPool, logger, paymentProvider, c.Param("returnNumber"), refundReturnRequest, adminUserId,
+		)
+		if refundErr != nil {
+			respondWithReturnError(c, logger, refundErr, "Return not found")
+			return
+		}
+
+		returnDetail, returnDetailErr := lib.GetReturnDetail(dbPool, refundedReturn)
+		if returnDetailErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching return detail: %v", returnDetailErr))
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Refunded %v on return %v", refundTotal, refundedReturn.ReturnNumber),
+			"results": gin.H{
+				"return":           returnDetail,
+				"refundTotalCents": refundTotal,
+			},
+		})
+	})
+}
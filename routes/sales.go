@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//nolint:funlen
+func Sales(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+	// The item's list price changes and its sales, past, running and scheduled
+	r.GET("/api/v1/admin/products/:slug/price-history", func(c *gin.Context) {
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		inventoryItemId, itemErr := lib.GetInventoryItemIdBySlug(dbPool, c.Param("slug"))
+		if itemErr != nil {
+			respondWithShopAdminError(c, logger, itemErr, "Product not found")
+			return
+		}
+
+		priceHistory, historyErr := lib.GetPriceHistory(dbPool, inventoryItemId)
+		if historyErr != nil {
+			respondWithShopAdminError(c, logger, historyErr, "Product not found")
+			return
+		}
+		sales, salesErr := lib.GetSales(dbPool, inventoryItemId)
+		if salesErr != nil {
+			respondWithShopAdminError(c, logger, salesErr, "Product not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"priceHistory": priceHistory,
+				"sales":        sales,
+			},
+		})
+	})
+
+	// Put a variant on sale between startsAt (now if left out) and endsAt
+	r.POST("/api/v1/admin/products/:slug/sales", func(c *gin.Context) {
+		var saleRequest lib.SaleRequest
+		if !bindAndValidate(c, logger, &saleRequest) {
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		inventoryItemId, itemErr := lib.GetInventoryItemIdBySlug(dbPool, c.Param("slug"))
+		if itemErr != nil {
+			respondWithShopAdminError(c, logger, itemErr, "Product not found")
+			return
+		}
+
+		sale, saleErr := lib.ScheduleSale(dbPool, logger, inventoryItemId, saleRequest)
+		if saleErr != nil {
+			respondWithShopAdminError(c, logger, saleErr, "Product not found")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Sale scheduled for %v", sale.Sku),
+			"results": gin.H{
+				"sale": sale,
+			},
+		})
+	})
+
+	// Ends a running sale now, or cancels one that hasn't started
+	r.DELETE("/api/v1/admin/products/:slug/sales/:id", func(c *gin.Context) {
+		saleId, idErr := strconv.Atoi(c.Param("id"))
+		if idErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Invalid sale id",
+			})
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		inventoryItemId, itemErr := lib.GetInventoryItemIdBySlug(dbPool, c.Param("slug"))
+		if itemErr != nil {
+			respondWithShopAdminError(c, logger, itemErr, "Product not found")
+			return
+		}
+
+		endErr := lib.EndSale(dbPool, inventoryItemId, saleId)
+		if endErr != nil {
+			respondWithShopAdminError(c, logger, endErr, "Sale not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Sale ended",
+		})
+	})
+}
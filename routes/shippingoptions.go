@@ -0,0 +1,98 @@
+package routes
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//nolint:funlen
+func ShippingOptions(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+	r.POST("/api/v1/admin/shipping-options", func(c *gin.Context) {
+		var shippingOptionRequest lib.ShippingOptionRequest
+		if !bindAndValidate(c, logger, &shippingOptionRequest) {
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		shippingOption, addErr := lib.AddShippingOption(dbPool, shippingOptionRequest)
+		if addErr != nil {
+			respondWithShopAdminError(c, logger, addErr, "Shipping option not found")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Shipping option %v created", shippingOption.Name),
+			"results": gin.H{
+				"shippingOption": shippingOption,
+			},
+		})
+	})
+
+	r.PUT("/api/v1/admin/shipping-options/:id", func(c *gin.Context) {
+		shippingOptionId, idErr := strconv.Atoi(c.Param("id"))
+		if idErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Invalid shipping option id",
+			})
+			return
+		}
+
+		var shippingOptionRequest lib.ShippingOptionRequest
+		if !bindAndValidate(c, logger, &shippingOptionRequest) {
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		shippingOption, updateErr := lib.UpdateShippingOption(dbPool, shippingOptionId, shippingOptionRequest)
+		if updateErr != nil {
+			respondWithShopAdminError(c, logger, updateErr, "Shipping option not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Shipping option %v updated", shippingOption.Name),
+			"results": gin.H{
+				"shippingOption": shippingOption,
+			},
+		})
+	})
+
+	r.DELETE("/api/v1/admin/shipping-options/:id", func(c *gin.Context) {
+		shippingOptionId, idErr := strconv.Atoi(c.Param("id"))
+		if idErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Invalid shipping option id",
+			})
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		deleteErr := lib.DeleteShippingOption(dbPool, shippingOptionId)
+		if deleteErr != nil {
+			respondWithShopAdminError(c, logger, deleteErr, "Shipping option not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Shipping option deleted",
+		})
+	})
+}
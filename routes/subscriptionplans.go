@@ -0,0 +1,89 @@
+package routes
+
+import (
+	"log/slog"
+	"net/http"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//nolint:funlen
+func SubscriptionPlans(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+	// Every subscription plan, including ones no longer offered
+	r.GET("/api/v1/admin/subscription-plans", func(c *gin.Context) {
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		plans, plansErr := lib.GetSubscriptionPlans(dbPool, true)
+		if plansErr != nil {
+			respondWithShopAdminError(c, logger, plansErr, "Subscription plan not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"plans": plans,
+			},
+		})
+	})
+
+	r.POST("/api/v1/admin/subscription-plans", func(c *gin.Context) {
+		var planRequest lib.SubscriptionPlanRequest
+		if !bindAndValidate(c, logger, &planRequest) {
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		plan, saveErr := lib.SaveSubscriptionPlan(dbPool, logger, 0, planRequest)
+		if saveErr != nil {
+			respondWithShopAdminError(c, logger, saveErr, "Subscription plan not found")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "OK",
+			"message": "Subscription plan created",
+			"results": gin.H{
+				"plan": plan,
+			},
+		})
+	})
+
+	// Replaces the plan's items. Subscribers get them from their next shipment on.
+	r.PUT("/api/v1/admin/subscription-plans/:slug", func(c *gin.Context) {
+		var planRequest lib.SubscriptionPlanRequest
+		if !bindAndValidate(c, logger, &planRequest) {
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		planId, planIdErr := lib.GetSubscriptionPlanIdBySlug(dbPool, c.Param("slug"))
+		if planIdErr != nil {
+			respondWithShopAdminError(c, logger, planIdErr, "Subscription plan not found")
+			return
+		}
+
+		plan, saveErr := lib.SaveSubscriptionPlan(dbPool, logger, planId, planRequest)
+		if saveErr != nil {
+			respondWithShopAdminError(c, logger, saveErr, "Subscription plan not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Subscription plan updated",
+			"results": gin.H{
+				"plan": plan,
+			},
+		})
+	})
+}
@@ -0,0 +1,251 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// respondWithSubscriptionError maps errors from subscription management onto responses
+func respondWithSubscriptionError(c *gin.Context, logger *slog.Logger, err error) {
+	var badRequestErr *lib.StatusBadRequestError
+	if errors.As(err, &badRequestErr) {
+		logger.Error(fmt.Sprintf("Subscription request rejected: %v", badRequestErr.Message))
+		c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+			Status:    "ERROR",
+			Message:   badRequestErr.Message,
+			ErrorCode: badRequestErr.ErrorCode,
+		})
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status":  "ERROR",
+			"message": "Subscription not found",
+		})
+		return
+	}
+	logger.Error(fmt.Sprintf("Error processing subscription: %v", err))
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"status":  "ERROR",
+		"message": "Error processing subscription",
+	})
+}
+
+//nolint:funlen
+func Subscriptions(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger, paymentProvider lib.PaymentProvider) {
+	// Plans that can be subscribed to, with what's in the box
+	r.GET("/api/v1/subscription-plans", func(c *gin.Context) {
+		plans, plansErr := lib.GetSubscriptionPlans(dbPool, false)
+		if plansErr != nil {
+			respondWithSubscriptionError(c, logger, plansErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"plans": plans,
+			},
+		})
+	})
+
+	// The signed-in user's subscriptions, cancelled ones last
+	r.GET("/api/v1/subscriptions", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		subscriptions, subscriptionsErr := lib.GetSubscriptionsByUserId(dbPool, userId)
+		if subscriptionsErr != nil {
+			respondWithSubscriptionError(c, logger, subscriptionsErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"subscriptions": subscriptions,
+			},
+		})
+	})
+
+	/*
+		Subscribe
+		1. Validate request
+		2. Get user from sessionId
+		3. Save the card with the payment provider and start the subscription. The first box is charged
+		   for and shipped on the next run of the subscription job.
+	*/
+	r.POST("/api/v1/subscriptions", func(c *gin.Context) {
+		var subscribeRequest lib.SubscribeRequest
+		if !bindAndValidate(c, logger, &subscribeRequest) {
+			return
+		}
+
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		subscription, subscribeErr := lib.Subscribe(dbPool, logger, paymentProvider, userId, subscribeRequest)
+		if subscribeErr != nil {
+			respondWithSubscriptionError(c, logger, subscribeErr)
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "OK",
+			"message": "Subscribed",
+			"results": gin.H{
+				"subscription": subscription,
+			},
+		})
+	})
+
+	// Subscription detail with its shipments - users can only see their own subscriptions
+	r.GET("/api/v1/subscriptions/:id", func(c *gin.Context) {
+		subscriptionId, userId, ok := getIdParamAndUserIdOrError(c, dbPool, logger, "subscription")
+		if !ok {
+			return
+		}
+
+		subscription, subscriptionErr := lib.GetUserSubscription(dbPool, userId, subscriptionId)
+		if subscriptionErr != nil {
+			respondWithSubscriptionError(c, logger, subscriptionErr)
+			return
+		}
+		shipments, shipmentsErr := lib.GetSubscriptionShipments(dbPool, subscription.Id)
+		if shipmentsErr != nil {
+			respondWithSubscriptionError(c, logger, shipmentsErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"subscription": subscription,
+				"shipments":    shipments,
+			},
+		})
+	})
+
+	// Pause, resume and cancel share a handler. A cancelled subscription is kept for its shipment history.
+	updateStatus := func(toStatus string) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			subscriptionId, userId, ok := getIdParamAndUserIdOrError(c, dbPool, logger, "subscription")
+			if !ok {
+				return
+			}
+
+			subscription, updateErr := lib.UpdateSubscriptionStatus(dbPool, logger, userId, subscriptionId, toStatus)
+			if updateErr != nil {
+				respondWithSubscriptionError(c, logger, updateErr)
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"status":  "OK",
+				"message": fmt.Sprintf("Subscription %v", subscription.Status),
+				"results": gin.H{
+					"subscription": subscription,
+				},
+			})
+		}
+	}
+	r.PUT("/api/v1/subscriptions/:id/pause", updateStatus(lib.SubscriptionStatusPaused))
+	r.PUT("/api/v1/subscriptions/:id/resume", updateStatus(lib.SubscriptionStatusActive))
+	r.DELETE("/api/v1/subscriptions/:id", updateStatus(lib.SubscriptionStatusCancelled))
+
+	// Skip the next cycle. nextShipmentOn moves on by one interval.
+	r.POST("/api/v1/subscriptions/:id/skip", func(c *gin.Context) {
+		subscriptionId, userId, ok := getIdParamAndUserIdOrError(c, dbPool, logger, "subscription")
+		if !ok {
+			return
+		}
+
+		shipment, skipErr := lib.SkipSubscriptionCycle(dbPool, logger, userId, subscriptionId)
+		if skipErr != nil {
+			respondWithSubscriptionError(c, logger, skipErr)
+			return
+		}
+		subscription, subscriptionErr := lib.GetUserSubscription(dbPool, userId, subscriptionId)
+		if subscriptionErr != nil {
+			respondWithSubscriptionError(c, logger, subscriptionErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Cycle skipped",
+			"results": gin.H{
+				"subscription": subscription,
+				"shipment":     shipment,
+			},
+		})
+	})
+
+	// Change plan, and optionally shipping option, from the next cycle on
+	r.PUT("/api/v1/subscriptions/:id/plan", func(c *gin.Context) {
+		var changePlanRequest lib.ChangeSubscriptionPlanRequest
+		if !bindAndValidate(c, logger, &changePlanRequest) {
+			return
+		}
+
+		subscriptionId, userId, ok := getIdParamAndUserIdOrError(c, dbPool, logger, "subscription")
+		if !ok {
+			return
+		}
+
+		subscription, changeErr := lib.ChangeSubscriptionPlan(dbPool, logger, userId, subscriptionId, changePlanRequest)
+		if changeErr != nil {
+			respondWithSubscriptionError(c, logger, changeErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Subscription changed to %v", subscription.PlanName),
+			"results": gin.H{
+				"subscription": subscription,
+			},
+		})
+	})
+
+	// Replace the card each cycle is charged to. Resume a subscription paused by declined charges afterwards.
+	r.PUT("/api/v1/subscriptions/:id/card", func(c *gin.Context) {
+		var cardRequest lib.SubscriptionCardRequest
+		if !bindAndValidate(c, logger, &cardRequest) {
+			return
+		}
+
+		subscriptionId, userId, ok := getIdParamAndUserIdOrError(c, dbPool, logger, "subscription")
+		if !ok {
+			return
+		}
+
+		subscription, updateErr := lib.UpdateSubscriptionCard(
+			dbPool, logger, paymentProvider, userId, subscriptionId, cardRequest.Card,
+		)
+		if updateErr != nil {
+			respondWithSubscriptionError(c, logger, updateErr)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Card updated",
+			"results": gin.H{
+				"subscription": subscription,
+			},
+		})
+	})
+}
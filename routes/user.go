@@ -13,7 +13,7 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func User(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+func User(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger, guestCarts lib.GuestCarts) {
 	r.GET("/api/v1/user", func(c *gin.Context) {
 		isUserAdmin, isUserAdminErr := lib.IsUserAdmin(c, dbPool, logger)
 		if isUserAdminErr != nil {
@@ -99,6 +99,18 @@ func User(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
 
 		logger.Info(fmt.Sprintf("User post vote sum: %v", userPostVoteSum))
 
+		// Only users looking at their own profile see their heat profile
+		var heatProfile *lib.HeatProfile
+		signedInUserId, _ := lib.GetUserIdFromSession(c, dbPool, logger)
+		if signedInUserId == user.Id {
+			profile, heatProfileErr := lib.GetHeatProfile(dbPool, user.Id)
+			if heatProfileErr != nil {
+				logger.Error(fmt.Sprintf("Error fetching heat profile: %v", heatProfileErr.Error()))
+			} else {
+				heatProfile = &profile
+			}
+		}
+
 		c.JSON(http.StatusOK, lib.UserProfileResponse{
 			Status: "OK",
 			Results: lib.UserProfileResponseResults{
@@ -107,10 +119,59 @@ func User(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
 				UserPostCount:       userPostCount,
 				UserPostVoteSum:     userPostVoteSum,
 				UserModeratedBoards: userModeratedBoards,
+				HeatProfile:         heatProfile,
+			},
+		})
+	})
+
+	// Get the signed-in user's heat profile
+	r.GET("/api/v1/user/heat-profile", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		heatProfile, heatProfileErr := lib.GetHeatProfile(dbPool, userId)
+		if heatProfileErr != nil {
+			logger.Error(fmt.Sprintf("Error fetching heat profile: %v", heatProfileErr.Error()))
+			c.JSON(http.StatusInternalServerError, lib.GenericResponse{
+				Status:  "ERROR",
+				Message: "Error fetching heat profile",
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"heatProfile": heatProfile,
 			},
 		})
 	})
 
+	// Reset the signed-in user's heat profile
+	r.DELETE("/api/v1/user/heat-profile", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		resetErr := lib.ResetHeatProfile(dbPool, userId)
+		if resetErr != nil {
+			logger.Error(fmt.Sprintf("Error resetting heat profile: %v", resetErr.Error()))
+			c.JSON(http.StatusInternalServerError, lib.GenericResponse{
+				Status:  "ERROR",
+				Message: "Error resetting heat profile",
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, lib.GenericResponse{
+			Status:  "OK",
+			Message: "Heat profile reset",
+		})
+	})
+
 	// Sign in
 	r.POST("/api/v1/user/sign-in", func(c *gin.Context) {
 		loginRequest := lib.LoginRequest{}
@@ -153,12 +214,15 @@ func User(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
 			return
 		}
 
+		mergedCartItems := mergeGuestCartOnSignIn(c, dbPool, logger, guestCarts, verifiedUser.Id)
+
 		c.JSON(http.StatusOK, lib.SignInResponse{
 			Status:  "OK",
 			Message: "Sign in successful",
 			Results: lib.SignInResponseResults{
-				SessionId: sessionId,
-				User:      verifiedUser,
+				SessionId:       sessionId,
+				User:            verifiedUser,
+				MergedCartItems: mergedCartItems,
 			},
 		})
 	})
@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"testing"
 
 	"hotsauceshop/lib"
@@ -41,6 +42,26 @@ func GetUserIdFromSessionOrError(c *gin.Context, dbPool *pgxpool.Pool, logger *s
 	return userId, nil
 }
 
+// getIdParamAndUserIdOrError reads the :id param and the signed-in user, responding with an
+// error and returning false if either is invalid. resourceName is used in the error message.
+func getIdParamAndUserIdOrError(
+	c *gin.Context, dbPool *pgxpool.Pool, logger *slog.Logger, resourceName string,
+) (int, int, bool) {
+	id, idErr := strconv.Atoi(c.Param("id"))
+	if idErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "ERROR",
+			"message": fmt.Sprintf("Invalid %v id", resourceName),
+		})
+		return 0, 0, false
+	}
+	userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+	if userSessionErr != nil || userId == 0 {
+		return 0, 0, false
+	}
+	return id, userId, true
+}
+
 func CreateUserAndVerify(request CreateUserRequest) lib.UserCreateResponse {
 	var userCreateResponse lib.UserCreateResponse
 	request.E.POST("/api/v1/user").
@@ -0,0 +1,116 @@
+package routes
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//nolint:funlen
+func Variants(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+	r.POST("/api/v1/admin/products/:slug/variants", func(c *gin.Context) {
+		var variantRequest lib.VariantRequest
+		if !bindAndValidate(c, logger, &variantRequest) {
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		inventoryItemId, itemErr := lib.GetInventoryItemIdBySlug(dbPool, c.Param("slug"))
+		if itemErr != nil {
+			respondWithShopAdminError(c, logger, itemErr, "Product not found")
+			return
+		}
+
+		variant, saveErr := lib.SaveVariant(dbPool, logger, inventoryItemId, 0, variantRequest)
+		if saveErr != nil {
+			respondWithShopAdminError(c, logger, saveErr, "Variant not found")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Variant %v created", variant.Sku),
+			"results": gin.H{
+				"variant": variant,
+			},
+		})
+	})
+
+	r.PUT("/api/v1/admin/products/:slug/variants/:id", func(c *gin.Context) {
+		variantId, idErr := strconv.Atoi(c.Param("id"))
+		if idErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Invalid variant id",
+			})
+			return
+		}
+
+		var variantRequest lib.VariantRequest
+		if !bindAndValidate(c, logger, &variantRequest) {
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		inventoryItemId, itemErr := lib.GetInventoryItemIdBySlug(dbPool, c.Param("slug"))
+		if itemErr != nil {
+			respondWithShopAdminError(c, logger, itemErr, "Product not found")
+			return
+		}
+
+		variant, saveErr := lib.SaveVariant(dbPool, logger, inventoryItemId, variantId, variantRequest)
+		if saveErr != nil {
+			respondWithShopAdminError(c, logger, saveErr, "Variant not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Variant %v updated", variant.Sku),
+			"results": gin.H{
+				"variant": variant,
+			},
+		})
+	})
+
+	r.DELETE("/api/v1/admin/products/:slug/variants/:id", func(c *gin.Context) {
+		variantId, idErr := strconv.Atoi(c.Param("id"))
+		if idErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "ERROR",
+				"message": "Invalid variant id",
+			})
+			return
+		}
+		if !isShopAdminOrError(c, dbPool, logger) {
+			return
+		}
+
+		inventoryItemId, itemErr := lib.GetInventoryItemIdBySlug(dbPool, c.Param("slug"))
+		if itemErr != nil {
+			respondWithShopAdminError(c, logger, itemErr, "Product not found")
+			return
+		}
+
+		deleteErr := lib.DeleteVariant(dbPool, inventoryItemId, variantId)
+		if deleteErr != nil {
+			respondWithShopAdminError(c, logger, deleteErr, "Variant not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Variant deleted",
+		})
+	})
+}
@@ -0,0 +1,305 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"hotsauceshop/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// respondWithWishlistError maps errors from wishlist management onto responses
+func respondWithWishlistError(c *gin.Context, logger *slog.Logger, err error, notFoundMessage string) {
+	var badRequestErr *lib.StatusBadRequestError
+	if errors.As(err, &badRequestErr) {
+		logger.Error(fmt.Sprintf("Wishlist request rejected: %v", badRequestErr.Message))
+		c.JSON(badRequestErr.StatusCode, lib.GenericResponseWithErrorCode{
+			Status:    "ERROR",
+			Message:   badRequestErr.Message,
+			ErrorCode: badRequestErr.ErrorCode,
+		})
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status":  "ERROR",
+			"message": notFoundMessage,
+		})
+		return
+	}
+	logger.Error(fmt.Sprintf("Error processing wishlist: %v", err))
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"status":  "ERROR",
+		"message": "Error processing wishlist",
+	})
+}
+
+// getWishlistItemIdOrError responds with 400 and returns false if :itemId isn't a number
+func getWishlistItemIdOrError(c *gin.Context) (int, bool) {
+	wishlistItemId, idErr := strconv.Atoi(c.Param("itemId"))
+	if idErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "ERROR",
+			"message": "Invalid wishlist item id",
+		})
+		return 0, false
+	}
+	return wishlistItemId, true
+}
+
+//nolint:funlen
+func Wishlists(r *gin.Engine, dbPool *pgxpool.Pool, logger *slog.Logger) {
+	// The signed-in user's wishlists, with how many items are on each
+	r.GET("/api/v1/wishlists", func(c *gin.Context) {
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		wishlists, wishlistsErr := lib.GetWishlistsByUserId(dbPool, userId)
+		if wishlistsErr != nil {
+			respondWithWishlistError(c, logger, wishlistsErr, "Wishlist not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"wishlists": wishlists,
+			},
+		})
+	})
+
+	r.POST("/api/v1/wishlists", func(c *gin.Context) {
+		var wishlistRequest lib.WishlistRequest
+		if !bindAndValidate(c, logger, &wishlistRequest) {
+			return
+		}
+
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		wishlist, createErr := lib.CreateWishlist(dbPool, logger, userId, wishlistRequest)
+		if createErr != nil {
+			respondWithWishlistError(c, logger, createErr, "Wishlist not found")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("Wishlist %v created", wishlist.Name),
+			"results": gin.H{
+				"wishlist": wishlist,
+			},
+		})
+	})
+
+	// Wishlist detail - users can only see their own wishlists here; shared ones are under /shared-wishlists
+	r.GET("/api/v1/wishlists/:id", func(c *gin.Context) {
+		wishlistId, userId, ok := getIdParamAndUserIdOrError(c, dbPool, logger, "wishlist")
+		if !ok {
+			return
+		}
+
+		wishlist, wishlistErr := lib.GetUserWishlist(dbPool, userId, wishlistId)
+		if wishlistErr != nil {
+			respondWithWishlistError(c, logger, wishlistErr, "Wishlist not found")
+			return
+		}
+		items, itemsErr := lib.GetWishlistItems(dbPool, wishlist.Id)
+		if itemsErr != nil {
+			respondWithWishlistError(c, logger, itemsErr, "Wishlist not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"wishlist": wishlist,
+				"items":    items,
+			},
+		})
+	})
+
+	// Rename, or share and stop sharing, a wishlist
+	r.PUT("/api/v1/wishlists/:id", func(c *gin.Context) {
+		var wishlistRequest lib.WishlistRequest
+		if !bindAndValidate(c, logger, &wishlistRequest) {
+			return
+		}
+
+		wishlistId, userId, ok := getIdParamAndUserIdOrError(c, dbPool, logger, "wishlist")
+		if !ok {
+			return
+		}
+
+		wishlist, updateErr := lib.UpdateWishlist(dbPool, userId, wishlistId, wishlistRequest)
+		if updateErr != nil {
+			respondWithWishlistError(c, logger, updateErr, "Wishlist not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Wishlist updated",
+			"results": gin.H{
+				"wishlist": wishlist,
+			},
+		})
+	})
+
+	r.DELETE("/api/v1/wishlists/:id", func(c *gin.Context) {
+		wishlistId, userId, ok := getIdParamAndUserIdOrError(c, dbPool, logger, "wishlist")
+		if !ok {
+			return
+		}
+
+		deleteErr := lib.DeleteWishlist(dbPool, userId, wishlistId)
+		if deleteErr != nil {
+			respondWithWishlistError(c, logger, deleteErr, "Wishlist not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Wishlist deleted",
+		})
+	})
+
+	// Save an item to a wishlist. Saving a variant that's already there replaces its quantity.
+	r.POST("/api/v1/wishlists/:id/items", func(c *gin.Context) {
+		var addItemRequest lib.AddWishlistItemRequest
+		if !bindAndValidate(c, logger, &addItemRequest) {
+			return
+		}
+
+		wishlistId, userId, ok := getIdParamAndUserIdOrError(c, dbPool, logger, "wishlist")
+		if !ok {
+			return
+		}
+
+		wishlistItem, addErr := lib.AddWishlistItem(dbPool, logger, userId, wishlistId, addItemRequest)
+		if addErr != nil {
+			respondWithWishlistError(c, logger, addErr, "Wishlist not found")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("%v saved", wishlistItem.Name),
+			"results": gin.H{
+				"wishlistItem": wishlistItem,
+			},
+		})
+	})
+
+	r.DELETE("/api/v1/wishlists/:id/items/:itemId", func(c *gin.Context) {
+		wishlistItemId, ok := getWishlistItemIdOrError(c)
+		if !ok {
+			return
+		}
+		wishlistId, userId, ok := getIdParamAndUserIdOrError(c, dbPool, logger, "wishlist")
+		if !ok {
+			return
+		}
+
+		deleteErr := lib.DeleteWishlistItem(dbPool, userId, wishlistId, wishlistItemId)
+		if deleteErr != nil {
+			respondWithWishlistError(c, logger, deleteErr, "Wishlist item not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": "Wishlist item removed",
+		})
+	})
+
+	/*
+		Move a wishlist item to the cart
+		1. Get user from sessionId
+		2. Add the item's quantity to the cart, checking stock
+		3. Take it off the wishlist
+	*/
+	r.POST("/api/v1/wishlists/:id/items/:itemId/move-to-cart", func(c *gin.Context) {
+		wishlistItemId, ok := getWishlistItemIdOrError(c)
+		if !ok {
+			return
+		}
+		wishlistId, userId, ok := getIdParamAndUserIdOrError(c, dbPool, logger, "wishlist")
+		if !ok {
+			return
+		}
+
+		cartItem, moveErr := lib.MoveWishlistItemToCart(dbPool, logger, userId, wishlistId, wishlistItemId)
+		if moveErr != nil {
+			respondWithWishlistError(c, logger, moveErr, "Wishlist item not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("%v moved to cart", cartItem.DisplayName()),
+			"results": gin.H{
+				"cartItem": cartItem,
+			},
+		})
+	})
+
+	// Save a cart line for later, to the wishlist given or the user's "Saved for later" list
+	r.POST("/api/v1/cart/save-for-later", func(c *gin.Context) {
+		var saveForLaterRequest lib.SaveForLaterRequest
+		if !bindAndValidate(c, logger, &saveForLaterRequest) {
+			return
+		}
+
+		userId, userSessionErr := GetUserIdFromSessionOrError(c, dbPool, logger)
+		if userSessionErr != nil || userId == 0 {
+			return
+		}
+
+		wishlistItem, saveErr := lib.SaveCartItemForLater(dbPool, logger, userId, saveForLaterRequest)
+		if saveErr != nil {
+			respondWithWishlistError(c, logger, saveErr, "Wishlist not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "OK",
+			"message": fmt.Sprintf("%v saved for later", wishlistItem.Name),
+			"results": gin.H{
+				"wishlistItem": wishlistItem,
+			},
+		})
+	})
+
+	// A shared wishlist - anyone with the link can see it while it's public
+	r.GET("/api/v1/shared-wishlists/:slug", func(c *gin.Context) {
+		wishlist, wishlistErr := lib.GetSharedWishlist(dbPool, c.Param("slug"))
+		if wishlistErr != nil {
+			respondWithWishlistError(c, logger, wishlistErr, "Wishlist not found")
+			return
+		}
+		items, itemsErr := lib.GetWishlistItems(dbPool, wishlist.Id)
+		if itemsErr != nil {
+			respondWithWishlistError(c, logger, itemsErr, "Wishlist not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+			"results": gin.H{
+				"wishlist": wishlist,
+				"items":    items,
+			},
+		})
+	})
+}
@@ -7,10 +7,13 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func WS(r *gin.Engine, wsConn *websocket.Conn, logger *slog.Logger) {
+func WS(r *gin.Engine, wsConn *websocket.Conn, dbPool *pgxpool.Pool, logger *slog.Logger) {
 	r.GET("/ws", func(c *gin.Context) {
-		lib.HandleWSConnection(c, logger)
+		// Signed-in users can also receive messages meant only for them
+		userId, _ := lib.GetUserIdFromSession(c, dbPool, logger)
+		lib.HandleWSConnection(c, logger, userId)
 	})
 }
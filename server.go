@@ -35,18 +35,64 @@ func main() {
 		logger.Error(fmt.Sprintf("Error setting timezone: %v", err))
 	}
 
+	ranCommand, commandErr := runCommand(os.Args[1:], dbPool, logger)
+	if commandErr != nil {
+		logger.Error(commandErr.Error())
+		dbPool.Close()
+		os.Exit(1)
+	}
+	if ranCommand {
+		return
+	}
+
+	paymentProvider, paymentProviderErr := lib.NewPaymentProvider(config.Payments)
+	if paymentProviderErr != nil {
+		panic(fmt.Sprintf("Could not set up payment provider: %v", paymentProviderErr))
+	}
+
+	taxRules, taxRulesErr := lib.NewTaxRules(config.Tax)
+	if taxRulesErr != nil {
+		panic(fmt.Sprintf("Could not set up tax rules: %v", taxRulesErr))
+	}
+
+	guestCarts, guestCartsErr := lib.NewGuestCarts(config.GuestCarts)
+	if guestCartsErr != nil {
+		panic(fmt.Sprintf("Could not set up guest carts: %v", guestCartsErr))
+	}
+
+	abandonedCarts, abandonedCartsErr := lib.NewAbandonedCarts(config.AbandonedCarts)
+	if abandonedCartsErr != nil {
+		panic(fmt.Sprintf("Could not set up abandoned cart reminders: %v", abandonedCartsErr))
+	}
+
+	startScheduledJobs(dbPool, logger, paymentProvider, abandonedCarts, lib.PendingPaymentTimeout(config.Orders))
+
 	r := gin.Default()
 
 	store := persistence.NewInMemoryStore(time.Minute * config.Cache.DefaultCacheTime)
 	var wsConn *websocket.Conn
-	routes.WS(r, wsConn, logger)
+	routes.WS(r, wsConn, dbPool, logger)
 	routes.Products(r, dbPool, logger, store)
 	routes.Tags(r, dbPool, store)
-	routes.Cart(r, dbPool, logger)
-	routes.User(r, dbPool, logger)
+	routes.Cart(r, dbPool, logger, taxRules, guestCarts)
+	routes.User(r, dbPool, logger, guestCarts)
 	routes.Session(r, dbPool, logger)
-	routes.Admin(r, dbPool, logger, store)
-	routes.Orders(r, dbPool, logger)
+	routes.Admin(r, dbPool, logger, paymentProvider, store)
+	routes.Coupons(r, dbPool, logger)
+	routes.ShippingOptions(r, dbPool, logger)
+	routes.Variants(r, dbPool, logger)
+	routes.Bundles(r, dbPool, logger)
+	routes.Sales(r, dbPool, logger)
+	routes.CatalogueImports(r, dbPool, logger)
+	routes.ProductImages(r, dbPool, logger)
+	routes.GiftCards(r, dbPool, logger)
+	routes.SubscriptionPlans(r, dbPool, logger)
+	routes.Reports(r, dbPool, logger)
+	routes.Orders(r, dbPool, logger, paymentProvider, taxRules)
+	routes.Returns(r, dbPool, logger, paymentProvider)
+	routes.Subscriptions(r, dbPool, logger, paymentProvider)
+	routes.Wishlists(r, dbPool, logger)
+	routes.PriceAlerts(r, dbPool, logger)
 	routes.Boards(r, dbPool, logger)
 	routes.Votes(r, dbPool, logger)
 